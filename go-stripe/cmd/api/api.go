@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"myapp/internal/cards"
 	"myapp/internal/driver"
+	"myapp/internal/health"
 	"myapp/internal/models"
+	"myapp/internal/ratelimit"
+	"myapp/internal/tax"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -17,20 +26,33 @@ type config struct {
 	port int
 	env  string
 	db   struct {
-		dsn string
+		dsn     string
+		timeout time.Duration
 	}
 	stripe struct {
-		secret string
-		key    string
+		secret        string
+		key           string
+		webhookSecret string
 	}
-	smtp struct {
+	gateway string
+	smtp    struct {
 		host     string
 		port     int
 		username string
 		password string
 	}
-	secretkey string
-	frontend  string
+	secretkey       string
+	frontend        string
+	invoice         string
+	reservationTTL  time.Duration
+	taxRates        string
+	shutdownTimeout time.Duration
+	preStopDelay    time.Duration
+	twoFactorRoles  string
+	login           struct {
+		maxFailures int
+		lockout     time.Duration
+	}
 }
 
 type application struct {
@@ -38,7 +60,13 @@ type application struct {
 	infoLog  *log.Logger
 	errorLog *log.Logger
 	version  string
-	DB       models.DBModel
+	DB       models.Store
+	Gateway  cards.PaymentGateway
+	TaxRates *tax.Table
+	Health   *health.Checker
+	// roles that must use two-factor authentication
+	TwoFactorRoles models.RoleSet
+	Limiter        *ratelimit.Limiter
 }
 
 func (app *application) serve() error {
@@ -51,51 +79,149 @@ func (app *application) serve() error {
 		WriteTimeout:      5 * time.Second,
 	}
 
+	// on SIGINT or SIGTERM stop taking requests and let the ones in flight finish
+	shutdownErr := make(chan error)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-quit
+
+		app.infoLog.Printf("Shutting down back end server on %s\n", sig)
+		app.Health.Drain()
+
+		// keep serving while load balancers notice /readyz failing
+		time.Sleep(app.config.preStopDelay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+		defer cancel()
+
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
 	app.infoLog.Printf("Starting back end server in %s mode on port %d\n", app.config.env, app.config.port)
 
-	return srv.ListenAndServe()
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownErr
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Println("Stopped back end server")
+
+	return nil
 }
 
 func main() {
+	err := run()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// returns once the server has shut down, after the deferred cleanup has run
+func run() error {
 	var cfg config
 
 	flag.IntVar(&cfg.port, "port", 4001, "Server port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application environment {development|production|maintenance}")
 	flag.StringVar(&cfg.db.dsn, "dsn", "piatoss:secret@tcp(localhost:3306)/widgets?parseTime=true&tls=false", "dsn")
+	flag.DurationVar(&cfg.db.timeout, "db-timeout", models.DefaultQueryTimeout, "longest a database query may run")
 
 	flag.StringVar(&cfg.smtp.host, "smtphost", "smtp.mailtrap.io", "smtp host")
 	flag.StringVar(&cfg.smtp.username, "smtpuser", os.Getenv("SMTP_USERNAME"), "smtp user")
 	flag.StringVar(&cfg.smtp.password, "smtppwd", os.Getenv("SMTP_PASSWORD"), "smtp password")
 	flag.IntVar(&cfg.smtp.port, "smtpport", 587, "smtp port")
 
+	flag.StringVar(&cfg.gateway, "gateway", cards.GatewayStripe, "Payment gateway {stripe|fake}")
+
 	flag.StringVar(&cfg.secretkey, "secret", "6z9srQg39vLfULthfRrzYKLJqzMVPAkD", "secret key")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "url to frontend")
+	flag.StringVar(&cfg.invoice, "invoice", "http://localhost:5000", "url to invoice microservice")
+	flag.DurationVar(&cfg.reservationTTL, "reservation-ttl", 15*time.Minute, "how long stock is held for an unpaid payment intent")
+	flag.StringVar(&cfg.taxRates, "tax-rates", "./tax-rates/rates.csv", "sales tax rate table (.csv or .json)")
+	flag.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long requests in flight may take to finish on shutdown")
+	flag.DurationVar(&cfg.preStopDelay, "pre-stop-delay", 5*time.Second, "how long to keep taking requests once /readyz fails on shutdown")
+	flag.StringVar(&cfg.twoFactorRoles, "two-factor-roles", "finance,owner", "roles that must use two-factor authentication, comma separated")
+	flag.IntVar(&cfg.login.maxFailures, "max-login-failures", 10, "failed logins of an account before it is locked")
+	flag.DurationVar(&cfg.login.lockout, "lockout", 15*time.Minute, "how long an account is locked, and how long its failed logins count")
 
 	flag.Parse()
 
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	cfg.stripe.webhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
+
+	gateway, err := cards.NewGateway(cfg.gateway, cfg.stripe.secret, cfg.stripe.key)
+	if err != nil {
+		return err
+	}
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
 	conn, err := driver.OpenDB(cfg.db.dsn)
 	if err != nil {
-		errorLog.Fatal(err)
+		return err
 	}
+	// closed once serve has drained the requests
 	defer conn.Close()
 
+	taxRates, err := tax.Load(cfg.taxRates)
+	if err != nil {
+		return err
+	}
+
+	twoFactorRoles, err := models.ParseRoleSet(cfg.twoFactorRoles)
+	if err != nil {
+		return err
+	}
+
 	app := &application{
 		config:   cfg,
 		infoLog:  infoLog,
 		errorLog: errorLog,
 		version:  version,
-		DB:       models.DBModel{DB: conn},
+		DB:       &models.DBModel{DB: conn, Timeout: cfg.db.timeout},
+		Gateway:  gateway,
+		TaxRates: taxRates,
+		Health:   health.New(2 * time.Second),
+
+		TwoFactorRoles: twoFactorRoles,
 	}
 
-	err = app.serve()
-	if err != nil {
-		app.errorLog.Println(err)
-		log.Fatal(err)
+	// in the database, so that every instance counts the same attempts
+	app.Limiter = ratelimit.New(app.DB, cfg.login.maxFailures, cfg.login.lockout)
+
+	app.Health.Add("database", health.Ping(conn))
+	app.Health.Add("smtp", health.Dial(cfg.smtp.host, cfg.smtp.port))
+	app.Health.Add("invoice", health.Get(cfg.invoice+"/healthz"))
+
+	// the fake gateway prorates plan changes with the prices of the plans
+	if fake, ok := gateway.(*cards.FakeGateway); ok {
+		plans, err := app.DB.GetActivePlans(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, p := range plans {
+			fake.Prices[p.StripePriceID] = cards.FakePrice{Amount: int64(p.Price), Currency: p.Currency, Interval: p.Interval}
+		}
 	}
+
+	// stopped once serve returns, before the database pool is closed
+	sweeping, stopSweeping := context.WithCancel(context.Background())
+	var sweepers sync.WaitGroup
+	defer sweepers.Wait()
+	defer stopSweeping()
+
+	app.every(sweeping, &sweepers, time.Minute, app.sweepReservations)
+	app.every(sweeping, &sweepers, time.Hour, app.remindTrials)
+	app.every(sweeping, &sweepers, time.Hour, app.sweepIdempotencyKeys)
+	app.every(sweeping, &sweepers, time.Minute, app.notifyLockouts)
+	app.every(sweeping, &sweepers, time.Hour, app.sweepRateLimits)
+
+	return app.serve()
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"myapp/internal/models"
+	"net/http"
+	"time"
+)
+
+// snapshot of an entity for the audit log, nil is recorded as null
+func auditSnapshot(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	return out
+}
+
+// record what the admin user of the request did to an entity, with its state
+// before and after. The action has already happened, so a failure is only logged,
+// with the whole entry so that it can be added by hand
+func (app *application) audit(r *http.Request, action, entity string, entityID any, before, after any) {
+	user := app.contextUser(r)
+
+	entry := models.AuditEntry{
+		UserID:    user.ID,
+		UserEmail: user.Email,
+		Action:    action,
+		Entity:    entity,
+		EntityID:  fmt.Sprint(entityID),
+		Before:    auditSnapshot(before),
+		After:     auditSnapshot(after),
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+
+	// recorded even when the client has gone away
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := app.DB.InsertAuditEntry(ctx, entry)
+	if err != nil {
+		out, _ := json.Marshal(entry)
+		app.errorLog.Printf("audit entry not recorded: %v: %s\n", err, out)
+	}
+}
+
+// the filter of the audit page, dates are inclusive
+type auditFilterPayload struct {
+	UserID   int    `json:"user_id"`
+	Action   string `json:"action"`
+	Entity   string `json:"entity"`
+	EntityID string `json:"entity_id"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+func (p auditFilterPayload) filter() (models.AuditFilter, error) {
+	f := models.AuditFilter{
+		UserID:   p.UserID,
+		Action:   p.Action,
+		Entity:   p.Entity,
+		EntityID: p.EntityID,
+	}
+
+	if p.From != "" {
+		from, err := time.Parse("2006-01-02", p.From)
+		if err != nil {
+			return f, errors.New("invalid from date")
+		}
+		f.From = from
+	}
+
+	if p.To != "" {
+		to, err := time.Parse("2006-01-02", p.To)
+		if err != nil {
+			return f, errors.New("invalid to date")
+		}
+		f.To = to.AddDate(0, 0, 1)
+	}
+
+	return f, nil
+}
+
+// a page of the audit log, newest first
+func (app *application) AuditLog(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		PageSize    int `json:"page_size"`
+		CurrentPage int `json:"page"`
+		auditFilterPayload
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if payload.PageSize < 1 || payload.CurrentPage < 1 {
+		app.badRequest(w, r, errors.New("invalid page"))
+		return
+	}
+
+	f, err := payload.filter()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	entries, lastPage, totalRecords, err := app.DB.GetAuditEntriesPaginated(r.Context(), f, payload.PageSize, payload.CurrentPage)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		CurrentPage  int                  `json:"current_page"`
+		PageSize     int                  `json:"page_size"`
+		LastPage     int                  `json:"last_page"`
+		TotalRecords int                  `json:"total_records"`
+		Entries      []*models.AuditEntry `json:"entries"`
+	}
+
+	resp.CurrentPage = payload.CurrentPage
+	resp.PageSize = payload.PageSize
+	resp.LastPage = lastPage
+	resp.TotalRecords = totalRecords
+	resp.Entries = entries
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// every entry of the audit log matching the filter, as a json file
+func (app *application) ExportAuditLog(w http.ResponseWriter, r *http.Request) {
+	var payload auditFilterPayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	f, err := payload.filter()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	entries, err := app.DB.GetAuditEntries(r.Context(), f)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if entries == nil {
+		entries = []*models.AuditEntry{}
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.json"`, time.Now().Format("2006-01-02")))
+
+	app.writeJSON(w, http.StatusOK, entries, headers)
+}
+
+// state of an order for the audit log, nil when it can't be read
+func (app *application) auditOrder(ctx context.Context, id int) map[string]any {
+	order, err := app.DB.GetOrderByID(ctx, id)
+	if err != nil {
+		return nil
+	}
+
+	refundable, err := app.DB.GetRefundableAmount(ctx, order.TransactionID)
+	if err != nil {
+		return nil
+	}
+
+	state := map[string]any{
+		"status":     order.Status.Name,
+		"amount":     order.Transaction.Amount,
+		"refundable": refundable,
+		"currency":   order.Transaction.Currency,
+	}
+
+	if sub, err := app.DB.GetSubscriptionByOrderID(ctx, id); err == nil {
+		state["subscription_status"] = sub.Status
+		state["cancel_at_period_end"] = sub.CancelAtPeriodEnd
+	}
+
+	return state
+}
+
+// state of an admin user for the audit log, without the password
+func auditUser(u models.User) map[string]any {
+	return map[string]any{
+		"first_name": u.FirstName,
+		"last_name":  u.LastName,
+		"email":      u.Email,
+		"role":       u.Role,
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"myapp/internal/encryption"
+	"myapp/internal/models"
+	"myapp/internal/ratelimit"
+	"myapp/internal/urlsigner"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type contextKey string
+
+const customerContextKey = contextKey("customer")
+
+// the customer authenticated by CustomerAuth
+func (app *application) contextCustomer(r *http.Request) *models.Customer {
+	return r.Context().Value(customerContextKey).(*models.Customer)
+}
+
+// every request for a password or login link may send an email, so the ip and the
+// inbox are limited across both. The email is limited whether it has orders or not
+func (app *application) allowCustomerEmail(w http.ResponseWriter, r *http.Request, email string) bool {
+	err := app.Limiter.Allow(r.Context(), ratelimit.IPKey("customer-email", clientIP(r)), ratelimit.ResetPerIP)
+	if err == nil {
+		err = app.Limiter.Allow(r.Context(), ratelimit.EmailKey("customer-email", email), ratelimit.ResetPerEmail)
+	}
+	if err != nil {
+		app.rateLimited(w, r, err)
+		return false
+	}
+	return true
+}
+
+// email a customer a link to set the password of their account, the answer is
+// the same whether or not the email belongs to a customer
+func (app *application) SendCustomerPasswordEmail(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "If we have orders for that email, a link to set your password is on its way"
+
+	if !app.allowCustomerEmail(w, r, payload.Email) {
+		return
+	}
+
+	customer, err := app.DB.GetCustomerByEmail(r.Context(), payload.Email)
+	if err != nil {
+		app.writeJSON(w, http.StatusAccepted, resp)
+		return
+	}
+
+	link := fmt.Sprintf("%s/account/reset-password?email=%s", app.config.frontend, url.QueryEscape(customer.Email))
+
+	// get signed url
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	signedLink := signer.GenerateTokenFromString(link)
+
+	var data struct {
+		Link string
+	}
+
+	data.Link = signedLink
+
+	// a failure is only logged, answering it would tell that the email has an account
+	err = app.SendMail("info@widgets.com", customer.Email,
+		"Your Widgets Account", "customer-password", data)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// set the password of a customer, the email is encrypted by the reset page
+func (app *application) ResetCustomerPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	encryptor := encryption.Encryption{
+		Key: []byte(app.config.secretkey),
+	}
+
+	realEmail, err := encryptor.Decrypt(payload.Email)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	customer, err := app.DB.GetCustomerByEmail(r.Context(), realEmail)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if len(payload.Password) < models.MinCustomerPassword {
+		app.badRequest(w, r, fmt.Errorf("password must be at least %d characters", models.MinCustomerPassword))
+		return
+	}
+
+	newHash, err := bcrypt.GenerateFromPassword([]byte(payload.Password), 12)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.UpdatePasswordForCustomer(r.Context(), customer, string(newHash))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "password set"
+
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// email a customer a link that logs them in without a password, the answer is the
+// same whether or not the email belongs to a customer
+func (app *application) SendCustomerLoginLink(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "If we have orders for that email, a login link is on its way"
+
+	if !app.allowCustomerEmail(w, r, payload.Email) {
+		return
+	}
+
+	customer, err := app.DB.GetCustomerByEmail(r.Context(), payload.Email)
+	if err != nil {
+		app.writeJSON(w, http.StatusAccepted, resp)
+		return
+	}
+
+	link := fmt.Sprintf("%s/account/magic-link?email=%s", app.config.frontend, url.QueryEscape(customer.Email))
+
+	// get signed url
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	signedLink := signer.GenerateTokenFromString(link)
+
+	var data struct {
+		Link string
+	}
+
+	data.Link = signedLink
+
+	// a failure is only logged, answering it would tell that the email has an account
+	err = app.SendMail("info@widgets.com", customer.Email,
+		"Your Widgets Login Link", "customer-login-link", data)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// get an order of the authenticated customer, other customers' orders look like they don't exist
+func (app *application) customerOrder(r *http.Request) (models.Order, error) {
+	orderID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return models.Order{}, errors.New("invalid order")
+	}
+
+	order, err := app.DB.GetOrderByID(r.Context(), orderID)
+	if err != nil || order.CustomerID != app.contextCustomer(r).ID {
+		return models.Order{}, errors.New("order not found")
+	}
+
+	return order, nil
+}
+
+// the invoice of an order as it was sent after checkout
+func orderInvoice(order models.Order) Invoice {
+	inv := Invoice{
+		ID:              order.ID,
+		Quantity:        order.Quantity,
+		Subtotal:        order.Subtotal,
+		Amount:          order.Amount,
+		Currency:        order.Transaction.Currency,
+		Discount:        order.Discount,
+		FirstName:       order.Customer.FirstName,
+		LastName:        order.Customer.LastName,
+		Email:           order.Customer.Email,
+		CreatedAt:       order.CreatedAt,
+		BillingAddress:  order.BillingAddress,
+		ShippingAddress: order.ShippingAddress,
+	}
+
+	for _, item := range order.Items {
+		product := item.Widget.Name
+		if order.PlanID > 0 {
+			product = order.Plan.InvoiceProduct()
+		}
+		inv.Items = append(inv.Items, InvoiceItem{Product: product, Quantity: item.Quantity, Amount: item.Amount})
+	}
+
+	for _, t := range order.Taxes {
+		inv.Taxes = append(inv.Taxes, InvoiceTax{Jurisdiction: t.Jurisdiction, Name: t.Name, Rate: t.Rate, Amount: t.Amount})
+	}
+
+	return inv
+}
+
+// have the invoice service create the pdf of an invoice, the caller closes the body
+func (app *application) RenderInvoice(inv Invoice) (*http.Response, error) {
+	invoiceURL := fmt.Sprintf("%s/invoice/pdf", app.config.invoice)
+	out, err := json.MarshalIndent(inv, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", invoiceURL, bytes.NewBuffer(out))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("invoice service returned %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+// download the pdf invoice of an order
+func (app *application) CustomerInvoice(w http.ResponseWriter, r *http.Request) {
+	order, err := app.customerOrder(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp, err := app.RenderInvoice(orderInvoice(order))
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the invoice could not be created, please try again later"))
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", resp.Header.Get("Content-Disposition"))
+
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"myapp/internal/cards"
 	"myapp/internal/encryption"
 	"myapp/internal/models"
+	"myapp/internal/money"
+	"myapp/internal/ratelimit"
+	"myapp/internal/tax"
 	"myapp/internal/urlsigner"
 	"myapp/internal/validator"
 	"net/http"
@@ -21,29 +26,54 @@ import (
 )
 
 type stripePayload struct {
-	Currency      string `json:"currency"`
-	Amount        string `json:"amount"`
-	PaymentMethod string `json:"payment_method"`
-	Email         string `json:"email"`
-	CardBrand     string `json:"card_brand"`
-	ExpiryMonth   int    `json:"exp_month"`
-	ExpiryYear    int    `json:"exp_year"`
-	LastFour      string `json:"last_four"`
-	Plan          string `json:"plan"`
-	ProductID     string `json:"product_id"`
-	FirstName     string `json:"first_name"`
-	LastName      string `json:"last_name"`
+	Currency        string         `json:"currency"`
+	Amount          string         `json:"amount"`
+	PaymentMethod   string         `json:"payment_method"`
+	Email           string         `json:"email"`
+	CardBrand       string         `json:"card_brand"`
+	ExpiryMonth     int            `json:"exp_month"`
+	ExpiryYear      int            `json:"exp_year"`
+	LastFour        string         `json:"last_four"`
+	PlanID          int            `json:"plan_id"`
+	ProductID       string         `json:"product_id"`
+	FirstName       string         `json:"first_name"`
+	LastName        string         `json:"last_name"`
+	CartToken       string         `json:"cart_token"`
+	Quantity        int            `json:"quantity"`
+	PromotionCode   string         `json:"promotion_code"`
+	BillingAddress  models.Address `json:"billing_address"`
+	ShippingAddress models.Address `json:"shipping_address"`
 }
 
 type Invoice struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID       int           `json:"id"`
+	Quantity int           `json:"quantity"`
+	Subtotal int           `json:"subtotal"`
+	Amount   int           `json:"amount"`
+	Currency string        `json:"currency"`
+	Discount int           `json:"discount"`
+	Items    []InvoiceItem `json:"items"`
+	Taxes    []InvoiceTax  `json:"taxes"`
+	// printed on the invoice, subscriptions have no shipping address
+	BillingAddress  models.Address `json:"billing_address"`
+	ShippingAddress models.Address `json:"shipping_address"`
+	FirstName       string         `json:"first_name"`
+	LastName        string         `json:"last_name"`
+	Email           string         `json:"email"`
+	CreatedAt       time.Time      `json:"created_at"`
+}
+
+type InvoiceItem struct {
+	Product  string `json:"product"`
+	Quantity int    `json:"quantity"`
+	Amount   int    `json:"amount"`
+}
+
+type InvoiceTax struct {
+	Jurisdiction string  `json:"jurisdiction"`
+	Name         string  `json:"name"`
+	Rate         float64 `json:"rate"`
+	Amount       int     `json:"amount"`
 }
 
 type jsonResponse struct {
@@ -62,26 +92,111 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	amount, err := strconv.Atoi(payload.Amount)
+	// widgets are shipped, so both addresses are needed before taking payment
+	payload.BillingAddress = payload.BillingAddress.Normalize()
+	payload.ShippingAddress = payload.ShippingAddress.Normalize()
+
+	v := validator.NewValidator()
+	payload.BillingAddress.Validate(v, models.AddressBilling)
+	payload.ShippingAddress.Validate(v, models.AddressShipping)
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	// only what is bought comes from the client, the amount is computed here
+	var items []models.OrderItem
+
+	if payload.CartToken != "" {
+		cart, err := app.DB.GetCartByToken(r.Context(), payload.CartToken)
+		if err != nil {
+			app.badRequest(w, r, errors.New("cart not found"))
+			return
+		}
+
+		if len(cart.Items) == 0 {
+			app.badRequest(w, r, errors.New("cart is empty"))
+			return
+		}
+
+		items = cart.OrderItems()
+	} else {
+		widgetID, err := strconv.Atoi(payload.ProductID)
+		if err != nil {
+			app.badRequest(w, r, errors.New("a product or cart is required"))
+			return
+		}
+
+		quantity := payload.Quantity
+		if quantity < 1 {
+			quantity = 1
+		}
+
+		items = append(items, models.OrderItem{WidgetID: widgetID, Quantity: quantity})
+	}
+
+	currency := models.DefaultCurrency
+	if payload.Currency != "" {
+		c, err := money.Lookup(payload.Currency)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		currency = c.Code
+	}
+
+	quote, err := app.DB.QuoteItems(r.Context(), items, currency)
 	if err != nil {
-		app.errorLog.Println(err)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errors.New("product not found")
+		}
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if payload.PromotionCode != "" {
+		quote, err = app.DB.QuotePromotion(r.Context(), quote, payload.PromotionCode)
+		if err != nil {
+			app.promotionError(w, r, err)
+			return
+		}
+	}
+
+	quote, err = quote.ApplyTax(app.TaxRates, payload.BillingAddress.TaxAddress())
+	if err != nil {
+		app.taxError(w, r, err)
 		return
 	}
 
-	// create Card instance
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: payload.Currency,
+	// reject before creating a payment intent that could never be fulfilled
+	err = app.DB.CheckStock(r.Context(), quote.Items)
+	if err != nil {
+		app.stockError(w, r, err)
+		return
 	}
 
 	okay := true
 
-	pi, msg, err := card.Charge(payload.Currency, amount) // try to charge
+	metadata := quote.Metadata()
+	if payload.CartToken != "" {
+		metadata["cart_token"] = payload.CartToken
+	}
+
+	pi, msg, err := app.gateway(r).Charge(quote.Currency, quote.Total, metadata) // try to charge
 	if err != nil {
 		okay = false
 	}
 
+	if okay {
+		// another checkout may have taken the stock in the meantime
+		err = app.DB.ReserveStock(r.Context(), pi.ID, quote.Items, app.config.reservationTTL)
+		if err != nil {
+			app.stockError(w, r, err)
+			return
+		}
+	}
+
 	// succeeded
 	if okay {
 		out, err := json.MarshalIndent(pi, "", "\t")
@@ -108,6 +223,80 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// create a payment intent for an amount typed into the virtual terminal by an admin
+func (app *application) VirtualTerminalPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var payload stripePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	amount, err := strconv.Atoi(payload.Amount)
+	if err != nil || amount < 1 {
+		app.badRequest(w, r, errors.New("invalid amount"))
+		return
+	}
+
+	currency := models.DefaultCurrency
+	if payload.Currency != "" {
+		c, err := money.Lookup(payload.Currency)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		currency = c.Code
+	}
+
+	pi, msg, err := app.gateway(r).Charge(currency, amount, map[string]string{"source": "virtual-terminal"})
+	if err != nil {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: msg})
+		return
+	}
+
+	app.audit(r, models.AuditTerminalPaymentIntent, "payment_intent", pi.ID, nil,
+		map[string]any{"amount": amount, "currency": currency})
+
+	app.writeJSON(w, http.StatusOK, pi)
+}
+
+// respond to a promotion code that can't be used, as a message for the customer
+func (app *application) promotionError(w http.ResponseWriter, r *http.Request, err error) {
+	var promoErr *models.PromotionError
+	if errors.As(err, &promoErr) {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: promoErr.Error()})
+		return
+	}
+
+	app.errorLog.Println(err)
+	app.badRequest(w, r, err)
+}
+
+// respond to a billing address taxes can't be computed for, as a message for the customer
+func (app *application) taxError(w http.ResponseWriter, r *http.Request, err error) {
+	var addrErr *tax.AddressError
+	if errors.As(err, &addrErr) {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: addrErr.Error()})
+		return
+	}
+
+	app.errorLog.Println(err)
+	app.badRequest(w, r, err)
+}
+
+// respond to a failed stock check, out of stock is reported with a conflict status
+func (app *application) stockError(w http.ResponseWriter, r *http.Request, err error) {
+	var outOfStock *models.OutOfStockError
+	if errors.As(err, &outOfStock) {
+		app.writeJSON(w, http.StatusConflict, jsonResponse{OK: false, Message: outOfStock.Error()})
+		return
+	}
+
+	app.errorLog.Println(err)
+	app.badRequest(w, r, err)
+}
+
 func (app *application) GetWidgetById(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	widgetID, err := strconv.Atoi(id)
@@ -116,7 +305,7 @@ func (app *application) GetWidgetById(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	widget, err := app.DB.GetWidget(widgetID)
+	widget, err := app.DB.GetWidget(r.Context(), widgetID)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
@@ -132,6 +321,57 @@ func (app *application) GetWidgetById(w http.ResponseWriter, r *http.Request) {
 	w.Write(out)
 }
 
+// currency of the stripe plan a subscription was created for
+func subscriptionCurrency(subscription *stripe.Subscription) string {
+	if subscription.Items != nil && len(subscription.Items.Data) > 0 {
+		plan := subscription.Items.Data[0].Plan
+		if plan != nil && plan.Currency != "" {
+			return string(plan.Currency)
+		}
+	}
+	return models.DefaultCurrency
+}
+
+// check a promotion code for a subscription to widget, creating its stripe coupon on first use
+func (app *application) subscriptionPromotion(ctx context.Context, gateway cards.PaymentGateway, code string, widget models.Widget) (models.Promotion, int, error) {
+	promotion, err := app.DB.GetPromotionByCode(ctx, code)
+	if err != nil {
+		return promotion, 0, err
+	}
+
+	err = promotion.Usable(time.Now())
+	if err != nil {
+		return promotion, 0, err
+	}
+
+	discount, err := promotion.ApplyToPlan(widget)
+	if err != nil {
+		return promotion, 0, err
+	}
+
+	if promotion.StripeCouponID == "" {
+		coupon := cards.Coupon{Name: promotion.Code, Months: promotion.DurationMonths}
+		if promotion.Kind == models.PromotionPercent {
+			coupon.PercentOff = promotion.Value
+		} else {
+			coupon.AmountOff = promotion.Value
+			coupon.Currency = promotion.Currency
+		}
+
+		promotion.StripeCouponID, err = gateway.CreateCoupon(coupon)
+		if err != nil {
+			return promotion, 0, err
+		}
+
+		err = app.DB.SetPromotionCoupon(ctx, promotion.ID, promotion.StripeCouponID)
+		if err != nil {
+			return promotion, 0, err
+		}
+	}
+
+	return promotion, discount, nil
+}
+
 func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 	var data stripePayload
 	err := json.NewDecoder(r.Body).Decode(&data)
@@ -141,20 +381,38 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 	}
 
 	// validate data
+	data.BillingAddress = data.BillingAddress.Normalize()
+
 	v := validator.NewValidator()
 	v.Check(len(data.FirstName) > 1, "first_name", "must be at least 2 characters")
 	v.Check(len(data.LastName) > 1, "last_name", "must be at least 2 characters")
 	v.Check(strings.Contains(data.Email, "@"), "email", "must contain @")
+	data.BillingAddress.Validate(v, models.AddressBilling)
 
 	if !v.Valid() {
 		app.failedValidation(w, r, v.Errors)
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: data.Currency,
+	// the plan and its price come from the catalog, not from the client
+	plan, err := app.DB.GetPlan(r.Context(), data.PlanID)
+	if err != nil || !plan.Active {
+		app.badRequest(w, r, errors.New("invalid plan"))
+		return
+	}
+	widget := plan.PricedWidget()
+
+	gateway := app.gateway(r)
+
+	var promotion models.Promotion
+	discount := 0
+
+	if data.PromotionCode != "" {
+		promotion, discount, err = app.subscriptionPromotion(r.Context(), gateway, data.PromotionCode, widget)
+		if err != nil {
+			app.promotionError(w, r, err)
+			return
+		}
 	}
 
 	okay := true
@@ -162,7 +420,29 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 
 	txnMsg := "Transaction successful"
 
-	stripeCustomer, msg, err := card.CreateCustomer(data.PaymentMethod, data.Email)
+	// a customer logged in to their account is billed through the stripe customer we
+	// already have, anyone else only gives an email and gets a stripe customer of their
+	// own, so that they can't change the card of the account with that email
+	var customer models.Customer
+	if r.Header.Get("Authorization") != "" {
+		account, err := app.authenticateCustomerToken(r)
+		if err != nil {
+			app.invalidCredentials(w)
+			return
+		}
+		if account.Email == models.NormalizeEmail(data.Email) {
+			customer = *account
+		}
+	}
+
+	var stripeCustomer *stripe.Customer
+	var msg string
+
+	if customer.StripeCustomerID != "" {
+		stripeCustomer, msg, err = gateway.UpdateCustomerPaymentMethod(customer.StripeCustomerID, data.PaymentMethod)
+	} else {
+		stripeCustomer, msg, err = gateway.CreateCustomer(data.PaymentMethod, data.Email)
+	}
 	if err != nil {
 		app.errorLog.Println(err)
 		okay = false
@@ -170,37 +450,39 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 	}
 
 	if okay {
-		subscription, err = card.SubscribeToPlan(stripeCustomer, data.Plan, data.Email, data.LastFour, "")
+		subscription, err = gateway.SubscribeToPlan(stripeCustomer, plan.StripePriceID, data.Email, data.LastFour, "", promotion.StripeCouponID, plan.TrialDays)
 		if err != nil {
 			app.errorLog.Println(err)
 			okay = false
 			txnMsg = "Error subscribing customer"
+		} else {
+			app.infoLog.Println("Subscription ID:", subscription.ID)
 		}
-		app.infoLog.Println("Subscription ID:", subscription.ID)
 	}
 
 	if okay {
-		productID, err := strconv.Atoi(data.ProductID)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
+		subscriber := models.Customer{
+			FirstName:        data.FirstName,
+			LastName:         data.LastName,
+			Email:            data.Email,
+			StripeCustomerID: stripeCustomer.ID,
 		}
 
-		customerID, err := app.SaveCustomer(data.FirstName, data.LastName, data.Email)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
-		}
+		data.BillingAddress.Kind = models.AddressBilling
+		data.BillingAddress.Name = data.FirstName + " " + data.LastName
 
-		amount, err := strconv.Atoi(data.Amount)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
+		// what the first invoice charges, a trial is free and the promotion applies to the
+		// first invoice after it
+		subtotal := widget.Price
+		amount := widget.Price - discount
+		if plan.TrialDays > 0 {
+			subtotal, amount, discount = 0, 0, 0
+			txnMsg = fmt.Sprintf("Your %d day free trial has started", plan.TrialDays)
 		}
 
 		txn := models.Transaction{
 			Amount:              amount,
-			Currency:            "cad",
+			Currency:            subscriptionCurrency(subscription),
 			LastFour:            data.LastFour,
 			ExpiryMonth:         data.ExpiryMonth,
 			ExpiryYear:          data.ExpiryYear,
@@ -209,38 +491,48 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 			PaymentMethod:       data.PaymentMethod,
 		}
 
-		txnID, err := app.SaveTransaction(txn)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
-		}
-
 		order := models.Order{
-			WidgetID:      productID,
-			TransactionID: txnID,
-			CustomerID:    customerID,
-			StatusID:      1,
-			Quantity:      1,
-			Amount:        amount,
-			CreatedAt:     time.Now(),
-			UpdatedAt:     time.Now(),
+			WidgetID:    plan.WidgetID,
+			PlanID:      plan.ID,
+			StatusID:    subscriptionState(subscription).OrderStatus(),
+			Quantity:    1,
+			Subtotal:    subtotal,
+			Amount:      amount,
+			PromotionID: promotion.ID,
+			Discount:    discount,
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+			Items: []models.OrderItem{
+				{WidgetID: plan.WidgetID, Quantity: 1, Price: widget.Price, Amount: subtotal},
+			},
+			BillingAddress: data.BillingAddress,
 		}
 
-		orderID, err := app.SaveOrder(order)
+		state := subscriptionState(subscription)
+		state.PlanID = plan.ID
+
+		orderID, err := app.saveSubscription(subscriber, txn, order, state)
 		if err != nil {
-			app.errorLog.Println(err)
+			app.needsReconciliation(subscriber, txn, order, err)
+			app.writeJSON(w, http.StatusOK, jsonResponse{OK: false, Message: reconciliationMessage})
 			return
 		}
 
 		inv := Invoice{
 			ID:        orderID,
+			Subtotal:  order.Subtotal,
 			Amount:    order.Amount,
-			Product:   "Bronze Plan Monthly Subscription",
+			Currency:  txn.Currency,
+			Discount:  order.Discount,
 			Quantity:  order.Quantity,
 			FirstName: data.FirstName,
 			LastName:  data.LastName,
 			Email:     data.Email,
 			CreatedAt: time.Now(),
+			Items: []InvoiceItem{
+				{Product: plan.InvoiceProduct(), Quantity: order.Quantity, Amount: subtotal},
+			},
+			BillingAddress: order.BillingAddress,
 		}
 
 		err = app.CallInvoiceService(inv)
@@ -265,7 +557,7 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 }
 
 func (app *application) CallInvoiceService(inv Invoice) error {
-	url := "http://localhost:5000/invoice/create-and-send"
+	url := fmt.Sprintf("%s/invoice/create-and-send", app.config.invoice)
 	out, err := json.MarshalIndent(inv, "", "\t")
 	if err != nil {
 		return err
@@ -289,32 +581,114 @@ func (app *application) CallInvoiceService(inv Invoice) error {
 	return nil
 }
 
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-	}
+// shown to a customer whose subscription started but could not be saved
+const reconciliationMessage = "Your subscription has started but we could not save it. It has been recorded and we will contact you, please don't subscribe again"
+
+// save a new subscription in one database transaction: the customer and their stripe
+// customer, their billing address, the transaction, the order, the use of its promotion
+// and the subscription state, returns the order id. it doesn't run in the request's
+// context, stripe has started the subscription so it is saved even if the customer has gone
+func (app *application) saveSubscription(customer models.Customer, txn models.Transaction, order models.Order, state models.Subscription) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var orderID int
+
+	err := app.DB.WithTx(ctx, func(tx models.Store) error {
+		// a returning customer keeps their row, so all their orders stay together
+		customerID, err := tx.GetOrInsertCustomer(ctx, customer)
+		if err != nil {
+			return err
+		}
+
+		// returning subscribers are billed through the stripe customer, the one a customer
+		// already has isn't replaced by the one made for a guest giving their email
+		existing, err := tx.GetCustomer(ctx, customerID)
+		if err != nil {
+			return err
+		}
+		if existing.StripeCustomerID == "" {
+			err = tx.UpdateCustomerStripeID(ctx, customerID, customer.StripeCustomerID)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the order keeps its own copy of the address, so failures are only logged
+		address := order.BillingAddress
+		address.CustomerID = customerID
+		_, err = tx.InsertAddress(ctx, address)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+
+		order.TransactionID, err = tx.InsertTransaction(ctx, txn)
+		if err != nil {
+			return err
+		}
+
+		// the subscription has started with the coupon, so an order using a promotion up
+		// by other orders since it was checked is saved and marked
+		if order.PromotionID > 0 {
+			within, err := tx.RedeemPromotion(ctx, order.PromotionID)
+			if err != nil {
+				return err
+			}
+			order.PromotionOverused = !within
+		}
+
+		order.CustomerID = customerID
+		orderID, err = tx.InsertOrder(ctx, order)
+		if err != nil {
+			return err
+		}
 
-	id, err := app.DB.InsertCustomer(customer)
+		state.CustomerID = customerID
+		state.OrderID = orderID
+		_, err = tx.InsertSubscription(ctx, state)
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	return id, nil
+	if order.PromotionOverused {
+		app.infoLog.Printf("order %d used promotion %d beyond its limit\n", orderID, order.PromotionID)
+	}
+
+	return orderID, nil
 }
 
-func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(txn)
+// record a subscription stripe started but that could not be saved, it is logged as
+// well since the database may be the reason, the record outlives the request
+func (app *application) needsReconciliation(customer models.Customer, txn models.Transaction, order models.Order, cause error) {
+	details, err := json.Marshal(map[string]any{
+		"customer":    customer,
+		"transaction": txn,
+		"order":       order,
+	})
 	if err != nil {
-		return 0, err
+		app.errorLog.Println(err)
 	}
 
-	return id, nil
+	app.errorLog.Printf("subscription %s needs reconciliation: %s: %s\n", txn.PaymentIntent, cause, details)
+
+	_, err = app.DB.InsertReconciliation(context.Background(), models.Reconciliation{
+		Kind:          models.ReconcileSubscription,
+		PaymentIntent: txn.PaymentIntent,
+		Email:         customer.Email,
+		Amount:        txn.Amount,
+		Currency:      txn.Currency,
+		Details:       string(details),
+		Error:         cause.Error(),
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+	}
 }
 
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
+func (app *application) SaveTransaction(ctx context.Context, txn models.Transaction) (int, error) {
+	id, err := app.DB.InsertTransaction(ctx, txn)
 	if err != nil {
 		return 0, err
 	}
@@ -327,6 +701,10 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	var userInput struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		// a code of the user's authenticator app or one of their recovery codes
+		Code string `json:"code"`
+		// the device logging in, listed with the user's tokens
+		Name string `json:"name"`
 	}
 
 	err := app.readJSON(w, r, &userInput)
@@ -335,9 +713,24 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	err = app.Limiter.Allow(r.Context(), ratelimit.IPKey("login", clientIP(r)), ratelimit.LoginPerIP)
+	if err != nil {
+		app.rateLimited(w, r, err)
+		return
+	}
+
+	// accounts are slowed down, then locked, after failed logins
+	accountKey := ratelimit.AccountKey(userInput.Email)
+	err = app.Limiter.Check(r.Context(), accountKey)
+	if err != nil {
+		app.rateLimited(w, r, err)
+		return
+	}
+
 	// get the user from database by email
-	user, err := app.DB.GetUserByEmail(userInput.Email)
+	user, err := app.DB.GetUserByEmail(r.Context(), userInput.Email)
 	if err != nil {
+		app.loginFailed(r.Context(), userInput.Email)
 		app.invalidCredentials(w)
 		return
 	}
@@ -345,15 +738,41 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	// validate user password
 	validPassword, err := app.passwordMatches(user.Password, userInput.Password)
 	if err != nil {
+		app.loginFailed(r.Context(), userInput.Email)
 		app.invalidCredentials(w)
 		return
 	}
 
 	if !validPassword {
+		app.loginFailed(r.Context(), userInput.Email)
 		app.invalidCredentials(w)
 		return
 	}
 
+	if user.TwoFactorEnabled {
+		if userInput.Code == "" {
+			app.twoFactorCodeRequired(w)
+			return
+		}
+
+		ok, err := app.checkTwoFactor(r.Context(), user.ID, userInput.Code)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		if !ok {
+			app.loginFailed(r.Context(), userInput.Email)
+			app.invalidCredentials(w)
+			return
+		}
+	}
+
+	err = app.Limiter.Succeed(r.Context(), accountKey)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
 	// generate the token
 	token, err := models.GenerateToken(user.ID, 24*time.Hour, models.ScopeAuthentication)
 	if err != nil {
@@ -361,8 +780,10 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	token.Name = tokenName(userInput.Name, r.UserAgent())
+
 	// save token to database
-	err = app.DB.InsertToken(token, user)
+	err = app.DB.InsertToken(r.Context(), token, user)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -373,11 +794,32 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		Error   bool          `json:"error"`
 		Message string        `json:"message"`
 		Token   *models.Token `json:"authentication_token"`
+		// the token only opens /api/admin/two-factor until it is set up
+		TwoFactorSetupRequired bool `json:"two_factor_setup_required"`
+		// posted with the login form, the web's proof that the code was checked here
+		LoginChallenge string `json:"login_challenge,omitempty"`
+	}
+
+	if user.TwoFactorEnabled {
+		challenge, err := models.GenerateToken(user.ID, loginChallengeTTL, models.ScopeLoginChallenge)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		err = app.DB.InsertToken(r.Context(), challenge, user)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		payload.LoginChallenge = challenge.PlainText
 	}
 
 	payload.Error = false
 	payload.Message = fmt.Sprintf("token for %s created", userInput.Email)
 	payload.Token = token
+	payload.TwoFactorSetupRequired = app.TwoFactorRoles.Has(user.Role) && !user.TwoFactorEnabled
 
 	err = app.writeJSON(w, http.StatusOK, payload)
 	if err != nil {
@@ -388,7 +830,7 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 // check authentication
 func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Request) {
 	// validate the token and get associated user
-	user, err := app.authenticateToken(r)
+	user, _, err := app.authenticateToken(r)
 	if err != nil {
 		app.invalidCredentials(w)
 		return
@@ -405,30 +847,70 @@ func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Reque
 	app.writeJSON(w, http.StatusOK, payload)
 }
 
-// extract token from request header and return user matching to token
-func (app *application) authenticateToken(r *http.Request) (*models.User, error) {
+// extract token from request header
+func bearerToken(r *http.Request) (string, error) {
 	authorizationHeader := r.Header.Get("Authorization")
 	if authorizationHeader == "" {
-		return nil, errors.New("no authorization header received")
+		return "", errors.New("no authorization header received")
 	}
 
 	headerParts := strings.Split(authorizationHeader, " ") // should be []string{"Bearer", token}
 	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		return nil, errors.New("no authorization header received")
+		return "", errors.New("no authorization header received")
 	}
 
 	token := headerParts[1]
 	if len(token) != 26 {
-		return nil, errors.New("authentication token wrong size")
+		return "", errors.New("authentication token wrong size")
+	}
+
+	return token, nil
+}
+
+const userContextKey = contextKey("user")
+
+const tokenContextKey = contextKey("token")
+
+// the admin user authenticated by Auth
+func (app *application) contextUser(r *http.Request) *models.User {
+	return r.Context().Value(userContextKey).(*models.User)
+}
+
+// the token the admin user authenticated with
+func (app *application) contextToken(r *http.Request) *models.Token {
+	return r.Context().Value(tokenContextKey).(*models.Token)
+}
+
+// extract token from request header and return user matching to token
+func (app *application) authenticateToken(r *http.Request) (*models.User, *models.Token, error) {
+	plainText, err := bearerToken(r)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// get the user from the tokens table
-	user, err := app.DB.GetUserForToken(token)
+	user, token, err := app.DB.GetUserForToken(r.Context(), plainText)
 	if err != nil {
-		return nil, errors.New("no matching user found")
+		return nil, nil, errors.New("no matching user found")
 	}
 
-	return user, nil
+	return user, token, nil
+}
+
+// extract token from request header and return customer matching to token
+func (app *application) authenticateCustomerToken(r *http.Request) (*models.Customer, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// get the customer from the customer_tokens table
+	customer, err := app.DB.GetCustomerForToken(r.Context(), token)
+	if err != nil {
+		return nil, errors.New("no matching customer found")
+	}
+
+	return customer, nil
 }
 
 func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r *http.Request) {
@@ -452,18 +934,22 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		return
 	}
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
-	}
-
-	pi, err := card.RetrievePaymentIntent(txnData.PaymentIntent)
+	pi, err := app.Gateway.RetrievePaymentIntent(txnData.PaymentIntent)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	pm, err := card.GetPaymentMethod(txnData.PaymentMethod)
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		app.badRequest(w, r, errors.New("the payment has not succeeded"))
+		return
+	}
+
+	// record what the payment intent charged, not what the browser reports
+	txnData.PaymentAmount = int(pi.Amount)
+	txnData.PaymentCurrency = pi.Currency
+
+	pm, err := app.Gateway.GetPaymentMethod(txnData.PaymentMethod)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -485,12 +971,20 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		TransactionStatusID: 2,
 	}
 
-	_, err = app.SaveTransaction(txn)
+	txnID, err := app.SaveTransaction(r.Context(), txn)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
+	app.audit(r, models.AuditTerminalCharge, "transaction", txnID, nil, map[string]any{
+		"amount":         txn.Amount,
+		"currency":       txn.Currency,
+		"payment_intent": txn.PaymentIntent,
+		"last_four":      txn.LastFour,
+		"email":          txnData.Email,
+	})
+
 	app.writeJSON(w, http.StatusOK, txn)
 }
 
@@ -506,8 +1000,21 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	// every request may send an email, so both the ip and the inbox are limited
+	err = app.Limiter.Allow(r.Context(), ratelimit.IPKey("reset", clientIP(r)), ratelimit.ResetPerIP)
+	if err != nil {
+		app.rateLimited(w, r, err)
+		return
+	}
+
+	err = app.Limiter.Allow(r.Context(), ratelimit.EmailKey("reset", payload.Email), ratelimit.ResetPerEmail)
+	if err != nil {
+		app.rateLimited(w, r, err)
+		return
+	}
+
 	// verify email
-	_, err = app.DB.GetUserByEmail(payload.Email)
+	_, err = app.DB.GetUserByEmail(r.Context(), payload.Email)
 	if err != nil {
 		var resp struct {
 			Error   bool   `json:"error"`
@@ -578,7 +1085,7 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := app.DB.GetUserByEmail(realEmail)
+	user, err := app.DB.GetUserByEmail(r.Context(), realEmail)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -590,7 +1097,7 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.UpdatePasswordForUser(user, string(newHash))
+	err = app.DB.UpdatePasswordForUser(r.Context(), user, string(newHash))
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -619,7 +1126,7 @@ func (app *application) AllSales(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	allSales, lastPage, totalRecords, err := app.DB.GetAllOrdersPaginated(payload.PageSize, payload.CurrentPage, 0)
+	allSales, lastPage, totalRecords, err := app.DB.GetAllOrdersPaginated(r.Context(), payload.PageSize, payload.CurrentPage, 0)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -644,8 +1151,9 @@ func (app *application) AllSales(w http.ResponseWriter, r *http.Request) {
 
 func (app *application) AllSubscriptions(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
-		PageSize    int `json:"page_size"`
-		CurrentPage int `json:"page"`
+		PageSize    int    `json:"page_size"`
+		CurrentPage int    `json:"page"`
+		Filter      string `json:"filter"`
 	}
 
 	err := app.readJSON(w, r, &payload)
@@ -654,8 +1162,8 @@ func (app *application) AllSubscriptions(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// allSubs, err := app.DB.GetAllOrders(1)
-	allSubs, lastPage, totalRecords, err := app.DB.GetAllOrdersPaginated(payload.PageSize, payload.CurrentPage, 1)
+	// allSubs, err := app.DB.GetAllOrders(r.Context(), 1)
+	allSubs, lastPage, totalRecords, err := app.DB.GetSubscriptionOrdersPaginated(r.Context(), payload.PageSize, payload.CurrentPage, payload.Filter)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -686,7 +1194,7 @@ func (app *application) GetSale(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	order, err := app.DB.GetOrderByID(orderID)
+	order, err := app.DB.GetOrderByID(r.Context(), orderID)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -701,6 +1209,8 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		PaymentIntent string `json:"pi"`
 		Amount        int    `json:"amount"`
 		Currency      string `json:"currency"`
+		Reason        string `json:"reason"`
+		Note          string `json:"note"`
 	}
 
 	err := app.readJSON(w, r, &chargeToRefund)
@@ -709,32 +1219,88 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: chargeToRefund.Currency,
+	// the amounts come from the order, not from the page
+	order, err := app.DB.GetOrderByID(r.Context(), chargeToRefund.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
 	}
 
-	err = card.Refund(chargeToRefund.PaymentIntent, chargeToRefund.Amount)
+	refundable, err := app.DB.GetRefundableAmount(r.Context(), order.TransactionID)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	// update status in db
-	err = app.DB.UpdateOrderStatus(chargeToRefund.ID, 2)
+	// over-refunds are rejected before they reach stripe
+	v := validator.NewValidator()
+	v.Check(order.Transaction.PaymentIntent == chargeToRefund.PaymentIntent, "pi", "doesn't match the order")
+	v.Check(chargeToRefund.Amount > 0, "amount", "must be greater than 0")
+	v.Check(chargeToRefund.Amount <= refundable, "amount",
+		fmt.Sprintf("can't be more than the %s not refunded yet", money.Format(refundable, order.Transaction.Currency)))
+	v.Check(models.ValidRefundReason(chargeToRefund.Reason), "reason", "must be one of the refund reasons")
+	v.Check(len(chargeToRefund.Note) <= 255, "note", "must be at most 255 characters")
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	before := app.auditOrder(r.Context(), order.ID)
+
+	refundID, err := app.gateway(r).Refund(order.Transaction.PaymentIntent, chargeToRefund.Amount, chargeToRefund.Reason)
 	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// record the refund and update the statuses in db
+	refundable, err = app.DB.InsertRefund(r.Context(), models.Refund{
+		TransactionID:  order.TransactionID,
+		OrderID:        order.ID,
+		UserID:         app.contextUser(r).ID,
+		Amount:         chargeToRefund.Amount,
+		Currency:       order.Transaction.Currency,
+		Reason:         chargeToRefund.Reason,
+		Note:           chargeToRefund.Note,
+		StripeRefundID: refundID,
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+		app.audit(r, models.AuditRefund, "order", order.ID, before, map[string]any{
+			"refund": map[string]any{"amount": chargeToRefund.Amount, "reason": chargeToRefund.Reason, "stripe_refund_id": refundID},
+			"error":  err.Error(),
+		})
 		app.badRequest(w, r, errors.New("the charge was refunded, but the database could not be updated"))
 		return
 	}
 
+	// a partly refunded order keeps its stock
+	if refundable <= 0 {
+		_, err = app.DB.RestockOrder(r.Context(), order.ID)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	after := app.auditOrder(r.Context(), order.ID)
+	if after != nil {
+		after["refund"] = map[string]any{
+			"amount":           chargeToRefund.Amount,
+			"reason":           chargeToRefund.Reason,
+			"note":             chargeToRefund.Note,
+			"stripe_refund_id": refundID,
+		}
+	}
+	app.audit(r, models.AuditRefund, "order", order.ID, before, after)
+
 	var resp struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
 	}
 
 	resp.Error = false
-	resp.Message = "Charge refunded"
+	resp.Message = fmt.Sprintf("Refunded %s", money.Format(chargeToRefund.Amount, order.Transaction.Currency))
 
 	app.writeJSON(w, http.StatusOK, resp)
 }
@@ -752,24 +1318,42 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: subToCancel.Currency,
+	// the subscription to cancel comes from the order, not from the page
+	order, err := app.DB.GetOrderByID(r.Context(), subToCancel.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.NewValidator()
+	v.Check(order.Widget.IsRecurring, "id", "isn't a subscription")
+	v.Check(order.Transaction.PaymentIntent == subToCancel.PaymentIntent, "pi", "doesn't match the order")
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
 	}
 
-	err = card.CancelSubscription(subToCancel.PaymentIntent)
+	before := app.auditOrder(r.Context(), order.ID)
+
+	// the subscription id is kept as the payment intent of the order's transaction
+	sub, err := app.gateway(r).CancelSubscription(order.Transaction.PaymentIntent)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	err = app.DB.UpdateOrderStatus(subToCancel.ID, 3)
+	// also sets the status of the order
+	err = app.saveSubscriptionState(r.Context(), sub)
 	if err != nil {
+		app.audit(r, models.AuditCancelSubscription, "order", order.ID, before,
+			map[string]any{"stripe_subscription_id": sub.ID, "error": err.Error()})
 		app.badRequest(w, r, errors.New("the subscription was cancelled, but the database could not be updated"))
 		return
 	}
 
+	app.audit(r, models.AuditCancelSubscription, "order", order.ID, before, app.auditOrder(r.Context(), order.ID))
+
 	var resp struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
@@ -782,7 +1366,7 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 }
 
 func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
-	allUsers, err := app.DB.GetAllUsers()
+	allUsers, err := app.DB.GetAllUsers(r.Context())
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -799,13 +1383,28 @@ func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := app.DB.GetOneUser(userID)
+	user, err := app.DB.GetOneUser(r.Context(), userID)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, user)
+	lockedUntil, err := app.Limiter.LockedUntil(r.Context(), ratelimit.AccountKey(user.Email))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		models.User
+		// zero unless failed logins locked the account
+		LockedUntil time.Time `json:"locked_until"`
+	}
+
+	resp.User = user
+	resp.LockedUntil = lockedUntil
+
+	app.writeJSON(w, http.StatusOK, resp)
 }
 
 func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
@@ -824,9 +1423,30 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the url names the user, not the body
+	user.ID = userID
+
+	v := validator.NewValidator()
+	v.Check(models.ValidRole(user.Role), "role", "must be viewer, support, finance or owner")
+	// owners can't lock themselves out of managing users
+	if userID > 0 && userID == app.contextUser(r).ID {
+		v.Check(user.Role == app.contextUser(r).Role, "role", "you can't change your own role")
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
 	if userID > 0 {
 		// edit existing user
-		err = app.DB.EditUser(user)
+		existing, err := app.DB.GetOneUser(r.Context(), userID)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		err = app.DB.EditUser(r.Context(), user)
 		if err != nil {
 			app.badRequest(w, r, err)
 			return
@@ -839,12 +1459,16 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			err = app.DB.UpdatePasswordForUser(user, string(newHash))
+			err = app.DB.UpdatePasswordForUser(r.Context(), user, string(newHash))
 			if err != nil {
 				app.badRequest(w, r, err)
 				return
 			}
 		}
+
+		after := auditUser(user)
+		after["password_changed"] = user.Password != ""
+		app.audit(r, models.AuditUserEdit, "user", userID, auditUser(existing), after)
 	} else {
 		// create new user
 		newHash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
@@ -853,11 +1477,17 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		err = app.DB.AddUser(user, string(newHash))
+		err = app.DB.AddUser(r.Context(), user, string(newHash))
 		if err != nil {
 			app.badRequest(w, r, err)
 			return
 		}
+
+		created, err := app.DB.GetUserByEmail(r.Context(), user.Email)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		app.audit(r, models.AuditUserCreate, "user", created.ID, nil, auditUser(user))
 	}
 
 	var resp struct {
@@ -883,12 +1513,25 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.DeleteUser(userID)
+	if userID == app.contextUser(r).ID {
+		app.badRequest(w, r, errors.New("you can't delete your own user"))
+		return
+	}
+
+	existing, err := app.DB.GetOneUser(r.Context(), userID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.DeleteUser(r.Context(), userID)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
+	app.audit(r, models.AuditUserDelete, "user", userID, auditUser(existing), nil)
+
 	var resp struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"myapp/internal/cards"
+	"myapp/internal/health"
+	"myapp/internal/models"
+	"myapp/internal/ratelimit"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72/webhook"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// an api server on a memory store and the fake gateway
+type testServer struct {
+	app     *application
+	db      *models.MemoryStore
+	gateway *cards.FakeGateway
+	srv     *httptest.Server
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	ts := &testServer{
+		db:      models.NewMemoryStore(),
+		gateway: cards.NewFakeGateway(),
+	}
+
+	ts.app = &application{
+		infoLog:  log.New(io.Discard, "", 0),
+		errorLog: log.New(io.Discard, "", 0),
+		DB:       ts.db,
+		Gateway:  ts.gateway,
+		Health:   health.New(time.Second),
+	}
+	ts.app.config.reservationTTL = time.Hour
+	ts.app.Limiter = ratelimit.New(ts.db, 10, time.Minute)
+
+	ts.srv = httptest.NewServer(ts.app.routes())
+	t.Cleanup(ts.srv.Close)
+
+	return ts
+}
+
+// post payload as json with the given headers, and decode the response into out
+func (ts *testServer) post(t *testing.T, path string, payload any, header http.Header, out any) *http.Response {
+	t.Helper()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ts.srv.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+	}
+	return resp
+}
+
+// an admin user with the given role and a login token for them
+func (ts *testServer) login(t *testing.T, role string) http.Header {
+	t.Helper()
+	ctx := context.Background()
+
+	email := role + "@example.com"
+	err := ts.db.AddUser(ctx, models.User{FirstName: "Admin", LastName: "User", Email: email, Role: role}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := ts.db.GetUserByEmail(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := models.GenerateToken(user.ID, time.Hour, models.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.db.InsertToken(ctx, token, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return http.Header{"Authorization": {"Bearer " + token.PlainText}}
+}
+
+var toronto = models.Address{
+	Name:       "Ada Lovelace",
+	Line1:      "1 King St W",
+	City:       "Toronto",
+	Region:     "ON",
+	PostalCode: "M5H 1A1",
+	Country:    "CA",
+}
+
+func TestPaymentIntent(t *testing.T) {
+	ts := newTestServer(t)
+	widgetID := ts.db.AddWidget(models.Widget{Name: "Widget", Price: 1000, InventoryLevel: 10})
+
+	payload := stripePayload{
+		ProductID:       strconv.Itoa(widgetID),
+		Quantity:        2,
+		Amount:          "1", // ignored, the amount comes from the catalog
+		BillingAddress:  toronto,
+		ShippingAddress: toronto,
+	}
+
+	var pi struct {
+		ID       string `json:"id"`
+		Amount   int    `json:"amount"`
+		Currency string `json:"currency"`
+	}
+	resp := ts.post(t, "/api/payment-intent", payload, nil, &pi)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if pi.Amount != 2000 || pi.Currency != models.DefaultCurrency {
+		t.Errorf("got a payment intent for %d %s", pi.Amount, pi.Currency)
+	}
+
+	available, err := ts.db.AvailableStock(context.Background(), widgetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if available != 8 {
+		t.Errorf("got %d available, want 8 once reserved", available)
+	}
+
+	// more than is in stock is refused before charging
+	payload.Quantity = 9
+	resp = ts.post(t, "/api/payment-intent", payload, nil, nil)
+	if resp.StatusCode == http.StatusOK {
+		t.Error("created a payment intent for more than is in stock")
+	}
+}
+
+func TestRefundCharge(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	widgetID := ts.db.AddWidget(models.Widget{Name: "Widget", Price: 1000, InventoryLevel: 10})
+	header := ts.login(t, models.RoleOwner)
+
+	pi, _, err := ts.gateway.Charge(models.DefaultCurrency, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	customerID, err := ts.db.InsertCustomer(ctx, models.Customer{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txnID, err := ts.db.InsertTransaction(ctx, models.Transaction{
+		Amount:              1000,
+		Currency:            models.DefaultCurrency,
+		PaymentIntent:       pi.ID,
+		TransactionStatusID: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orderID, err := ts.db.InsertOrder(ctx, models.Order{
+		WidgetID:      widgetID,
+		TransactionID: txnID,
+		CustomerID:    customerID,
+		StatusID:      1,
+		Quantity:      1,
+		Subtotal:      1000,
+		Amount:        1000,
+		Items:         []models.OrderItem{{WidgetID: widgetID, Quantity: 1, Price: 1000, Amount: 1000}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refund := func(amount int, key string) *http.Response {
+		h := header.Clone()
+		h.Set("Idempotency-Key", key)
+		return ts.post(t, "/api/admin/refund", map[string]any{
+			"id": orderID, "pi": pi.ID, "amount": amount, "reason": "requested_by_customer",
+		}, h, nil)
+	}
+	status := func() int {
+		order, err := ts.db.GetOrderByID(ctx, orderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return order.StatusID
+	}
+
+	if resp := refund(400, "first"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if s := status(); s != models.StatusPartiallyRefunded {
+		t.Errorf("got order status %d after a partial refund", s)
+	}
+
+	// the same request sent again is answered from the first one
+	resp := refund(400, "first")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("got status %d, replayed %q", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+
+	if resp := refund(601, "too-much"); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("refunded more than was paid, got status %d", resp.StatusCode)
+	}
+
+	if resp := refund(600, "rest"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if s := status(); s != models.StatusRefunded {
+		t.Errorf("got order status %d after refunding the rest", s)
+	}
+
+	refunds, err := ts.db.GetOrderRefunds(ctx, orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refunds) != 2 {
+		t.Errorf("got %d refunds in the ledger, want 2", len(refunds))
+	}
+
+	w, err := ts.db.GetWidget(ctx, widgetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.InventoryLevel != 11 {
+		t.Errorf("got stock %d, want the refunded widget back", w.InventoryLevel)
+	}
+}
+
+// a monthly plan of 20.00 known to the store and the gateway
+func (ts *testServer) addPlan(t *testing.T) int {
+	t.Helper()
+
+	widgetID := ts.db.AddWidget(models.Widget{Name: "Bronze", IsRecurring: true})
+	ts.gateway.Prices["price_bronze"] = cards.FakePrice{Amount: 2000, Currency: models.DefaultCurrency, Interval: models.IntervalMonth}
+
+	return ts.db.AddPlan(models.Plan{
+		WidgetID:      widgetID,
+		Slug:          "bronze-monthly",
+		Name:          "Bronze",
+		Interval:      models.IntervalMonth,
+		Price:         2000,
+		Currency:      models.DefaultCurrency,
+		StripePriceID: "price_bronze",
+		Active:        true,
+	})
+}
+
+// subscribe email to the plan as a guest
+func (ts *testServer) subscribe(t *testing.T, planID int, email string) {
+	t.Helper()
+
+	payload := stripePayload{
+		PlanID:         planID,
+		PaymentMethod:  "pm_card_visa",
+		Email:          email,
+		FirstName:      "Ada",
+		LastName:       "Lovelace",
+		LastFour:       "4242",
+		ExpiryMonth:    12,
+		ExpiryYear:     2034,
+		BillingAddress: toronto,
+	}
+
+	var resp jsonResponse
+	if r := ts.post(t, "/api/create-customer-and-subscribe-to-plan", payload, nil, &resp); r.StatusCode != http.StatusOK || !resp.OK {
+		t.Fatalf("got status %d, %+v", r.StatusCode, resp)
+	}
+}
+
+func TestCreateCustomerAndSubscribeToPlan(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	planID := ts.addPlan(t)
+
+	// a customer who already subscribed with this email
+	existingID, err := ts.db.InsertCustomer(ctx, models.Customer{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com", StripeCustomerID: "cus_ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.subscribe(t, planID, "ada@example.com")
+
+	orders, err := ts.db.GetAllOrders(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 1 || orders[0].Amount != 2000 || orders[0].PlanID != planID {
+		t.Fatalf("got orders %v", orders)
+	}
+
+	sub, err := ts.db.GetSubscriptionByOrderID(ctx, orders[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.StripeSubscriptionID != orders[0].Transaction.PaymentIntent {
+		t.Errorf("got subscription %s for an order paid by %s", sub.StripeSubscriptionID, orders[0].Transaction.PaymentIntent)
+	}
+
+	// giving someone's email without their token doesn't bill or change their card
+	existing, err := ts.db.GetCustomer(ctx, existingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing.StripeCustomerID != "cus_ada" {
+		t.Errorf("a guest changed the stripe customer to %s", existing.StripeCustomerID)
+	}
+}
+
+func TestCancelSubscription(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	planID := ts.addPlan(t)
+	header := ts.login(t, models.RoleOwner)
+
+	ts.subscribe(t, planID, "ada@example.com")
+	ts.subscribe(t, planID, "grace@example.com")
+
+	orders, err := ts.db.GetAllOrders(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 2 {
+		t.Fatalf("got %d orders", len(orders))
+	}
+	order, other := orders[0], orders[1]
+
+	cancel := func(pi string) *http.Response {
+		return ts.post(t, "/api/admin/cancel-subscription", map[string]any{"id": order.ID, "pi": pi}, header, nil)
+	}
+	status := func(id int) int {
+		o, err := ts.db.GetOrderByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o.StatusID
+	}
+
+	// the subscription of another order can't be cancelled through this one
+	if resp := cancel(other.Transaction.PaymentIntent); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for the subscription of another order", resp.StatusCode)
+	}
+	if _, err := ts.gateway.CancelSubscription(other.Transaction.PaymentIntent); err != nil {
+		t.Errorf("the other subscription was cancelled: %v", err)
+	}
+
+	if resp := cancel(order.Transaction.PaymentIntent); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if s := status(order.ID); s != models.StatusCancelled {
+		t.Errorf("got order status %d", s)
+	}
+}
+
+func TestCustomerEmailsAreLimited(t *testing.T) {
+	ts := newTestServer(t)
+
+	// a password link and login links for the same inbox count together
+	paths := []string{"/api/customer/forgot-password", "/api/customer/login-link", "/api/customer/login-link"}
+	for _, path := range paths {
+		if resp := ts.post(t, path, map[string]string{"email": "nobody@example.com"}, nil, nil); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("POST %s: got status %d", path, resp.StatusCode)
+		}
+	}
+
+	resp := ts.post(t, "/api/customer/forgot-password", map[string]string{"email": "Nobody@example.com"}, nil, nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("got status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// other inboxes aren't held up until the ip has had its share
+	if resp := ts.post(t, "/api/customer/login-link", map[string]string{"email": "somebody@example.com"}, nil, nil); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("got status %d for another email", resp.StatusCode)
+	}
+}
+
+// deliver a stripe event about object, signed with the webhook secret of the server
+func (ts *testServer) deliver(t *testing.T, id, eventType string, created time.Time, object any) *http.Response {
+	t.Helper()
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(map[string]any{
+		"id":      id,
+		"object":  "event",
+		"type":    eventType,
+		"created": created.Unix(),
+		"data":    map[string]json.RawMessage{"object": data},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	signature := webhook.ComputeSignature(now, body, ts.app.config.stripe.webhookSecret)
+	header := http.Header{"Stripe-Signature": {fmt.Sprintf("t=%d,v1=%s", now.Unix(), hex.EncodeToString(signature))}}
+
+	return ts.post(t, "/api/webhooks/stripe", json.RawMessage(body), header, nil)
+}
+
+func TestLateFailureKeepsPaidTransaction(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.config.stripe.webhookSecret = "whsec_test"
+	ctx := context.Background()
+
+	pi, _, err := ts.gateway.Charge(models.DefaultCurrency, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txnID, err := ts.db.InsertTransaction(ctx, models.Transaction{
+		Amount:              1000,
+		Currency:            models.DefaultCurrency,
+		PaymentIntent:       pi.ID,
+		TransactionStatusID: models.TransactionStatusCleared,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() int {
+		txn, ok := ts.db.Transaction(txnID)
+		if !ok {
+			t.Fatal("transaction not found")
+		}
+		return txn.TransactionStatusID
+	}
+
+	// the first attempt was declined, the retry went through, and stripe
+	// delivers the failure after the success
+	failedAt := time.Now().Add(-time.Minute)
+	paidAt := failedAt.Add(10 * time.Second)
+	object := map[string]any{"id": pi.ID, "object": "payment_intent"}
+
+	if resp := ts.deliver(t, "evt_succeeded", "payment_intent.succeeded", paidAt, object); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if resp := ts.deliver(t, "evt_failed", "payment_intent.payment_failed", failedAt, object); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if s := status(); s != models.TransactionStatusCleared {
+		t.Errorf("got transaction status %d after a late failure, want it to stay cleared", s)
+	}
+
+	// a failure after the payment was recorded is still applied
+	later := time.Now().Add(time.Minute)
+	if resp := ts.deliver(t, "evt_failed_later", "payment_intent.payment_failed", later, object); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if s := status(); s != models.TransactionStatusDeclined {
+		t.Errorf("got transaction status %d, want declined", s)
+	}
+}
+
+// an smtp server that counts the connections made to it and closes them, so that
+// sending mail fails once it has been counted
+func (ts *testServer) countMail(t *testing.T) *int32 {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var n int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&n, 1)
+			conn.Close()
+		}
+	}()
+
+	ts.app.config.smtp.host = "127.0.0.1"
+	ts.app.config.smtp.port = ln.Addr().(*net.TCPAddr).Port
+
+	return &n
+}
+
+func TestLoginLocksOut(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	mails := ts.countMail(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.db.AddUser(ctx, models.User{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com", Role: models.RoleViewer}, string(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := ts.db.GetUserByEmail(ctx, "ada@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no delay between failures, only the lockout after 10
+	now := time.Now()
+	ts.app.Limiter.Now = func() time.Time { return now }
+	ts.app.Limiter.Delay = 0
+
+	login := func(password string) *http.Response {
+		return ts.post(t, "/api/authenticate", map[string]string{"email": "ada@example.com", "password": password}, nil, nil)
+	}
+
+	for i := 0; i < 10; i++ {
+		if resp := login("guess"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("wrong password, got status %d", resp.StatusCode)
+		}
+	}
+
+	resp := login("password")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "60" {
+		t.Fatalf("while locked out got status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// the lock is told about once, however often the notifier runs and the
+	// account is tried while locked
+	ts.app.notifyLockouts()
+	for i := 0; i < 3; i++ {
+		login("guess")
+	}
+	ts.app.notifyLockouts()
+	if n := atomic.LoadInt32(mails); n != 1 {
+		t.Errorf("sent %d lockout emails, want 1", n)
+	}
+
+	// an owner lifts the lock before it ends
+	resp = ts.post(t, "/api/admin/all-users/unlock/"+strconv.Itoa(user.ID), nil, ts.login(t, models.RoleOwner), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unlock: got status %d", resp.StatusCode)
+	}
+	if resp := login("password"); resp.StatusCode != http.StatusOK {
+		t.Errorf("after unlocking got status %d", resp.StatusCode)
+	}
+}
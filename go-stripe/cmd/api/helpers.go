@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
+	"myapp/internal/cards"
+	"myapp/internal/ratelimit"
 	"net/http"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -86,6 +91,19 @@ func (app *application) invalidCredentials(w http.ResponseWriter) error {
 	return nil
 }
 
+// the user is authenticated but their role doesn't allow the request
+func (app *application) forbidden(w http.ResponseWriter) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "your role doesn't allow this action"
+
+	return app.writeJSON(w, http.StatusForbidden, payload)
+}
+
 func (app *application) passwordMatches(hash, password string) (bool, error) {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	if err != nil {
@@ -113,3 +131,108 @@ func (app *application) failedValidation(w http.ResponseWriter, r *http.Request,
 
 	app.writeJSON(w, http.StatusUnprocessableEntity, payload)
 }
+
+// the payment gateway for a request, its writes to stripe carry the request's
+// Idempotency-Key so that stripe doesn't repeat them either
+func (app *application) gateway(r *http.Request) cards.PaymentGateway {
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		// scoped like the saved responses, two senders of one key don't share stripe's either
+		if owner := idempotencyOwner(r); owner != "" {
+			key = owner + "/" + key
+		}
+		return app.Gateway.WithIdempotencyKey(key)
+	}
+	return app.Gateway
+}
+
+// run sweep every interval until ctx is done, stopping waits for the sweep in progress
+func (app *application) every(ctx context.Context, wg *sync.WaitGroup, interval time.Duration, sweep func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sweep()
+			}
+		}
+	}()
+}
+
+// delete expired stock reservations
+func (app *application) sweepReservations() {
+	n, err := app.DB.ReleaseExpiredReservations(context.Background())
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if n > 0 {
+		app.infoLog.Printf("released %d expired stock reservations\n", n)
+	}
+}
+
+// email the customers whose trial converts within trialReminderLead
+func (app *application) remindTrials() {
+	subs, err := app.DB.GetTrialsEndingBefore(context.Background(), time.Now().Add(trialReminderLead))
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	for _, sub := range subs {
+		// not marked as sent, so it is tried again on the next tick
+		err = app.sendTrialReminder(context.Background(), sub)
+		if err != nil {
+			app.errorLog.Printf("trial reminder for subscription %d: %s\n", sub.ID, err)
+		}
+	}
+}
+
+// delete the idempotency keys older than idempotencyKeyTTL
+func (app *application) sweepIdempotencyKeys() {
+	n, err := app.DB.DeleteIdempotencyKeysBefore(context.Background(), time.Now().Add(-idempotencyKeyTTL))
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if n > 0 {
+		app.infoLog.Printf("deleted %d expired idempotency keys\n", n)
+	}
+}
+
+// email the users whose accounts were locked since the last tick
+func (app *application) notifyLockouts() {
+	locks, err := app.DB.GetRateLimitLocksToNotify(context.Background())
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	for _, lock := range locks {
+		err = app.sendLockoutEmail(context.Background(), lock)
+		if err != nil {
+			app.errorLog.Printf("lockout email for %s: %s\n", lock.Email, err)
+		}
+	}
+}
+
+// delete the rate limit hits older than ratelimit.Retention
+func (app *application) sweepRateLimits() {
+	n, err := app.DB.DeleteRateLimitsBefore(context.Background(), time.Now().Add(-ratelimit.Retention))
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if n > 0 {
+		app.infoLog.Printf("deleted %d expired rate limit hits\n", n)
+	}
+}
@@ -1,14 +1,183 @@
 package main
 
-import "net/http"
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"myapp/internal/models"
+	"net/http"
+	"time"
+)
 
+// admin tokens open the /api/admin endpoints, the user is put in the request context
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := app.authenticateToken(r)
+		user, token, err := app.authenticateToken(r)
 		if err != nil {
 			app.invalidCredentials(w)
 			return
 		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, tokenContextKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// only let through the admin users whose role allows permission, with a token
+// whose scope allows it too, used after Auth
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !app.contextUser(r).Can(permission) || !app.contextToken(r).Allows(permission) {
+				app.forbidden(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// only let through the tokens given at login, so that a scoped token can't make
+// tokens or change two-factor authentication, used after Auth
+func (app *application) RequireLoginToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextToken(r).Scope != models.ScopeAuthentication {
+			app.forbidden(w)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// customer tokens only open the /api/customer endpoints, the customer is put in the request context
+func (app *application) CustomerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		customer, err := app.authenticateCustomerToken(r)
+		if err != nil {
+			app.invalidCredentials(w)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), customerContextKey, customer)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// keys are kept as long as stripe keeps them
+	idempotencyKeyTTL = 24 * time.Hour
+	// a request still unanswered after this long is taken to have failed
+	idempotencyAbandonAfter = 2 * time.Minute
+)
+
+// records the response of a handler while writing it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// requests with an Idempotency-Key header are handled once per sender and endpoint,
+// repeating one replays the saved response, reusing a key for another payload is a
+// conflict. on authenticated routes it goes after Auth or CustomerAuth
+func (app *application) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// stripe keys are derived from it and limited to 255 characters
+		if len(key) > 200 {
+			app.badRequest(w, r, errors.New("the idempotency key can't be longer than 200 characters"))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+
+		req, started, err := app.DB.StartIdempotentRequest(r.Context(), key, idempotencyOwner(r), r.URL.Path, hash, idempotencyAbandonAfter)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, errors.New("the idempotency key could not be checked"))
+			return
+		}
+
+		if !started {
+			switch {
+			case req.RequestHash != hash:
+				app.idempotencyConflict(w, "the idempotency key was already used for another request")
+			case req.StatusCode == 0:
+				app.idempotencyConflict(w, "a request with this idempotency key is still being handled")
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(req.StatusCode)
+				w.Write(req.ResponseBody)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// the outcome is stored even when the client has gone, a retry of the key needs it,
+		// server errors are not replayed, the request can be tried again
+		if rec.status >= http.StatusInternalServerError {
+			err = app.DB.DeleteIdempotentRequest(context.Background(), req.ID)
+		} else {
+			err = app.DB.SaveIdempotentResponse(context.Background(), req.ID, rec.status, rec.body.Bytes())
+		}
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	})
+}
+
+// whom an idempotency key belongs to, the admin user or customer authenticated before
+// the middleware, anonymous requests share one scope
+func idempotencyOwner(r *http.Request) string {
+	if user, ok := r.Context().Value(userContextKey).(*models.User); ok {
+		return fmt.Sprintf("user:%d", user.ID)
+	}
+	if customer, ok := r.Context().Value(customerContextKey).(*models.Customer); ok {
+		return fmt.Sprintf("customer:%d", customer.ID)
+	}
+	return ""
+}
+
+func (app *application) idempotencyConflict(w http.ResponseWriter, message string) {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = message
+
+	app.writeJSON(w, http.StatusConflict, payload)
+}
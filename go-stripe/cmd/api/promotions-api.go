@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"myapp/internal/models"
+	"myapp/internal/money"
+	"myapp/internal/validator"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// list every promotion code
+func (app *application) AllPromotions(w http.ResponseWriter, r *http.Request) {
+	promotions, err := app.DB.GetAllPromotions(r.Context())
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, promotions)
+}
+
+// get a promotion and the orders placed with it
+func (app *application) OnePromotion(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	promotionID, err := strconv.Atoi(id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	promotion, err := app.DB.GetPromotion(r.Context(), promotionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errors.New("promotion not found")
+		}
+		app.badRequest(w, r, err)
+		return
+	}
+
+	usage, err := app.DB.GetPromotionUsage(r.Context(), promotionID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Promotion models.Promotion        `json:"promotion"`
+		Usage     []models.PromotionUsage `json:"usage"`
+	}
+
+	resp.Promotion = promotion
+	resp.Usage = usage
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// create a promotion code
+func (app *application) CreatePromotion(w http.ResponseWriter, r *http.Request) {
+	var promotion models.Promotion
+
+	err := app.readJSON(w, r, &promotion)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	promotion.Code = models.PromotionCode(promotion.Code)
+
+	v := validator.NewValidator()
+	v.Check(len(promotion.Code) >= 3, "code", "must be at least 3 characters")
+	v.Check(promotion.Kind == models.PromotionPercent || promotion.Kind == models.PromotionFixed, "kind", "must be percent or fixed")
+	if promotion.Kind == models.PromotionPercent {
+		v.Check(promotion.Value > 0 && promotion.Value <= 100, "value", "must be between 1 and 100")
+	} else {
+		v.Check(promotion.Value > 0, "value", "must be greater than 0")
+		_, err := money.Lookup(promotion.Currency)
+		v.Check(err == nil, "currency", "must be a supported currency")
+	}
+	v.Check(promotion.DurationMonths >= 0, "duration_months", "can't be negative")
+	v.Check(promotion.MaxUses >= 0, "max_uses", "can't be negative")
+	v.Check(promotion.ExpiresAt.IsZero() || promotion.ExpiresAt.After(promotion.StartsAt), "expires_at", "must be after the start date")
+
+	if promotion.WidgetID > 0 {
+		_, err := app.DB.GetWidget(r.Context(), promotion.WidgetID)
+		v.Check(err == nil, "widget_id", "no such widget")
+	}
+
+	if _, err := app.DB.GetPromotionByCode(r.Context(), promotion.Code); err == nil {
+		v.AddError("code", "is already in use")
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	id, err := app.DB.InsertPromotion(r.Context(), promotion)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	created, err := app.DB.GetPromotion(r.Context(), id)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	app.audit(r, models.AuditPromotionCreate, "promotion", id, nil, created)
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "Promotion created", ID: id})
+}
+
+// enable or disable a promotion code
+func (app *application) SetPromotionActive(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	promotionID, err := strconv.Atoi(id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var payload struct {
+		Active bool `json:"active"`
+	}
+
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	before, err := app.DB.GetPromotion(r.Context(), promotionID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.SetPromotionActive(r.Context(), promotionID, payload.Active)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	after := before
+	after.Active = payload.Active
+	action := models.AuditPromotionDisable
+	if payload.Active {
+		action = models.AuditPromotionEnable
+	}
+	app.audit(r, action, "promotion", promotionID, before, after)
+
+	msg := "Promotion disabled"
+	if payload.Active {
+		msg = "Promotion enabled"
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: msg})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"myapp/internal/models"
+	"myapp/internal/ratelimit"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// the ip address of the client, without its port
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// answer a request the limiter refused with 429 and when to try again, any other
+// error of the limiter is a bad request
+func (app *application) rateLimited(w http.ResponseWriter, r *http.Request, err error) error {
+	var limited *ratelimit.LimitedError
+	if !errors.As(err, &limited) {
+		return app.badRequest(w, r, err)
+	}
+
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = limited.Error()
+
+	w.Header().Set("Retry-After", strconv.Itoa(limited.Seconds()))
+	return app.writeJSON(w, http.StatusTooManyRequests, payload)
+}
+
+// count a failed login of the account, the limiter locks it after too many
+func (app *application) loginFailed(ctx context.Context, email string) {
+	err := app.Limiter.Fail(ctx, ratelimit.AccountKey(email), email)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// lift the lockout of a user before it ends
+func (app *application) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.DB.GetOneUser(r.Context(), userID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	key := ratelimit.AccountKey(user.Email)
+
+	lockedUntil, err := app.Limiter.LockedUntil(r.Context(), key)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if lockedUntil.IsZero() {
+		app.badRequest(w, r, errors.New("the user is not locked"))
+		return
+	}
+
+	err = app.Limiter.Unlock(r.Context(), key)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.audit(r, models.AuditUserUnlock, "user", userID,
+		map[string]any{"locked_until": lockedUntil}, map[string]any{"locked_until": nil})
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "user unlocked"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// tell a user their account was locked after too many failed logins
+func (app *application) sendLockoutEmail(ctx context.Context, lock ratelimit.Lock) error {
+	// the email is about the admin account, a locked customer login isn't told
+	if lock.Key != ratelimit.AccountKey(lock.Email) {
+		_, err := app.DB.SetRateLimitLockNotified(ctx, lock.Key)
+		return err
+	}
+
+	_, err := app.DB.GetUserByEmail(ctx, lock.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		// someone guessing at an email that has no account, there is no one to tell
+		_, err = app.DB.SetRateLimitLockNotified(ctx, lock.Key)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	// claim the lock first, so that only one instance of the api sends the email
+	claimed, err := app.DB.SetRateLimitLockNotified(ctx, lock.Key)
+	if err != nil || !claimed {
+		return err
+	}
+
+	var data struct {
+		Until string
+		Link  string
+	}
+
+	data.Until = lock.Until.Format("January 2, 2006 at 3:04 PM MST")
+	data.Link = app.config.frontend + "/forgot-password"
+
+	return app.SendMail("info@widgets.com", lock.Email,
+		"Your Widgets Account Is Locked", "account-locked", data)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"myapp/internal/models"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -14,48 +15,118 @@ func (app *application) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key"},
+		ExposedHeaders:   []string{"Idempotent-Replayed"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
-	mux.Post("/api/payment-intent", app.GetPaymentIntent)
+	// liveness and readiness for the orchestrator
+	mux.Get("/healthz", app.Health.Live)
+	mux.Get("/readyz", app.Health.Ready)
+
+	// requests that move money can be retried with the same Idempotency-Key
+	mux.With(app.Idempotent).Post("/api/payment-intent", app.GetPaymentIntent)
 
 	mux.Get("/api/widget/{id}", app.GetWidgetById)
 
-	mux.Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
+	mux.Get("/api/plans", app.Plans)
+
+	mux.With(app.Idempotent).Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
 
 	mux.Post("/api/authenticate", app.CreateAuthToken)
 
 	mux.Post("/api/is-authenticated", app.CheckAuthentication)
 
+	// stripe events, authenticated by the Stripe-Signature header
+	mux.Post("/api/webhooks/stripe", app.StripeWebhook)
+
 	// create new mux and apply middleware to it
 	// routes starting with /api/admin will be grouped together and protected by middleware
 	mux.Route("/api/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
 
-		// should be authenticated to post virtual terminal request
-		mux.Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
-
-		mux.Post("/all-sales", app.AllSales)
-		mux.Post("/get-sales/{id}", app.GetSale)
-
-		mux.Post("/all-subscriptions", app.AllSubscriptions)
-
-		mux.Post("/refund", app.RefundCharge)
-		mux.Post("/cancel-subscription", app.CancelSubscription)
-
-		mux.Post("/all-users", app.AllUsers)
-		mux.Post("/all-users/{id}", app.OneUser)
-
-		mux.Post("/all-users/edit/{id}", app.EditUser)
-
-		mux.Post("/all-users/delete/{id}", app.DeleteUser)
+		mux.Post("/logout", app.Logout)
+
+		// open to every admin user, so that the ones whose role must use two-factor
+		// authentication can set it up
+		login := app.RequireLoginToken
+		mux.With(login).Post("/two-factor", app.TwoFactorStatus)
+		mux.With(login).Post("/two-factor/setup", app.SetupTwoFactor)
+		mux.With(login).Post("/two-factor/confirm", app.ConfirmTwoFactor)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequireTwoFactor)
+
+			// each route needs a permission of the user's role
+			terminal := app.RequirePermission(models.PermissionVirtualTerminal)
+			mux.With(terminal, app.Idempotent).Post("/virtual-terminal-payment-intent", app.VirtualTerminalPaymentIntent)
+			mux.With(terminal).Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(app.RequirePermission(models.PermissionViewSales))
+				mux.Post("/all-sales", app.AllSales)
+				mux.Post("/get-sales/{id}", app.GetSale)
+				mux.Post("/all-subscriptions", app.AllSubscriptions)
+				mux.Post("/all-promotions", app.AllPromotions)
+				mux.Post("/promotions/{id}", app.OnePromotion)
+			})
+
+			mux.With(app.RequirePermission(models.PermissionRefund), app.Idempotent).Post("/refund", app.RefundCharge)
+			mux.With(app.RequirePermission(models.PermissionCancelSubscription), app.Idempotent).Post("/cancel-subscription", app.CancelSubscription)
+
+			promotions := app.RequirePermission(models.PermissionManagePromotions)
+			mux.With(promotions).Post("/promotions/create", app.CreatePromotion)
+			mux.With(promotions).Post("/promotions/active/{id}", app.SetPromotionActive)
+
+			mux.With(app.RequirePermission(models.PermissionViewTaxReport)).Post("/tax-report", app.TaxReport)
+
+			// a user's own tokens, only managed with a login token
+			mux.Group(func(mux chi.Router) {
+				mux.Use(app.RequireLoginToken)
+				mux.Post("/tokens", app.AllTokens)
+				mux.Post("/tokens/create", app.CreateToken)
+				mux.Post("/tokens/revoke/{id}", app.RevokeToken)
+			})
+
+			audit := app.RequirePermission(models.PermissionViewAudit)
+			mux.With(audit).Post("/audit", app.AuditLog)
+			mux.With(audit).Post("/audit/export", app.ExportAuditLog)
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(app.RequirePermission(models.PermissionManageUsers))
+				mux.Post("/all-users", app.AllUsers)
+				mux.Post("/all-users/{id}", app.OneUser)
+				mux.Post("/all-users/edit/{id}", app.EditUser)
+				mux.Post("/all-users/delete/{id}", app.DeleteUser)
+				mux.Post("/all-users/two-factor/reset/{id}", app.ResetTwoFactor)
+				mux.Post("/all-users/unlock/{id}", app.UnlockUser)
+			})
+		})
 	})
 
 	mux.Post("/api/forgot-password", app.SendPasswordResetEmail)
 
 	mux.Post("/api/reset-password", app.ResetPassword)
 
+	// customer accounts, separate from admin users
+	mux.Post("/api/customer/forgot-password", app.SendCustomerPasswordEmail)
+	mux.Post("/api/customer/reset-password", app.ResetCustomerPassword)
+	mux.Post("/api/customer/login-link", app.SendCustomerLoginLink)
+
+	// customer portal, authenticated by a customer token
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.CustomerAuth)
+
+		mux.Post("/api/customer/orders/{id}/invoice", app.CustomerInvoice)
+		mux.Post("/api/customer/subscriptions/{id}/card", app.UpdateSubscriptionCard)
+		mux.Post("/api/customer/subscriptions/{id}/preview-change", app.PreviewSubscriptionChange)
+		mux.With(app.Idempotent).Post("/api/customer/subscriptions/{id}/change", app.ChangeSubscriptionPlan)
+		mux.Post("/api/customer/subscriptions/{id}/cancel", app.CancelCustomerSubscription)
+		mux.Post("/api/customer/subscriptions/{id}/reactivate", app.ReactivateCustomerSubscription)
+		mux.Post("/api/customer/subscriptions/{id}/pause", app.PauseCustomerSubscription)
+		mux.Post("/api/customer/subscriptions/{id}/resume", app.ResumeCustomerSubscription)
+	})
+
 	return mux
 }
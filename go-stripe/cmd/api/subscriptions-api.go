@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"myapp/internal/models"
+	"myapp/internal/money"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// how long a proration preview can be confirmed for the amount it showed
+const prorationPreviewTTL = time.Hour
+
+// how long before a trial converts its customer is reminded
+const trialReminderLead = 3 * 24 * time.Hour
+
+// the plans customers can subscribe to
+func (app *application) Plans(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.DB.GetActivePlans(r.Context())
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, plans)
+}
+
+func unixTime(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(t, 0)
+}
+
+// id of the price a stripe subscription bills
+func subscriptionPrice(sub *stripe.Subscription) string {
+	if sub.Items == nil || len(sub.Items.Data) == 0 {
+		return ""
+	}
+
+	item := sub.Items.Data[0]
+	if item.Price != nil && item.Price.ID != "" {
+		return item.Price.ID
+	}
+	if item.Plan != nil {
+		return item.Plan.ID
+	}
+	return ""
+}
+
+// the state of a stripe subscription as it is stored
+func subscriptionState(sub *stripe.Subscription) models.Subscription {
+	return models.Subscription{
+		StripeSubscriptionID: sub.ID,
+		Status:               string(sub.Status),
+		CurrentPeriodStart:   unixTime(sub.CurrentPeriodStart),
+		CurrentPeriodEnd:     unixTime(sub.CurrentPeriodEnd),
+		CancelAt:             unixTime(sub.CancelAt),
+		CancelAtPeriodEnd:    sub.CancelAtPeriodEnd,
+		Paused:               sub.PauseCollection.Behavior != "",
+		CanceledAt:           unixTime(sub.CanceledAt),
+		TrialStart:           unixTime(sub.TrialStart),
+		TrialEnd:             unixTime(sub.TrialEnd),
+	}
+}
+
+// store the state stripe returned for a subscription, the plan follows the price it bills
+func (app *application) saveSubscriptionState(ctx context.Context, sub *stripe.Subscription) error {
+	state := subscriptionState(sub)
+
+	if price := subscriptionPrice(sub); price != "" {
+		plan, err := app.DB.GetPlanByStripePrice(ctx, price)
+		if err == nil {
+			state.PlanID = plan.ID
+		}
+	}
+
+	n, err := app.DB.UpdateSubscriptionState(ctx, state)
+	if err != nil {
+		return fmt.Errorf("updating subscription %s: %w", sub.ID, err)
+	}
+
+	if n == 0 {
+		app.infoLog.Printf("no subscription found for %s\n", sub.ID)
+	}
+
+	return nil
+}
+
+// get a subscription of the authenticated customer, other customers' subscriptions look like they don't exist
+func (app *application) customerSubscription(r *http.Request) (models.Subscription, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return models.Subscription{}, errors.New("invalid subscription")
+	}
+
+	sub, err := app.DB.GetSubscription(r.Context(), id)
+	if err != nil || sub.CustomerID != app.contextCustomer(r).ID {
+		return models.Subscription{}, errors.New("subscription not found")
+	}
+
+	if sub.Ended() {
+		return sub, errors.New("the subscription has ended, please subscribe again")
+	}
+
+	return sub, nil
+}
+
+// the plan a subscription is moved to, it must be active and billed in the same currency
+func (app *application) planChange(ctx context.Context, sub models.Subscription, planID int) (models.Plan, error) {
+	plan, err := app.DB.GetPlan(ctx, planID)
+	if err != nil || !plan.Active {
+		return plan, errors.New("invalid plan")
+	}
+
+	if plan.ID == sub.PlanID {
+		return plan, errors.New("you are already subscribed to this plan")
+	}
+
+	if plan.Currency != sub.Plan.Currency {
+		return plan, errors.New("the plan is billed in another currency")
+	}
+
+	return plan, nil
+}
+
+// upgraded, downgraded or switched, for messages about a plan change
+func planChangeVerb(from, to models.Plan) string {
+	switch {
+	case to.Tier > from.Tier:
+		return "upgraded"
+	case to.Tier < from.Tier:
+		return "downgraded"
+	default:
+		return "switched"
+	}
+}
+
+// show what changing plan costs now, the proration date is sent back to confirm the change
+func (app *application) PreviewSubscriptionChange(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		PlanID int `json:"plan_id"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	sub, err := app.customerSubscription(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	plan, err := app.planChange(r.Context(), sub, payload.PlanID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	prorationDate := time.Now().Unix()
+
+	amount, err := app.Gateway.PreviewPlanChange(sub.StripeSubscriptionID, plan.StripePriceID, prorationDate)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the change could not be priced, please try again later"))
+		return
+	}
+
+	var resp struct {
+		Error         bool   `json:"error"`
+		Message       string `json:"message"`
+		Amount        int    `json:"amount"`
+		Currency      string `json:"currency"`
+		ProrationDate int64  `json:"proration_date"`
+	}
+
+	resp.Error = false
+	resp.Amount = int(amount)
+	resp.Currency = plan.Currency
+	resp.ProrationDate = prorationDate
+
+	verb := planChangeVerb(sub.Plan, plan)
+	switch {
+	case amount > 0:
+		resp.Message = fmt.Sprintf("Your subscription will be %s to %s and %s will be charged now",
+			verb, plan.InvoiceProduct(), money.Format(int(amount), plan.Currency))
+	case amount < 0:
+		resp.Message = fmt.Sprintf("Your subscription will be %s to %s and %s will be credited to your next invoices",
+			verb, plan.InvoiceProduct(), money.Format(int(-amount), plan.Currency))
+	default:
+		resp.Message = fmt.Sprintf("Your subscription will be %s to %s with nothing due now", verb, plan.InvoiceProduct())
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// move a subscription to another plan, prorated as of the date of the preview
+func (app *application) ChangeSubscriptionPlan(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		PlanID        int   `json:"plan_id"`
+		ProrationDate int64 `json:"proration_date"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	sub, err := app.customerSubscription(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	plan, err := app.planChange(r.Context(), sub, payload.PlanID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	previewed := time.Unix(payload.ProrationDate, 0)
+	if payload.ProrationDate == 0 || previewed.After(time.Now()) || time.Since(previewed) > prorationPreviewTTL {
+		app.badRequest(w, r, errors.New("the price of the change has expired, please review it again"))
+		return
+	}
+
+	stripeSub, err := app.gateway(r).ChangePlan(sub.StripeSubscriptionID, plan.StripePriceID, payload.ProrationDate)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the plan could not be changed, please try again later"))
+		return
+	}
+
+	err = app.saveSubscriptionState(r.Context(), stripeSub)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the plan was changed, but the database could not be updated"))
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = fmt.Sprintf("Your subscription was %s to %s", planChangeVerb(sub.Plan, plan), plan.InvoiceProduct())
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// bill a subscription to another card
+func (app *application) UpdateSubscriptionCard(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		PaymentMethod string `json:"payment_method"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	sub, err := app.customerSubscription(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	_, msg, err := app.Gateway.UpdateSubscriptionPaymentMethod(sub.StripeSubscriptionID, payload.PaymentMethod)
+	if err != nil {
+		app.errorLog.Println(err)
+		if msg == "" {
+			msg = "The card could not be updated"
+		}
+		app.badRequest(w, r, errors.New(msg))
+		return
+	}
+
+	// the card is already billed, so failing to record it is only logged
+	order, err := app.DB.GetOrderByID(r.Context(), sub.OrderID)
+	if err == nil {
+		var pm *stripe.PaymentMethod
+		pm, err = app.Gateway.GetPaymentMethod(payload.PaymentMethod)
+		if err == nil && pm.Card != nil {
+			err = app.DB.UpdateTransactionCard(r.Context(), order.TransactionID, pm.ID, pm.Card.Last4, int(pm.Card.ExpMonth), int(pm.Card.ExpYear))
+		}
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Your subscription will be billed to the new card"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// apply a gateway operation to a subscription of the customer and store the state it returns
+func (app *application) updateCustomerSubscription(w http.ResponseWriter, r *http.Request,
+	check func(models.Subscription) error, update func(string) (*stripe.Subscription, error), message string) {
+	sub, err := app.customerSubscription(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = check(sub)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	stripeSub, err := update(sub.StripeSubscriptionID)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the subscription could not be updated, please try again later"))
+		return
+	}
+
+	err = app.saveSubscriptionState(r.Context(), stripeSub)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, errors.New("the subscription was updated, but the database could not be updated"))
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = message
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// cancel a subscription at the end of the period already paid for
+func (app *application) CancelCustomerSubscription(w http.ResponseWriter, r *http.Request) {
+	app.updateCustomerSubscription(w, r, func(sub models.Subscription) error {
+		if sub.CancelScheduled() {
+			return errors.New("the subscription is already cancelled")
+		}
+		return nil
+	}, app.Gateway.CancelSubscription, "Your subscription will end with the current billing period")
+}
+
+// undo a cancellation before the subscription has ended
+func (app *application) ReactivateCustomerSubscription(w http.ResponseWriter, r *http.Request) {
+	app.updateCustomerSubscription(w, r, func(sub models.Subscription) error {
+		if !sub.CancelScheduled() {
+			return errors.New("the subscription is not cancelled")
+		}
+		return nil
+	}, app.Gateway.ReactivateSubscription, "Your subscription will continue")
+}
+
+// stop billing a subscription until it is resumed
+func (app *application) PauseCustomerSubscription(w http.ResponseWriter, r *http.Request) {
+	app.updateCustomerSubscription(w, r, func(sub models.Subscription) error {
+		if sub.Paused {
+			return errors.New("the subscription is already paused")
+		}
+		if sub.CancelScheduled() {
+			return errors.New("the subscription is cancelled")
+		}
+		return nil
+	}, app.Gateway.PauseSubscription, "Your subscription is paused, you won't be billed until you resume it")
+}
+
+// bill a paused subscription again
+func (app *application) ResumeCustomerSubscription(w http.ResponseWriter, r *http.Request) {
+	app.updateCustomerSubscription(w, r, func(sub models.Subscription) error {
+		if !sub.Paused {
+			return errors.New("the subscription is not paused")
+		}
+		return nil
+	}, app.Gateway.ResumeSubscription, "Your subscription is resumed")
+}
+
+// tell the customer of a trial when it converts and what they will be charged
+func (app *application) sendTrialReminder(ctx context.Context, sub *models.Subscription) error {
+	customer, err := app.DB.GetCustomer(ctx, sub.CustomerID)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		FirstName string
+		Plan      string
+		TrialEnd  string
+		Amount    string
+		Link      string
+	}
+
+	data.FirstName = customer.FirstName
+	data.Plan = sub.Plan.InvoiceProduct()
+	data.TrialEnd = sub.TrialEnd.Format("January 2, 2006")
+	data.Amount = fmt.Sprintf("%s/%s", money.Format(sub.Plan.Price, sub.Plan.Currency), sub.Plan.Interval)
+	data.Link = fmt.Sprintf("%s/account/orders/%d", app.config.frontend, sub.OrderID)
+
+	err = app.SendMail("info@widgets.com", customer.Email,
+		"Your Widgets Free Trial Ends Soon", "trial-ending", data)
+	if err != nil {
+		return err
+	}
+
+	return app.DB.SetTrialReminderSent(ctx, sub.ID)
+}
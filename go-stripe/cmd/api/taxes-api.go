@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// total the taxes collected per jurisdiction between two dates, for filing
+func (app *application) TaxReport(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// dates are inclusive, the report covers whole days
+	from, err := time.Parse("2006-01-02", payload.From)
+	if err != nil {
+		app.badRequest(w, r, errors.New("invalid from date"))
+		return
+	}
+
+	to, err := time.Parse("2006-01-02", payload.To)
+	if err != nil {
+		app.badRequest(w, r, errors.New("invalid to date"))
+		return
+	}
+
+	if to.Before(from) {
+		app.badRequest(w, r, errors.New("the report must end after it starts"))
+		return
+	}
+
+	report, err := app.DB.GetTaxReport(r.Context(), from, to.AddDate(0, 0, 1))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, report)
+}
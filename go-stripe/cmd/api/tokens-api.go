@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"myapp/internal/models"
+	"myapp/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// how long a scoped token lasts unless another number of days is asked for
+	defaultTokenDays = 90
+	maxTokenDays     = 365
+)
+
+// the name of a login token, the device the user named or else their browser
+func tokenName(name, userAgent string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = strings.TrimSpace(userAgent)
+	}
+	if name == "" {
+		name = "login"
+	}
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	return name
+}
+
+// the tokens of the logged in user, CurrentID is the one of the request
+func (app *application) AllTokens(w http.ResponseWriter, r *http.Request) {
+	user := app.contextUser(r)
+
+	tokens, err := app.DB.GetTokensForUser(r.Context(), user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Tokens    []models.Token `json:"tokens"`
+		CurrentID int            `json:"current_id"`
+		// the scopes the user's role can make tokens of
+		Scopes []string `json:"scopes"`
+	}
+
+	resp.Tokens = tokens
+	resp.CurrentID = app.contextToken(r).ID
+	resp.Scopes = user.TokenScopes()
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// make a named token of a scope for a device or an integration, the token is
+// only shown in the response
+func (app *application) CreateToken(w http.ResponseWriter, r *http.Request) {
+	user := app.contextUser(r)
+
+	var payload struct {
+		Name          string `json:"name"`
+		Scope         string `json:"scope"`
+		ExpiresInDays int    `json:"expires_in_days"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.ExpiresInDays == 0 {
+		payload.ExpiresInDays = defaultTokenDays
+	}
+
+	allowed := false
+	for _, scope := range user.TokenScopes() {
+		allowed = allowed || scope == payload.Scope
+	}
+
+	v := validator.NewValidator()
+	v.Check(payload.Name != "", "name", "must be provided")
+	v.Check(len(payload.Name) <= 255, "name", "must be at most 255 characters")
+	v.Check(allowed, "scope", "is not a scope your role can make tokens of")
+	v.Check(payload.ExpiresInDays > 0 && payload.ExpiresInDays <= maxTokenDays, "expires_in_days",
+		"must be between 1 and "+strconv.Itoa(maxTokenDays))
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	token, err := models.GenerateToken(user.ID, time.Duration(payload.ExpiresInDays)*24*time.Hour, payload.Scope)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	token.Name = payload.Name
+
+	err = app.DB.InsertToken(r.Context(), token, *user)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.audit(r, models.AuditTokenCreate, "token", token.ID, nil,
+		map[string]any{"name": token.Name, "scope": token.Scope, "expiry": token.Expiry})
+
+	var resp struct {
+		Error   bool          `json:"error"`
+		Message string        `json:"message"`
+		Token   *models.Token `json:"token"`
+	}
+
+	resp.Error = false
+	resp.Message = "token created, copy it now, it won't be shown again"
+	resp.Token = token
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// revoke one of the logged in user's tokens
+func (app *application) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	user := app.contextUser(r)
+
+	id := chi.URLParam(r, "id")
+	tokenID, err := strconv.Atoi(id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var existing *models.Token
+	tokens, err := app.DB.GetTokensForUser(r.Context(), user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	for i := range tokens {
+		if tokens[i].ID == tokenID {
+			existing = &tokens[i]
+		}
+	}
+
+	if existing == nil {
+		app.badRequest(w, r, errors.New("no such token"))
+		return
+	}
+
+	_, err = app.DB.DeleteToken(r.Context(), user.ID, tokenID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.audit(r, models.AuditTokenRevoke, "token", tokenID,
+		map[string]any{"name": existing.Name, "scope": existing.Scope, "expiry": existing.Expiry}, nil)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "token revoked"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// revoke the token of the request
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	_, err := app.DB.DeleteToken(r.Context(), app.contextUser(r).ID, app.contextToken(r).ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "logged out"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
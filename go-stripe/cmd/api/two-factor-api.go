@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"myapp/internal/encryption"
+	"myapp/internal/models"
+	"myapp/internal/totp"
+	"myapp/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// the name authenticator apps list the codes under
+const twoFactorIssuer = "Widgets"
+
+// how long the login page has to post the login challenge to the web
+const loginChallengeTTL = 2 * time.Minute
+
+// the password was right, but the user must also send a code of their authenticator app
+func (app *application) twoFactorCodeRequired(w http.ResponseWriter) error {
+	var payload struct {
+		Error             bool   `json:"error"`
+		Message           string `json:"message"`
+		TwoFactorRequired bool   `json:"two_factor_required"`
+	}
+
+	payload.Error = true
+	payload.Message = "enter the code of your authenticator app or a recovery code"
+	payload.TwoFactorRequired = true
+
+	return app.writeJSON(w, http.StatusUnauthorized, payload)
+}
+
+// users whose role must use two-factor authentication can only set it up until
+// they have, used after Auth
+func (app *application) RequireTwoFactor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextUser(r)
+		if app.TwoFactorRoles.Has(user.Role) && !user.TwoFactorEnabled {
+			var payload struct {
+				Error                  bool   `json:"error"`
+				Message                string `json:"message"`
+				TwoFactorSetupRequired bool   `json:"two_factor_setup_required"`
+			}
+
+			payload.Error = true
+			payload.Message = "your role must set up two-factor authentication first"
+			payload.TwoFactorSetupRequired = true
+
+			app.writeJSON(w, http.StatusForbidden, payload)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check a code of the user's authenticator app, or use up one of their recovery
+// codes. A code of the app can't be used twice
+func (app *application) checkTwoFactor(ctx context.Context, userID int, code string) (bool, error) {
+	tf, err := app.DB.GetTwoFactor(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	if !tf.Enabled {
+		return false, nil
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+
+	if _, err := strconv.Atoi(code); err == nil && len(code) == totp.Digits {
+		encryptor := encryption.Encryption{
+			Key: []byte(app.config.secretkey),
+		}
+
+		secret, err := encryptor.Decrypt(tf.Secret)
+		if err != nil {
+			return false, err
+		}
+
+		step, ok := totp.Validate(secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+
+		return app.DB.UseTwoFactorStep(ctx, userID, step)
+	}
+
+	used, err := app.DB.UseRecoveryCode(ctx, userID, models.HashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	if used {
+		app.infoLog.Printf("user %d logged in with a recovery code, %d left\n", userID, tf.RecoveryCodesLeft-1)
+	}
+
+	return used, nil
+}
+
+// whether the user has two-factor authentication, and whether their role must
+func (app *application) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	user := app.contextUser(r)
+
+	tf, err := app.DB.GetTwoFactor(r.Context(), user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Enabled           bool `json:"enabled"`
+		Required          bool `json:"required"`
+		RecoveryCodesLeft int  `json:"recovery_codes_left"`
+	}
+
+	resp.Enabled = tf.Enabled
+	resp.Required = app.TwoFactorRoles.Has(user.Role)
+	resp.RecoveryCodesLeft = tf.RecoveryCodesLeft
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// start setting up an authenticator app, the secret is only used once the user
+// has confirmed a code of it
+func (app *application) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := app.contextUser(r)
+
+	if user.TwoFactorEnabled {
+		app.badRequest(w, r, errors.New("two-factor authentication is already set up"))
+		return
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	encryptor := encryption.Encryption{
+		Key: []byte(app.config.secretkey),
+	}
+
+	encrypted, err := encryptor.Encrypt(secret)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.SetTwoFactorSecret(r.Context(), user.ID, encrypted)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+		Secret  string `json:"secret"`
+		URI     string `json:"uri"`
+	}
+
+	resp.Error = false
+	resp.Message = "scan the code with your authenticator app"
+	resp.Secret = secret
+	resp.URI = totp.URI(twoFactorIssuer, user.Email, secret)
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// turn on two-factor authentication with the first code of the authenticator app,
+// the recovery codes are only shown in the response
+func (app *application) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := app.contextUser(r)
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	tf, err := app.DB.GetTwoFactor(r.Context(), user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if tf.Enabled {
+		app.badRequest(w, r, errors.New("two-factor authentication is already set up"))
+		return
+	}
+
+	if tf.Secret == "" {
+		app.badRequest(w, r, errors.New("set up an authenticator app first"))
+		return
+	}
+
+	encryptor := encryption.Encryption{
+		Key: []byte(app.config.secretkey),
+	}
+
+	secret, err := encryptor.Decrypt(tf.Secret)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	step, ok := totp.Validate(secret, strings.ReplaceAll(payload.Code, " ", ""), time.Now())
+
+	v := validator.NewValidator()
+	v.Check(ok, "code", "is not the current code of your authenticator app")
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	codes, hashes, err := models.GenerateRecoveryCodes(models.RecoveryCodeCount)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.EnableTwoFactor(r.Context(), user.ID, step, hashes)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.audit(r, models.AuditTwoFactorEnable, "user", user.ID,
+		map[string]any{"two_factor_enabled": false}, map[string]any{"two_factor_enabled": true})
+
+	var resp struct {
+		Error         bool     `json:"error"`
+		Message       string   `json:"message"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	resp.Error = false
+	resp.Message = "two-factor authentication is set up"
+	resp.RecoveryCodes = codes
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// turn off two-factor authentication of another user who lost their authenticator
+// app and recovery codes, they set it up again at their next login
+func (app *application) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if userID == app.contextUser(r).ID {
+		app.badRequest(w, r, errors.New("you can't reset your own two-factor authentication"))
+		return
+	}
+
+	existing, err := app.DB.GetOneUser(r.Context(), userID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.ResetTwoFactor(r.Context(), userID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.audit(r, models.AuditTwoFactorReset, "user", userID,
+		map[string]any{"two_factor_enabled": existing.TwoFactorEnabled}, map[string]any{"two_factor_enabled": false})
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "two-factor authentication reset"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"myapp/internal/models"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// receive stripe events, verify their signature and apply them to orders and transactions
+func (app *application) StripeWebhook(w http.ResponseWriter, r *http.Request) {
+	maxBytes := 65536
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	event, err := webhook.ConstructEvent(body, r.Header.Get("Stripe-Signature"), app.config.stripe.webhookSecret)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// stripe delivers events at least once, skip the ones already handled
+	isNew, err := app.DB.RecordStripeEvent(r.Context(), event.ID, event.Type)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not record event"})
+		return
+	}
+
+	if !isNew {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "event already handled"})
+		return
+	}
+
+	err = app.handleStripeEvent(r.Context(), event)
+	if err != nil {
+		app.errorLog.Printf("stripe event %s (%s): %s\n", event.ID, event.Type, err)
+
+		// forget the event so that stripe's retry is handled again, even when stripe has stopped waiting
+		if err := app.DB.DeleteStripeEvent(context.Background(), event.ID); err != nil {
+			app.errorLog.Println(err)
+		}
+
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "could not handle event"})
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true})
+}
+
+// map a stripe event onto order and transaction statuses
+func (app *application) handleStripeEvent(ctx context.Context, event stripe.Event) error {
+	switch event.Type {
+	case "payment_intent.succeeded":
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return err
+		}
+		return app.updateTransactionStatus(ctx, pi.ID, models.TransactionStatusCleared)
+
+	case "payment_intent.payment_failed":
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return err
+		}
+		_, err := app.declineTransactions(ctx, pi.ID, event)
+		return err
+
+	case "charge.refunded":
+		var ch stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &ch); err != nil {
+			return err
+		}
+		if ch.PaymentIntent == nil {
+			return nil
+		}
+
+		// the ledger of the order sets its statuses and returns its stock
+		recorded, err := app.recordStripeRefunds(ctx, &ch)
+		if err != nil || recorded {
+			return err
+		}
+
+		if ch.AmountRefunded < ch.Amount {
+			err := app.updateTransactionStatus(ctx, ch.PaymentIntent.ID, models.TransactionStatusPartiallyRefunded)
+			if err != nil {
+				return err
+			}
+			return app.updateOrderStatus(ctx, ch.PaymentIntent.ID, models.StatusPartiallyRefunded)
+		}
+
+		err = app.updateTransactionStatus(ctx, ch.PaymentIntent.ID, models.TransactionStatusRefunded)
+		if err != nil {
+			return err
+		}
+
+		err = app.updateOrderStatus(ctx, ch.PaymentIntent.ID, models.StatusRefunded)
+		if err != nil {
+			return err
+		}
+
+		// a no-op for orders already restocked by the admin refund
+		return app.DB.RestockOrdersByPaymentIntent(ctx, ch.PaymentIntent.ID)
+
+	case "charge.dispute.created":
+		var d stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &d); err != nil {
+			return err
+		}
+		if d.PaymentIntent == nil {
+			return nil
+		}
+		return app.updateOrderStatus(ctx, d.PaymentIntent.ID, models.StatusDisputed)
+
+	case "customer.subscription.updated":
+		var sub stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+			return err
+		}
+
+		// plan changes, periods, cancellations and the status of the order
+		return app.saveSubscriptionState(ctx, &sub)
+
+	case "customer.subscription.deleted":
+		var sub stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+			return err
+		}
+		return app.saveSubscriptionState(ctx, &sub)
+
+	case "invoice.payment_failed":
+		var inv stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
+			return err
+		}
+		if inv.Subscription == nil {
+			return nil
+		}
+
+		// a failure older than the last payment leaves the subscription as it is
+		n, err := app.declineTransactions(ctx, inv.Subscription.ID, event)
+		if err != nil || n == 0 {
+			return err
+		}
+		return app.updateOrderStatus(ctx, inv.Subscription.ID, models.StatusPastDue)
+
+	default:
+		app.infoLog.Printf("ignoring stripe event %s (%s)\n", event.ID, event.Type)
+		return nil
+	}
+}
+
+// record the refunds of a charge in the ledger of its order, the ones made from the
+// stripe dashboard as well as the ones the admin refund may not have saved yet, false
+// when the charge has no order or doesn't list its refunds
+func (app *application) recordStripeRefunds(ctx context.Context, ch *stripe.Charge) (bool, error) {
+	if ch.Refunds == nil || len(ch.Refunds.Data) == 0 {
+		return false, nil
+	}
+
+	orderID, err := app.DB.GetOrderIDByPaymentIntent(ctx, ch.PaymentIntent.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	order, err := app.DB.GetOrderByID(ctx, orderID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, refund := range ch.Refunds.Data {
+		if refund.Status == stripe.RefundStatusFailed || refund.Status == stripe.RefundStatusCanceled {
+			continue
+		}
+
+		reason := string(refund.Reason)
+		if !models.ValidRefundReason(reason) {
+			reason = models.RefundReasonOther
+		}
+
+		_, err = app.DB.InsertRefund(ctx, models.Refund{
+			TransactionID:  order.TransactionID,
+			OrderID:        order.ID,
+			Amount:         int(refund.Amount),
+			Currency:       order.Transaction.Currency,
+			Reason:         reason,
+			Note:           "recorded from stripe",
+			StripeRefundID: refund.ID,
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	refundable, err := app.DB.GetRefundableAmount(ctx, order.TransactionID)
+	if err != nil {
+		return false, err
+	}
+
+	// a no-op for orders already restocked by the admin refund
+	if refundable <= 0 {
+		_, err = app.DB.RestockOrder(ctx, order.ID)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (app *application) updateOrderStatus(ctx context.Context, pi string, statusID int) error {
+	n, err := app.DB.UpdateOrderStatusByPaymentIntent(ctx, pi, statusID)
+	if err != nil {
+		return fmt.Errorf("updating orders for %s: %w", pi, err)
+	}
+
+	if n == 0 {
+		app.infoLog.Printf("no orders found for %s\n", pi)
+	}
+
+	return nil
+}
+
+func (app *application) updateTransactionStatus(ctx context.Context, pi string, statusID int) error {
+	n, err := app.DB.UpdateTransactionStatusByPaymentIntent(ctx, pi, statusID)
+	if err != nil {
+		return fmt.Errorf("updating transactions for %s: %w", pi, err)
+	}
+
+	if n == 0 {
+		app.infoLog.Printf("no transactions found for %s\n", pi)
+	}
+
+	return nil
+}
+
+// mark declined the transactions of pi last changed before the failure event was created,
+// the ones paid or refunded since keep their status
+func (app *application) declineTransactions(ctx context.Context, pi string, event stripe.Event) (int, error) {
+	n, err := app.DB.DeclineTransactionsByPaymentIntent(ctx, pi, time.Unix(event.Created, 0))
+	if err != nil {
+		return 0, fmt.Errorf("declining transactions for %s: %w", pi, err)
+	}
+
+	if n == 0 {
+		app.infoLog.Printf("no transactions of %s older than event %s\n", pi, event.ID)
+	}
+
+	return n, nil
+}
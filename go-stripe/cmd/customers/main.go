@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"myapp/internal/driver"
+	"myapp/internal/models"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+)
+
+type config struct {
+	db struct {
+		dsn     string
+		timeout time.Duration
+	}
+}
+
+type application struct {
+	config   config
+	infoLog  *log.Logger
+	errorLog *log.Logger
+	DB       models.DBModel
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: customers [flags] command
+
+Commands:
+  duplicates          list emails used by more than one customer
+  merge               merge every duplicate into the oldest customer with its email
+  merge KEEP ID...    merge the customers ID... into KEEP, for one person using different emails
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	var cfg config
+
+	flag.StringVar(&cfg.db.dsn, "dsn", "piatoss:secret@tcp(localhost:3306)/widgets?parseTime=true&tls=false", "dsn")
+	flag.DurationVar(&cfg.db.timeout, "db-timeout", models.DefaultQueryTimeout, "longest a database query may run")
+	flag.Usage = usage
+
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+
+	conn, err := driver.OpenDB(cfg.db.dsn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	defer conn.Close()
+
+	app := &application{
+		config:   cfg,
+		infoLog:  infoLog,
+		errorLog: errorLog,
+		DB:       models.DBModel{DB: conn, Timeout: cfg.db.timeout},
+	}
+
+	// interrupting a merge rolls back the customer being merged
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = app.run(ctx, flag.Args())
+	if err != nil {
+		app.errorLog.Println(err)
+		stop()
+		conn.Close()
+		os.Exit(1)
+	}
+}
+
+// execute the command given on the command line
+func (app *application) run(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "duplicates":
+		return app.duplicates(ctx)
+	case "merge":
+		if len(args) == 1 {
+			return app.mergeAll(ctx)
+		}
+		if len(args) < 3 {
+			return fmt.Errorf("usage: customers merge KEEP ID...")
+		}
+
+		var ids []int
+		for _, a := range args[1:] {
+			id, err := strconv.Atoi(a)
+			if err != nil {
+				return fmt.Errorf("invalid customer id %q", a)
+			}
+			ids = append(ids, id)
+		}
+
+		return app.merge(ctx, ids[0], ids[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// print every email with the customers that would be merged
+func (app *application) duplicates(ctx context.Context) error {
+	duplicates, err := app.DB.GetDuplicateCustomers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range duplicates {
+		fmt.Printf("%-40s  keep %d  merge %v\n", d.Email, d.Keep, d.IDs)
+	}
+	app.infoLog.Printf("%d emails with duplicate customers\n", len(duplicates))
+
+	return nil
+}
+
+// merge the duplicates of every email, each email in its own transaction
+func (app *application) mergeAll(ctx context.Context) error {
+	duplicates, err := app.DB.GetDuplicateCustomers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range duplicates {
+		err = app.merge(ctx, d.Keep, d.IDs)
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.Email, err)
+		}
+	}
+
+	if len(duplicates) == 0 {
+		app.infoLog.Println("no duplicate customers")
+	}
+
+	return nil
+}
+
+// move the orders of ids to keep and delete them
+func (app *application) merge(ctx context.Context, keep int, ids []int) error {
+	_, err := app.DB.GetCustomer(ctx, keep)
+	if err != nil {
+		return fmt.Errorf("customer %d: %w", keep, err)
+	}
+
+	err = app.DB.MergeCustomers(ctx, keep, ids)
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Printf("merged %v into customer %d\n", ids, keep)
+
+	return nil
+}
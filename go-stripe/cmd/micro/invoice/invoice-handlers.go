@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"myapp/internal/money"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/phpdave11/gofpdf"
@@ -10,14 +12,68 @@ import (
 )
 
 type Order struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID       int         `json:"id"`
+	Quantity int         `json:"quantity"`
+	Subtotal int         `json:"subtotal"`
+	Amount   int         `json:"amount"`
+	Currency string      `json:"currency"`
+	Discount int         `json:"discount"`
+	Taxes    []OrderTax  `json:"taxes"`
+	Items    []OrderItem `json:"items"`
+	// shipping is empty for subscriptions
+	BillingAddress  Address   `json:"billing_address"`
+	ShippingAddress Address   `json:"shipping_address"`
+	FirstName       string    `json:"first_name"`
+	LastName        string    `json:"last_name"`
+	Email           string    `json:"email"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type OrderItem struct {
+	Product  string `json:"product"`
+	Quantity int    `json:"quantity"`
+	Amount   int    `json:"amount"`
+}
+
+type Address struct {
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+}
+
+// the address as printed on the invoice, nothing when none was recorded
+func (a Address) lines() []string {
+	if a.Line1 == "" {
+		return nil
+	}
+
+	var lines []string
+	for _, l := range []string{a.Name, a.Line1, a.Line2} {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	city := a.City
+	for _, part := range []string{a.Region, a.PostalCode} {
+		if part != "" {
+			city += " " + part
+		}
+	}
+
+	return append(lines, city, a.Country)
+}
+
+// tax charged by one jurisdiction, Rate is a percentage
+type OrderTax struct {
+	Jurisdiction string  `json:"jurisdiction"`
+	Name         string  `json:"name"`
+	Rate         float64 `json:"rate"`
+	Amount       int     `json:"amount"`
 }
 
 func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Request) {
@@ -62,6 +118,27 @@ func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Requ
 	app.writeJSON(w, http.StatusCreated, resp)
 }
 
+// generate the pdf invoice of an order and send it back instead of mailing it,
+// for customers downloading an invoice again
+func (app *application) CreateInvoice(w http.ResponseWriter, r *http.Request) {
+	var order Order
+
+	err := app.readJSON(w, r, &order)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.createInvoicePDF(order)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"invoice-%d.pdf\"", order.ID))
+	http.ServeFile(w, r, fmt.Sprintf("./invoices/%d.pdf", order.ID))
+}
+
 func (app *application) createInvoicePDF(order Order) error {
 	pdf := gofpdf.New("P", "mm", "Letter", "")
 	pdf.SetMargins(10, 13, 10)
@@ -85,13 +162,69 @@ func (app *application) createInvoicePDF(order Order) error {
 	pdf.Ln(5)
 	pdf.CellFormat(97, 8, order.CreatedAt.Format("2006-01-02"), "", 0, "L", false, 0, "")
 
-	pdf.SetX(58)
+	// billing and shipping addresses side by side above the lines
+	addressBlock := func(x float64, title string, lines []string) {
+		pdf.SetY(64)
+		pdf.SetFont("Times", "B", 9)
+		pdf.SetX(x)
+		pdf.CellFormat(95, 4, title, "", 0, "L", false, 0, "")
+		pdf.SetFont("Times", "", 9)
+		for _, l := range lines {
+			pdf.Ln(4)
+			pdf.SetX(x)
+			pdf.CellFormat(95, 4, l, "", 0, "L", false, 0, "")
+		}
+	}
+
+	if lines := order.BillingAddress.lines(); lines != nil {
+		addressBlock(10, "Bill To", lines)
+	}
+	if lines := order.ShippingAddress.lines(); lines != nil {
+		addressBlock(110, "Ship To", lines)
+	}
+	pdf.SetFont("Times", "", 11)
+
+	// one row per order line
 	pdf.SetY(93)
-	pdf.CellFormat(155, 8, order.Product, "", 0, "L", false, 0, "")
-	pdf.SetX(166)
-	pdf.CellFormat(20, 8, fmt.Sprintf("%d", order.Quantity), "", 0, "C", false, 0, "")
-	pdf.SetX(185)
-	pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(order.Amount/100.0)), "", 0, "R", false, 0, "")
+	for _, item := range order.Items {
+		pdf.SetX(10)
+		pdf.CellFormat(155, 8, item.Product, "", 0, "L", false, 0, "")
+		pdf.SetX(166)
+		pdf.CellFormat(20, 8, fmt.Sprintf("%d", item.Quantity), "", 0, "C", false, 0, "")
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, money.FormatCode(item.Amount, order.Currency), "", 0, "R", false, 0, "")
+		pdf.Ln(8)
+	}
+
+	// subtotal, discount and taxes below the lines, labels are right aligned
+	// against the amount column so long tax names fit
+	summaryRow := func(label string, amount int) {
+		pdf.SetX(100)
+		pdf.CellFormat(83, 8, label, "", 0, "R", false, 0, "")
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, money.FormatCode(amount, order.Currency), "", 0, "R", false, 0, "")
+		pdf.Ln(8)
+	}
+
+	if order.Subtotal > 0 && (order.Discount > 0 || len(order.Taxes) > 0) {
+		summaryRow("Subtotal", order.Subtotal)
+	}
+
+	// promotion discount
+	if order.Discount > 0 {
+		summaryRow("Discount", -order.Discount)
+	}
+
+	// one row per jurisdiction for the customer's records
+	for _, t := range order.Taxes {
+		summaryRow(fmt.Sprintf("%s %s%% (%s)", t.Name, strconv.FormatFloat(t.Rate, 'f', -1, 64), t.Jurisdiction), t.Amount)
+	}
+
+	// order total below the lines
+	if len(order.Items) > 1 || order.Discount > 0 || len(order.Taxes) > 0 {
+		pdf.SetFont("Times", "B", 11)
+		summaryRow("Total", order.Amount)
+	}
 
 	invoicePath := fmt.Sprintf("./invoices/%d.pdf", order.ID)
 
@@ -18,7 +18,12 @@ func (app *application) routes() http.Handler {
 		MaxAge:           300,
 	}))
 
+	// liveness and readiness for the orchestrator
+	mux.Get("/healthz", app.Health.Live)
+	mux.Get("/readyz", app.Health.Ready)
+
 	mux.Post("/invoice/create-and-send", app.CreateAndSendInvoice)
+	mux.Post("/invoice/pdf", app.CreateInvoice)
 
 	return mux
 }
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"myapp/internal/health"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -19,7 +24,9 @@ type config struct {
 		username string
 		password string
 	}
-	frontend string
+	frontend        string
+	shutdownTimeout time.Duration
+	preStopDelay    time.Duration
 }
 
 type application struct {
@@ -27,6 +34,7 @@ type application struct {
 	infoLog  *log.Logger
 	errorLog *log.Logger
 	version  string
+	Health   *health.Checker
 }
 
 func (app *application) serve() error {
@@ -39,9 +47,40 @@ func (app *application) serve() error {
 		WriteTimeout:      5 * time.Second,
 	}
 
+	// on SIGINT or SIGTERM stop taking requests and let the ones in flight finish
+	shutdownErr := make(chan error)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-quit
+
+		app.infoLog.Printf("Shutting down invoice microservice on %s\n", sig)
+		app.Health.Drain()
+
+		// keep serving while load balancers notice /readyz failing
+		time.Sleep(app.config.preStopDelay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+		defer cancel()
+
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
 	app.infoLog.Printf("Starting invoice microservice on port %d\n", app.config.port)
 
-	return srv.ListenAndServe()
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownErr
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Println("Stopped invoice microservice")
+
+	return nil
 }
 
 func main() {
@@ -55,6 +94,8 @@ func main() {
 	flag.IntVar(&cfg.smtp.port, "smtpport", 587, "smtp port")
 
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "url to frontend")
+	flag.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long requests in flight may take to finish on shutdown")
+	flag.DurationVar(&cfg.preStopDelay, "pre-stop-delay", 5*time.Second, "how long to keep taking requests once /readyz fails on shutdown")
 
 	flag.Parse()
 
@@ -66,8 +107,11 @@ func main() {
 		infoLog:  infoLog,
 		errorLog: errorLog,
 		version:  version,
+		Health:   health.New(2 * time.Second),
 	}
 
+	app.Health.Add("smtp", health.Dial(cfg.smtp.host, cfg.smtp.port))
+
 	app.CreateDirIfNotExist("./invoices")
 
 	err := app.serve()
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"myapp/internal/driver"
+	"myapp/internal/migrations"
+	"myapp/internal/models"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type config struct {
+	db struct {
+		dsn string
+	}
+	timeout   time.Duration
+	seedAdmin struct {
+		email    string
+		password string
+	}
+}
+
+type application struct {
+	config   config
+	infoLog  *log.Logger
+	errorLog *log.Logger
+	migrator *migrations.Migrator
+	db       *sql.DB
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: migrate [flags] command
+
+Commands:
+  up            apply all pending migrations
+  down          roll back the most recently applied migration
+  status        list migrations and when they were applied
+  to VERSION    migrate up or down to VERSION, 0 rolls back everything
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	var cfg config
+
+	flag.StringVar(&cfg.db.dsn, "dsn", "piatoss:secret@tcp(localhost:3306)/widgets?parseTime=true&tls=false", "dsn")
+	flag.DurationVar(&cfg.timeout, "timeout", 5*time.Minute, "time allowed for the whole command")
+	flag.StringVar(&cfg.seedAdmin.email, "seed-admin", "", "after up, add an owner with this email")
+	flag.StringVar(&cfg.seedAdmin.password, "seed-admin-password", "", "password of the owner added by -seed-admin, generated when empty")
+	flag.Usage = usage
+
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+
+	conn, err := driver.OpenDB(cfg.db.dsn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	defer conn.Close()
+
+	migrator, err := migrations.NewMigrator(conn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	app := &application{
+		config:   cfg,
+		infoLog:  infoLog,
+		errorLog: errorLog,
+		migrator: migrator,
+		db:       conn,
+	}
+
+	err = app.run(flag.Args())
+	if err != nil {
+		app.errorLog.Println(err)
+		conn.Close()
+		os.Exit(1)
+	}
+}
+
+// execute the command given on the command line
+func (app *application) run(args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.timeout)
+	defer cancel()
+
+	if app.config.seedAdmin.email != "" && args[0] != "up" {
+		return errors.New("-seed-admin can only be used with up")
+	}
+
+	var done []migrations.Migration
+	var err error
+
+	switch args[0] {
+	case "up":
+		done, err = app.migrator.Up(ctx)
+	case "down":
+		done, err = app.migrator.Down(ctx)
+	case "to":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: migrate to VERSION")
+		}
+
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+
+		done, err = app.migrator.To(ctx, version)
+	case "status":
+		return app.status(ctx)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	for _, m := range done {
+		app.infoLog.Printf("%s: %06d_%s\n", args[0], m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	version, err := app.migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(done) == 0 {
+		app.infoLog.Printf("no change, schema is at version %d\n", version)
+	} else {
+		app.infoLog.Printf("schema is at version %d\n", version)
+	}
+
+	if app.config.seedAdmin.email != "" {
+		return app.seedAdmin(ctx)
+	}
+
+	return nil
+}
+
+// add an owner to log in with, printing the password when it was generated
+func (app *application) seedAdmin(ctx context.Context) error {
+	email := strings.ToLower(app.config.seedAdmin.email)
+	db := &models.DBModel{DB: app.db}
+
+	_, err := db.GetUserByEmail(ctx, email)
+	if err == nil {
+		return fmt.Errorf("a user with the email %s already exists", email)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	password := app.config.seedAdmin.password
+	generated := password == ""
+	if generated {
+		b := make([]byte, 18)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		password = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return err
+	}
+
+	u := models.User{
+		FirstName: "Admin",
+		LastName:  "User",
+		Email:     email,
+		Role:      models.RoleOwner,
+	}
+	err = db.AddUser(ctx, u, string(hash))
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Printf("added owner %s\n", email)
+	if generated {
+		fmt.Printf("password: %s\n", password)
+	}
+
+	return nil
+}
+
+// print every migration with the time it was applied
+func (app *application) status(ctx context.Context) error {
+	statuses, err := app.migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range statuses {
+		applied := "pending"
+		if !s.AppliedAt.IsZero() {
+			applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%06d  %-45s  %s\n", s.Version, s.Name, applied)
+	}
+
+	return nil
+}
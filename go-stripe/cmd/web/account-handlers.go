@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"myapp/internal/encryption"
+	"myapp/internal/models"
+	"myapp/internal/ratelimit"
+	"myapp/internal/urlsigner"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// display the customer login page
+func (app *application) CustomerLoginPage(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "customer-login", nil); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// authenticate customer and save customerID to session, admin users log in at /login
+func (app *application) PostCustomerLogin(w http.ResponseWriter, r *http.Request) {
+	app.Session.RenewToken(r.Context())
+
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	email := r.Form.Get("email")
+	password := r.Form.Get("password")
+
+	// limited like the admin login, customer accounts are counted apart from users
+	err = app.Limiter.Allow(r.Context(), ratelimit.IPKey("customer-login", clientIP(r)), ratelimit.LoginPerIP)
+	if err == nil {
+		err = app.Limiter.Check(r.Context(), ratelimit.CustomerKey(email))
+	}
+	var limited *ratelimit.LimitedError
+	if errors.As(err, &limited) {
+		app.Session.Put(r.Context(), "error", limited.Error())
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	id, err := app.DB.AuthenticateCustomer(r.Context(), email, password)
+	if err != nil {
+		err = app.Limiter.Fail(r.Context(), ratelimit.CustomerKey(email), email)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "Invalid email or password")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+
+	err = app.Limiter.Succeed(r.Context(), ratelimit.CustomerKey(email))
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	err = app.loginCustomer(r, id)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	http.Redirect(w, r, "/account/orders", http.StatusSeeOther)
+}
+
+// save customerID to session with a token for the /api/customer endpoints
+func (app *application) loginCustomer(r *http.Request, customerID int) error {
+	customer, err := app.DB.GetCustomer(r.Context(), customerID)
+	if err != nil {
+		return err
+	}
+
+	token, err := models.GenerateToken(customer.ID, 24*time.Hour, models.ScopeCustomer)
+	if err != nil {
+		return err
+	}
+
+	err = app.DB.InsertCustomerToken(r.Context(), token, customer)
+	if err != nil {
+		return err
+	}
+
+	app.Session.Put(r.Context(), "customerID", customer.ID)
+	app.Session.Put(r.Context(), "customerToken", token.PlainText)
+
+	return nil
+}
+
+// log in a customer through a signed link emailed by the api
+func (app *application) CustomerMagicLink(w http.ResponseWriter, r *http.Request) {
+	reqURL := r.RequestURI
+	testURL := fmt.Sprintf("%s%s", app.config.frontend, reqURL)
+	email := r.URL.Query().Get("email")
+
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	// make sure token is valid and not expired
+	if !signer.VerifyToken(testURL) || signer.Expired(testURL, 10) {
+		app.Session.Put(r.Context(), "error", "That login link is invalid or has expired, please ask for a new one")
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+
+	customer, err := app.DB.GetCustomerByEmail(r.Context(), email)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.RenewToken(r.Context())
+
+	err = app.loginCustomer(r, customer.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	http.Redirect(w, r, "/account/orders", http.StatusSeeOther)
+}
+
+// log the customer out, the cart and an admin login are kept
+func (app *application) CustomerLogout(w http.ResponseWriter, r *http.Request) {
+	if token := app.Session.GetString(r.Context(), "customerToken"); token != "" {
+		err := app.DB.DeleteCustomerToken(r.Context(), token)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	app.Session.Remove(r.Context(), "customerID")
+	app.Session.Remove(r.Context(), "customerToken")
+	app.Session.RenewToken(r.Context())
+
+	http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+}
+
+// display the page that emails a customer a link to set their password
+func (app *application) CustomerForgotPassword(w http.ResponseWriter, r *http.Request) {
+	stringMap := make(map[string]string)
+	stringMap["title"] = "Set Your Password"
+	stringMap["forgot-url"] = "/api/customer/forgot-password"
+	if err := app.renderTemplate(w, r, "forgot-password", &templateData{
+		StringMap: stringMap,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// display the password form of a customer reached through a signed link
+func (app *application) ShowCustomerResetPassword(w http.ResponseWriter, r *http.Request) {
+	reqURL := r.RequestURI
+	testURL := fmt.Sprintf("%s%s", app.config.frontend, reqURL)
+	email := r.URL.Query().Get("email")
+
+	signer := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	valid := signer.VerifyToken(testURL)
+
+	if !valid {
+		app.errorLog.Println("Invalid url - tampering detected")
+		return
+	}
+
+	// make sure token is not expired
+	expired := signer.Expired(testURL, 10)
+	if expired {
+		app.errorLog.Println("Link expired")
+		return
+	}
+
+	encryptor := encryption.Encryption{
+		Key: []byte(app.config.secretkey),
+	}
+
+	encryptedEmail, err := encryptor.Encrypt(email)
+	if err != nil {
+		app.errorLog.Println("Encryption failed")
+		return
+	}
+
+	data := make(map[string]any)
+	data["email"] = encryptedEmail
+
+	stringMap := make(map[string]string)
+	stringMap["title"] = "Set Your Password"
+	stringMap["reset-url"] = "/api/customer/reset-password"
+	stringMap["login-url"] = "/account/login"
+
+	if err := app.renderTemplate(w, r, "reset-password", &templateData{
+		StringMap: stringMap,
+		Data:      data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// display the orders and subscriptions of the logged in customer
+func (app *application) CustomerOrders(w http.ResponseWriter, r *http.Request) {
+	customerID := app.Session.GetInt(r.Context(), "customerID")
+
+	customer, err := app.DB.GetCustomer(r.Context(), customerID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	orders, err := app.DB.GetCustomerOrders(r.Context(), customerID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	data := make(map[string]any)
+	data["customer"] = customer
+	data["orders"] = orders
+
+	if err := app.renderTemplate(w, r, "customer-orders", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// display one order of the logged in customer
+func (app *application) CustomerOrder(w http.ResponseWriter, r *http.Request) {
+	customerID := app.Session.GetInt(r.Context(), "customerID")
+
+	orderID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	order, err := app.DB.GetOrderByID(r.Context(), orderID)
+	// other customers' orders look like they don't exist
+	if err != nil || order.CustomerID != customerID {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := make(map[string]any)
+	data["order"] = order
+
+	// subscription orders can be managed from the page
+	if order.Widget.IsRecurring {
+		sub, err := app.DB.GetSubscriptionByOrderID(r.Context(), order.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			app.errorLog.Println(err)
+			return
+		}
+
+		if err == nil {
+			plans, err := app.DB.GetActivePlans(r.Context())
+			if err != nil {
+				app.errorLog.Println(err)
+				return
+			}
+
+			data["subscription"] = sub
+			data["plans"] = plans
+		}
+	}
+
+	if err := app.renderTemplate(w, r, "customer-order", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"myapp/internal/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// get the cart referenced by the session, an empty cart is created when create is true
+func (app *application) sessionCart(r *http.Request, create bool) (models.Cart, error) {
+	token := app.Session.GetString(r.Context(), "cartToken")
+	if token != "" {
+		cart, err := app.DB.GetCartByToken(r.Context(), token)
+		if err == nil {
+			return cart, nil
+		}
+		app.Session.Remove(r.Context(), "cartToken")
+	}
+
+	if !create {
+		return models.Cart{}, nil
+	}
+
+	cart, err := app.DB.CreateCart(r.Context())
+	if err != nil {
+		return cart, err
+	}
+
+	app.Session.Put(r.Context(), "cartToken", cart.Token)
+
+	return cart, nil
+}
+
+// read widget_id and quantity from a posted cart form
+func cartFormValues(r *http.Request) (int, int, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	widgetID, err := strconv.Atoi(r.Form.Get("widget_id"))
+	if err != nil {
+		return 0, 0, errors.New("invalid widget")
+	}
+
+	quantity := 1
+	if q := r.Form.Get("quantity"); q != "" {
+		quantity, err = strconv.Atoi(q)
+		if err != nil {
+			return 0, 0, errors.New("invalid quantity")
+		}
+	}
+
+	return widgetID, quantity, nil
+}
+
+// price the cart in the session currency, staying in the default currency when
+// some item isn't sold in it
+func (app *application) priceCart(r *http.Request, cart *models.Cart, td *templateData) {
+	err := app.DB.PriceCart(r.Context(), cart, app.sessionCurrency(r))
+
+	var notPriced *models.NotPricedError
+	if errors.As(err, &notPriced) {
+		td.Error = fmt.Sprintf("%s, prices are shown in %s", notPriced, strings.ToUpper(cart.Currency))
+	} else if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// display the cart
+func (app *application) ShowCart(w http.ResponseWriter, r *http.Request) {
+	cart, err := app.sessionCart(r, false)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	td := &templateData{}
+	app.priceCart(r, &cart, td)
+
+	data := make(map[string]any)
+	data["cart"] = cart
+	td.Data = data
+
+	if err := app.renderTemplate(w, r, "cart", td); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// add a widget to the cart
+func (app *application) AddToCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, quantity, err := cartFormValues(r)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	widget, err := app.DB.GetWidget(r.Context(), widgetID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if widget.IsRecurring {
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("%s is a subscription and can't be added to the cart", widget.Name))
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	if quantity < 1 {
+		app.Session.Put(r.Context(), "error", "Quantity must be at least 1")
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	available, err := app.DB.AvailableStock(r.Context(), widget.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if available <= 0 {
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("%s is out of stock", widget.Name))
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart, err := app.sessionCart(r, true)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	err = app.DB.AddCartItem(r.Context(), cart.ID, widget.ID, quantity)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Added %d x %s to the cart", quantity, widget.Name))
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// change the quantity of a cart line, zero removes it
+func (app *application) UpdateCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, quantity, err := cartFormValues(r)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart, err := app.sessionCart(r, false)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if cart.ID > 0 {
+		err = app.DB.UpdateCartItem(r.Context(), cart.ID, widgetID, quantity)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// remove a line from the cart
+func (app *application) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, _, err := cartFormValues(r)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart, err := app.sessionCart(r, false)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if cart.ID > 0 {
+		err = app.DB.RemoveCartItem(r.Context(), cart.ID, widgetID)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// display the checkout page for the cart
+func (app *application) CartCheckout(w http.ResponseWriter, r *http.Request) {
+	cart, err := app.sessionCart(r, false)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if len(cart.Items) == 0 {
+		app.Session.Put(r.Context(), "error", "Your cart is empty")
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	td := &templateData{}
+	app.priceCart(r, &cart, td)
+
+	data := make(map[string]any)
+	data["cart"] = cart
+	td.Data = data
+
+	if err := app.renderTemplate(w, r, "cart-checkout", td, "stripe-js"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// handle cart transaction data, save the order with one line per cart item and redirect to receipt page
+func (app *application) CartPaymentSucceeded(w http.ResponseWriter, r *http.Request) {
+	txnData, err := app.GetTransactionData(r)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	// the cart is gone once its order is saved, so a form posted again is
+	// recognised by its payment intent
+	if app.orderSaved(r.Context(), txnData.PaymentIntentID) {
+		app.Session.Put(r.Context(), "receipt", txnData)
+		http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+		return
+	}
+
+	cart, err := app.sessionCart(r, false)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if len(cart.Items) == 0 {
+		app.errorLog.Println("payment succeeded for an empty cart")
+		return
+	}
+
+	// the payment intent was created for the cart total computed by the api
+	billing, shipping := checkoutAddresses(r)
+
+	quote, err := app.quoteOrder(r.Context(), cart.OrderItems(), txnData.PaymentCurrency, r.Form.Get("promotion_code"), billing.TaxAddress())
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	err = checkPayment(txnData, quote)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Your payment could not be matched to the cart, please contact us")
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	customer := models.Customer{
+		FirstName: txnData.FirstName,
+		LastName:  txnData.LastName,
+		Email:     txnData.Email,
+	}
+
+	// create a new transaction
+	txn := models.Transaction{
+		Amount:              txnData.PaymentAmount,
+		Currency:            txnData.PaymentCurrency,
+		LastFour:            txnData.LastFour,
+		PaymentIntent:       txnData.PaymentIntentID,
+		PaymentMethod:       txnData.PaymentMethodID,
+		ExpiryMonth:         int(txnData.ExpiryMonth),
+		ExpiryYear:          int(txnData.ExpiryYear),
+		BankReturnCode:      txnData.BankReturnCode,
+		TransactionStatusID: 2,
+	}
+
+	// create a new order, the header points at the first line's widget
+	order := models.Order{
+		WidgetID:        cart.Items[0].WidgetID,
+		StatusID:        1,
+		Quantity:        quote.Quantity(),
+		Subtotal:        quote.Subtotal,
+		Amount:          quote.Total,
+		PromotionID:     quote.PromotionID,
+		Discount:        quote.Discount,
+		Tax:             quote.Tax,
+		TaxCountry:      quote.TaxAddress.Country,
+		TaxRegion:       quote.TaxAddress.Region,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+		Items:           quote.Items,
+		Taxes:           quote.OrderTaxes(),
+		BillingAddress:  billing,
+		ShippingAddress: shipping,
+	}
+
+	orderID, err := app.saveCheckout(customer, txn, order, billing, shipping)
+	if err != nil && app.orderSaved(r.Context(), txnData.PaymentIntentID) {
+		// the same form posted twice at once, the other request saved the order
+		app.Session.Put(r.Context(), "receipt", txnData)
+		http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.needsReconciliation(customer, txn, order, err)
+
+		// the cart was paid for, it is not offered for payment again
+		err = app.DB.DeleteCart(r.Context(), cart.ID)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		app.Session.Remove(r.Context(), "cartToken")
+
+		app.Session.Put(r.Context(), "error", reconciliationMessage)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err = app.DB.DeleteCart(r.Context(), cart.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	app.Session.Remove(r.Context(), "cartToken")
+
+	// call invoice microservice
+	inv := Invoice{
+		ID:              orderID,
+		Subtotal:        order.Subtotal,
+		Amount:          order.Amount,
+		Currency:        txn.Currency,
+		Discount:        order.Discount,
+		Taxes:           invoiceTaxes(order),
+		Quantity:        order.Quantity,
+		FirstName:       txnData.FirstName,
+		LastName:        txnData.LastName,
+		Email:           txnData.Email,
+		CreatedAt:       time.Now(),
+		BillingAddress:  order.BillingAddress,
+		ShippingAddress: order.ShippingAddress,
+	}
+
+	for _, item := range order.Items {
+		inv.Items = append(inv.Items, InvoiceItem{
+			Product:  item.Widget.Name,
+			Quantity: item.Quantity,
+			Amount:   item.Amount,
+		})
+	}
+
+	err = app.CallInvoiceService(inv)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "receipt", txnData)
+	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+}
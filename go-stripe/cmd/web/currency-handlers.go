@@ -0,0 +1,41 @@
+package main
+
+import (
+	"myapp/internal/models"
+	"myapp/internal/money"
+	"net/http"
+	"net/url"
+)
+
+// currency picked by the customer, the default currency until one is picked
+func (app *application) sessionCurrency(r *http.Request) string {
+	currency := app.Session.GetString(r.Context(), "currency")
+	if _, err := money.Lookup(currency); err != nil {
+		return models.DefaultCurrency
+	}
+	return currency
+}
+
+// remember the currency picked on the storefront and go back to the page it was picked on
+func (app *application) SetCurrency(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	currency, err := money.Lookup(r.Form.Get("currency"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "That currency is not supported")
+	} else {
+		app.Session.Put(r.Context(), "currency", currency.Code)
+	}
+
+	// only redirect back to pages of this site
+	back := "/"
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host && ref.Path != "" {
+		back = ref.RequestURI()
+	}
+
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
@@ -2,17 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"myapp/internal/cards"
 	"myapp/internal/encryption"
 	"myapp/internal/models"
+	"myapp/internal/ratelimit"
+	"myapp/internal/tax"
 	"myapp/internal/urlsigner"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v72"
 )
 
 // display home page
@@ -50,7 +56,7 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		TransactionStatusID: 2,
 	}
 
-	_, err = app.SaveTransaction(txn)
+	_, err = app.SaveTransaction(r.Context(), txn)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
@@ -84,7 +90,21 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	widget, err := app.DB.GetWidget(widgetID)
+	td := &templateData{}
+
+	// show the price in the customer's currency when the widget is sold in it
+	widget, err := app.DB.GetWidgetInCurrency(r.Context(), widgetID, app.sessionCurrency(r))
+	var notPriced *models.NotPricedError
+	if errors.As(err, &notPriced) {
+		widget, err = app.DB.GetWidget(r.Context(), widgetID)
+		td.Error = fmt.Sprintf("%s, the price is shown in %s", notPriced, strings.ToUpper(widget.Currency))
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	available, err := app.DB.AvailableStock(r.Context(), widgetID)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
@@ -92,23 +112,52 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 
 	data := make(map[string]any)
 	data["widget"] = widget
+	data["available"] = available
+	td.Data = data
 
-	if err := app.renderTemplate(w, r, "buy-once", &templateData{
-		Data: data,
-	}, "stripe-js"); err != nil {
+	if err := app.renderTemplate(w, r, "buy-once", td, "stripe-js"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
 type Invoice struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID       int           `json:"id"`
+	Quantity int           `json:"quantity"`
+	Subtotal int           `json:"subtotal"`
+	Amount   int           `json:"amount"`
+	Currency string        `json:"currency"`
+	Discount int           `json:"discount"`
+	Taxes    []InvoiceTax  `json:"taxes"`
+	Items    []InvoiceItem `json:"items"`
+	// printed on the invoice
+	BillingAddress  models.Address `json:"billing_address"`
+	ShippingAddress models.Address `json:"shipping_address"`
+	FirstName       string         `json:"first_name"`
+	LastName        string         `json:"last_name"`
+	Email           string         `json:"email"`
+	CreatedAt       time.Time      `json:"created_at"`
+}
+
+type InvoiceItem struct {
+	Product  string `json:"product"`
+	Quantity int    `json:"quantity"`
+	Amount   int    `json:"amount"`
+}
+
+type InvoiceTax struct {
+	Jurisdiction string  `json:"jurisdiction"`
+	Name         string  `json:"name"`
+	Rate         float64 `json:"rate"`
+	Amount       int     `json:"amount"`
+}
+
+// taxes of an order for the invoice
+func invoiceTaxes(order models.Order) []InvoiceTax {
+	var taxes []InvoiceTax
+	for _, t := range order.Taxes {
+		taxes = append(taxes, InvoiceTax{Jurisdiction: t.Jurisdiction, Name: t.Name, Rate: t.Rate, Amount: t.Amount})
+	}
+	return taxes
 }
 
 // handle widget transaction data and redirect to recipt page
@@ -131,13 +180,36 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// create a new customer
-	customerID, err := app.SaveCustomer(txnData.FirstName, txnData.LastName, txnData.Email)
+	// a form posted again shows the receipt of the order already saved
+	if app.orderSaved(r.Context(), txnData.PaymentIntentID) {
+		app.Session.Put(r.Context(), "receipt", txnData)
+		http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+		return
+	}
+
+	// the order is priced again from the catalog, and must match what was charged
+	billing, shipping := checkoutAddresses(r)
+
+	quote, err := app.quoteOrder(r.Context(), []models.OrderItem{{WidgetID: widgetID, Quantity: 1}}, txnData.PaymentCurrency, r.Form.Get("promotion_code"), billing.TaxAddress())
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	err = checkPayment(txnData, quote)
 	if err != nil {
 		app.errorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Your payment could not be matched to the order, please contact us")
+		http.Redirect(w, r, fmt.Sprintf("/widget/%d", widgetID), http.StatusSeeOther)
 		return
 	}
 
+	customer := models.Customer{
+		FirstName: txnData.FirstName,
+		LastName:  txnData.LastName,
+		Email:     txnData.Email,
+	}
+
 	// create a new transaction
 	txn := models.Transaction{
 		Amount:              txnData.PaymentAmount,
@@ -151,40 +223,58 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		TransactionStatusID: 2,
 	}
 
-	txnID, err := app.SaveTransaction(txn)
-	if err != nil {
-		app.errorLog.Println(err)
-		return
-	}
-
 	// create a new order
 	order := models.Order{
-		WidgetID:      widgetID,
-		TransactionID: txnID,
-		CustomerID:    customerID,
-		StatusID:      1,
-		Quantity:      1,
-		Amount:        txnData.PaymentAmount,
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
+		WidgetID:        widgetID,
+		StatusID:        1,
+		Quantity:        quote.Quantity(),
+		Subtotal:        quote.Subtotal,
+		Amount:          quote.Total,
+		PromotionID:     quote.PromotionID,
+		Discount:        quote.Discount,
+		Tax:             quote.Tax,
+		TaxCountry:      quote.TaxAddress.Country,
+		TaxRegion:       quote.TaxAddress.Region,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+		Items:           quote.Items,
+		Taxes:           quote.OrderTaxes(),
+		BillingAddress:  billing,
+		ShippingAddress: shipping,
+	}
+
+	orderID, err := app.saveCheckout(customer, txn, order, billing, shipping)
+	if err != nil && app.orderSaved(r.Context(), txnData.PaymentIntentID) {
+		// the same form posted twice at once, the other request saved the order
+		app.Session.Put(r.Context(), "receipt", txnData)
+		http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+		return
 	}
-
-	orderID, err := app.SaveOrder(order)
 	if err != nil {
-		app.errorLog.Println(err)
+		app.needsReconciliation(customer, txn, order, err)
+		app.Session.Put(r.Context(), "error", reconciliationMessage)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
 	// call invoice microservice
 	inv := Invoice{
 		ID:        orderID,
+		Subtotal:  order.Subtotal,
 		Amount:    order.Amount,
-		Product:   "Widget",
+		Currency:  txn.Currency,
+		Discount:  order.Discount,
+		Taxes:     invoiceTaxes(order),
 		Quantity:  order.Quantity,
 		FirstName: txnData.FirstName,
 		LastName:  txnData.LastName,
 		Email:     txnData.Email,
 		CreatedAt: time.Now(),
+		Items: []InvoiceItem{
+			{Product: quote.Items[0].Widget.Name, Quantity: order.Quantity, Amount: quote.Items[0].Amount},
+		},
+		BillingAddress:  order.BillingAddress,
+		ShippingAddress: order.ShippingAddress,
 	}
 
 	err = app.CallInvoiceService(inv)
@@ -199,7 +289,7 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 }
 
 func (app *application) CallInvoiceService(inv Invoice) error {
-	url := "http://localhost:5000/invoice/create-and-send"
+	url := fmt.Sprintf("%s/invoice/create-and-send", app.config.invoice)
 	out, err := json.MarshalIndent(inv, "", "\t")
 	if err != nil {
 		return err
@@ -237,26 +327,44 @@ func (app *application) Receipt(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// display the page to subscribe bronze plan
-func (app *application) BronzePlan(w http.ResponseWriter, r *http.Request) {
-	widget, err := app.DB.GetWidget(2)
+// display the plans customers can subscribe to
+func (app *application) Plans(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.DB.GetActivePlans(r.Context())
 	if err != nil {
 		app.errorLog.Println(err)
 		return
 	}
 
 	data := make(map[string]any)
-	data["widget"] = widget
+	data["plans"] = plans
 
-	if err := app.renderTemplate(w, r, "bronze-plan", &templateData{
+	if err := app.renderTemplate(w, r, "plans", &templateData{
 		Data: data,
 	}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
-// display bronze plan(subscription) receipt page
-func (app *application) BronzePlanReceipt(w http.ResponseWriter, r *http.Request) {
+// display the page to subscribe to a plan
+func (app *application) Plan(w http.ResponseWriter, r *http.Request) {
+	plan, err := app.DB.GetPlanBySlug(r.Context(), chi.URLParam(r, "slug"))
+	if err != nil || !plan.Active {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := make(map[string]any)
+	data["plan"] = plan
+
+	if err := app.renderTemplate(w, r, "plan", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// display plan(subscription) receipt page
+func (app *application) PlanReceipt(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "receipt-plan", nil); err != nil {
 		app.errorLog.Println(err)
 	}
@@ -270,6 +378,8 @@ type TransactionData struct {
 	PaymentMethodID string
 	PaymentAmount   int
 	PaymentCurrency string
+	PaymentItems    string
+	PaymentTaxes    string
 	LastFour        string
 	ExpiryMonth     int
 	ExpiryYear      int
@@ -290,27 +400,18 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	email := r.Form.Get("email")
 	paymentIntent := r.Form.Get("payment_intent")
 	paymentMethod := r.Form.Get("payment_method")
-	paymentAmount := r.Form.Get("payment_amount")
-	paymentCurrency := r.Form.Get("payment_currency")
 
-	amount, err := strconv.Atoi(paymentAmount)
+	pi, err := app.Gateway.RetrievePaymentIntent(paymentIntent)
 	if err != nil {
 		app.errorLog.Println(err)
 		return txnData, err
 	}
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		return txnData, fmt.Errorf("payment intent %s has status %s", pi.ID, pi.Status)
 	}
 
-	pi, err := card.RetrievePaymentIntent(paymentIntent)
-	if err != nil {
-		app.errorLog.Println(err)
-		return txnData, err
-	}
-
-	pm, err := card.GetPaymentMethod(paymentMethod)
+	pm, err := app.Gateway.GetPaymentMethod(paymentMethod)
 	if err != nil {
 		app.errorLog.Println(err)
 		return txnData, err
@@ -326,8 +427,10 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 		Email:           email,
 		PaymentIntentID: paymentIntent,
 		PaymentMethodID: paymentMethod,
-		PaymentAmount:   amount,
-		PaymentCurrency: paymentCurrency,
+		PaymentAmount:   int(pi.Amount),
+		PaymentCurrency: pi.Currency,
+		PaymentItems:    pi.Metadata["items"],
+		PaymentTaxes:    pi.Metadata["tax_location"],
 		LastFour:        lastFour,
 		ExpiryMonth:     int(expiryMonth),
 		ExpiryYear:      int(expiryYear),
@@ -337,35 +440,192 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	return txnData, nil
 }
 
-// save customer information into database and return id
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
+// address fields named prefix_line1 etc. posted with a checkout form
+func formAddress(r *http.Request, prefix string) models.Address {
+	return models.Address{
+		Kind:       prefix,
+		Name:       r.Form.Get(prefix + "_name"),
+		Line1:      r.Form.Get(prefix + "_line1"),
+		Line2:      r.Form.Get(prefix + "_line2"),
+		City:       r.Form.Get(prefix + "_city"),
+		Region:     r.Form.Get(prefix + "_region"),
+		PostalCode: r.Form.Get(prefix + "_postal_code"),
+		Country:    r.Form.Get(prefix + "_country"),
+	}.Normalize()
+}
+
+// billing and shipping addresses posted with a checkout form, the api checked them
+// before the card was charged. shipping is a copy of billing when ship_to_billing is ticked
+func checkoutAddresses(r *http.Request) (models.Address, models.Address) {
+	billing := formAddress(r, models.AddressBilling)
+	billing.Name = strings.TrimSpace(r.Form.Get("first_name") + " " + r.Form.Get("last_name"))
+
+	if r.Form.Get("ship_to_billing") != "" {
+		shipping := billing
+		shipping.Kind = models.AddressShipping
+		return billing, shipping
 	}
 
-	id, err := app.DB.InsertCustomer(customer)
+	return billing, formAddress(r, models.AddressShipping)
+}
+
+// price the items of a paid order again, with the promotion code the customer
+// entered and the taxes for their billing address
+func (app *application) quoteOrder(ctx context.Context, items []models.OrderItem, currency, code string, addr tax.Address) (models.Quote, error) {
+	quote, err := app.DB.QuoteItems(ctx, items, currency)
 	if err != nil {
-		return 0, err
+		return quote, err
 	}
 
-	return id, nil
+	if code != "" {
+		// the code was checked when the payment intent was created, it may have been
+		// used up since but the customer paid the discounted price
+		promotion, err := app.DB.GetPromotionByCode(ctx, code)
+		if err != nil {
+			return quote, err
+		}
+
+		quote, err = promotion.Apply(quote)
+		if err != nil {
+			return quote, err
+		}
+	}
+
+	return quote.ApplyTax(app.TaxRates, addr)
 }
 
-// save transaction information into database and return id
-func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(txn)
+// make sure the payment intent charged exactly what the server quoted for the order
+func checkPayment(txnData TransactionData, quote models.Quote) error {
+	if txnData.PaymentAmount != quote.Total || txnData.PaymentCurrency != quote.Currency {
+		return fmt.Errorf("payment intent %s charged %d %s, order is quoted at %d %s",
+			txnData.PaymentIntentID, txnData.PaymentAmount, txnData.PaymentCurrency, quote.Total, quote.Currency)
+	}
+
+	// intents created by the api name the items they were quoted for
+	if txnData.PaymentItems != "" && txnData.PaymentItems != quote.ItemsKey() {
+		return fmt.Errorf("payment intent %s was created for items %s, order has %s",
+			txnData.PaymentIntentID, txnData.PaymentItems, quote.ItemsKey())
+	}
+
+	// the same total can be owed to a different jurisdiction
+	if txnData.PaymentTaxes != "" && txnData.PaymentTaxes != quote.TaxAddress.String() {
+		return fmt.Errorf("payment intent %s was taxed for %s, order is billed to %s",
+			txnData.PaymentIntentID, txnData.PaymentTaxes, quote.TaxAddress)
+	}
+
+	return nil
+}
+
+// shown to a customer whose payment went through but whose order could not be saved
+const reconciliationMessage = "Your payment went through but we could not save your order. It has been recorded and we will contact you, please don't pay again"
+
+// save a paid checkout in one database transaction: the customer, the addresses they
+// entered, the transaction, the order, the use of its promotion and the sale of the stock
+// reserved for it, returns the order id. it doesn't run in the request's context, the
+// customer has paid so the order is saved even if they have gone
+func (app *application) saveCheckout(customer models.Customer, txn models.Transaction, order models.Order, addresses ...models.Address) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var orderID int
+
+	err := app.DB.WithTx(ctx, func(tx models.Store) error {
+		// a returning customer keeps their row, so all their orders stay together
+		customerID, err := tx.GetOrInsertCustomer(ctx, customer)
+		if err != nil {
+			return err
+		}
+
+		// the order keeps its own copy of the addresses, so failures are only logged
+		for _, a := range addresses {
+			a.CustomerID = customerID
+			_, err = tx.InsertAddress(ctx, a)
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+		}
+
+		order.TransactionID, err = tx.InsertTransaction(ctx, txn)
+		if err != nil {
+			return err
+		}
+
+		// the customer paid the discounted price, so an order using a promotion up by
+		// other orders since the quote is saved and marked
+		if order.PromotionID > 0 {
+			within, err := tx.RedeemPromotion(ctx, order.PromotionID)
+			if err != nil {
+				return err
+			}
+			order.PromotionOverused = !within
+		}
+
+		order.CustomerID = customerID
+		orderID, err = tx.InsertOrder(ctx, order)
+		if err != nil {
+			return err
+		}
+
+		// turn the reservation made with the payment intent into a sale
+		return tx.CommitStock(ctx, txn.PaymentIntent, order.Items)
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	return id, nil
+	if order.PromotionOverused {
+		app.infoLog.Printf("order %d used promotion %d beyond its limit\n", orderID, order.PromotionID)
+	}
+
+	return orderID, nil
 }
 
-// save order information into database and return id
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
+// whether the order paid by a payment intent has been saved already, a lookup that
+// fails is logged and reported as not saved, the unique payment intent still stops
+// the order from being saved twice
+func (app *application) orderSaved(ctx context.Context, pi string) bool {
+	_, err := app.DB.GetOrderIDByPaymentIntent(ctx, pi)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.errorLog.Println(err)
+		}
+		return false
+	}
+
+	return true
+}
+
+// record a checkout stripe accepted but that could not be saved, it is logged as
+// well since the database may be the reason, the record outlives the request
+func (app *application) needsReconciliation(customer models.Customer, txn models.Transaction, order models.Order, cause error) {
+	details, err := json.Marshal(map[string]any{
+		"customer":    customer,
+		"transaction": txn,
+		"order":       order,
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.errorLog.Printf("payment %s needs reconciliation: %s: %s\n", txn.PaymentIntent, cause, details)
+
+	_, err = app.DB.InsertReconciliation(context.Background(), models.Reconciliation{
+		Kind:          models.ReconcilePayment,
+		PaymentIntent: txn.PaymentIntent,
+		Email:         customer.Email,
+		Amount:        txn.Amount,
+		Currency:      txn.Currency,
+		Details:       string(details),
+		Error:         cause.Error(),
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// save transaction information into database and return id
+func (app *application) SaveTransaction(ctx context.Context, txn models.Transaction) (int, error) {
+	id, err := app.DB.InsertTransaction(ctx, txn)
 	if err != nil {
 		return 0, err
 	}
@@ -393,13 +653,61 @@ func (app *application) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
 
-	id, err := app.DB.Authenticate(email, password)
+	// the login page has already asked the api, which counts its own hits of the ip
+	err = app.Limiter.Allow(r.Context(), ratelimit.IPKey("web-login", clientIP(r)), ratelimit.LoginPerIP)
+	if err == nil {
+		err = app.Limiter.Check(r.Context(), ratelimit.AccountKey(email))
+	}
+	var limited *ratelimit.LimitedError
+	if errors.As(err, &limited) {
+		app.Session.Put(r.Context(), "error", limited.Error())
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	id, err := app.DB.Authenticate(r.Context(), email, password)
+	if err != nil {
+		err = app.Limiter.Fail(r.Context(), ratelimit.AccountKey(email), email)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.DB.GetOneUser(r.Context(), id)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
+	// the api checks the code of users with two-factor authentication and gives the
+	// login page a challenge to post along, which logs in once within minutes
+	if user.TwoFactorEnabled {
+		challengeUser, err := app.DB.UseLoginChallenge(r.Context(), r.Form.Get("login_challenge"))
+		if err != nil || challengeUser != id {
+			app.Session.Put(r.Context(), "error", "Enter the code of your authenticator app")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+	}
+
+	err = app.Limiter.Succeed(r.Context(), ratelimit.AccountKey(email))
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
 	app.Session.Put(r.Context(), "userID", id)
+
+	if app.TwoFactorRoles.Has(user.Role) && !user.TwoFactorEnabled {
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
@@ -412,7 +720,12 @@ func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w, r, "forgot-password", nil); err != nil {
+	stringMap := make(map[string]string)
+	stringMap["title"] = "Forgot Password"
+	stringMap["forgot-url"] = "/api/forgot-password"
+	if err := app.renderTemplate(w, r, "forgot-password", &templateData{
+		StringMap: stringMap,
+	}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
@@ -453,8 +766,14 @@ func (app *application) ShowResetPassword(w http.ResponseWriter, r *http.Request
 	data := make(map[string]any)
 	data["email"] = encryptedEmail
 
+	stringMap := make(map[string]string)
+	stringMap["title"] = "Reset Password"
+	stringMap["reset-url"] = "/api/reset-password"
+	stringMap["login-url"] = "/login"
+
 	if err := app.renderTemplate(w, r, "reset-password", &templateData{
-		Data: data,
+		StringMap: stringMap,
+		Data:      data,
 	}); err != nil {
 		app.errorLog.Println(err)
 	}
@@ -481,8 +800,14 @@ func (app *application) ShowSale(w http.ResponseWriter, r *http.Request) {
 	stringMap["status-badge"] = "Refunded"
 	stringMap["success-title"] = "Refunded!"
 	stringMap["success-message"] = "Your charge has been refunded."
+	intMap := make(map[string]int)
+	intMap["partial-refunds"] = 1
+	if user, _ := app.sessionUser(r); user.Can(models.PermissionRefund) {
+		intMap["can-refund"] = 1
+	}
 	if err := app.renderTemplate(w, r, "sale", &templateData{
 		StringMap: stringMap,
+		IntMap:    intMap,
 	}); err != nil {
 		app.errorLog.Println(err)
 	}
@@ -497,13 +822,63 @@ func (app *application) ShowSubscription(w http.ResponseWriter, r *http.Request)
 	stringMap["status-badge"] = "Cancelled"
 	stringMap["success-title"] = "Cancelled!"
 	stringMap["success-message"] = "Your subscription has been cancelled."
+	intMap := make(map[string]int)
+	if user, _ := app.sessionUser(r); user.Can(models.PermissionCancelSubscription) {
+		intMap["can-refund"] = 1
+	}
 	if err := app.renderTemplate(w, r, "sale", &templateData{
 		StringMap: stringMap,
+		IntMap:    intMap,
 	}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
+// display the promotion codes
+func (app *application) AllPromotions(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-promotions", nil); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// display one promotion with its usage, or the form to create one when id is 0
+func (app *application) OnePromotion(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "one-promotion", nil); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// display the taxes collected per jurisdiction
+func (app *application) TaxReport(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "tax-report", nil); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) AuditLog(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]any)
+	data["actions"] = models.AuditActions
+	if err := app.renderTemplate(w, r, "audit", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// set up the authenticator app of the logged in user
+func (app *application) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "two-factor", nil); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// the api tokens of the logged in user
+func (app *application) Tokens(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "tokens", nil); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "all-users", nil); err != nil {
 		app.errorLog.Println(err)
@@ -511,7 +886,11 @@ func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w, r, "one-user", nil); err != nil {
+	data := make(map[string]any)
+	data["roles"] = models.Roles()
+	if err := app.renderTemplate(w, r, "one-user", &templateData{
+		Data: data,
+	}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
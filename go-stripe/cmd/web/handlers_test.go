@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"log"
+	"myapp/internal/cards"
+	"myapp/internal/models"
+	"myapp/internal/ratelimit"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// a web server on a memory store and the fake gateway, with the invoices it sends
+type testServer struct {
+	app     *application
+	db      *models.MemoryStore
+	gateway *cards.FakeGateway
+	srv     *httptest.Server
+	client  *http.Client
+
+	mu       sync.Mutex
+	invoices []Invoice
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	ts := &testServer{
+		db:      models.NewMemoryStore(),
+		gateway: cards.NewFakeGateway(),
+	}
+
+	invoices := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var inv Invoice
+		if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+			t.Errorf("invoice: %v", err)
+		}
+		ts.mu.Lock()
+		ts.invoices = append(ts.invoices, inv)
+		ts.mu.Unlock()
+	}))
+	t.Cleanup(invoices.Close)
+
+	gob.Register(TransactionData{})
+	session = scs.New()
+
+	ts.app = &application{
+		infoLog:  log.New(io.Discard, "", 0),
+		errorLog: log.New(io.Discard, "", 0),
+		DB:       ts.db,
+		Session:  session,
+		Gateway:  ts.gateway,
+	}
+	ts.app.config.invoice = invoices.URL
+	ts.app.Limiter = ratelimit.New(ts.db, 10, time.Minute)
+
+	ts.srv = httptest.NewServer(ts.app.routes())
+	t.Cleanup(ts.srv.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.client = &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return ts
+}
+
+// post a form and return where the server redirected to
+func (ts *testServer) post(t *testing.T, path string, form url.Values) string {
+	t.Helper()
+
+	resp, err := ts.client.PostForm(ts.srv.URL+path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("POST %s: got status %d, want a redirect", path, resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+// charge what the api would for items shipped to Toronto and reserve their stock
+func (ts *testServer) pay(t *testing.T, items []models.OrderItem) string {
+	t.Helper()
+	ctx := context.Background()
+
+	quote, err := ts.db.QuoteItems(ctx, items, models.DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quote, err = quote.ApplyTax(nil, checkoutForm("").billing().TaxAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pi, _, err := ts.gateway.Charge(quote.Currency, quote.Total, quote.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ts.db.ReserveStock(ctx, pi.ID, quote.Items, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pi.ID
+}
+
+type form url.Values
+
+// the checkout form the pages post once stripe has taken the payment
+func checkoutForm(pi string) form {
+	return form{
+		"payment_intent":      {pi},
+		"payment_method":      {"pm_card_visa"},
+		"first_name":          {"Ada"},
+		"last_name":           {"Lovelace"},
+		"email":               {"ada@example.com"},
+		"billing_line1":       {"1 King St W"},
+		"billing_city":        {"Toronto"},
+		"billing_region":      {"ON"},
+		"billing_postal_code": {"M5H 1A1"},
+		"billing_country":     {"CA"},
+		"ship_to_billing":     {"1"},
+	}
+}
+
+func (f form) billing() models.Address {
+	r := &http.Request{Form: url.Values(f)}
+	billing, _ := checkoutAddresses(r)
+	return billing
+}
+
+func (ts *testServer) orders(t *testing.T) []*models.Order {
+	t.Helper()
+
+	orders, err := ts.db.GetAllOrders(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return orders
+}
+
+func (ts *testServer) stock(t *testing.T, widgetID int) (int, int) {
+	t.Helper()
+
+	w, err := ts.db.GetWidget(context.Background(), widgetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	available, err := ts.db.AvailableStock(context.Background(), widgetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.InventoryLevel, available
+}
+
+func TestPaymentSucceeded(t *testing.T) {
+	ts := newTestServer(t)
+	widgetID := ts.db.AddWidget(models.Widget{Name: "Widget", Price: 1000, InventoryLevel: 10})
+
+	pi := ts.pay(t, []models.OrderItem{{WidgetID: widgetID, Quantity: 1}})
+
+	f := checkoutForm(pi)
+	f["product_id"] = []string{strconv.Itoa(widgetID)}
+
+	if got := ts.post(t, "/payment-succeeded", url.Values(f)); got != "/receipt" {
+		t.Fatalf("redirected to %s", got)
+	}
+
+	orders := ts.orders(t)
+	if len(orders) != 1 {
+		t.Fatalf("got %d orders", len(orders))
+	}
+	if orders[0].Amount != 1000 || orders[0].Transaction.PaymentIntent != pi {
+		t.Errorf("got order of %d paid by %s", orders[0].Amount, orders[0].Transaction.PaymentIntent)
+	}
+	if level, available := ts.stock(t, widgetID); level != 9 || available != 9 {
+		t.Errorf("got stock %d, %d available, want 9", level, available)
+	}
+	if len(ts.invoices) != 1 || ts.invoices[0].Email != "ada@example.com" {
+		t.Errorf("got invoices %v", ts.invoices)
+	}
+
+	// the back button posts the form again
+	if got := ts.post(t, "/payment-succeeded", url.Values(f)); got != "/receipt" {
+		t.Fatalf("posted again, redirected to %s", got)
+	}
+	if n := len(ts.orders(t)); n != 1 {
+		t.Errorf("got %d orders after posting again", n)
+	}
+	if level, _ := ts.stock(t, widgetID); level != 9 {
+		t.Errorf("got stock %d after posting again", level)
+	}
+}
+
+func TestPaymentSucceededForAnotherAmount(t *testing.T) {
+	ts := newTestServer(t)
+	cheap := ts.db.AddWidget(models.Widget{Name: "Cheap", Price: 100, InventoryLevel: 10})
+	dear := ts.db.AddWidget(models.Widget{Name: "Dear", Price: 5000, InventoryLevel: 10})
+
+	// paid for the cheap widget, posted as the dear one
+	pi := ts.pay(t, []models.OrderItem{{WidgetID: cheap, Quantity: 1}})
+
+	f := checkoutForm(pi)
+	f["product_id"] = []string{strconv.Itoa(dear)}
+
+	if got := ts.post(t, "/payment-succeeded", url.Values(f)); got != "/widget/"+strconv.Itoa(dear) {
+		t.Errorf("redirected to %s", got)
+	}
+	if n := len(ts.orders(t)); n != 0 {
+		t.Errorf("got %d orders", n)
+	}
+}
+
+func TestPaymentSucceededWithUsedUpPromotion(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	widgetID := ts.db.AddWidget(models.Widget{Name: "Widget", Price: 1000, InventoryLevel: 10})
+
+	promotionID, err := ts.db.InsertPromotion(ctx, models.Promotion{Code: "ONCE", Kind: models.PromotionPercent, Value: 10, MaxUses: 1, Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quote, err := ts.db.QuoteItems(ctx, []models.OrderItem{{WidgetID: widgetID, Quantity: 1}}, models.DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quote, err = ts.db.QuotePromotion(ctx, quote, "ONCE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two customers were quoted the last use and both paid the discounted price
+	var pis []string
+	for i := 0; i < 2; i++ {
+		pi, _, err := ts.gateway.Charge(quote.Currency, quote.Total, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pis = append(pis, pi.ID)
+	}
+
+	for i, pi := range pis {
+		f := checkoutForm(pi)
+		f["product_id"] = []string{strconv.Itoa(widgetID)}
+		f["promotion_code"] = []string{"ONCE"}
+
+		if got := ts.post(t, "/payment-succeeded", url.Values(f)); got != "/receipt" {
+			t.Errorf("checkout %d redirected to %s", i+1, got)
+		}
+	}
+
+	promotion, err := ts.db.GetPromotion(ctx, promotionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promotion.TimesUsed != 2 {
+		t.Errorf("promotion used %d times", promotion.TimesUsed)
+	}
+
+	// the second order is kept, marked as beyond the limit
+	for i, pi := range pis {
+		id, err := ts.db.GetOrderIDByPaymentIntent(ctx, pi)
+		if err != nil {
+			t.Fatalf("order of checkout %d: %v", i+1, err)
+		}
+		order, err := ts.db.GetOrderByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order.Discount != 100 || order.PromotionOverused != (i == 1) {
+			t.Errorf("checkout %d: got discount %d, overused %t", i+1, order.Discount, order.PromotionOverused)
+		}
+	}
+}
+
+func TestCartPaymentSucceeded(t *testing.T) {
+	ts := newTestServer(t)
+	a := ts.db.AddWidget(models.Widget{Name: "A", Price: 1000, InventoryLevel: 5})
+	b := ts.db.AddWidget(models.Widget{Name: "B", Price: 250, InventoryLevel: 5})
+
+	ts.post(t, "/cart/add", url.Values{"widget_id": {strconv.Itoa(a)}, "quantity": {"1"}})
+	ts.post(t, "/cart/add", url.Values{"widget_id": {strconv.Itoa(b)}, "quantity": {"2"}})
+
+	pi := ts.pay(t, []models.OrderItem{{WidgetID: a, Quantity: 1}, {WidgetID: b, Quantity: 2}})
+
+	if got := ts.post(t, "/cart/payment-succeeded", url.Values(checkoutForm(pi))); got != "/receipt" {
+		t.Fatalf("redirected to %s", got)
+	}
+
+	orders := ts.orders(t)
+	if len(orders) != 1 || orders[0].Amount != 1500 {
+		t.Fatalf("got orders %v", orders)
+	}
+	items, err := ts.db.GetOrderItems(context.Background(), orders[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Errorf("got %d order lines", len(items))
+	}
+	if level, _ := ts.stock(t, b); level != 3 {
+		t.Errorf("got stock %d of B", level)
+	}
+
+	// the cart is gone, posting again shows the receipt without another order
+	if got := ts.post(t, "/cart/payment-succeeded", url.Values(checkoutForm(pi))); got != "/receipt" {
+		t.Fatalf("posted again, redirected to %s", got)
+	}
+	if n := len(ts.orders(t)); n != 1 {
+		t.Errorf("got %d orders after posting again", n)
+	}
+	if level, _ := ts.stock(t, b); level != 3 {
+		t.Errorf("got stock %d of B after posting again", level)
+	}
+}
+
+func TestLoginWithTwoFactor(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.db.AddUser(ctx, models.User{FirstName: "Admin", LastName: "User", Email: "admin@example.com", Role: models.RoleOwner}, string(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := ts.db.GetUserByEmail(ctx, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.db.EnableTwoFactor(ctx, user.ID, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := func(scope string) string {
+		token, err := models.GenerateToken(user.ID, time.Hour, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.db.InsertToken(ctx, token, user); err != nil {
+			t.Fatal(err)
+		}
+		return token.PlainText
+	}
+	login := func(challenge string) string {
+		ts.client.Jar, _ = cookiejar.New(nil)
+		return ts.post(t, "/login", url.Values{
+			"email":           {"admin@example.com"},
+			"password":        {"password"},
+			"login_challenge": {challenge},
+		})
+	}
+
+	// a login token, say one left in another browser, isn't a second factor
+	if got := login(token(models.ScopeAuthentication)); got != "/login" {
+		t.Errorf("logged in with a login token, redirected to %s", got)
+	}
+
+	challenge := token(models.ScopeLoginChallenge)
+	if got := login(challenge); got != "/" {
+		t.Errorf("logged in with a challenge, redirected to %s", got)
+	}
+	if got := login(challenge); got != "/login" {
+		t.Errorf("logged in twice with a challenge, redirected to %s", got)
+	}
+
+	// nor is a challenge a token
+	if _, _, err := ts.db.GetUserForToken(ctx, token(models.ScopeLoginChallenge)); err == nil {
+		t.Error("a challenge authenticated as a token")
+	}
+}
+
+func TestCustomerLoginIsLimited(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ts.db.InsertCustomer(ctx, models.Customer{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.db.UpdatePasswordForCustomer(ctx, models.Customer{ID: id, Email: "ada@example.com"}, string(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(password string) string {
+		return ts.post(t, "/account/login", url.Values{"email": {"ada@example.com"}, "password": {password}})
+	}
+
+	if got := login("password"); got != "/account/orders" {
+		t.Fatalf("redirected to %s", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := login("guess"); got != "/account/login" {
+			t.Fatalf("wrong password, redirected to %s", got)
+		}
+	}
+
+	// after 3 failures the account waits before the next attempt, even the right one
+	if got := login("password"); got != "/account/login" {
+		t.Errorf("logged in straight after 3 failures, redirected to %s", got)
+	}
+}
+
+func TestLoginLocksOut(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.db.AddUser(ctx, models.User{FirstName: "Admin", LastName: "User", Email: "admin@example.com", Role: models.RoleViewer}, string(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no delay between failures, only the lockout after 10
+	now := time.Now()
+	ts.app.Limiter.Now = func() time.Time { return now }
+	ts.app.Limiter.Delay = 0
+
+	login := func(password string) string {
+		ts.client.Jar, _ = cookiejar.New(nil)
+		return ts.post(t, "/login", url.Values{"email": {"admin@example.com"}, "password": {password}})
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := login("guess"); got != "/login" {
+			t.Fatalf("wrong password, redirected to %s", got)
+		}
+	}
+
+	if got := login("password"); got != "/login" {
+		t.Errorf("logged in while locked out, redirected to %s", got)
+	}
+	until, err := ts.app.Limiter.LockedUntil(ctx, ratelimit.AccountKey("Admin@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("locked until %s, want %s", until, now.Add(time.Minute))
+	}
+
+	// the customer account of the same email isn't locked with it
+	if err := ts.app.Limiter.Check(ctx, ratelimit.CustomerKey("admin@example.com")); err != nil {
+		t.Errorf("got %v for the customer account", err)
+	}
+
+	now = now.Add(time.Minute)
+	if got := login("password"); got != "/" {
+		t.Errorf("once the lock was over, redirected to %s", got)
+	}
+}
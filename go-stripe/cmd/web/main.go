@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"myapp/internal/cards"
 	"myapp/internal/driver"
+	"myapp/internal/health"
 	"myapp/internal/models"
+	"myapp/internal/ratelimit"
+	"myapp/internal/tax"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/alexedwards/scs/mysqlstore"
@@ -26,14 +34,25 @@ type config struct {
 	env  string
 	api  string
 	db   struct {
-		dsn string
+		dsn     string
+		timeout time.Duration
 	}
 	stripe struct {
 		secret string
 		key    string
 	}
-	secretkey string
-	frontend  string
+	gateway         string
+	secretkey       string
+	frontend        string
+	invoice         string
+	taxRates        string
+	shutdownTimeout time.Duration
+	preStopDelay    time.Duration
+	twoFactorRoles  string
+	login           struct {
+		maxFailures int
+		lockout     time.Duration
+	}
 }
 
 type application struct {
@@ -42,8 +61,14 @@ type application struct {
 	errorLog      *log.Logger
 	templateCache map[string]*template.Template
 	version       string
-	DB            models.DBModel
+	DB            models.Store
 	Session       *scs.SessionManager
+	Gateway       cards.PaymentGateway
+	TaxRates      *tax.Table
+	Health        *health.Checker
+	// roles that must use two-factor authentication
+	TwoFactorRoles models.RoleSet
+	Limiter        *ratelimit.Limiter
 }
 
 func (app *application) serve() error {
@@ -56,42 +81,113 @@ func (app *application) serve() error {
 		WriteTimeout:      5 * time.Second,
 	}
 
+	// websockets are hijacked, so Shutdown leaves them to the hub
+	srv.RegisterOnShutdown(app.CloseWsClients)
+
+	// on SIGINT or SIGTERM stop taking requests and let the ones in flight finish
+	shutdownErr := make(chan error)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-quit
+
+		app.infoLog.Printf("Shutting down HTTP server on %s\n", sig)
+		app.Health.Drain()
+
+		// keep serving while load balancers notice /readyz failing
+		time.Sleep(app.config.preStopDelay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+		defer cancel()
+
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
 	app.infoLog.Printf("Starting HTTP server in %s mode on port %d\n", app.config.env, app.config.port)
 
-	return srv.ListenAndServe()
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownErr
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Println("Stopped HTTP server")
+
+	return nil
 }
 
 func main() {
 	gob.Register(TransactionData{}) // specify type of session data
 
+	err := run()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// returns once the server has shut down, after the deferred cleanup has run
+func run() error {
 	var cfg config
 
 	flag.IntVar(&cfg.port, "port", 4000, "Server port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application environment {development|production}")
 	flag.StringVar(&cfg.api, "api", "http://localhost:4001", "URL to api")
 	flag.StringVar(&cfg.db.dsn, "dsn", "piatoss:secret@tcp(localhost:3306)/widgets?parseTime=true&tls=false", "dsn")
+	flag.DurationVar(&cfg.db.timeout, "db-timeout", models.DefaultQueryTimeout, "longest a database query may run")
+
+	flag.StringVar(&cfg.gateway, "gateway", cards.GatewayStripe, "Payment gateway {stripe|fake}")
 
 	flag.StringVar(&cfg.secretkey, "secret", "6z9srQg39vLfULthfRrzYKLJqzMVPAkD", "secret key")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "url to frontend")
+	flag.StringVar(&cfg.invoice, "invoice", "http://localhost:5000", "url to invoice microservice")
+	flag.StringVar(&cfg.taxRates, "tax-rates", "./tax-rates/rates.csv", "sales tax rate table (.csv or .json)")
+	flag.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long requests in flight may take to finish on shutdown")
+	flag.DurationVar(&cfg.preStopDelay, "pre-stop-delay", 5*time.Second, "how long to keep taking requests once /readyz fails on shutdown")
+	flag.StringVar(&cfg.twoFactorRoles, "two-factor-roles", "finance,owner", "roles that must use two-factor authentication, comma separated")
+	flag.IntVar(&cfg.login.maxFailures, "max-login-failures", 10, "failed logins of an account before it is locked")
+	flag.DurationVar(&cfg.login.lockout, "lockout", 15*time.Minute, "how long an account is locked, and how long its failed logins count")
 
 	flag.Parse()
 
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
 
+	gateway, err := cards.NewGateway(cfg.gateway, cfg.stripe.secret, cfg.stripe.key)
+	if err != nil {
+		return err
+	}
+
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
 	conn, err := driver.OpenDB(cfg.db.dsn)
 	if err != nil {
-		errorLog.Fatal(err)
+		return err
 	}
+	// closed once serve has drained the requests
 	defer conn.Close()
 
+	taxRates, err := tax.Load(cfg.taxRates)
+	if err != nil {
+		return err
+	}
+
+	twoFactorRoles, err := models.ParseRoleSet(cfg.twoFactorRoles)
+	if err != nil {
+		return err
+	}
+
 	// set up session manager
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
-	session.Store = mysqlstore.New(conn)
+	// its sweep of expired sessions is stopped before the database pool is closed
+	store := mysqlstore.New(conn)
+	defer store.StopCleanup()
+	session.Store = store
 
 	tc := make(map[string]*template.Template)
 
@@ -101,15 +197,22 @@ func main() {
 		errorLog:      errorLog,
 		templateCache: tc,
 		version:       version,
-		DB:            models.DBModel{DB: conn},
+		DB:            &models.DBModel{DB: conn, Timeout: cfg.db.timeout},
 		Session:       session,
+		Gateway:       gateway,
+		TaxRates:      taxRates,
+		Health:        health.New(2 * time.Second),
+
+		TwoFactorRoles: twoFactorRoles,
 	}
 
+	// shares its counts with the api through the database
+	app.Limiter = ratelimit.New(app.DB, cfg.login.maxFailures, cfg.login.lockout)
+
+	app.Health.Add("database", health.Ping(conn))
+	app.Health.Add("invoice", health.Get(cfg.invoice+"/healthz"))
+
 	go app.ListenToWsChannel()
 
-	err = app.serve()
-	if err != nil {
-		app.errorLog.Println(err)
-		log.Fatal(err)
-	}
+	return app.serve()
 }
@@ -1,6 +1,15 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"myapp/internal/models"
+	"net"
+	"net/http"
+)
+
+type contextKey string
+
+const userContextKey = contextKey("user")
 
 // set up middleware that loads and saves session automatically
 func SessionLoad(next http.Handler) http.Handler {
@@ -14,6 +23,77 @@ func (app *application) Auth(next http.Handler) http.Handler {
 			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 			return
 		}
+
+		// the user's role is read on every request, so changing it takes effect at once
+		user, err := app.DB.GetOneUser(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+		if err != nil {
+			app.Session.Remove(r.Context(), "userID")
+			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+
+		// users whose role must use two-factor authentication can only set it up until they have
+		if app.TwoFactorRoles.Has(user.Role) && !user.TwoFactorEnabled && r.URL.Path != "/admin/two-factor" {
+			app.Session.Put(r.Context(), "error", "Your role must set up two-factor authentication first")
+			http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// only let through the admin users whose role allows permission, used after Auth
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, _ := app.sessionUser(r)
+			if !user.Can(permission) {
+				app.Session.Put(r.Context(), "error", "Your role doesn't allow you to open that page")
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// the admin user logged in to the session, put in the context by Auth on admin pages
+func (app *application) sessionUser(r *http.Request) (models.User, bool) {
+	if user, ok := r.Context().Value(userContextKey).(models.User); ok {
+		return user, true
+	}
+
+	if !app.Session.Exists(r.Context(), "userID") {
+		return models.User{}, false
+	}
+
+	user, err := app.DB.GetOneUser(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		return models.User{}, false
+	}
+
+	return user, true
+}
+
+// customers log in separately from admin users, with 'customerID' and the token
+// of the /api/customer endpoints in the session
+func (app *application) CustomerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.Session.Exists(r.Context(), "customerID") || !app.Session.Exists(r.Context(), "customerToken") {
+			http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// the ip address of the client, without its port
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
@@ -4,6 +4,8 @@ import (
 	"embed"
 	"fmt"
 	"html/template"
+	"myapp/internal/models"
+	"myapp/internal/money"
 	"net/http"
 	"strings"
 )
@@ -19,19 +21,31 @@ type templateData struct {
 	Error                string
 	IsAuthenticated      int
 	UserID               int
+	UserRole             string
+	CustomerID           int
+	CustomerToken        string
 	API                  string
 	CSSVersion           string
 	StripeSecretKey      string
 	StripePublishableKey string
+	PaymentGateway       string
+	Currency             string
+	Currencies           []money.Currency
+}
+
+// whether the role of the logged in admin user allows permission, pages hide
+// the actions it doesn't allow
+func (td *templateData) Can(permission string) bool {
+	return models.Can(td.UserRole, permission)
 }
 
 var functions = template.FuncMap{
 	"formatCurrency": formatCurrency,
 }
 
-func formatCurrency(n int) string {
-	f := float32(n) / float32(100)
-	return fmt.Sprintf("$%.2f", f)
+// format an amount in minor units of currency
+func formatCurrency(n int, currency string) string {
+	return money.Format(n, currency)
 }
 
 //go:embed templates
@@ -42,14 +56,31 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 	td.API = app.config.api
 	td.StripeSecretKey = app.config.stripe.secret
 	td.StripePublishableKey = app.config.stripe.key
+	td.PaymentGateway = app.config.gateway
+	td.Currency = app.sessionCurrency(r)
+	td.Currencies = money.Currencies()
+
+	// one-time messages put in the session before a redirect
+	if td.Flash == "" {
+		td.Flash = app.Session.PopString(r.Context(), "flash")
+	}
+	if td.Error == "" {
+		td.Error = app.Session.PopString(r.Context(), "error")
+	}
 
 	if app.Session.Exists(r.Context(), "userID") {
 		td.IsAuthenticated = 1
 		td.UserID = app.Session.GetInt(r.Context(), "userID")
+		if user, ok := app.sessionUser(r); ok {
+			td.UserRole = user.Role
+		}
 	} else {
 		td.IsAuthenticated = 0
 		td.UserID = 0
 	}
+
+	td.CustomerID = app.Session.GetInt(r.Context(), "customerID")
+	td.CustomerToken = app.Session.GetString(r.Context(), "customerToken")
 	return td
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"myapp/internal/models"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -10,6 +11,10 @@ func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(SessionLoad) // middleware
 
+	// liveness and readiness for the orchestrator
+	mux.Get("/healthz", app.Health.Live)
+	mux.Get("/readyz", app.Health.Ready)
+
 	// home page
 	mux.Get("/", app.Home)
 
@@ -19,16 +24,31 @@ func (app *application) routes() http.Handler {
 	// virtual terminal page protected by middleware
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
-		mux.Get("/virtual-terminal", app.VirtualTerminal)
-
-		mux.Get("/all-sales", app.AllSales)
-		mux.Get("/sales/{id}", app.ShowSale)
 
-		mux.Get("/all-subscriptions", app.AllSubscriptions)
-		mux.Get("/subscriptions/{id}", app.ShowSubscription)
-
-		mux.Get("/all-users", app.AllUsers)
-		mux.Get("/all-users/{id}", app.OneUser)
+		mux.Get("/two-factor", app.TwoFactor)
+		mux.Get("/tokens", app.Tokens)
+
+		// each page needs a permission of the user's role
+		mux.With(app.RequirePermission(models.PermissionVirtualTerminal)).Get("/virtual-terminal", app.VirtualTerminal)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionViewSales))
+			mux.Get("/all-sales", app.AllSales)
+			mux.Get("/sales/{id}", app.ShowSale)
+			mux.Get("/all-subscriptions", app.AllSubscriptions)
+			mux.Get("/subscriptions/{id}", app.ShowSubscription)
+			mux.Get("/promotions", app.AllPromotions)
+			mux.Get("/promotions/{id}", app.OnePromotion)
+		})
+
+		mux.With(app.RequirePermission(models.PermissionViewTaxReport)).Get("/tax-report", app.TaxReport)
+		mux.With(app.RequirePermission(models.PermissionViewAudit)).Get("/audit", app.AuditLog)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionManageUsers))
+			mux.Get("/all-users", app.AllUsers)
+			mux.Get("/all-users/{id}", app.OneUser)
+		})
 	})
 
 	// widget page
@@ -36,9 +56,21 @@ func (app *application) routes() http.Handler {
 	mux.Post("/payment-succeeded", app.PaymentSucceeded)
 	mux.Get("/receipt", app.Receipt)
 
-	// subscription page
-	mux.Get("/plans/bronze", app.BronzePlan)
-	mux.Get("/receipt/bronze", app.BronzePlanReceipt)
+	// storefront currency
+	mux.Post("/currency", app.SetCurrency)
+
+	// shopping cart
+	mux.Get("/cart", app.ShowCart)
+	mux.Post("/cart/add", app.AddToCart)
+	mux.Post("/cart/update", app.UpdateCart)
+	mux.Post("/cart/remove", app.RemoveFromCart)
+	mux.Get("/cart/checkout", app.CartCheckout)
+	mux.Post("/cart/payment-succeeded", app.CartPaymentSucceeded)
+
+	// subscription pages
+	mux.Get("/plans", app.Plans)
+	mux.Get("/plans/{slug}", app.Plan)
+	mux.Get("/receipt/plan", app.PlanReceipt)
 
 	// authentication page
 	mux.Get("/login", app.LoginPage)
@@ -49,6 +81,20 @@ func (app *application) routes() http.Handler {
 	mux.Get("/forgot-password", app.ForgotPassword)
 	mux.Get("/reset-password", app.ShowResetPassword)
 
+	// customer accounts, separate from admin users
+	mux.Get("/account/login", app.CustomerLoginPage)
+	mux.Post("/account/login", app.PostCustomerLogin)
+	mux.Get("/account/magic-link", app.CustomerMagicLink)
+	mux.Get("/account/logout", app.CustomerLogout)
+	mux.Get("/account/forgot-password", app.CustomerForgotPassword)
+	mux.Get("/account/reset-password", app.ShowCustomerResetPassword)
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.CustomerAuth)
+		mux.Get("/account/orders", app.CustomerOrders)
+		mux.Get("/account/orders/{id}", app.CustomerOrder)
+	})
+
 	fileServer := http.FileServer(http.Dir("./static")) // use file system
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -38,6 +40,9 @@ var upgradeConnection = websocket.Upgrader{
 
 var clients = make(map[WebSocketConnection]string)
 
+// guards clients, which the handlers, the channel listener and shutdown share
+var clientsMu sync.Mutex
+
 var wsChan = make(chan WsPayload)
 
 // websocket handler
@@ -60,7 +65,9 @@ func (app *application) WsEndPoint(w http.ResponseWriter, r *http.Request) {
 	}
 
 	conn := WebSocketConnection{Conn: ws}
+	clientsMu.Lock()
 	clients[conn] = "" // register client
+	clientsMu.Unlock()
 
 	go app.ListenForWS(&conn) // keep listening while websocket connection is alive
 }
@@ -105,6 +112,9 @@ func (app *application) ListenToWsChannel() {
 }
 
 func (app *application) broadcastToAll(response WsJsonResponse) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
 	for client := range clients {
 		// broadcast to every connected client
 		err := client.WriteJSON(response)
@@ -115,3 +125,21 @@ func (app *application) broadcastToAll(response WsJsonResponse) {
 		}
 	}
 }
+
+// tell every client the server is going away and close its connection
+func (app *application) CloseWsClients() {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for client := range clients {
+		err := client.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		_ = client.Close()
+		delete(clients, client)
+	}
+
+	app.infoLog.Println("Closed websocket connections")
+}
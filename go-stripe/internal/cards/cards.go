@@ -1,19 +1,21 @@
 package cards
 
 import (
+	"fmt"
+
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/customer"
-	"github.com/stripe/stripe-go/v72/paymentintent"
-	"github.com/stripe/stripe-go/v72/paymentmethod"
-	"github.com/stripe/stripe-go/v72/refund"
-	"github.com/stripe/stripe-go/v72/sub"
+	"github.com/stripe/stripe-go/v72/client"
 )
 
-// card info
+// card info, stripe implementation of PaymentGateway
 type Card struct {
 	Secret   string
 	Key      string
 	Currency string
+	// sent with the writes to stripe, see WithIdempotencyKey
+	idempotencyKey string
+	// nil talks to api.stripe.com, tests point it at a local server
+	backends *stripe.Backends
 }
 
 // transaction info
@@ -26,23 +28,44 @@ type Transaction struct {
 }
 
 // use intuitive, meaningful method name
-func (c *Card) Charge(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	return c.CreatePaymentIntent(currency, amount)
+func (c *Card) Charge(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	return c.CreatePaymentIntent(currency, amount, metadata)
+}
+
+// stripe api client bound to the card secret, so the global stripe.Key is never touched
+func (c *Card) api() *client.API {
+	return client.New(c.Secret, c.backends)
+}
+
+// a copy of the card whose writes to stripe carry idempotency keys derived from key,
+// one per kind of write as stripe refuses a key reused with other parameters
+func (c *Card) WithIdempotencyKey(key string) PaymentGateway {
+	card := *c
+	card.idempotencyKey = key
+	return &card
 }
 
-func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	stripe.Key = c.Secret
+// set the idempotency key of a write, when the card has one
+func (c *Card) idempotent(params *stripe.Params, write string) {
+	if c.idempotencyKey != "" {
+		params.SetIdempotencyKey(c.idempotencyKey + "-" + write)
+	}
+}
 
+func (c *Card) CreatePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
 	// collect payment intent params
 	params := &stripe.PaymentIntentParams{
 		Amount:   stripe.Int64(int64(amount)),
 		Currency: stripe.String(currency),
 	}
 
-	//params.AddMetadata("key", "value")
+	for k, v := range metadata {
+		params.AddMetadata(k, v)
+	}
+	c.idempotent(&params.Params, "payment-intent")
 
 	// create payment intent
-	pi, err := paymentintent.New(params)
+	pi, err := c.api().PaymentIntents.New(params)
 	if err != nil {
 		msg := ""
 		if stripeErr, ok := err.(*stripe.Error); ok {
@@ -56,9 +79,7 @@ func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.Payment
 
 // get payment method by pament method id
 func (c *Card) GetPaymentMethod(id string) (*stripe.PaymentMethod, error) {
-	stripe.Key = c.Secret
-
-	pm, err := paymentmethod.Get(id, nil)
+	pm, err := c.api().PaymentMethods.Get(id, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -68,9 +89,7 @@ func (c *Card) GetPaymentMethod(id string) (*stripe.PaymentMethod, error) {
 
 // retrieve payment intent by existing payment intent id as payment intent changes during its life cycle
 func (c *Card) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
-	stripe.Key = c.Secret
-
-	pi, err := paymentintent.Get(id, nil)
+	pi, err := c.api().PaymentIntents.Get(id, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -80,7 +99,6 @@ func (c *Card) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
 
 // create stripe customer
 func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error) {
-	stripe.Key = c.Secret
 	var msg string
 
 	customerParams := &stripe.CustomerParams{
@@ -90,8 +108,9 @@ func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error
 			DefaultPaymentMethod: stripe.String(pm),
 		},
 	}
+	c.idempotent(&customerParams.Params, "customer")
 
-	cust, err := customer.New(customerParams)
+	cust, err := c.api().Customers.New(customerParams)
 	if err != nil {
 		if stripeErr, ok := err.(*stripe.Error); ok {
 			msg = cardErrorMessage(stripeErr.Code)
@@ -102,8 +121,70 @@ func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error
 	return cust, msg, nil
 }
 
-// subscribe plan with customer id
-func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error) {
+// attach a payment method to an existing stripe customer and bill its invoices to it
+func (c *Card) UpdateCustomerPaymentMethod(customerID, pm string) (*stripe.Customer, string, error) {
+	var msg string
+
+	attachParams := &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(customerID),
+	}
+	c.idempotent(&attachParams.Params, "attach-payment-method")
+
+	_, err := c.api().PaymentMethods.Attach(pm, attachParams)
+	if err != nil {
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+		return nil, msg, err
+	}
+
+	customerParams := &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(pm),
+		},
+	}
+	c.idempotent(&customerParams.Params, "customer-payment-method")
+
+	cust, err := c.api().Customers.Update(customerID, customerParams)
+	if err != nil {
+		return nil, msg, err
+	}
+
+	return cust, msg, nil
+}
+
+// create a stripe coupon and return its id
+func (c *Card) CreateCoupon(coupon Coupon) (string, error) {
+	params := &stripe.CouponParams{
+		Name:     stripe.String(coupon.Name),
+		Duration: stripe.String(string(stripe.CouponDurationOnce)),
+	}
+
+	if coupon.Months > 0 {
+		params.Duration = stripe.String(string(stripe.CouponDurationRepeating))
+		params.DurationInMonths = stripe.Int64(int64(coupon.Months))
+	}
+
+	if coupon.PercentOff > 0 {
+		params.PercentOff = stripe.Float64(float64(coupon.PercentOff))
+	} else {
+		params.AmountOff = stripe.Int64(int64(coupon.AmountOff))
+		params.Currency = stripe.String(coupon.Currency)
+	}
+
+	c.idempotent(&params.Params, "coupon")
+
+	cp, err := c.api().Coupons.New(params)
+	if err != nil {
+		return "", err
+	}
+
+	return cp.ID, nil
+}
+
+// subscribe plan with customer id, coupon is optional, nothing is charged
+// before the end of the trial when trialDays is set
+func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType, coupon string, trialDays int) (*stripe.Subscription, error) {
 	stripeCustomerID := cust.ID
 	items := []*stripe.SubscriptionItemsParams{
 		{Plan: stripe.String(plan)},
@@ -114,11 +195,20 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 		Items:    items,
 	}
 
+	if coupon != "" {
+		params.Coupon = stripe.String(coupon)
+	}
+
+	if trialDays > 0 {
+		params.TrialPeriodDays = stripe.Int64(int64(trialDays))
+	}
+
 	params.AddMetadata("last_four", last4)
 	params.AddMetadata("card_type", cardType)
 	params.AddExpand("latest_invoice.payment_intent")
+	c.idempotent(&params.Params, "subscription")
 
-	subscription, err := sub.New(params)
+	subscription, err := c.api().Subscriptions.New(params)
 	if err != nil {
 		return nil, err
 	}
@@ -126,10 +216,9 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 	return subscription, nil
 }
 
-// get a refund
-func (c *Card) Refund(pi string, amount int) error {
-	stripe.Key = c.Secret
-
+// refund part or all of a payment intent and return the refund id, reasons other
+// than stripe's are kept out of the request
+func (c *Card) Refund(pi string, amount int, reason string) (string, error) {
 	amountToRefund := int64(amount)
 
 	refundParams := &stripe.RefundParams{
@@ -137,28 +226,167 @@ func (c *Card) Refund(pi string, amount int) error {
 		PaymentIntent: &pi,
 	}
 
-	_, err := refund.New(refundParams)
+	switch stripe.RefundReason(reason) {
+	case stripe.RefundReasonDuplicate, stripe.RefundReasonFraudulent, stripe.RefundReasonRequestedByCustomer:
+		refundParams.Reason = stripe.String(reason)
+	}
+	c.idempotent(&refundParams.Params, "refund")
+
+	refund, err := c.api().Refunds.New(refundParams)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return refund.ID, nil
 }
 
-// cancel subscription
-func (c *Card) CancelSubscription(subID string) error {
-	stripe.Key = c.Secret
-
+// cancel subscription at the end of the period already paid for
+func (c *Card) CancelSubscription(subID string) (*stripe.Subscription, error) {
 	params := &stripe.SubscriptionParams{
 		CancelAtPeriodEnd: stripe.Bool(true),
 	}
+	c.idempotent(&params.Params, "cancel-subscription")
+
+	return c.api().Subscriptions.Update(subID, params)
+}
+
+// undo a cancellation while the subscription is still in its paid period
+func (c *Card) ReactivateSubscription(subID string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+	}
+	c.idempotent(&params.Params, "reactivate-subscription")
+
+	return c.api().Subscriptions.Update(subID, params)
+}
+
+// stop collecting payment, the invoices created while paused are voided
+func (c *Card) PauseSubscription(subID string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{
+		PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+			Behavior: stripe.String(string(stripe.SubscriptionPauseCollectionBehaviorVoid)),
+		},
+	}
+	c.idempotent(&params.Params, "pause-subscription")
+
+	return c.api().Subscriptions.Update(subID, params)
+}
+
+// collect payment of a paused subscription again from the next invoice
+func (c *Card) ResumeSubscription(subID string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	// an empty value unsets pause_collection
+	params.AddExtra("pause_collection", "")
+	c.idempotent(&params.Params, "resume-subscription")
+
+	return c.api().Subscriptions.Update(subID, params)
+}
+
+// the only item of a subscription, subscriptions are created with a single plan
+func subscriptionItem(sub *stripe.Subscription) (*stripe.SubscriptionItem, error) {
+	if sub.Items == nil || len(sub.Items.Data) == 0 {
+		return nil, fmt.Errorf("subscription %s has no items", sub.ID)
+	}
+	return sub.Items.Data[0], nil
+}
+
+// amount charged, or credited when negative, for moving a subscription to price at
+// prorationDate, pass the same prorationDate to ChangePlan to charge exactly that
+func (c *Card) PreviewPlanChange(subID, price string, prorationDate int64) (int64, error) {
+	sub, err := c.api().Subscriptions.Get(subID, nil)
+	if err != nil {
+		return 0, err
+	}
 
-	_, err := sub.Update(subID, params)
+	item, err := subscriptionItem(sub)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	params := &stripe.InvoiceParams{
+		Customer:     stripe.String(sub.Customer.ID),
+		Subscription: stripe.String(subID),
+		SubscriptionItems: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(item.ID), Price: stripe.String(price)},
+		},
+		SubscriptionProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorAlwaysInvoice)),
+		SubscriptionProrationDate:     stripe.Int64(prorationDate),
+	}
+
+	inv, err := c.api().Invoices.GetNext(params)
+	if err != nil {
+		return 0, err
+	}
+
+	// the prorations, and the new period when the interval changes, are due now,
+	// lines of the renewal at the end of the current period are not
+	var amount int64
+	for _, line := range inv.Lines.Data {
+		if line.Proration || (line.Period != nil && line.Period.Start < sub.CurrentPeriodEnd) {
+			amount += line.Amount
+		}
+	}
+
+	return amount, nil
+}
+
+// move a subscription to price, invoicing the prorations right away
+func (c *Card) ChangePlan(subID, price string, prorationDate int64) (*stripe.Subscription, error) {
+	sub, err := c.api().Subscriptions.Get(subID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := subscriptionItem(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(item.ID), Price: stripe.String(price)},
+		},
+		ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorAlwaysInvoice)),
+		ProrationDate:     stripe.Int64(prorationDate),
+	}
+	c.idempotent(&params.Params, "change-plan")
+
+	return c.api().Subscriptions.Update(subID, params)
+}
+
+// bill the next invoices of a subscription to another card of the same customer
+func (c *Card) UpdateSubscriptionPaymentMethod(subID, pm string) (*stripe.Subscription, string, error) {
+	var msg string
+
+	sub, err := c.api().Subscriptions.Get(subID, nil)
+	if err != nil {
+		return nil, msg, err
+	}
+
+	attachParams := &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(sub.Customer.ID),
+	}
+	c.idempotent(&attachParams.Params, "attach-payment-method")
+
+	_, err = c.api().PaymentMethods.Attach(pm, attachParams)
+	if err != nil {
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+		return nil, msg, err
+	}
+
+	subParams := &stripe.SubscriptionParams{
+		DefaultPaymentMethod: stripe.String(pm),
+	}
+	c.idempotent(&subParams.Params, "subscription-payment-method")
+
+	sub, err = c.api().Subscriptions.Update(subID, subParams)
+	if err != nil {
+		return nil, msg, err
 	}
 
-	return nil
+	return sub, msg, nil
 }
 
 // custom error messages
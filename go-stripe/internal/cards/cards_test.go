@@ -0,0 +1,133 @@
+package cards
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// a card talking to a local server that answers with a stripe error, except for
+// reading a subscription, so that the calls that change one get to the failing write
+func testCard(t *testing.T, status int, errType stripe.ErrorType, code stripe.ErrorCode, msg string) *Card {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/subscriptions/") {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"id": %q, "object": "subscription", "customer": "cus_1"}`, strings.TrimPrefix(r.URL.Path, "/v1/subscriptions/"))
+			return
+		}
+
+		var body struct {
+			Error map[string]string `json:"error"`
+		}
+		body.Error = map[string]string{"type": string(errType), "code": string(code), "message": msg}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(srv.Close)
+
+	config := &stripe.BackendConfig{
+		URL:               stripe.String(srv.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelNull},
+	}
+
+	return &Card{
+		Secret: "sk_test_local",
+		backends: &stripe.Backends{
+			API:     stripe.GetBackendWithConfig(stripe.APIBackend, config),
+			Connect: stripe.GetBackendWithConfig(stripe.ConnectBackend, config),
+			Uploads: stripe.GetBackendWithConfig(stripe.UploadsBackend, config),
+		},
+	}
+}
+
+// the fake must fail like stripe does, so that the handlers' error paths can be
+// run against it
+func TestFakeErrorsMatchStripe(t *testing.T) {
+	f := NewFakeGateway()
+	f.DeclineAmounts[666] = stripe.ErrorCodeCardDeclined
+	f.Prices["price_monthly"] = FakePrice{Amount: 1000, Currency: "usd", Interval: "month"}
+
+	pi, _, err := f.Charge("usd", 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		status  int
+		errType stripe.ErrorType
+		code    stripe.ErrorCode
+		// the message for the customer, when the method returns one
+		call func(g PaymentGateway) (string, error)
+	}{
+		{"declined charge", http.StatusPaymentRequired, stripe.ErrorTypeCard, stripe.ErrorCodeCardDeclined,
+			func(g PaymentGateway) (string, error) {
+				_, msg, err := g.Charge("usd", 666, nil)
+				return msg, err
+			}},
+		{"missing payment intent", http.StatusNotFound, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeResourceMissing,
+			func(g PaymentGateway) (string, error) {
+				_, err := g.RetrievePaymentIntent("pi_missing")
+				return "", err
+			}},
+		{"missing payment method", http.StatusNotFound, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeResourceMissing,
+			func(g PaymentGateway) (string, error) {
+				_, err := g.GetPaymentMethod("pm_missing")
+				return "", err
+			}},
+		{"customer with an expired card", http.StatusPaymentRequired, stripe.ErrorTypeCard, stripe.ErrorCodeExpiredCard,
+			func(g PaymentGateway) (string, error) {
+				_, msg, err := g.CreateCustomer("pm_card_chargeDeclinedExpiredCard", "a@example.com")
+				return msg, err
+			}},
+		{"new customer card declined", http.StatusPaymentRequired, stripe.ErrorTypeCard, stripe.ErrorCodeCardDeclined,
+			func(g PaymentGateway) (string, error) {
+				_, msg, err := g.UpdateCustomerPaymentMethod("cus_1", "pm_card_chargeDeclined")
+				return msg, err
+			}},
+		{"refund over the amount", http.StatusBadRequest, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeAmountTooLarge,
+			func(g PaymentGateway) (string, error) {
+				_, err := g.Refund(pi.ID, 1001, "")
+				return "", err
+			}},
+		{"cancel a missing subscription", http.StatusNotFound, stripe.ErrorTypeInvalidRequest, stripe.ErrorCodeResourceMissing,
+			func(g PaymentGateway) (string, error) {
+				_, err := g.CancelSubscription("sub_missing")
+				return "", err
+			}},
+		{"subscription card declined", http.StatusPaymentRequired, stripe.ErrorTypeCard, stripe.ErrorCodeCardDeclined,
+			func(g PaymentGateway) (string, error) {
+				_, msg, err := g.UpdateSubscriptionPaymentMethod("sub_fake_1", "pm_card_chargeDeclined")
+				return msg, err
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			card := testCard(t, tt.status, tt.errType, tt.code, "error from stripe")
+
+			stripeMsg, stripeErr := tt.call(card)
+			fakeMsg, fakeErr := tt.call(f)
+
+			want := stripeError(t, stripeErr)
+			got := stripeError(t, fakeErr)
+
+			if got.Type != want.Type || got.Code != want.Code {
+				t.Errorf("fake failed with %s %s, stripe with %s %s", got.Type, got.Code, want.Type, want.Code)
+			}
+			if fakeMsg != stripeMsg {
+				t.Errorf("fake told the customer %q, stripe %q", fakeMsg, stripeMsg)
+			}
+		})
+	}
+}
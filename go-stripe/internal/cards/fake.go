@@ -0,0 +1,503 @@
+package cards
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// payment method used by the fake gateway when confirming a payment intent
+const FakeDefaultPaymentMethod = "pm_card_visa"
+
+// card details of a fake payment method, Code is returned as a card error when set
+type FakeCard struct {
+	Brand    stripe.PaymentMethodCardBrand
+	Last4    string
+	ExpMonth uint64
+	ExpYear  uint64
+	Code     stripe.ErrorCode
+}
+
+// a price known to the fake gateway, Interval is month or year
+type FakePrice struct {
+	Amount   int64
+	Currency string
+	Interval string
+}
+
+// deterministic in-memory payment gateway for local development and tests
+type FakeGateway struct {
+	// payment methods known to the gateway, keyed by id
+	Cards map[string]FakeCard
+	// amounts for which Charge fails with the given card error code
+	DeclineAmounts map[int]stripe.ErrorCode
+	// status given to new subscriptions
+	SubscriptionStatus stripe.SubscriptionStatus
+	// prices subscriptions can be billed, keyed by id, used to prorate plan changes
+	Prices map[string]FakePrice
+
+	mu            sync.Mutex
+	seq           int
+	intents       map[string]*stripe.PaymentIntent
+	refunded      map[string]int64
+	customers     map[string]*stripe.Customer
+	subscriptions map[string]*stripe.Subscription
+}
+
+// returns a fake gateway with the stripe test payment methods
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		Cards: map[string]FakeCard{
+			"pm_card_visa":                            {Brand: stripe.PaymentMethodCardBrandVisa, Last4: "4242", ExpMonth: 12, ExpYear: 2034},
+			"pm_card_mastercard":                      {Brand: stripe.PaymentMethodCardBrandMastercard, Last4: "4444", ExpMonth: 12, ExpYear: 2034},
+			"pm_card_amex":                            {Brand: stripe.PaymentMethodCardBrandAmex, Last4: "8431", ExpMonth: 12, ExpYear: 2034},
+			"pm_card_chargeDeclined":                  {Brand: stripe.PaymentMethodCardBrandVisa, Last4: "0002", ExpMonth: 12, ExpYear: 2034, Code: stripe.ErrorCodeCardDeclined},
+			"pm_card_chargeDeclinedInsufficientFunds": {Brand: stripe.PaymentMethodCardBrandVisa, Last4: "9995", ExpMonth: 12, ExpYear: 2034, Code: stripe.ErrorCodeBalanceInsufficient},
+			"pm_card_chargeDeclinedExpiredCard":       {Brand: stripe.PaymentMethodCardBrandVisa, Last4: "0069", ExpMonth: 12, ExpYear: 2034, Code: stripe.ErrorCodeExpiredCard},
+			"pm_card_chargeDeclinedIncorrectCvc":      {Brand: stripe.PaymentMethodCardBrandVisa, Last4: "0127", ExpMonth: 12, ExpYear: 2034, Code: stripe.ErrorCodeIncorrectCVC},
+		},
+		DeclineAmounts:     make(map[int]stripe.ErrorCode),
+		SubscriptionStatus: stripe.SubscriptionStatusActive,
+		Prices:             make(map[string]FakePrice),
+		intents:            make(map[string]*stripe.PaymentIntent),
+		refunded:           make(map[string]int64),
+		customers:          make(map[string]*stripe.Customer),
+		subscriptions:      make(map[string]*stripe.Subscription),
+	}
+}
+
+// next deterministic id with the given prefix, caller must hold the lock
+func (f *FakeGateway) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake_%d", prefix, f.seq)
+}
+
+// card error in the same shape stripe returns it
+func fakeCardError(code stripe.ErrorCode) *stripe.Error {
+	return &stripe.Error{
+		Type: stripe.ErrorTypeCard,
+		Code: code,
+		Msg:  cardErrorMessage(code),
+	}
+}
+
+// fake payment intents are confirmed immediately with the default payment method
+func (f *FakeGateway) Charge(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if code, ok := f.DeclineAmounts[amount]; ok {
+		return nil, cardErrorMessage(code), fakeCardError(code)
+	}
+
+	f.seq++
+	pi := fakePaymentIntent(fmt.Sprintf("pi_fake_%d_%d_%s", f.seq, amount, currency), amount, currency)
+	pi.Metadata = metadata
+	f.intents[pi.ID] = pi
+
+	return pi, "", nil
+}
+
+// build a succeeded payment intent, amount and currency are encoded in the id
+// so that separate processes sharing no state agree on the same intent, metadata
+// is only known to the process that created the intent
+func fakePaymentIntent(id string, amount int, currency string) *stripe.PaymentIntent {
+	return &stripe.PaymentIntent{
+		ID:             id,
+		Object:         "payment_intent",
+		Amount:         int64(amount),
+		AmountReceived: int64(amount),
+		Currency:       currency,
+		ClientSecret:   fmt.Sprintf("%s_secret_fake", id),
+		Created:        time.Now().Unix(),
+		Status:         stripe.PaymentIntentStatusSucceeded,
+		PaymentMethod:  &stripe.PaymentMethod{ID: FakeDefaultPaymentMethod},
+		Charges: &stripe.ChargeList{
+			Data: []*stripe.Charge{
+				{ID: "ch_" + strings.TrimPrefix(id, "pi_"), Amount: int64(amount), Currency: stripe.Currency(currency), Paid: true},
+			},
+		},
+	}
+}
+
+// look up a payment intent, recreating intents created by another process, caller must hold the lock
+func (f *FakeGateway) intent(id string) (*stripe.PaymentIntent, error) {
+	if pi, ok := f.intents[id]; ok {
+		return pi, nil
+	}
+
+	parts := strings.Split(id, "_")
+	if len(parts) == 5 && parts[0] == "pi" && parts[1] == "fake" {
+		amount, err := strconv.Atoi(parts[3])
+		if err == nil {
+			pi := fakePaymentIntent(id, amount, parts[4])
+			f.intents[id] = pi
+			return pi, nil
+		}
+	}
+
+	return nil, &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeResourceMissing, Msg: "No such payment_intent: " + id}
+}
+
+func (f *FakeGateway) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.intent(id)
+}
+
+func (f *FakeGateway) GetPaymentMethod(id string) (*stripe.PaymentMethod, error) {
+	c, ok := f.Cards[id]
+	if !ok {
+		return nil, &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeResourceMissing, Msg: "No such PaymentMethod: " + id}
+	}
+
+	return &stripe.PaymentMethod{
+		ID:     id,
+		Object: "payment_method",
+		Type:   stripe.PaymentMethodTypeCard,
+		Card: &stripe.PaymentMethodCard{
+			Brand:    c.Brand,
+			Last4:    c.Last4,
+			ExpMonth: c.ExpMonth,
+			ExpYear:  c.ExpYear,
+		},
+	}, nil
+}
+
+// attaching a declining payment method fails like it does on stripe
+func (f *FakeGateway) CreateCustomer(pm, email string) (*stripe.Customer, string, error) {
+	c, ok := f.Cards[pm]
+	if !ok {
+		code := stripe.ErrorCodeResourceMissing
+		return nil, cardErrorMessage(code), fakeCardError(code)
+	}
+	if c.Code != "" {
+		return nil, cardErrorMessage(c.Code), fakeCardError(c.Code)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust := &stripe.Customer{
+		ID:      f.nextID("cus"),
+		Object:  "customer",
+		Email:   email,
+		Created: time.Now().Unix(),
+		InvoiceSettings: &stripe.CustomerInvoiceSettings{
+			DefaultPaymentMethod: &stripe.PaymentMethod{ID: pm},
+		},
+	}
+	f.customers[cust.ID] = cust
+
+	return cust, "", nil
+}
+
+// customers are forgotten when the server restarts, so unknown ids are taken as given
+func (f *FakeGateway) UpdateCustomerPaymentMethod(customerID, pm string) (*stripe.Customer, string, error) {
+	c, ok := f.Cards[pm]
+	if !ok {
+		code := stripe.ErrorCodeResourceMissing
+		return nil, cardErrorMessage(code), fakeCardError(code)
+	}
+	if c.Code != "" {
+		return nil, cardErrorMessage(c.Code), fakeCardError(c.Code)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust, ok := f.customers[customerID]
+	if !ok {
+		cust = &stripe.Customer{
+			ID:      customerID,
+			Object:  "customer",
+			Created: time.Now().Unix(),
+		}
+		f.customers[customerID] = cust
+	}
+	cust.InvoiceSettings = &stripe.CustomerInvoiceSettings{
+		DefaultPaymentMethod: &stripe.PaymentMethod{ID: pm},
+	}
+
+	return cust, "", nil
+}
+
+// fake coupons only get an id, the fake gateway doesn't bill invoices
+func (f *FakeGateway) CreateCoupon(coupon Coupon) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.nextID("coupon"), nil
+}
+
+func (f *FakeGateway) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType, coupon string, trialDays int) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.customers[cust.ID]; !ok {
+		return nil, &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeResourceMissing, Msg: "No such customer: " + cust.ID}
+	}
+
+	var discount *stripe.Discount
+	if coupon != "" {
+		discount = &stripe.Discount{Coupon: &stripe.Coupon{ID: coupon}}
+	}
+
+	now := time.Now()
+	subscription := &stripe.Subscription{
+		ID:       f.nextID("sub"),
+		Object:   "subscription",
+		Customer: cust,
+		Status:   f.SubscriptionStatus,
+		Discount: discount,
+		Created:  now.Unix(),
+		Metadata: map[string]string{
+			"last_four": last4,
+			"card_type": cardType,
+		},
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{ID: f.nextID("si")},
+			},
+		},
+	}
+	f.setPrice(subscription, plan, now)
+
+	// the first period is the trial, like on stripe
+	if trialDays > 0 {
+		trialEnd := now.AddDate(0, 0, trialDays)
+		subscription.Status = stripe.SubscriptionStatusTrialing
+		subscription.TrialStart = now.Unix()
+		subscription.TrialEnd = trialEnd.Unix()
+		subscription.CurrentPeriodEnd = trialEnd.Unix()
+	}
+
+	f.subscriptions[subscription.ID] = subscription
+
+	return subscription, nil
+}
+
+// refunds are limited to the amount not yet refunded on the payment intent
+func (f *FakeGateway) Refund(pi string, amount int, reason string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, err := f.intent(pi)
+	if err != nil {
+		return "", err
+	}
+
+	if f.refunded[pi]+int64(amount) > intent.AmountReceived {
+		return "", &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeAmountTooLarge, Msg: "Refund amount is greater than unrefunded amount on charge"}
+	}
+	f.refunded[pi] += int64(amount)
+
+	f.seq++
+	return fmt.Sprintf("re_fake_%d", f.seq), nil
+}
+
+// bill a subscription price from now on, starting a new period, the caller holds f.mu
+func (f *FakeGateway) setPrice(subscription *stripe.Subscription, price string, now time.Time) {
+	p := f.Prices[price]
+
+	item := subscription.Items.Data[0]
+	item.Plan = &stripe.Plan{ID: price, Amount: p.Amount, Currency: stripe.Currency(p.Currency), Interval: stripe.PlanInterval(p.Interval)}
+	item.Price = &stripe.Price{ID: price, UnitAmount: p.Amount, Currency: stripe.Currency(p.Currency)}
+
+	end := now.AddDate(0, 1, 0)
+	if p.Interval == "year" {
+		end = now.AddDate(1, 0, 0)
+	}
+	subscription.CurrentPeriodStart = now.Unix()
+	subscription.CurrentPeriodEnd = end.Unix()
+}
+
+// look up a subscription, the caller holds f.mu
+func (f *FakeGateway) subscription(subID string) (*stripe.Subscription, error) {
+	subscription, ok := f.subscriptions[subID]
+	if !ok && strings.HasPrefix(subID, "sub_fake_") {
+		// created before a restart of the process, its price is unknown
+		now := time.Now()
+		subscription = &stripe.Subscription{
+			ID:                 subID,
+			Object:             "subscription",
+			Status:             f.SubscriptionStatus,
+			CurrentPeriodStart: now.Unix(),
+			CurrentPeriodEnd:   now.AddDate(0, 1, 0).Unix(),
+			Items: &stripe.SubscriptionItemList{
+				Data: []*stripe.SubscriptionItem{
+					{ID: f.nextID("si"), Plan: &stripe.Plan{}},
+				},
+			},
+		}
+		f.subscriptions[subID] = subscription
+		ok = true
+	}
+	if !ok {
+		return nil, &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeResourceMissing, Msg: "No such subscription: " + subID}
+	}
+
+	return subscription, nil
+}
+
+// look up a subscription that has not ended, the caller holds f.mu
+func (f *FakeGateway) activeSubscription(subID string) (*stripe.Subscription, error) {
+	subscription, err := f.subscription(subID)
+	if err != nil {
+		return nil, err
+	}
+	if subscription.Status == stripe.SubscriptionStatusCanceled {
+		return nil, &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Msg: "No such active subscription: " + subID}
+	}
+
+	return subscription, nil
+}
+
+func (f *FakeGateway) CancelSubscription(subID string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, err := f.activeSubscription(subID)
+	if err != nil {
+		return nil, err
+	}
+	subscription.CancelAtPeriodEnd = true
+
+	return subscription, nil
+}
+
+func (f *FakeGateway) ReactivateSubscription(subID string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, err := f.activeSubscription(subID)
+	if err != nil {
+		return nil, err
+	}
+	subscription.CancelAtPeriodEnd = false
+
+	return subscription, nil
+}
+
+func (f *FakeGateway) PauseSubscription(subID string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, err := f.activeSubscription(subID)
+	if err != nil {
+		return nil, err
+	}
+	subscription.PauseCollection = stripe.SubscriptionPauseCollection{Behavior: stripe.SubscriptionPauseCollectionBehaviorVoid}
+
+	return subscription, nil
+}
+
+func (f *FakeGateway) ResumeSubscription(subID string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, err := f.activeSubscription(subID)
+	if err != nil {
+		return nil, err
+	}
+	subscription.PauseCollection = stripe.SubscriptionPauseCollection{}
+
+	return subscription, nil
+}
+
+// prorate like stripe does by the second, the unused part of the current price is
+// credited and the new price is charged for the rest of the period, or for a whole
+// new period when the interval changes, the caller holds f.mu
+func (f *FakeGateway) prorate(subscription *stripe.Subscription, price string, prorationDate int64) (int64, error) {
+	p, ok := f.Prices[price]
+	if !ok {
+		return 0, &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeResourceMissing, Msg: "No such price: " + price}
+	}
+
+	current := subscription.Items.Data[0].Plan
+	start, end := subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd
+	if prorationDate < start || prorationDate > end || end == start {
+		return 0, &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Msg: "The proration date must be in the current period"}
+	}
+
+	unused := current.Amount * (end - prorationDate) / (end - start)
+	if string(current.Interval) != p.Interval {
+		return p.Amount - unused, nil
+	}
+
+	return p.Amount*(end-prorationDate)/(end-start) - unused, nil
+}
+
+func (f *FakeGateway) PreviewPlanChange(subID, price string, prorationDate int64) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, err := f.activeSubscription(subID)
+	if err != nil {
+		return 0, err
+	}
+
+	return f.prorate(subscription, price, prorationDate)
+}
+
+// the period restarts when the interval changes, like on stripe
+func (f *FakeGateway) ChangePlan(subID, price string, prorationDate int64) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, err := f.activeSubscription(subID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.prorate(subscription, price, prorationDate)
+	if err != nil {
+		return nil, err
+	}
+
+	item := subscription.Items.Data[0]
+	if string(item.Plan.Interval) != f.Prices[price].Interval {
+		f.setPrice(subscription, price, time.Now())
+		return subscription, nil
+	}
+
+	start, end := subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd
+	f.setPrice(subscription, price, time.Unix(start, 0))
+	subscription.CurrentPeriodEnd = end
+
+	return subscription, nil
+}
+
+// declining payment methods fail like they do when attached on stripe
+func (f *FakeGateway) UpdateSubscriptionPaymentMethod(subID, pm string) (*stripe.Subscription, string, error) {
+	c, ok := f.Cards[pm]
+	if !ok {
+		code := stripe.ErrorCodeResourceMissing
+		return nil, cardErrorMessage(code), fakeCardError(code)
+	}
+	if c.Code != "" {
+		return nil, cardErrorMessage(c.Code), fakeCardError(c.Code)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subscription, err := f.subscription(subID)
+	if err != nil {
+		return nil, "", err
+	}
+	subscription.DefaultPaymentMethod = &stripe.PaymentMethod{ID: pm}
+
+	return subscription, "", nil
+}
+
+// repeated requests are replayed by the api before they reach the gateway, so the
+// fake ignores idempotency keys
+func (f *FakeGateway) WithIdempotencyKey(key string) PaymentGateway {
+	return f
+}
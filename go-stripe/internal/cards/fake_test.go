@@ -0,0 +1,299 @@
+package cards
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+var _ PaymentGateway = (*FakeGateway)(nil)
+var _ PaymentGateway = (*Card)(nil)
+
+// the stripe error of err, failing the test when it isn't one
+func stripeError(t *testing.T, err error) *stripe.Error {
+	t.Helper()
+
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) {
+		t.Fatalf("got error %v, want a *stripe.Error", err)
+	}
+	return stripeErr
+}
+
+func TestFakeChargeSucceeds(t *testing.T) {
+	f := NewFakeGateway()
+
+	pi, msg, err := f.Charge("usd", 1000, map[string]string{"order": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != "" {
+		t.Errorf("got message %q, want none", msg)
+	}
+	if pi.Status != stripe.PaymentIntentStatusSucceeded || pi.Amount != 1000 || pi.Currency != "usd" {
+		t.Errorf("got intent %s %d %s", pi.Status, pi.Amount, pi.Currency)
+	}
+	if pi.Metadata["order"] != "1" {
+		t.Errorf("got metadata %v", pi.Metadata)
+	}
+
+	got, err := f.RetrievePaymentIntent(pi.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != pi.ID || got.AmountReceived != 1000 {
+		t.Errorf("got intent %s received %d", got.ID, got.AmountReceived)
+	}
+
+	// the web server retrieves the intents the api created
+	other, err := NewFakeGateway().RetrievePaymentIntent(pi.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Amount != 1000 || other.Currency != "usd" {
+		t.Errorf("got intent of another process %d %s", other.Amount, other.Currency)
+	}
+}
+
+func TestFakeChargeDeclined(t *testing.T) {
+	f := NewFakeGateway()
+	f.DeclineAmounts[666] = stripe.ErrorCodeCardDeclined
+
+	pi, msg, err := f.Charge("usd", 666, nil)
+	if pi != nil {
+		t.Errorf("got intent %s, want none", pi.ID)
+	}
+	if msg != "Your card was declined" {
+		t.Errorf("got message %q", msg)
+	}
+	stripeErr := stripeError(t, err)
+	if stripeErr.Type != stripe.ErrorTypeCard || stripeErr.Code != stripe.ErrorCodeCardDeclined {
+		t.Errorf("got error %s %s", stripeErr.Type, stripeErr.Code)
+	}
+}
+
+func TestFakeRetrieveMissingPaymentIntent(t *testing.T) {
+	_, err := NewFakeGateway().RetrievePaymentIntent("pi_missing")
+
+	stripeErr := stripeError(t, err)
+	if stripeErr.Code != stripe.ErrorCodeResourceMissing {
+		t.Errorf("got code %s", stripeErr.Code)
+	}
+}
+
+func TestFakePaymentMethods(t *testing.T) {
+	f := NewFakeGateway()
+
+	pm, err := f.GetPaymentMethod("pm_card_mastercard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pm.Card.Last4 != "4444" || pm.Card.Brand != stripe.PaymentMethodCardBrandMastercard {
+		t.Errorf("got card %s %s", pm.Card.Brand, pm.Card.Last4)
+	}
+
+	_, err = f.GetPaymentMethod("pm_unknown")
+	if stripeError(t, err).Code != stripe.ErrorCodeResourceMissing {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestFakeCustomers(t *testing.T) {
+	f := NewFakeGateway()
+
+	_, msg, err := f.CreateCustomer("pm_card_chargeDeclinedExpiredCard", "a@example.com")
+	if msg != "Your card is expired" || stripeError(t, err).Code != stripe.ErrorCodeExpiredCard {
+		t.Errorf("got %q %v", msg, err)
+	}
+
+	cust, _, err := f.CreateCustomer("pm_card_visa", "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cust.Email != "a@example.com" || cust.InvoiceSettings.DefaultPaymentMethod.ID != "pm_card_visa" {
+		t.Errorf("got customer %s %s", cust.Email, cust.InvoiceSettings.DefaultPaymentMethod.ID)
+	}
+
+	cust, _, err = f.UpdateCustomerPaymentMethod(cust.ID, "pm_card_amex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cust.InvoiceSettings.DefaultPaymentMethod.ID != "pm_card_amex" {
+		t.Errorf("got payment method %s", cust.InvoiceSettings.DefaultPaymentMethod.ID)
+	}
+
+	_, _, err = f.UpdateCustomerPaymentMethod(cust.ID, "pm_card_chargeDeclined")
+	if stripeError(t, err).Code != stripe.ErrorCodeCardDeclined {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestFakeRefunds(t *testing.T) {
+	f := NewFakeGateway()
+
+	pi, _, err := f.Charge("usd", 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := f.Refund(pi.ID, 400, "requested_by_customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Error("got no refund id")
+	}
+
+	_, err = f.Refund(pi.ID, 601, "")
+	if stripeError(t, err).Code != stripe.ErrorCodeAmountTooLarge {
+		t.Errorf("got error %v", err)
+	}
+
+	_, err = f.Refund(pi.ID, 600, "")
+	if err != nil {
+		t.Errorf("refunding the rest: %v", err)
+	}
+
+	_, err = f.Refund("pi_missing", 1, "")
+	if stripeError(t, err).Code != stripe.ErrorCodeResourceMissing {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestFakeSubscriptionLifecycle(t *testing.T) {
+	f := NewFakeGateway()
+	f.Prices["price_monthly"] = FakePrice{Amount: 1000, Currency: "usd", Interval: "month"}
+
+	_, err := f.SubscribeToPlan(&stripe.Customer{ID: "cus_missing"}, "price_monthly", "a@example.com", "4242", "visa", "", 0)
+	if stripeError(t, err).Code != stripe.ErrorCodeResourceMissing {
+		t.Errorf("got error %v", err)
+	}
+
+	cust, _, err := f.CreateCustomer("pm_card_visa", "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := f.SubscribeToPlan(cust, "price_monthly", "a@example.com", "4242", "visa", "coupon_1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != stripe.SubscriptionStatusActive || sub.Discount.Coupon.ID != "coupon_1" {
+		t.Errorf("got subscription %s", sub.Status)
+	}
+	if sub.Items.Data[0].Price.UnitAmount != 1000 {
+		t.Errorf("got price %d", sub.Items.Data[0].Price.UnitAmount)
+	}
+
+	sub, err = f.CancelSubscription(sub.ID)
+	if err != nil || !sub.CancelAtPeriodEnd {
+		t.Errorf("cancel: %v", err)
+	}
+	sub, err = f.ReactivateSubscription(sub.ID)
+	if err != nil || sub.CancelAtPeriodEnd {
+		t.Errorf("reactivate: %v", err)
+	}
+	sub, err = f.PauseSubscription(sub.ID)
+	if err != nil || sub.PauseCollection.Behavior != stripe.SubscriptionPauseCollectionBehaviorVoid {
+		t.Errorf("pause: %v", err)
+	}
+	sub, err = f.ResumeSubscription(sub.ID)
+	if err != nil || sub.PauseCollection.Behavior != "" {
+		t.Errorf("resume: %v", err)
+	}
+
+	sub, _, err = f.UpdateSubscriptionPaymentMethod(sub.ID, "pm_card_amex")
+	if err != nil || sub.DefaultPaymentMethod.ID != "pm_card_amex" {
+		t.Errorf("update payment method: %v", err)
+	}
+
+	_, err = f.CancelSubscription("cus_not_a_subscription")
+	if stripeError(t, err).Code != stripe.ErrorCodeResourceMissing {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestFakeTrial(t *testing.T) {
+	f := NewFakeGateway()
+	f.Prices["price_monthly"] = FakePrice{Amount: 1000, Currency: "usd", Interval: "month"}
+
+	cust, _, err := f.CreateCustomer("pm_card_visa", "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := f.SubscribeToPlan(cust, "price_monthly", "a@example.com", "4242", "visa", "", 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != stripe.SubscriptionStatusTrialing {
+		t.Errorf("got status %s", sub.Status)
+	}
+	if days := time.Unix(sub.TrialEnd, 0).Sub(time.Unix(sub.TrialStart, 0)).Hours() / 24; days < 13 || days > 15 {
+		t.Errorf("got a trial of %.1f days", days)
+	}
+}
+
+func TestFakePlanChange(t *testing.T) {
+	f := NewFakeGateway()
+	f.Prices["price_monthly"] = FakePrice{Amount: 1000, Currency: "usd", Interval: "month"}
+	f.Prices["price_premium"] = FakePrice{Amount: 3000, Currency: "usd", Interval: "month"}
+	f.Prices["price_yearly"] = FakePrice{Amount: 10000, Currency: "usd", Interval: "year"}
+
+	cust, _, err := f.CreateCustomer("pm_card_visa", "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := f.SubscribeToPlan(cust, "price_monthly", "a@example.com", "4242", "visa", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// halfway through the period half of the difference is due
+	half := (sub.CurrentPeriodStart + sub.CurrentPeriodEnd) / 2
+	amount, err := f.PreviewPlanChange(sub.ID, "price_premium", half)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount < 999 || amount > 1001 {
+		t.Errorf("got proration %d, want about 1000", amount)
+	}
+
+	// a new interval charges a whole period less the unused part
+	amount, err = f.PreviewPlanChange(sub.ID, "price_yearly", half)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount < 9499 || amount > 9501 {
+		t.Errorf("got proration %d, want about 9500", amount)
+	}
+
+	_, err = f.PreviewPlanChange(sub.ID, "price_premium", sub.CurrentPeriodEnd+1)
+	if err == nil {
+		t.Error("previewed a change outside the period")
+	}
+	_, err = f.PreviewPlanChange(sub.ID, "price_missing", half)
+	if stripeError(t, err).Code != stripe.ErrorCodeResourceMissing {
+		t.Errorf("got error %v", err)
+	}
+
+	sub, err = f.ChangePlan(sub.ID, "price_yearly", half)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Items.Data[0].Price.ID != "price_yearly" {
+		t.Errorf("got price %s", sub.Items.Data[0].Price.ID)
+	}
+	if days := time.Unix(sub.CurrentPeriodEnd, 0).Sub(time.Unix(sub.CurrentPeriodStart, 0)).Hours() / 24; days < 365 {
+		t.Errorf("got a period of %.1f days after changing to yearly", days)
+	}
+}
+
+func TestFakeIgnoresIdempotencyKeys(t *testing.T) {
+	f := NewFakeGateway()
+	if f.WithIdempotencyKey("key") != PaymentGateway(f) {
+		t.Error("got another gateway")
+	}
+}
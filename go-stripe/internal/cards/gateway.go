@@ -0,0 +1,55 @@
+package cards
+
+import (
+	"fmt"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+const (
+	GatewayStripe = "stripe"
+	GatewayFake   = "fake"
+)
+
+// payment operations used by the servers, implemented by stripe (Card) and FakeGateway
+type PaymentGateway interface {
+	Charge(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error)
+	RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error)
+	GetPaymentMethod(id string) (*stripe.PaymentMethod, error)
+	CreateCustomer(pm, email string) (*stripe.Customer, string, error)
+	UpdateCustomerPaymentMethod(customerID, pm string) (*stripe.Customer, string, error)
+	CreateCoupon(coupon Coupon) (string, error)
+	SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType, coupon string, trialDays int) (*stripe.Subscription, error)
+	Refund(pi string, amount int, reason string) (string, error)
+	CancelSubscription(subID string) (*stripe.Subscription, error)
+	ReactivateSubscription(subID string) (*stripe.Subscription, error)
+	PauseSubscription(subID string) (*stripe.Subscription, error)
+	ResumeSubscription(subID string) (*stripe.Subscription, error)
+	PreviewPlanChange(subID, price string, prorationDate int64) (int64, error)
+	ChangePlan(subID, price string, prorationDate int64) (*stripe.Subscription, error)
+	UpdateSubscriptionPaymentMethod(subID, pm string) (*stripe.Subscription, string, error)
+	// the gateway for one request, whose writes are repeated at most once
+	WithIdempotencyKey(key string) PaymentGateway
+}
+
+// discount applied to the invoices of a subscription, either PercentOff or AmountOff is set
+type Coupon struct {
+	Name       string
+	PercentOff int
+	AmountOff  int
+	Currency   string
+	// number of monthly invoices discounted, zero discounts the first one only
+	Months int
+}
+
+// return the payment gateway selected by name
+func NewGateway(name, secret, key string) (PaymentGateway, error) {
+	switch name {
+	case GatewayStripe:
+		return &Card{Secret: secret, Key: key}, nil
+	case GatewayFake:
+		return NewFakeGateway(), nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway %q", name)
+	}
+}
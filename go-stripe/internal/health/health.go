@@ -0,0 +1,145 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type check struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// liveness and readiness of a server, it is ready while every check passes and
+// it is not draining for a shutdown
+type Checker struct {
+	// longest a check may run
+	Timeout  time.Duration
+	checks   []check
+	draining int32
+}
+
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func New(timeout time.Duration) *Checker {
+	return &Checker{Timeout: timeout}
+}
+
+// add a service the server needs to be ready
+func (c *Checker) Add(name string, run func(ctx context.Context) error) {
+	c.checks = append(c.checks, check{name: name, run: run})
+}
+
+// fail readiness from now on, so no new traffic is sent while shutting down
+func (c *Checker) Drain() {
+	atomic.StoreInt32(&c.draining, 1)
+}
+
+// GET /healthz, the process is up and serving
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, response{Status: "ok"})
+}
+
+// GET /readyz, runs the checks at the same time
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&c.draining) == 1 {
+		writeJSON(w, http.StatusServiceUnavailable, response{Status: "draining"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.Timeout)
+	defer cancel()
+
+	resp := response{Status: "ok", Checks: make(map[string]string)}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, ch := range c.checks {
+		wg.Add(1)
+		go func(ch check) {
+			defer wg.Done()
+
+			result := "ok"
+			if err := ch.run(ctx); err != nil {
+				result = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[ch.name] = result
+			if result != "ok" {
+				resp.Status = "unavailable"
+			}
+		}(ch)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp response) {
+	out, _ := json.MarshalIndent(resp, "", "\t")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// check that the database answers
+func Ping(db *sql.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+// check that a tcp service like smtp accepts connections
+func Dial(host string, port int) func(ctx context.Context) error {
+	addr := net.JoinHostPort(host, fmt.Sprint(port))
+
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// check that an http service answers url with 200
+func Get(url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned %s", url, resp.Status)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,328 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed sql
+var migrationFS embed.FS
+
+// one schema change, read from sql/{version}_{name}.{up|down}.sql
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migration along with the time it was applied, AppliedAt is zero if pending
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// applies the embedded migrations and records applied versions in schema_migrations
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+// returns a migrator with the embedded migrations sorted by version
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := load(migrationFS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		DB:         db,
+		Migrations: migrations,
+	}, nil
+}
+
+// read migrations from the sql directory of fsys
+func load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+
+	for _, e := range entries {
+		fileName := e.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s: name must look like {version}_{name}", fileName)
+		}
+
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version: %w", fileName, err)
+		}
+
+		content, err := fs.ReadFile(fsys, "sql/"+fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		} else if m.Name != parts[1] {
+			return nil, fmt.Errorf("migration version %d used by %s and %s", version, m.Name, parts[1])
+		}
+
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// create the table holding applied versions
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	stmt := `
+		create table if not exists schema_migrations (
+			version int not null,
+			name varchar(255) not null,
+			applied_at timestamp not null default current_timestamp,
+			primary key (version)
+		) engine = InnoDB default charset = utf8mb4
+	`
+
+	_, err := m.DB.ExecContext(ctx, stmt)
+	return err
+}
+
+// applied versions and the time they were applied
+func (m *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `select version, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// list every migration with its applied time
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, mig := range m.Migrations {
+		statuses = append(statuses, MigrationStatus{
+			Migration: mig,
+			AppliedAt: applied[mig.Version],
+		})
+	}
+
+	return statuses, nil
+}
+
+// highest applied version, 0 if none
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+
+	return version, nil
+}
+
+// apply every pending migration, returns the migrations applied
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	if len(m.Migrations) == 0 {
+		return nil, nil
+	}
+	return m.To(ctx, m.Migrations[len(m.Migrations)-1].Version)
+}
+
+// roll back the most recently applied migration
+func (m *Migrator) Down(ctx context.Context) ([]Migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(m.Migrations) - 1; i >= 0; i-- {
+		mig := m.Migrations[i]
+		if _, ok := applied[mig.Version]; ok {
+			if err := m.run(ctx, mig, false); err != nil {
+				return nil, err
+			}
+			return []Migration{mig}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// migrate up or down so that exactly the migrations up to and including version are applied,
+// returns the migrations applied or rolled back
+func (m *Migrator) To(ctx context.Context, version int) ([]Migration, error) {
+	if version != 0 && !m.exists(version) {
+		return nil, fmt.Errorf("unknown migration version %d", version)
+	}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+
+	// roll back newer migrations first, newest first
+	for i := len(m.Migrations) - 1; i >= 0; i-- {
+		mig := m.Migrations[i]
+		if _, ok := applied[mig.Version]; ok && mig.Version > version {
+			if err := m.run(ctx, mig, false); err != nil {
+				return done, err
+			}
+			done = append(done, mig)
+		}
+	}
+
+	for _, mig := range m.Migrations {
+		if _, ok := applied[mig.Version]; !ok && mig.Version <= version {
+			if err := m.run(ctx, mig, true); err != nil {
+				return done, err
+			}
+			done = append(done, mig)
+		}
+	}
+
+	return done, nil
+}
+
+func (m *Migrator) exists(version int) bool {
+	for _, mig := range m.Migrations {
+		if mig.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// execute the statements of one migration and record it
+func (m *Migrator) run(ctx context.Context, mig Migration, up bool) error {
+	script := mig.Up
+	if !up {
+		if mig.Down == "" {
+			return fmt.Errorf("migration %d_%s has no down file", mig.Version, mig.Name)
+		}
+		script = mig.Down
+	}
+
+	// mysql commits ddl implicitly, the transaction only groups the data changes
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range splitStatements(script) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, name, applied_at) values (?, ?, ?)`,
+			mig.Version, mig.Name, time.Now())
+	} else {
+		_, err = tx.ExecContext(ctx, `delete from schema_migrations where version = ?`, mig.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// split a script into statements terminated by a semicolon at the end of a line
+func splitStatements(script string) []string {
+	var statements []string
+
+	for _, stmt := range strings.Split(script, ";\n") {
+		stmt = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(stmt), ";"))
+		if stmt == "" || isComment(stmt) {
+			continue
+		}
+		statements = append(statements, stmt)
+	}
+
+	return statements
+}
+
+// true if every line of stmt is an sql comment
+func isComment(stmt string) bool {
+	for _, line := range strings.Split(stmt, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
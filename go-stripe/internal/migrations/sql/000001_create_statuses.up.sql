@@ -0,0 +1,15 @@
+create table statuses (
+	id int unsigned not null auto_increment,
+	name varchar(255) not null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id)
+) engine = InnoDB default charset = utf8mb4;
+
+create table transaction_statuses (
+	id int unsigned not null auto_increment,
+	name varchar(255) not null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id)
+) engine = InnoDB default charset = utf8mb4;
@@ -0,0 +1,13 @@
+create table widgets (
+	id int unsigned not null auto_increment,
+	name varchar(255) not null default '',
+	description text not null,
+	inventory_level int not null default 0,
+	price int not null default 0,
+	image varchar(255),
+	is_recurring tinyint(1) not null default 0,
+	plan_id varchar(255) not null default '',
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id)
+) engine = InnoDB default charset = utf8mb4;
@@ -0,0 +1,3 @@
+drop table if exists orders;
+drop table if exists transactions;
+drop table if exists customers;
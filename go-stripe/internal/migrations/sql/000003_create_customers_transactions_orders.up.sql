@@ -0,0 +1,44 @@
+create table customers (
+	id int unsigned not null auto_increment,
+	first_name varchar(255) not null default '',
+	last_name varchar(255) not null default '',
+	email varchar(255) not null default '',
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id)
+) engine = InnoDB default charset = utf8mb4;
+
+create table transactions (
+	id int unsigned not null auto_increment,
+	amount int not null,
+	currency varchar(255) not null default '',
+	last_four varchar(4) not null default '',
+	expiry_month int not null default 0,
+	expiry_year int not null default 0,
+	payment_intent varchar(255) not null default '',
+	payment_method varchar(255) not null default '',
+	bank_return_code varchar(255) not null default '',
+	transaction_status_id int unsigned not null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	key transactions_payment_intent_idx (payment_intent),
+	constraint transactions_transaction_status_fk foreign key (transaction_status_id) references transaction_statuses (id)
+) engine = InnoDB default charset = utf8mb4;
+
+create table orders (
+	id int unsigned not null auto_increment,
+	widget_id int unsigned not null,
+	transaction_id int unsigned not null,
+	customer_id int unsigned not null,
+	status_id int unsigned not null,
+	quantity int not null,
+	amount int not null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	constraint orders_widget_fk foreign key (widget_id) references widgets (id),
+	constraint orders_transaction_fk foreign key (transaction_id) references transactions (id),
+	constraint orders_customer_fk foreign key (customer_id) references customers (id),
+	constraint orders_status_fk foreign key (status_id) references statuses (id)
+) engine = InnoDB default charset = utf8mb4;
@@ -0,0 +1,7 @@
+create table sessions (
+	token char(43) not null,
+	data blob not null,
+	expiry timestamp(6) not null,
+	primary key (token),
+	key sessions_expiry_idx (expiry)
+) engine = InnoDB default charset = utf8mb4;
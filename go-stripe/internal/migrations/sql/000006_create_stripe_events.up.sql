@@ -0,0 +1,6 @@
+create table stripe_events (
+	id varchar(255) not null,
+	type varchar(255) not null,
+	created_at timestamp not null default current_timestamp,
+	primary key (id)
+) engine = InnoDB default charset = utf8mb4;
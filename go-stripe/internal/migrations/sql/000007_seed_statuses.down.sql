@@ -0,0 +1,2 @@
+delete from transaction_statuses where id in (1, 2, 3, 4, 5);
+delete from statuses where id in (1, 2, 3, 4, 5);
@@ -0,0 +1,13 @@
+insert into statuses (id, name) values
+	(1, 'Cleared'),
+	(2, 'Refunded'),
+	(3, 'Cancelled'),
+	(4, 'Disputed'),
+	(5, 'Past Due');
+
+insert into transaction_statuses (id, name) values
+	(1, 'Pending'),
+	(2, 'Cleared'),
+	(3, 'Declined'),
+	(4, 'Refunded'),
+	(5, 'Partially refunded');
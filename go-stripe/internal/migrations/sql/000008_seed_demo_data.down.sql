@@ -0,0 +1 @@
+delete from widgets where id in (1, 2);
@@ -0,0 +1,4 @@
+-- plan_id must be replaced by a price id of your stripe account when not using -gateway=fake
+insert into widgets (id, name, description, inventory_level, price, image, is_recurring, plan_id) values
+	(1, 'Widget', 'A very nice widget.', 10, 1000, 'widget.png', 0, ''),
+	(2, 'Bronze Plan', 'Get three widgets for the price of two every month!', 0, 2000, '', 1, 'price_1LJVgJA2xBWtQ6OR5kjswQtP');
@@ -0,0 +1,40 @@
+create table carts (
+	id int unsigned not null auto_increment,
+	token char(26) not null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	unique key carts_token_idx (token)
+) engine = InnoDB default charset = utf8mb4;
+
+create table cart_items (
+	id int unsigned not null auto_increment,
+	cart_id int unsigned not null,
+	widget_id int unsigned not null,
+	quantity int not null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	unique key cart_items_cart_widget_idx (cart_id, widget_id),
+	constraint cart_items_cart_fk foreign key (cart_id) references carts (id) on delete cascade,
+	constraint cart_items_widget_fk foreign key (widget_id) references widgets (id)
+) engine = InnoDB default charset = utf8mb4;
+
+create table order_items (
+	id int unsigned not null auto_increment,
+	order_id int unsigned not null,
+	widget_id int unsigned not null,
+	quantity int not null,
+	price int not null,
+	amount int not null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	key order_items_order_idx (order_id),
+	constraint order_items_order_fk foreign key (order_id) references orders (id) on delete cascade,
+	constraint order_items_widget_fk foreign key (widget_id) references widgets (id)
+) engine = InnoDB default charset = utf8mb4;
+
+-- every existing order becomes a single line
+insert into order_items (order_id, widget_id, quantity, price, amount, created_at, updated_at)
+	select id, widget_id, quantity, amount div greatest(quantity, 1), amount, created_at, updated_at from orders;
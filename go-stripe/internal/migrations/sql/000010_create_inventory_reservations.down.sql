@@ -0,0 +1,3 @@
+alter table orders drop column restocked;
+
+drop table if exists inventory_reservations;
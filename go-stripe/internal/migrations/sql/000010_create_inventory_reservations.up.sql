@@ -0,0 +1,14 @@
+create table inventory_reservations (
+	id int unsigned not null auto_increment,
+	payment_intent varchar(255) not null,
+	widget_id int unsigned not null,
+	quantity int not null,
+	expires_at timestamp not null,
+	created_at timestamp not null default current_timestamp,
+	primary key (id),
+	key inventory_reservations_payment_intent_idx (payment_intent),
+	key inventory_reservations_widget_expires_idx (widget_id, expires_at),
+	constraint inventory_reservations_widget_fk foreign key (widget_id) references widgets (id)
+) engine = InnoDB default charset = utf8mb4;
+
+alter table orders add column restocked tinyint(1) not null default 0 after amount;
@@ -0,0 +1,28 @@
+create table widget_prices (
+	id int unsigned not null auto_increment,
+	widget_id int unsigned not null,
+	currency char(3) not null,
+	price int not null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	unique key widget_prices_widget_currency_idx (widget_id, currency),
+	constraint widget_prices_widget_fk foreign key (widget_id) references widgets (id) on delete cascade
+) engine = InnoDB default charset = utf8mb4;
+
+-- widgets.price stays the price in the default currency
+insert into widget_prices (widget_id, currency, price)
+select id, 'cad', price from widgets;
+
+-- regional prices of the demo widget, in minor units of each currency
+insert into widget_prices (widget_id, currency, price)
+select id, c.currency, c.price
+from widgets
+	cross join (
+		select 'usd' as currency, 750 as price
+		union all select 'eur', 700
+		union all select 'gbp', 600
+		union all select 'jpy', 1100
+		union all select 'krw', 10000
+	) c
+where widgets.id = 1;
@@ -0,0 +1,6 @@
+alter table orders
+	drop foreign key orders_promotion_fk,
+	drop column discount,
+	drop column promotion_id;
+
+drop table if exists promotions;
@@ -0,0 +1,27 @@
+create table promotions (
+	id int unsigned not null auto_increment,
+	code varchar(64) not null,
+	description varchar(255) not null default '',
+	kind varchar(16) not null,
+	value int not null,
+	currency char(3) not null default '',
+	widget_id int unsigned null,
+	plan_id varchar(255) not null default '',
+	duration_months int not null default 0,
+	max_uses int not null default 0,
+	times_used int not null default 0,
+	starts_at timestamp null,
+	expires_at timestamp null,
+	active tinyint(1) not null default 1,
+	stripe_coupon_id varchar(255) not null default '',
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	unique key promotions_code_idx (code),
+	constraint promotions_widget_fk foreign key (widget_id) references widgets (id) on delete cascade
+) engine = InnoDB default charset = utf8mb4;
+
+alter table orders
+	add column promotion_id int unsigned null after amount,
+	add column discount int not null default 0 after promotion_id,
+	add constraint orders_promotion_fk foreign key (promotion_id) references promotions (id);
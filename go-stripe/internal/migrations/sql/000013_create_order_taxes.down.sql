@@ -0,0 +1,9 @@
+drop table if exists order_taxes;
+
+alter table orders
+	drop column tax_region,
+	drop column tax_country,
+	drop column tax,
+	drop column subtotal;
+
+alter table widgets drop column tax_category;
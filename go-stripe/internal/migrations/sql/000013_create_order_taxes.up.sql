@@ -0,0 +1,23 @@
+alter table widgets add column tax_category varchar(32) not null default 'standard' after price;
+
+alter table orders
+	add column subtotal int not null default 0 after quantity,
+	add column tax int not null default 0 after discount,
+	add column tax_country char(2) not null default '' after tax,
+	add column tax_region varchar(8) not null default '' after tax_country;
+
+update orders set subtotal = amount + discount;
+
+create table order_taxes (
+	id int unsigned not null auto_increment,
+	order_id int unsigned not null,
+	jurisdiction varchar(32) not null,
+	name varchar(64) not null,
+	rate decimal(7,4) not null,
+	taxable int not null,
+	amount int not null,
+	created_at timestamp not null default current_timestamp,
+	primary key (id),
+	key order_taxes_jurisdiction_idx (jurisdiction),
+	constraint order_taxes_order_fk foreign key (order_id) references orders (id) on delete cascade
+) engine = InnoDB default charset = utf8mb4;
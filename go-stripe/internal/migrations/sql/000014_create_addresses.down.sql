@@ -0,0 +1,2 @@
+drop table if exists order_addresses;
+drop table if exists addresses;
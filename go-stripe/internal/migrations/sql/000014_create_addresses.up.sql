@@ -0,0 +1,34 @@
+create table addresses (
+	id int unsigned not null auto_increment,
+	customer_id int unsigned not null,
+	kind varchar(16) not null,
+	name varchar(255) not null default '',
+	line1 varchar(255) not null,
+	line2 varchar(255) not null default '',
+	city varchar(255) not null,
+	region varchar(8) not null default '',
+	postal_code varchar(16) not null default '',
+	country char(2) not null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	key addresses_customer_idx (customer_id),
+	constraint addresses_customer_fk foreign key (customer_id) references customers (id) on delete cascade
+) engine = InnoDB default charset = utf8mb4;
+
+create table order_addresses (
+	id int unsigned not null auto_increment,
+	order_id int unsigned not null,
+	kind varchar(16) not null,
+	name varchar(255) not null default '',
+	line1 varchar(255) not null,
+	line2 varchar(255) not null default '',
+	city varchar(255) not null,
+	region varchar(8) not null default '',
+	postal_code varchar(16) not null default '',
+	country char(2) not null,
+	created_at timestamp not null default current_timestamp,
+	primary key (id),
+	unique key order_addresses_order_kind_idx (order_id, kind),
+	constraint order_addresses_order_fk foreign key (order_id) references orders (id) on delete cascade
+) engine = InnoDB default charset = utf8mb4;
@@ -0,0 +1,4 @@
+alter table customers
+	drop key customers_email_idx,
+	drop column password,
+	drop column stripe_customer_id;
@@ -0,0 +1,6 @@
+update customers set email = lower(trim(email));
+
+alter table customers
+	add column stripe_customer_id varchar(255) not null default '' after email,
+	add column password varchar(60) not null default '' after stripe_customer_id,
+	add key customers_email_idx (email);
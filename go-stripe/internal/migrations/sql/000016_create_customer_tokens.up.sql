@@ -0,0 +1,11 @@
+create table customer_tokens (
+	id int unsigned not null auto_increment,
+	customer_id int unsigned not null,
+	token_hash varbinary(255) not null,
+	expiry timestamp not null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	key customer_tokens_token_hash_idx (token_hash),
+	constraint customer_tokens_customer_fk foreign key (customer_id) references customers (id) on delete cascade
+) engine = InnoDB default charset = utf8mb4;
@@ -0,0 +1,9 @@
+drop table if exists subscriptions;
+
+alter table orders
+	drop foreign key orders_plan_fk,
+	drop column plan_id;
+
+drop table if exists plans;
+
+delete from widgets where name in ('Silver Plan', 'Gold Plan') and is_recurring = 1;
@@ -0,0 +1,82 @@
+create table plans (
+	id int unsigned not null auto_increment,
+	widget_id int unsigned not null,
+	slug varchar(64) not null,
+	name varchar(255) not null,
+	tier int not null default 0,
+	billing_interval varchar(16) not null default 'month',
+	price int not null,
+	currency char(3) not null default 'cad',
+	stripe_price_id varchar(255) not null,
+	active tinyint(1) not null default 1,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	unique key plans_slug_idx (slug),
+	key plans_stripe_price_idx (stripe_price_id),
+	constraint plans_widget_fk foreign key (widget_id) references widgets (id) on delete cascade
+) engine = InnoDB default charset = utf8mb4;
+
+-- the product of each tier, the demo bronze plan already exists
+insert into widgets (name, description, inventory_level, price, image, is_recurring, plan_id) values
+	('Silver Plan', 'Get five widgets for the price of three every month!', 0, 3500, '', 1, 'price_silver_month'),
+	('Gold Plan', 'Get ten widgets for the price of five every month!', 0, 5000, '', 1, 'price_gold_month');
+
+-- monthly plans bill the price id already stored on the widget, replace the
+-- annual price ids with the ones of your stripe account unless using -gateway=fake
+insert into plans (widget_id, slug, name, tier, billing_interval, price, stripe_price_id)
+select w.id, p.slug, w.name, p.tier, p.billing_interval, p.price, if(p.billing_interval = 'month', w.plan_id, p.stripe_price_id)
+from widgets w
+	inner join (
+		select 'Bronze Plan' as widget, 'bronze' as slug, 1 as tier, 'month' as billing_interval, 2000 as price, '' as stripe_price_id
+		union all select 'Bronze Plan', 'bronze-annual', 1, 'year', 20000, 'price_bronze_year'
+		union all select 'Silver Plan', 'silver', 2, 'month', 3500, ''
+		union all select 'Silver Plan', 'silver-annual', 2, 'year', 35000, 'price_silver_year'
+		union all select 'Gold Plan', 'gold', 3, 'month', 5000, ''
+		union all select 'Gold Plan', 'gold-annual', 3, 'year', 50000, 'price_gold_year'
+	) p on (p.widget = w.name)
+where w.is_recurring = 1;
+
+-- the plan an order subscribed to, the subscription may have changed plan since
+alter table orders
+	add column plan_id int unsigned null after widget_id,
+	add constraint orders_plan_fk foreign key (plan_id) references plans (id);
+
+update orders o
+	inner join plans p on (p.widget_id = o.widget_id and p.billing_interval = 'month')
+set o.plan_id = p.id;
+
+-- state of stripe subscriptions, kept up to date by the api and the stripe webhook
+create table subscriptions (
+	id int unsigned not null auto_increment,
+	customer_id int unsigned not null,
+	plan_id int unsigned not null,
+	order_id int unsigned not null,
+	stripe_subscription_id varchar(255) not null,
+	status varchar(32) not null,
+	current_period_start timestamp null,
+	current_period_end timestamp null,
+	cancel_at timestamp null,
+	cancel_at_period_end tinyint(1) not null default 0,
+	paused tinyint(1) not null default 0,
+	canceled_at timestamp null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	unique key subscriptions_stripe_subscription_idx (stripe_subscription_id),
+	key subscriptions_order_idx (order_id),
+	constraint subscriptions_customer_fk foreign key (customer_id) references customers (id) on delete cascade,
+	constraint subscriptions_plan_fk foreign key (plan_id) references plans (id),
+	constraint subscriptions_order_fk foreign key (order_id) references orders (id) on delete cascade
+) engine = InnoDB default charset = utf8mb4;
+
+-- subscription orders store the subscription id as payment intent, periods are
+-- unknown until stripe sends the next customer.subscription.updated event
+insert into subscriptions (customer_id, plan_id, order_id, stripe_subscription_id, status, cancel_at_period_end, created_at, updated_at)
+select o.customer_id, o.plan_id, o.id, t.payment_intent,
+	case o.status_id when 5 then 'past_due' else 'active' end,
+	o.status_id = 3,
+	o.created_at, o.updated_at
+from orders o
+	inner join transactions t on (o.transaction_id = t.id)
+where o.plan_id is not null;
@@ -0,0 +1,12 @@
+update orders set status_id = 1 where status_id = 6;
+
+delete from statuses where id = 6;
+
+alter table subscriptions
+	drop key subscriptions_trial_end_idx,
+	drop column trial_reminder_sent_at,
+	drop column trial_end,
+	drop column trial_start;
+
+alter table plans
+	drop column trial_days;
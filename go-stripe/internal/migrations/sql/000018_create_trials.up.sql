@@ -0,0 +1,11 @@
+alter table plans
+	add column trial_days int not null default 0 after price;
+
+alter table subscriptions
+	add column trial_start timestamp null after canceled_at,
+	add column trial_end timestamp null after trial_start,
+	add column trial_reminder_sent_at timestamp null after trial_end,
+	add key subscriptions_trial_end_idx (status, trial_end);
+
+insert into statuses (id, name) values
+	(6, 'Trialing');
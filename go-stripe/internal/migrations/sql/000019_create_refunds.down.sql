@@ -0,0 +1,5 @@
+update orders set status_id = 1 where status_id = 7;
+
+delete from statuses where id = 7;
+
+drop table if exists refunds;
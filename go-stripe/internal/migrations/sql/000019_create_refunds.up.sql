@@ -0,0 +1,34 @@
+create table refunds (
+	id int unsigned not null auto_increment,
+	transaction_id int unsigned not null,
+	order_id int unsigned not null,
+	user_id int unsigned null,
+	amount int not null,
+	currency char(3) not null,
+	reason varchar(32) not null,
+	note varchar(255) not null default '',
+	stripe_refund_id varchar(255) not null default '',
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	key refunds_transaction_idx (transaction_id),
+	key refunds_order_idx (order_id),
+	constraint refunds_transaction_fk foreign key (transaction_id) references transactions (id) on delete cascade,
+	constraint refunds_order_fk foreign key (order_id) references orders (id) on delete cascade,
+	constraint refunds_user_fk foreign key (user_id) references users (id) on delete set null
+) engine = InnoDB default charset = utf8mb4;
+
+insert into statuses (id, name) values
+	(7, 'Partially Refunded');
+
+-- orders refunded before the ledger were refunded in full
+insert into refunds (transaction_id, order_id, amount, currency, reason, note, created_at, updated_at)
+	select t.id, o.id, t.amount, t.currency, 'other', 'refunded before refunds were recorded', o.updated_at, o.updated_at
+	from orders o
+		inner join transactions t on (o.transaction_id = t.id)
+	where o.status_id = 2;
+
+update transactions t
+	inner join orders o on (o.transaction_id = t.id)
+set t.transaction_status_id = 4
+where o.status_id = 2;
@@ -0,0 +1,13 @@
+create table idempotency_keys (
+	id int unsigned not null auto_increment,
+	idempotency_key varchar(255) not null,
+	endpoint varchar(255) not null,
+	request_hash char(64) not null,
+	status_code int not null default 0,
+	response_body mediumblob null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	unique key idempotency_keys_key_endpoint_idx (idempotency_key, endpoint),
+	key idempotency_keys_created_at_idx (created_at)
+) engine = InnoDB default charset = utf8mb4;
@@ -0,0 +1,16 @@
+create table reconciliations (
+	id int unsigned not null auto_increment,
+	kind varchar(32) not null,
+	payment_intent varchar(255) not null,
+	email varchar(255) not null default '',
+	amount int not null default 0,
+	currency char(3) not null default '',
+	details mediumtext not null,
+	error text not null,
+	resolved_at timestamp null,
+	created_at timestamp not null default current_timestamp,
+	updated_at timestamp not null default current_timestamp,
+	primary key (id),
+	key reconciliations_resolved_at_idx (resolved_at),
+	key reconciliations_payment_intent_idx (payment_intent)
+) engine = InnoDB default charset = utf8mb4;
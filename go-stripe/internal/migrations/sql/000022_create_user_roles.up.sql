@@ -0,0 +1,5 @@
+alter table users
+	add column role varchar(20) not null default 'viewer' after email;
+
+-- every user was an admin until now
+update users set role = 'owner';
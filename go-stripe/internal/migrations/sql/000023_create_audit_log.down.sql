@@ -0,0 +1,5 @@
+drop trigger if exists audit_log_no_delete;
+
+drop trigger if exists audit_log_no_update;
+
+drop table if exists audit_log;
@@ -0,0 +1,24 @@
+create table audit_log (
+	id bigint unsigned not null auto_increment,
+	user_id int unsigned null,
+	user_email varchar(255) not null default '',
+	action varchar(64) not null,
+	entity varchar(32) not null,
+	entity_id varchar(255) not null default '',
+	before_state mediumtext null,
+	after_state mediumtext null,
+	ip varchar(45) not null default '',
+	user_agent varchar(255) not null default '',
+	created_at timestamp not null default current_timestamp,
+	primary key (id),
+	key audit_log_created_at_idx (created_at),
+	key audit_log_user_id_idx (user_id, created_at),
+	key audit_log_action_idx (action, created_at),
+	key audit_log_entity_idx (entity, entity_id, created_at)
+) engine = InnoDB default charset = utf8mb4;
+
+-- entries are never changed; user_id has no foreign key so deleting a user leaves their
+-- entries, and user_email, as they were
+create trigger audit_log_no_update before update on audit_log for each row signal sqlstate '45000' set message_text = 'audit_log is append-only';
+
+create trigger audit_log_no_delete before delete on audit_log for each row signal sqlstate '45000' set message_text = 'audit_log is append-only';
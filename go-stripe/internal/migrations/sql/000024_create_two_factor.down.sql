@@ -0,0 +1,6 @@
+drop table if exists user_recovery_codes;
+
+alter table users
+	drop column totp_last_step,
+	drop column totp_enabled,
+	drop column totp_secret;
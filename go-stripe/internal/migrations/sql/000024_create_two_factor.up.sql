@@ -0,0 +1,16 @@
+-- the secret is encrypted with the app's secret key, last step stops a code being used twice
+alter table users
+	add column totp_secret varchar(255) not null default '' after password,
+	add column totp_enabled tinyint(1) not null default 0 after totp_secret,
+	add column totp_last_step bigint not null default 0 after totp_enabled;
+
+create table user_recovery_codes (
+	id int unsigned not null auto_increment,
+	user_id int unsigned not null,
+	code_hash varbinary(255) not null,
+	used_at timestamp null,
+	created_at timestamp not null default current_timestamp,
+	primary key (id),
+	key user_recovery_codes_user_id_idx (user_id),
+	constraint user_recovery_codes_user_fk foreign key (user_id) references users (id) on delete cascade
+) engine = InnoDB default charset = utf8mb4;
@@ -0,0 +1,3 @@
+drop table if exists rate_limit_locks;
+
+drop table if exists rate_limit_hits;
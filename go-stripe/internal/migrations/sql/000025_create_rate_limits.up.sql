@@ -0,0 +1,21 @@
+-- hits of ip addresses and accounts on the login and password reset endpoints,
+-- counted in sliding windows by every instance of the servers
+create table rate_limit_hits (
+	id bigint unsigned not null auto_increment,
+	rate_key varchar(255) not null,
+	created_at timestamp not null default current_timestamp,
+	primary key (id),
+	key rate_limit_hits_rate_key_idx (rate_key, created_at),
+	key rate_limit_hits_created_at_idx (created_at)
+) engine = InnoDB default charset = utf8mb4;
+
+-- accounts locked out after too many failed logins, the api emails the owner once
+create table rate_limit_locks (
+	rate_key varchar(255) not null,
+	email varchar(255) not null default '',
+	locked_until timestamp not null,
+	notified_at timestamp null,
+	created_at timestamp not null default current_timestamp,
+	primary key (rate_key),
+	key rate_limit_locks_locked_until_idx (locked_until)
+) engine = InnoDB default charset = utf8mb4;
@@ -0,0 +1,3 @@
+alter table tokens
+	drop column last_used_at,
+	drop column scope;
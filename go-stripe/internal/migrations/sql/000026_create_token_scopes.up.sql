@@ -0,0 +1,7 @@
+-- a user can have several tokens, named after the device or integration that uses them
+alter table tokens
+	add column scope varchar(32) not null default 'authentication' after token_hash,
+	add column last_used_at timestamp null after expiry;
+
+-- name held the last name of the user
+update tokens set name = 'login';
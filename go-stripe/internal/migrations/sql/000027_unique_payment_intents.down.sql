@@ -0,0 +1,3 @@
+alter table transactions
+	drop key transactions_payment_intent_idx,
+	add key transactions_payment_intent_idx (payment_intent);
@@ -0,0 +1,10 @@
+-- a payment is saved once, the copies a re-posted checkout made keep their rows
+-- under a marked payment intent
+update transactions t
+	inner join transactions first on (first.payment_intent = t.payment_intent and first.id < t.id)
+set
+	t.payment_intent = concat(t.payment_intent, '#dup-', t.id);
+
+alter table transactions
+	drop key transactions_payment_intent_idx,
+	add unique key transactions_payment_intent_idx (payment_intent);
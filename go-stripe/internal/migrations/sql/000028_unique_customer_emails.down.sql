@@ -0,0 +1,3 @@
+alter table customers
+	drop key customers_email_idx,
+	add key customers_email_idx (email);
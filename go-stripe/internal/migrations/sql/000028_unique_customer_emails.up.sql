@@ -0,0 +1,57 @@
+-- every other row of an email is merged into the oldest one, as the customers command
+-- does, before the email becomes unique
+create temporary table customer_merges (
+	id int unsigned not null,
+	keep_id int unsigned not null,
+	stripe_customer_id varchar(255) not null,
+	password varchar(60) not null,
+	primary key (id)
+);
+
+insert into customer_merges (id, keep_id, stripe_customer_id, password)
+select c.id, k.keep_id, c.stripe_customer_id, c.password
+from customers c
+	inner join (
+		select lower(trim(email)) as email, min(id) as keep_id from customers group by lower(trim(email))
+	) k on (lower(trim(c.email)) = k.email)
+where c.id <> k.keep_id;
+
+update orders o inner join customer_merges m on (o.customer_id = m.id) set o.customer_id = m.keep_id;
+
+update addresses a inner join customer_merges m on (a.customer_id = m.id) set a.customer_id = m.keep_id;
+
+update subscriptions s inner join customer_merges m on (s.customer_id = m.id) set s.customer_id = m.keep_id;
+
+-- the kept row takes a stripe customer or password it doesn't have from the newest duplicate
+create temporary table customer_takeovers (
+	keep_id int unsigned not null,
+	stripe_customer_id varchar(255) not null,
+	password varchar(60) not null,
+	primary key (keep_id)
+);
+
+insert into customer_takeovers (keep_id, stripe_customer_id, password)
+select
+	keep_id,
+	coalesce(substring_index(group_concat(nullif(stripe_customer_id, '') order by id desc), ',', 1), ''),
+	coalesce(substring_index(group_concat(nullif(password, '') order by id desc), ',', 1), '')
+from customer_merges
+group by keep_id;
+
+update customers k
+	inner join customer_takeovers t on (k.id = t.keep_id)
+set
+	k.stripe_customer_id = if(k.stripe_customer_id = '', t.stripe_customer_id, k.stripe_customer_id),
+	k.password = if(k.password = '', t.password, k.password);
+
+delete c from customers c inner join customer_merges m on (c.id = m.id);
+
+update customers set email = lower(trim(email));
+
+drop temporary table customer_takeovers;
+
+drop temporary table customer_merges;
+
+alter table customers
+	drop key customers_email_idx,
+	add unique key customers_email_idx (email);
@@ -0,0 +1,7 @@
+alter table refunds
+	drop key refunds_stripe_refund_idx;
+
+update refunds set stripe_refund_id = '' where stripe_refund_id is null;
+
+alter table refunds
+	modify stripe_refund_id varchar(255) not null default '';
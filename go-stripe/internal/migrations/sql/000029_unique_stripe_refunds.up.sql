@@ -0,0 +1,9 @@
+-- a refund is recorded once whether the admin refund or stripe's webhook saves it first,
+-- the refunds recorded without a stripe refund id have none
+alter table refunds
+	modify stripe_refund_id varchar(255) null default null;
+
+update refunds set stripe_refund_id = null where stripe_refund_id = '';
+
+alter table refunds
+	add unique key refunds_stripe_refund_idx (stripe_refund_id);
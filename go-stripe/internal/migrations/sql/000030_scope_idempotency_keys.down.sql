@@ -0,0 +1,7 @@
+-- keys only live for a day, the ones several owners used can't be kept apart
+delete from idempotency_keys;
+
+alter table idempotency_keys
+	drop key idempotency_keys_key_owner_endpoint_idx,
+	drop column owner,
+	add unique key idempotency_keys_key_endpoint_idx (idempotency_key, endpoint);
@@ -0,0 +1,6 @@
+-- keys are scoped to the admin user or customer who sent them, so that one can't
+-- replay the response to another's request
+alter table idempotency_keys
+	add column owner varchar(64) not null default '' after idempotency_key,
+	drop key idempotency_keys_key_endpoint_idx,
+	add unique key idempotency_keys_key_owner_endpoint_idx (idempotency_key, owner, endpoint);
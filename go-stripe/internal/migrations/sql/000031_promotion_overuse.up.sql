@@ -0,0 +1,4 @@
+-- an order paid at the discount of a promotion used up in the meantime is still
+-- saved, marked so that the use beyond the limit can be looked into
+alter table orders
+	add column promotion_overused tinyint(1) not null default 0 after discount;
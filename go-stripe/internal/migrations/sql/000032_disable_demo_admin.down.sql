@@ -0,0 +1 @@
+-- the demo password is not given back
@@ -0,0 +1,11 @@
+-- 000008 used to seed admin@example.com with the password "password", made an
+-- owner by 000022. that password is cleared and the user's sessions revoked, an
+-- administrator is now seeded with migrate -seed-admin
+delete t from tokens t
+	inner join users u on (u.id = t.user_id)
+where u.email = 'admin@example.com'
+	and u.password = '$2a$12$thIZ9lIFgh1JF7OrVGkdU.8kZ9oQrYHMNvvpDWC.FqNm9q1osbUi.';
+
+update users set password = ''
+where email = 'admin@example.com'
+	and password = '$2a$12$thIZ9lIFgh1JF7OrVGkdU.8kZ9oQrYHMNvvpDWC.FqNm9q1osbUi.';
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"myapp/internal/tax"
+	"myapp/internal/validator"
+	"strings"
+	"time"
+)
+
+// kinds of address
+const (
+	AddressBilling  = "billing"
+	AddressShipping = "shipping"
+)
+
+// type for postal addresses, kept per customer and copied onto every order
+type Address struct {
+	ID         int       `json:"id"`
+	CustomerID int       `json:"customer_id"`
+	Kind       string    `json:"kind"`
+	Name       string    `json:"name"`
+	Line1      string    `json:"line1"`
+	Line2      string    `json:"line2"`
+	City       string    `json:"city"`
+	Region     string    `json:"region"`
+	PostalCode string    `json:"postal_code"`
+	Country    string    `json:"country"`
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+// report whether no address was entered
+func (a Address) IsZero() bool {
+	return a.Line1 == "" && a.City == "" && a.Country == ""
+}
+
+// trim what a customer typed and use upper case codes
+func (a Address) Normalize() Address {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Line1 = strings.TrimSpace(a.Line1)
+	a.Line2 = strings.TrimSpace(a.Line2)
+	a.City = strings.TrimSpace(a.City)
+	a.Region = strings.ToUpper(strings.TrimSpace(a.Region))
+	a.PostalCode = strings.ToUpper(strings.TrimSpace(a.PostalCode))
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+	return a
+}
+
+// check the address, errors are keyed by the form field names, prefix_line1 etc.
+func (a Address) Validate(v *validator.Validator, prefix string) {
+	v.Check(a.Line1 != "", prefix+"_line1", "is required")
+	v.Check(a.City != "", prefix+"_city", "is required")
+	v.Check(len(a.Country) == 2, prefix+"_country", "is required")
+
+	if validator.RegionRequired(a.Country) {
+		v.Check(a.Region != "", prefix+"_region", "is required")
+	}
+
+	if validator.HasPostalCode(a.Country) {
+		v.Check(a.PostalCode != "", prefix+"_postal_code", "is required")
+		v.Check(validator.PostalCode(a.Country, a.PostalCode), prefix+"_postal_code", fmt.Sprintf("is not a valid postal code for %s", a.Country))
+	}
+}
+
+// location the address is taxed in
+func (a Address) TaxAddress() tax.Address {
+	return tax.NewAddress(a.Country, a.Region)
+}
+
+// the address as printed on a label
+func (a Address) Lines() []string {
+	var lines []string
+	for _, l := range []string{a.Name, a.Line1, a.Line2} {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	var city []string
+	for _, part := range []string{a.City, a.Region, a.PostalCode} {
+		if part != "" {
+			city = append(city, part)
+		}
+	}
+	lines = append(lines, strings.Join(city, " "), a.Country)
+
+	return lines
+}
+
+// save an address of a customer and return id
+func (m *DBModel) InsertAddress(ctx context.Context, a Address) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		insert into addresses
+			(customer_id, kind, name, line1, line2, city, region, postal_code, country,
+			created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := m.db().ExecContext(ctx, stmt,
+		a.CustomerID,
+		a.Kind,
+		a.Name,
+		a.Line1,
+		a.Line2,
+		a.City,
+		a.Region,
+		a.PostalCode,
+		a.Country,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// get the addresses of a customer, newest first
+func (m *DBModel) GetCustomerAddresses(ctx context.Context, customerID int) ([]Address, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var addresses []Address
+
+	rows, err := m.db().QueryContext(ctx, `
+		select
+			id, customer_id, kind, name, line1, line2, city, region, postal_code, country,
+			created_at, updated_at
+		from addresses
+		where customer_id = ?
+		order by id desc`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Address
+		err = rows.Scan(
+			&a.ID,
+			&a.CustomerID,
+			&a.Kind,
+			&a.Name,
+			&a.Line1,
+			&a.Line2,
+			&a.City,
+			&a.Region,
+			&a.PostalCode,
+			&a.Country,
+			&a.CreatedAt,
+			&a.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = append(addresses, a)
+	}
+
+	return addresses, nil
+}
+
+// get the billing and shipping addresses recorded with an order
+func (m *DBModel) GetOrderAddresses(ctx context.Context, orderID int) (Address, Address, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var billing, shipping Address
+
+	rows, err := m.db().QueryContext(ctx, `
+		select id, kind, name, line1, line2, city, region, postal_code, country, created_at
+		from order_addresses
+		where order_id = ?`, orderID)
+	if err != nil {
+		return billing, shipping, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Address
+		err = rows.Scan(
+			&a.ID,
+			&a.Kind,
+			&a.Name,
+			&a.Line1,
+			&a.Line2,
+			&a.City,
+			&a.Region,
+			&a.PostalCode,
+			&a.Country,
+			&a.CreatedAt,
+		)
+		if err != nil {
+			return billing, shipping, err
+		}
+
+		if a.Kind == AddressShipping {
+			shipping = a
+		} else {
+			billing = a
+		}
+	}
+
+	return billing, shipping, nil
+}
@@ -0,0 +1,248 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// actions recorded in the audit log, named entity.verb
+const (
+	AuditRefund                = "order.refund"
+	AuditCancelSubscription    = "subscription.cancel"
+	AuditTerminalPaymentIntent = "terminal.payment_intent"
+	AuditTerminalCharge        = "terminal.charge"
+	AuditPromotionCreate       = "promotion.create"
+	AuditPromotionEnable       = "promotion.enable"
+	AuditPromotionDisable      = "promotion.disable"
+	AuditUserCreate            = "user.create"
+	AuditUserEdit              = "user.edit"
+	AuditUserDelete            = "user.delete"
+	AuditTwoFactorEnable       = "user.two_factor_enable"
+	AuditTwoFactorReset        = "user.two_factor_reset"
+	AuditUserUnlock            = "user.unlock"
+	AuditTokenCreate           = "token.create"
+	AuditTokenRevoke           = "token.revoke"
+)
+
+// actions in the order of the filter on the audit page
+var AuditActions = []string{
+	AuditRefund,
+	AuditCancelSubscription,
+	AuditTerminalPaymentIntent,
+	AuditTerminalCharge,
+	AuditPromotionCreate,
+	AuditPromotionEnable,
+	AuditPromotionDisable,
+	AuditUserCreate,
+	AuditUserEdit,
+	AuditUserDelete,
+	AuditTwoFactorEnable,
+	AuditTwoFactorReset,
+	AuditUserUnlock,
+	AuditTokenCreate,
+	AuditTokenRevoke,
+}
+
+// type for an entry of the append-only audit log, Before and After are json
+// snapshots of the entity, null when it didn't exist
+type AuditEntry struct {
+	ID        int             `json:"id"`
+	UserID    int             `json:"user_id"`
+	UserEmail string          `json:"user_email"`
+	Action    string          `json:"action"`
+	Entity    string          `json:"entity"`
+	EntityID  string          `json:"entity_id"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	IP        string          `json:"ip"`
+	UserAgent string          `json:"user_agent"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// which entries to list, zero fields match every entry and To is exclusive
+type AuditFilter struct {
+	UserID   int
+	Action   string
+	Entity   string
+	EntityID string
+	From     time.Time
+	To       time.Time
+}
+
+// whether the filter matches e
+func (f AuditFilter) Match(e AuditEntry) bool {
+	return (f.UserID == 0 || e.UserID == f.UserID) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Entity == "" || e.Entity == f.Entity) &&
+		(f.EntityID == "" || e.EntityID == f.EntityID) &&
+		(f.From.IsZero() || !e.CreatedAt.Before(f.From)) &&
+		(f.To.IsZero() || e.CreatedAt.Before(f.To))
+}
+
+// sql condition and arguments of the filter
+func (f AuditFilter) where() (string, []any) {
+	conditions := []string{"1 = 1"}
+	var args []any
+
+	if f.UserID > 0 {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, f.UserID)
+	}
+	if f.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.Entity != "" {
+		conditions = append(conditions, "entity = ?")
+		args = append(args, f.Entity)
+	}
+	if f.EntityID != "" {
+		conditions = append(conditions, "entity_id = ?")
+		args = append(args, f.EntityID)
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, f.To)
+	}
+
+	return strings.Join(conditions, " and "), args
+}
+
+// json of a snapshot, null for nil
+func nullJSON(raw json.RawMessage) sql.NullString {
+	if len(raw) == 0 || string(raw) == "null" {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(raw), Valid: true}
+}
+
+// add an entry to the audit log, entries can't be changed afterwards
+func (m *DBModel) InsertAuditEntry(ctx context.Context, e AuditEntry) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var userID sql.NullInt64
+	if e.UserID > 0 {
+		userID = sql.NullInt64{Int64: int64(e.UserID), Valid: true}
+	}
+
+	result, err := m.db().ExecContext(ctx, `
+		insert into audit_log
+			(user_id, user_email, action, entity, entity_id, before_state, after_state, ip, user_agent, created_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, e.UserEmail, e.Action, e.Entity, e.EntityID, nullJSON(e.Before), nullJSON(e.After),
+		e.IP, truncate(e.UserAgent, 255), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// cut s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// the entries matching f, newest first
+func (m *DBModel) GetAuditEntries(ctx context.Context, f AuditFilter) ([]*AuditEntry, error) {
+	where, args := f.where()
+	return m.auditEntries(ctx, where+` order by created_at desc, id desc`, args...)
+}
+
+// a page of the entries matching f, newest first, with the last page and the number of entries
+func (m *DBModel) GetAuditEntriesPaginated(ctx context.Context, f AuditFilter, pageSize, page int) ([]*AuditEntry, int, int, error) {
+	where, args := f.where()
+
+	entries, err := m.auditEntries(ctx, where+` order by created_at desc, id desc limit ? offset ?`,
+		append(args, pageSize, (page-1)*pageSize)...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var totalRecords int
+	err = m.db().QueryRowContext(ctx, `select count(id) from audit_log where `+where, args...).Scan(&totalRecords)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	lastPage := totalRecords / pageSize
+	if totalRecords%pageSize != 0 {
+		lastPage += 1
+	}
+
+	return entries, lastPage, totalRecords, nil
+}
+
+func (m *DBModel) auditEntries(ctx context.Context, where string, args ...any) ([]*AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var entries []*AuditEntry
+
+	rows, err := m.db().QueryContext(ctx, `
+		select
+			id, coalesce(user_id, 0), user_email, action, entity, entity_id,
+			before_state, after_state, ip, user_agent, created_at
+		from
+			audit_log
+		where `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEntry
+		var before, after sql.NullString
+		err = rows.Scan(
+			&e.ID,
+			&e.UserID,
+			&e.UserEmail,
+			&e.Action,
+			&e.Entity,
+			&e.EntityID,
+			&before,
+			&after,
+			&e.IP,
+			&e.UserAgent,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+
+		entries = append(entries, &e)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,240 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"time"
+)
+
+// type for shopping carts, identified by a random token kept in the session
+type Cart struct {
+	ID        int        `json:"id"`
+	Token     string     `json:"token"`
+	Currency  string     `json:"currency"`
+	Items     []CartItem `json:"items"`
+	CreatedAt time.Time  `json:"-"`
+	UpdatedAt time.Time  `json:"-"`
+}
+
+// type for cart line items
+type CartItem struct {
+	ID        int       `json:"id"`
+	CartID    int       `json:"cart_id"`
+	WidgetID  int       `json:"widget_id"`
+	Quantity  int       `json:"quantity"`
+	Widget    Widget    `json:"widget"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// line total computed from the catalog price
+func (i CartItem) Amount() int {
+	return i.Widget.Price * i.Quantity
+}
+
+// cart total computed from the catalog prices
+func (c Cart) Total() int {
+	total := 0
+	for _, i := range c.Items {
+		total += i.Amount()
+	}
+	return total
+}
+
+// number of units in the cart
+func (c Cart) Quantity() int {
+	quantity := 0
+	for _, i := range c.Items {
+		quantity += i.Quantity
+	}
+	return quantity
+}
+
+// order lines priced at the current catalog prices
+func (c Cart) OrderItems() []OrderItem {
+	var items []OrderItem
+	for _, i := range c.Items {
+		items = append(items, OrderItem{
+			WidgetID: i.WidgetID,
+			Quantity: i.Quantity,
+			Price:    i.Widget.Price,
+			Amount:   i.Amount(),
+			Widget:   i.Widget,
+		})
+	}
+	return items
+}
+
+// create an empty cart with a new token
+func (m *DBModel) CreateCart(ctx context.Context) (Cart, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var cart Cart
+
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return cart, err
+	}
+
+	cart.Token = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	cart.CreatedAt = time.Now()
+	cart.UpdatedAt = time.Now()
+
+	stmt := `insert into carts (token, created_at, updated_at) values (?, ?, ?)`
+
+	result, err := m.db().ExecContext(ctx, stmt, cart.Token, cart.CreatedAt, cart.UpdatedAt)
+	if err != nil {
+		return cart, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return cart, err
+	}
+	cart.ID = int(id)
+
+	return cart, nil
+}
+
+// get a cart and its items with current widget prices in the default currency
+func (m *DBModel) GetCartByToken(ctx context.Context, token string) (Cart, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var cart Cart
+
+	row := m.db().QueryRowContext(ctx,
+		`select id, token, created_at, updated_at from carts where token = ?`, token)
+	err := row.Scan(&cart.ID, &cart.Token, &cart.CreatedAt, &cart.UpdatedAt)
+	if err != nil {
+		return cart, err
+	}
+
+	query := `
+		select
+			ci.id, ci.cart_id, ci.widget_id, ci.quantity, ci.created_at, ci.updated_at,
+			w.id, w.name, w.description, w.inventory_level, w.price,
+			coalesce(w.image, ''), w.is_recurring, w.plan_id
+		from
+			cart_items ci
+			inner join widgets w on (ci.widget_id = w.id)
+		where
+			ci.cart_id = ?
+		order by
+			ci.id
+	`
+
+	rows, err := m.db().QueryContext(ctx, query, cart.ID)
+	if err != nil {
+		return cart, err
+	}
+	defer rows.Close()
+
+	cart.Currency = DefaultCurrency
+
+	for rows.Next() {
+		var i CartItem
+		err = rows.Scan(
+			&i.ID,
+			&i.CartID,
+			&i.WidgetID,
+			&i.Quantity,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Widget.ID,
+			&i.Widget.Name,
+			&i.Widget.Description,
+			&i.Widget.InventoryLevel,
+			&i.Widget.Price,
+			&i.Widget.Image,
+			&i.Widget.IsRecurring,
+			&i.Widget.PlanID,
+		)
+		if err != nil {
+			return cart, err
+		}
+		i.Widget.Currency = DefaultCurrency
+
+		cart.Items = append(cart.Items, i)
+	}
+
+	return cart, nil
+}
+
+// add quantity units of a widget to the cart
+func (m *DBModel) AddCartItem(ctx context.Context, cartID, widgetID, quantity int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		insert into cart_items
+			(cart_id, widget_id, quantity, created_at, updated_at)
+		values (?, ?, ?, ?, ?)
+		on duplicate key update
+			quantity = quantity + values(quantity), updated_at = values(updated_at)
+	`
+
+	_, err := m.db().ExecContext(ctx, stmt, cartID, widgetID, quantity, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// set the quantity of a widget in the cart, a quantity below 1 removes the line
+func (m *DBModel) UpdateCartItem(ctx context.Context, cartID, widgetID, quantity int) error {
+	if quantity < 1 {
+		return m.RemoveCartItem(ctx, cartID, widgetID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `update cart_items set quantity = ?, updated_at = ? where cart_id = ? and widget_id = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, quantity, time.Now(), cartID, widgetID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// remove a widget from the cart
+func (m *DBModel) RemoveCartItem(ctx context.Context, cartID, widgetID int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `delete from cart_items where cart_id = ? and widget_id = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, cartID, widgetID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// delete a cart and its items
+func (m *DBModel) DeleteCart(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `delete from cart_items where cart_id = ?`
+	_, err := m.db().ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	stmt = `delete from carts where id = ?`
+	_, err = m.db().ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
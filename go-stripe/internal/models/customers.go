@@ -0,0 +1,319 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// shortest password a customer can set
+const MinCustomerPassword = 8
+
+// customers sharing an email, Keep is the oldest row and the others are merged into it
+type DuplicateCustomers struct {
+	Email string `json:"email"`
+	Keep  int    `json:"keep"`
+	IDs   []int  `json:"ids"`
+}
+
+// emails are compared ignoring case and surrounding spaces
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// get a customer by id
+func (m *DBModel) GetCustomer(ctx context.Context, id int) (Customer, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var c Customer
+
+	row := m.db().QueryRowContext(ctx, `
+		select
+			id, first_name, last_name, email, stripe_customer_id, password,
+			created_at, updated_at
+		from
+			customers
+		where id = ?`, id)
+
+	err := row.Scan(
+		&c.ID,
+		&c.FirstName,
+		&c.LastName,
+		&c.Email,
+		&c.StripeCustomerID,
+		&c.Password,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// get the customer with an email
+func (m *DBModel) GetCustomerByEmail(ctx context.Context, email string) (Customer, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var c Customer
+
+	row := m.db().QueryRowContext(ctx, `
+		select
+			id, first_name, last_name, email, stripe_customer_id, password,
+			created_at, updated_at
+		from
+			customers
+		where email = ?`, NormalizeEmail(email))
+
+	err := row.Scan(
+		&c.ID,
+		&c.FirstName,
+		&c.LastName,
+		&c.Email,
+		&c.StripeCustomerID,
+		&c.Password,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// return the id of the customer with the email of c, inserting c if there is none. the
+// email is unique, so checkouts of a new customer saved at the same time share one row
+func (m *DBModel) GetOrInsertCustomer(ctx context.Context, c Customer) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		insert into customers
+			(first_name, last_name, email, stripe_customer_id, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?)
+		on duplicate key update
+			id = last_insert_id(id)
+	`
+
+	result, err := m.db().ExecContext(ctx, stmt,
+		c.FirstName,
+		c.LastName,
+		NormalizeEmail(c.Email),
+		c.StripeCustomerID,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// remember the stripe customer of a customer so returning subscribers reuse it
+func (m *DBModel) UpdateCustomerStripeID(ctx context.Context, id int, stripeCustomerID string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `update customers set stripe_customer_id = ?, updated_at = ? where id = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, stripeCustomerID, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// set the password a customer logs in with
+func (m *DBModel) UpdatePasswordForCustomer(ctx context.Context, c Customer, hash string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `update customers set password = ?, updated_at = ? where id = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, hash, time.Now(), c.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// authenticate customer and return customerID, customers without a password can't log in
+func (m *DBModel) AuthenticateCustomer(ctx context.Context, email, password string) (int, error) {
+	c, err := m.GetCustomerByEmail(ctx, email)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.Password == "" {
+		return 0, errors.New("no password set")
+	}
+
+	err = checkPassword(c.Password, password)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.ID, nil
+}
+
+// get the orders and subscriptions of a customer, newest first
+func (m *DBModel) GetCustomerOrders(ctx context.Context, customerID int) ([]*Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var orders []*Order
+
+	query := `
+	SELECT
+		o.id, o.widget_id, o.transaction_id, o.customer_id,
+		o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
+		w.id, w.name, w.is_recurring, t.id, t.currency, t.last_four,
+		s.id, s.name
+	FROM
+		orders o
+		LEFT JOIN widgets w ON (o.widget_id = w.id)
+		LEFT JOIN transactions t ON (o.transaction_id = t.id)
+		LEFT JOIN statuses s ON (o.status_id = s.id)
+	WHERE
+		o.customer_id = ?
+	ORDER BY
+		o.created_at desc, o.id desc`
+
+	rows, err := m.db().QueryContext(ctx, query, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o Order
+		err = rows.Scan(
+			&o.ID,
+			&o.WidgetID,
+			&o.TransactionID,
+			&o.CustomerID,
+			&o.StatusID,
+			&o.Quantity,
+			&o.Amount,
+			&o.CreatedAt,
+			&o.UpdatedAt,
+			&o.Widget.ID,
+			&o.Widget.Name,
+			&o.Widget.IsRecurring,
+			&o.Transaction.ID,
+			&o.Transaction.Currency,
+			&o.Transaction.LastFour,
+			&o.Status.ID,
+			&o.Status.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		orders = append(orders, &o)
+	}
+
+	return orders, nil
+}
+
+// find emails used by more than one customer
+func (m *DBModel) GetDuplicateCustomers(ctx context.Context) ([]DuplicateCustomers, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var duplicates []DuplicateCustomers
+
+	rows, err := m.db().QueryContext(ctx, `
+		select c.id, lower(trim(c.email))
+		from customers c
+		where lower(trim(c.email)) in (
+			select lower(trim(email)) from customers group by lower(trim(email)) having count(*) > 1
+		)
+		order by lower(trim(c.email)), c.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var email string
+		err = rows.Scan(&id, &email)
+		if err != nil {
+			return nil, err
+		}
+
+		n := len(duplicates)
+		if n == 0 || duplicates[n-1].Email != email {
+			duplicates = append(duplicates, DuplicateCustomers{Email: email, Keep: id})
+			continue
+		}
+		duplicates[n-1].IDs = append(duplicates[n-1].IDs, id)
+	}
+
+	return duplicates, nil
+}
+
+// move the orders, addresses and subscriptions of the customers in ids to keepID and delete them,
+// keepID takes over a stripe customer or password it doesn't have from the newest duplicate
+func (m *DBModel) MergeCustomers(ctx context.Context, keepID int, ids []int) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	return m.withTx(ctx, func(tx *DBModel) error {
+		// newest first, so its stripe customer and password are the ones kept
+		for i := len(ids) - 1; i >= 0; i-- {
+			id := ids[i]
+			if id == keepID {
+				continue
+			}
+
+			_, err := tx.db().ExecContext(ctx, `update orders set customer_id = ? where customer_id = ?`, keepID, id)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.db().ExecContext(ctx, `update addresses set customer_id = ? where customer_id = ?`, keepID, id)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.db().ExecContext(ctx, `update subscriptions set customer_id = ? where customer_id = ?`, keepID, id)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.db().ExecContext(ctx, `
+				update customers k, customers d
+				set
+					k.stripe_customer_id = if(k.stripe_customer_id = '', d.stripe_customer_id, k.stripe_customer_id),
+					k.password = if(k.password = '', d.password, k.password),
+					k.updated_at = ?
+				where k.id = ? and d.id = ?`, time.Now(), keepID, id)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.db().ExecContext(ctx, `delete from customers where id = ?`, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.db().ExecContext(ctx, `update customers set email = lower(trim(email)) where id = ?`, keepID)
+		return err
+	})
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// type for stripe webhook events already handled
+type StripeEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"-"`
+}
+
+// record a stripe event id, returns false if the event was already recorded
+func (m *DBModel) RecordStripeEvent(ctx context.Context, id, eventType string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `insert ignore into stripe_events (id, type, created_at) values (?, ?, ?)`
+
+	result, err := m.db().ExecContext(ctx, stmt, id, eventType, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// forget a stripe event so that a redelivery of it is handled again
+func (m *DBModel) DeleteStripeEvent(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `delete from stripe_events where id = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
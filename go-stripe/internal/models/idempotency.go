@@ -0,0 +1,149 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// type for a request made with an Idempotency-Key header and its response, StatusCode
+// is zero while the request is being handled. Owner is the admin user or customer who
+// sent it, empty for anonymous requests
+type IdempotentRequest struct {
+	ID           int       `json:"id"`
+	Key          string    `json:"key"`
+	Owner        string    `json:"owner"`
+	Endpoint     string    `json:"endpoint"`
+	RequestHash  string    `json:"request_hash"`
+	StatusCode   int       `json:"status_code"`
+	ResponseBody []byte    `json:"-"`
+	CreatedAt    time.Time `json:"-"`
+	UpdatedAt    time.Time `json:"-"`
+}
+
+// start handling the request with a key, returns true when the key is new for the
+// owner and endpoint, otherwise false and the request first made with the key. A request with
+// the same hash left unfinished for longer than abandonAfter, by a crash or a timeout,
+// is taken over and returned with true
+func (m *DBModel) StartIdempotentRequest(ctx context.Context, key, owner, endpoint, hash string, abandonAfter time.Duration) (IdempotentRequest, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	req := IdempotentRequest{
+		Key:         key,
+		Owner:       owner,
+		Endpoint:    endpoint,
+		RequestHash: hash,
+	}
+
+	result, err := m.db().ExecContext(ctx, `
+		insert ignore into idempotency_keys
+			(idempotency_key, owner, endpoint, request_hash, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?)`,
+		key, owner, endpoint, hash, time.Now(), time.Now())
+	if err != nil {
+		return req, false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return req, false, err
+	}
+
+	if n == 1 {
+		id, err := result.LastInsertId()
+		if err != nil {
+			return req, false, err
+		}
+		req.ID = int(id)
+		return req, true, nil
+	}
+
+	row := m.db().QueryRowContext(ctx, `
+		select id, idempotency_key, owner, endpoint, request_hash, status_code,
+			coalesce(response_body, ''), created_at, updated_at
+		from idempotency_keys
+		where idempotency_key = ? and owner = ? and endpoint = ?`, key, owner, endpoint)
+
+	err = row.Scan(
+		&req.ID,
+		&req.Key,
+		&req.Owner,
+		&req.Endpoint,
+		&req.RequestHash,
+		&req.StatusCode,
+		&req.ResponseBody,
+		&req.CreatedAt,
+		&req.UpdatedAt,
+	)
+	if err != nil {
+		return req, false, err
+	}
+
+	if req.StatusCode != 0 || req.RequestHash != hash {
+		return req, false, nil
+	}
+
+	// only one of several retries takes over an abandoned request
+	result, err = m.db().ExecContext(ctx, `
+		update idempotency_keys set updated_at = ?
+		where id = ? and status_code = 0 and updated_at < ?`,
+		time.Now(), req.ID, time.Now().Add(-abandonAfter))
+	if err != nil {
+		return req, false, err
+	}
+
+	n, err = result.RowsAffected()
+	if err != nil {
+		return req, false, err
+	}
+
+	return req, n == 1, nil
+}
+
+// save the response to a request so that repeating it replays the response
+func (m *DBModel) SaveIdempotentResponse(ctx context.Context, id, statusCode int, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `update idempotency_keys set status_code = ?, response_body = ?, updated_at = ? where id = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, statusCode, body, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// forget a request so that it is handled again when repeated
+func (m *DBModel) DeleteIdempotentRequest(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `delete from idempotency_keys where id = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// delete the keys of requests made before t, returns the number deleted
+func (m *DBModel) DeleteIdempotencyKeysBefore(ctx context.Context, t time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, `delete from idempotency_keys where created_at < ?`, t)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
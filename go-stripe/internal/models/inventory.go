@@ -0,0 +1,252 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// returned when a widget doesn't have enough unreserved stock
+type OutOfStockError struct {
+	WidgetID   int
+	WidgetName string
+	Available  int
+}
+
+func (e *OutOfStockError) Error() string {
+	if e.Available <= 0 {
+		return fmt.Sprintf("%s is out of stock", e.WidgetName)
+	}
+	return fmt.Sprintf("only %d of %s left in stock", e.Available, e.WidgetName)
+}
+
+// stock of a widget not held by an unexpired reservation, lock the widget row when forUpdate is set
+func availableStock(ctx context.Context, q querier, widgetID int, forUpdate bool) (Widget, int, error) {
+	var w Widget
+
+	query := `select id, name, inventory_level, is_recurring from widgets where id = ?`
+	if forUpdate {
+		query += ` for update`
+	}
+
+	err := q.QueryRowContext(ctx, query, widgetID).Scan(&w.ID, &w.Name, &w.InventoryLevel, &w.IsRecurring)
+	if err != nil {
+		return w, 0, err
+	}
+
+	var reserved int
+	err = q.QueryRowContext(ctx, `
+		select coalesce(sum(quantity), 0)
+		from inventory_reservations
+		where widget_id = ? and expires_at > ?`, widgetID, time.Now()).Scan(&reserved)
+	if err != nil {
+		return w, 0, err
+	}
+
+	return w, w.InventoryLevel - reserved, nil
+}
+
+// get the stock of a widget that can still be sold
+func (m *DBModel) AvailableStock(ctx context.Context, widgetID int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	_, available, err := availableStock(ctx, m.db(), widgetID, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return available, nil
+}
+
+// check that every item can be sold, subscriptions are not stocked
+func (m *DBModel) CheckStock(ctx context.Context, items []OrderItem) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	for _, item := range items {
+		w, available, err := availableStock(ctx, m.db(), item.WidgetID, false)
+		if err != nil {
+			return err
+		}
+
+		if !w.IsRecurring && item.Quantity > available {
+			return &OutOfStockError{WidgetID: w.ID, WidgetName: w.Name, Available: available}
+		}
+	}
+
+	return nil
+}
+
+// hold stock for the items of a payment intent until ttl passes
+func (m *DBModel) ReserveStock(ctx context.Context, pi string, items []OrderItem, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		insert into inventory_reservations
+			(payment_intent, widget_id, quantity, expires_at, created_at)
+		values (?, ?, ?, ?, ?)
+	`
+
+	return m.withTx(ctx, func(tx *DBModel) error {
+		for _, item := range items {
+			// the widget row lock serializes concurrent reservations of the same widget
+			w, available, err := availableStock(ctx, tx.db(), item.WidgetID, true)
+			if err != nil {
+				return err
+			}
+
+			if w.IsRecurring {
+				continue
+			}
+
+			if item.Quantity > available {
+				return &OutOfStockError{WidgetID: w.ID, WidgetName: w.Name, Available: available}
+			}
+
+			_, err = tx.db().ExecContext(ctx, stmt, pi, item.WidgetID, item.Quantity, time.Now().Add(ttl), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// drop the reservations of a payment intent
+func (m *DBModel) ReleaseStock(ctx context.Context, pi string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `delete from inventory_reservations where payment_intent = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, pi)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// decrement the stock of the items sold by a payment intent and drop its reservations,
+// the stock is decremented even if the reservation already expired
+func (m *DBModel) CommitStock(ctx context.Context, pi string, items []OrderItem) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	return m.withTx(ctx, func(tx *DBModel) error {
+		for _, item := range items {
+			_, err := tx.db().ExecContext(ctx, `
+				update widgets
+				set inventory_level = inventory_level - ?, updated_at = ?
+				where id = ? and is_recurring = 0`, item.Quantity, time.Now(), item.WidgetID)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.db().ExecContext(ctx, `delete from inventory_reservations where payment_intent = ?`, pi)
+		return err
+	})
+}
+
+// delete expired reservations and return how many were removed
+func (m *DBModel) ReleaseExpiredReservations(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, `delete from inventory_reservations where expires_at <= ?`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// put the items of an order back into stock, only the first call for an order has an effect
+func (m *DBModel) RestockOrder(ctx context.Context, orderID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	restocked := false
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		result, err := tx.db().ExecContext(ctx, `update orders set restocked = 1 where id = ? and restocked = 0`, orderID)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return nil
+		}
+
+		_, err = tx.db().ExecContext(ctx, `
+			update widgets w
+				inner join order_items oi on (oi.widget_id = w.id)
+			set
+				w.inventory_level = w.inventory_level + oi.quantity, w.updated_at = ?
+			where
+				oi.order_id = ? and w.is_recurring = 0`, time.Now(), orderID)
+		if err != nil {
+			return err
+		}
+
+		restocked = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return restocked, nil
+}
+
+// restock every order paid by a payment intent
+func (m *DBModel) RestockOrdersByPaymentIntent(ctx context.Context, pi string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	rows, err := m.db().QueryContext(ctx, `
+		select o.id
+		from orders o inner join transactions t on (o.transaction_id = t.id)
+		where t.payment_intent = ?`, pi)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// the rows hold the connection, which restocking needs when it is a transaction
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := m.RestockOrder(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
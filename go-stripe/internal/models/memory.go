@@ -0,0 +1,2690 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"myapp/internal/ratelimit"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// names of the rows in statuses
+var statusNames = map[int]string{
+	StatusCleared:           "Cleared",
+	StatusRefunded:          "Refunded",
+	StatusCancelled:         "Cancelled",
+	StatusDisputed:          "Disputed",
+	StatusPastDue:           "Past Due",
+	StatusTrialing:          "Trialing",
+	StatusPartiallyRefunded: "Partially Refunded",
+}
+
+// in-memory store for handler tests, it answers the queries of DBModel from maps.
+// The catalog is added with AddWidget and AddPlan, missing rows are sql.ErrNoRows
+type MemoryStore struct {
+	mu   sync.Mutex
+	data *memoryData
+	// set on the store WithTx passes to its function
+	inTx bool
+}
+
+type widgetPriceKey struct {
+	widgetID int
+	currency string
+}
+
+type memoryReservation struct {
+	paymentIntent string
+	widgetID      int
+	quantity      int
+	expiresAt     time.Time
+}
+
+type memoryToken struct {
+	ownerID int
+	hash    string
+	expiry  time.Time
+	// only kept for the tokens of admin users
+	id        int
+	name      string
+	scope     string
+	createdAt time.Time
+	lastUsed  time.Time
+}
+
+func (t memoryToken) token() Token {
+	return Token{
+		ID:         t.id,
+		UserID:     int64(t.ownerID),
+		Name:       t.name,
+		Expiry:     t.expiry,
+		Scope:      t.scope,
+		CreatedAt:  t.createdAt,
+		LastUsedAt: t.lastUsed,
+	}
+}
+
+type memoryRateLimitHit struct {
+	key string
+	at  time.Time
+}
+
+type memoryRateLimitLock struct {
+	ratelimit.Lock
+	notified bool
+}
+
+type memoryRecoveryCode struct {
+	userID int
+	hash   string
+	used   bool
+}
+
+// the tables of a MemoryStore, orders keep their lines, taxes and addresses
+type memoryData struct {
+	seq             map[string]int
+	widgets         map[int]Widget
+	widgetPrices    map[widgetPriceKey]WidgetPrice
+	reservations    []memoryReservation
+	transactions    map[int]Transaction
+	orders          map[int]Order
+	restocked       map[int]bool
+	customers       map[int]Customer
+	addresses       map[int]Address
+	users           map[int]User
+	tokens          []memoryToken
+	customerTokens  []memoryToken
+	carts           map[int]Cart
+	cartItems       map[int]CartItem
+	promotions      map[int]Promotion
+	plans           map[int]Plan
+	subscriptions   map[int]Subscription
+	trialReminders  map[int]time.Time
+	refunds         map[int]Refund
+	events          map[string]StripeEvent
+	idempotencyKeys map[int]IdempotentRequest
+	reconciliations map[int]Reconciliation
+	auditLog        []AuditEntry
+	twoFactor       map[int]TwoFactor
+	recoveryCodes   []memoryRecoveryCode
+	rateLimitHits   []memoryRateLimitHit
+	rateLimitLocks  map[string]memoryRateLimitLock
+}
+
+// returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data: &memoryData{
+			seq:             make(map[string]int),
+			widgets:         make(map[int]Widget),
+			widgetPrices:    make(map[widgetPriceKey]WidgetPrice),
+			transactions:    make(map[int]Transaction),
+			orders:          make(map[int]Order),
+			restocked:       make(map[int]bool),
+			customers:       make(map[int]Customer),
+			addresses:       make(map[int]Address),
+			users:           make(map[int]User),
+			carts:           make(map[int]Cart),
+			cartItems:       make(map[int]CartItem),
+			promotions:      make(map[int]Promotion),
+			plans:           make(map[int]Plan),
+			subscriptions:   make(map[int]Subscription),
+			trialReminders:  make(map[int]time.Time),
+			refunds:         make(map[int]Refund),
+			events:          make(map[string]StripeEvent),
+			idempotencyKeys: make(map[int]IdempotentRequest),
+			reconciliations: make(map[int]Reconciliation),
+			twoFactor:       make(map[int]TwoFactor),
+			rateLimitLocks:  make(map[string]memoryRateLimitLock),
+		},
+	}
+}
+
+func cloneMap[K comparable, V any](m map[K]V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// copy of the tables, rows are values so they are not shared
+func (d *memoryData) clone() *memoryData {
+	return &memoryData{
+		seq:             cloneMap(d.seq),
+		widgets:         cloneMap(d.widgets),
+		widgetPrices:    cloneMap(d.widgetPrices),
+		reservations:    append([]memoryReservation(nil), d.reservations...),
+		transactions:    cloneMap(d.transactions),
+		orders:          cloneMap(d.orders),
+		restocked:       cloneMap(d.restocked),
+		customers:       cloneMap(d.customers),
+		addresses:       cloneMap(d.addresses),
+		users:           cloneMap(d.users),
+		tokens:          append([]memoryToken(nil), d.tokens...),
+		customerTokens:  append([]memoryToken(nil), d.customerTokens...),
+		carts:           cloneMap(d.carts),
+		cartItems:       cloneMap(d.cartItems),
+		promotions:      cloneMap(d.promotions),
+		plans:           cloneMap(d.plans),
+		subscriptions:   cloneMap(d.subscriptions),
+		trialReminders:  cloneMap(d.trialReminders),
+		refunds:         cloneMap(d.refunds),
+		events:          cloneMap(d.events),
+		idempotencyKeys: cloneMap(d.idempotencyKeys),
+		reconciliations: cloneMap(d.reconciliations),
+		auditLog:        append([]AuditEntry(nil), d.auditLog...),
+		twoFactor:       cloneMap(d.twoFactor),
+		recoveryCodes:   append([]memoryRecoveryCode(nil), d.recoveryCodes...),
+		rateLimitHits:   append([]memoryRateLimitHit(nil), d.rateLimitHits...),
+		rateLimitLocks:  cloneMap(d.rateLimitLocks),
+	}
+}
+
+// next id of a table
+func (d *memoryData) next(table string) int {
+	d.seq[table]++
+	return d.seq[table]
+}
+
+// lock the store for a query, queries fail like DBModel's once ctx is done
+func (s *MemoryStore) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	return nil
+}
+
+// run fn with a copy of the store that replaces it when fn returns nil, other
+// callers wait until fn returns so fn must only use tx
+func (s *MemoryStore) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	if s.inTx {
+		return fn(s)
+	}
+
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	tx := &MemoryStore{data: s.data.clone(), inTx: true}
+
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	s.data = tx.data
+	return nil
+}
+
+// add a widget to the catalog and return its id
+func (s *MemoryStore) AddWidget(w Widget) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.ID = s.data.next("widgets")
+	w.Currency = ""
+	w.CreatedAt = time.Now()
+	w.UpdatedAt = time.Now()
+	s.data.widgets[w.ID] = w
+
+	return w.ID
+}
+
+// add a plan of a widget added with AddWidget and return its id
+func (s *MemoryStore) AddPlan(p Plan) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.ID = s.data.next("plans")
+	p.Widget = Widget{}
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = time.Now()
+	s.data.plans[p.ID] = p
+
+	return p.ID
+}
+
+// the transaction with the given id, false when there is none
+func (s *MemoryStore) Transaction(id int) (Transaction, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	txn, ok := s.data.transactions[id]
+	return txn, ok
+}
+
+func (d *memoryData) widget(id int) (Widget, error) {
+	w, ok := d.widgets[id]
+	if !ok {
+		return w, sql.ErrNoRows
+	}
+	w.Currency = DefaultCurrency
+	return w, nil
+}
+
+func (d *memoryData) widgetPrice(widget Widget, currency string) (int, error) {
+	currency = strings.ToLower(currency)
+
+	p, ok := d.widgetPrices[widgetPriceKey{widget.ID, currency}]
+	if !ok {
+		if currency == DefaultCurrency {
+			return widget.Price, nil
+		}
+		return 0, &NotPricedError{WidgetName: widget.Name, Currency: currency}
+	}
+
+	return p.Price, nil
+}
+
+func (d *memoryData) widgetInCurrency(id int, currency string) (Widget, error) {
+	widget, err := d.widget(id)
+	if err != nil {
+		return widget, err
+	}
+
+	price, err := d.widgetPrice(widget, currency)
+	if err != nil {
+		return widget, err
+	}
+
+	widget.Price = price
+	widget.Currency = strings.ToLower(currency)
+
+	return widget, nil
+}
+
+func (s *MemoryStore) GetWidget(ctx context.Context, id int) (Widget, error) {
+	if err := s.lock(ctx); err != nil {
+		return Widget{}, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.widget(id)
+}
+
+func (s *MemoryStore) GetWidgetInCurrency(ctx context.Context, id int, currency string) (Widget, error) {
+	if err := s.lock(ctx); err != nil {
+		return Widget{}, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.widgetInCurrency(id, currency)
+}
+
+func (s *MemoryStore) GetWidgetPrices(ctx context.Context, widgetID int) ([]WidgetPrice, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	var prices []WidgetPrice
+	for _, p := range s.data.widgetPrices {
+		if p.WidgetID == widgetID {
+			prices = append(prices, p)
+		}
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].Currency < prices[j].Currency })
+
+	return prices, nil
+}
+
+func (s *MemoryStore) SetWidgetPrice(ctx context.Context, widgetID int, currency string, price int) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	key := widgetPriceKey{widgetID, strings.ToLower(currency)}
+
+	p, ok := s.data.widgetPrices[key]
+	if !ok {
+		p = WidgetPrice{ID: s.data.next("widget_prices"), WidgetID: widgetID, Currency: key.currency, CreatedAt: time.Now()}
+	}
+	p.Price = price
+	p.UpdatedAt = time.Now()
+	s.data.widgetPrices[key] = p
+
+	return nil
+}
+
+func (s *MemoryStore) QuoteItems(ctx context.Context, items []OrderItem, currency string) (Quote, error) {
+	if err := s.lock(ctx); err != nil {
+		return Quote{}, err
+	}
+	defer s.mu.Unlock()
+
+	return quoteItems(items, currency, s.data.widgetInCurrency)
+}
+
+// stock of a widget not held by an unexpired reservation
+func (d *memoryData) availableStock(widgetID int) (Widget, int, error) {
+	w, err := d.widget(widgetID)
+	if err != nil {
+		return w, 0, err
+	}
+
+	reserved := 0
+	for _, r := range d.reservations {
+		if r.widgetID == widgetID && r.expiresAt.After(time.Now()) {
+			reserved += r.quantity
+		}
+	}
+
+	return w, w.InventoryLevel - reserved, nil
+}
+
+func (s *MemoryStore) AvailableStock(ctx context.Context, widgetID int) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	_, available, err := s.data.availableStock(widgetID)
+	return available, err
+}
+
+func (s *MemoryStore) CheckStock(ctx context.Context, items []OrderItem) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	for _, item := range items {
+		w, available, err := s.data.availableStock(item.WidgetID)
+		if err != nil {
+			return err
+		}
+
+		if !w.IsRecurring && item.Quantity > available {
+			return &OutOfStockError{WidgetID: w.ID, WidgetName: w.Name, Available: available}
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) ReserveStock(ctx context.Context, pi string, items []OrderItem, ttl time.Duration) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	// nothing is reserved unless every item is
+	n := len(s.data.reservations)
+
+	for _, item := range items {
+		w, available, err := s.data.availableStock(item.WidgetID)
+		if err != nil {
+			s.data.reservations = s.data.reservations[:n]
+			return err
+		}
+
+		if w.IsRecurring {
+			continue
+		}
+
+		if item.Quantity > available {
+			s.data.reservations = s.data.reservations[:n]
+			return &OutOfStockError{WidgetID: w.ID, WidgetName: w.Name, Available: available}
+		}
+
+		s.data.reservations = append(s.data.reservations, memoryReservation{
+			paymentIntent: pi,
+			widgetID:      item.WidgetID,
+			quantity:      item.Quantity,
+			expiresAt:     time.Now().Add(ttl),
+		})
+	}
+
+	return nil
+}
+
+// drop the reservations keep returns false for, returns how many were dropped
+func (d *memoryData) dropReservations(keep func(r memoryReservation) bool) int {
+	var kept []memoryReservation
+	for _, r := range d.reservations {
+		if keep(r) {
+			kept = append(kept, r)
+		}
+	}
+
+	n := len(d.reservations) - len(kept)
+	d.reservations = kept
+
+	return n
+}
+
+func (s *MemoryStore) ReleaseStock(ctx context.Context, pi string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	s.data.dropReservations(func(r memoryReservation) bool { return r.paymentIntent != pi })
+
+	return nil
+}
+
+func (s *MemoryStore) CommitStock(ctx context.Context, pi string, items []OrderItem) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	for _, item := range items {
+		s.data.addStock(item.WidgetID, -item.Quantity)
+	}
+
+	s.data.dropReservations(func(r memoryReservation) bool { return r.paymentIntent != pi })
+
+	return nil
+}
+
+// change the stock of a widget, subscriptions are not stocked
+func (d *memoryData) addStock(widgetID, quantity int) {
+	w, ok := d.widgets[widgetID]
+	if !ok || w.IsRecurring {
+		return
+	}
+
+	w.InventoryLevel += quantity
+	w.UpdatedAt = time.Now()
+	d.widgets[widgetID] = w
+}
+
+func (s *MemoryStore) ReleaseExpiredReservations(ctx context.Context) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	n := s.data.dropReservations(func(r memoryReservation) bool { return r.expiresAt.After(now) })
+
+	return n, nil
+}
+
+func (d *memoryData) restockOrder(orderID int) bool {
+	o, ok := d.orders[orderID]
+	if !ok || d.restocked[orderID] {
+		return false
+	}
+
+	for _, item := range o.Items {
+		d.addStock(item.WidgetID, item.Quantity)
+	}
+	d.restocked[orderID] = true
+
+	return true
+}
+
+func (s *MemoryStore) RestockOrder(ctx context.Context, orderID int) (bool, error) {
+	if err := s.lock(ctx); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.restockOrder(orderID), nil
+}
+
+func (s *MemoryStore) RestockOrdersByPaymentIntent(ctx context.Context, pi string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	for id, o := range s.data.orders {
+		if s.data.transactions[o.TransactionID].PaymentIntent == pi {
+			s.data.restockOrder(id)
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) InsertOrder(ctx context.Context, order Order) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	d := s.data
+
+	order.ID = d.next("orders")
+	order.CreatedAt = time.Now()
+	order.UpdatedAt = time.Now()
+
+	items := make([]OrderItem, len(order.Items))
+	for i, item := range order.Items {
+		item.ID = d.next("order_items")
+		item.OrderID = order.ID
+		item.Discount = 0
+		item.CreatedAt = time.Now()
+		item.UpdatedAt = time.Now()
+		item.Widget = Widget{}
+		items[i] = item
+	}
+	order.Items = items
+
+	taxes := make([]OrderTax, len(order.Taxes))
+	for i, t := range order.Taxes {
+		t.ID = d.next("order_taxes")
+		t.OrderID = order.ID
+		t.CreatedAt = time.Now()
+		taxes[i] = t
+	}
+	order.Taxes = taxes
+
+	for kind, a := range map[string]*Address{AddressBilling: &order.BillingAddress, AddressShipping: &order.ShippingAddress} {
+		if a.IsZero() {
+			*a = Address{}
+			continue
+		}
+		a.ID = d.next("order_addresses")
+		a.CustomerID = 0
+		a.Kind = kind
+		a.CreatedAt = time.Now()
+		a.UpdatedAt = time.Time{}
+	}
+
+	order.Widget, order.Transaction, order.Customer = Widget{}, Transaction{}, Customer{}
+	order.Status, order.Plan, order.Refunds = Status{}, Plan{}, nil
+	d.orders[order.ID] = order
+
+	return order.ID, nil
+}
+
+// an order as the list queries return it, with its widget, transaction, customer and status
+func (d *memoryData) listedOrder(o Order) *Order {
+	o.Widget = d.widgets[o.WidgetID]
+	o.Transaction = d.transactions[o.TransactionID]
+	o.Customer = d.customers[o.CustomerID]
+	o.Customer.Password = ""
+	o.Status = Status{ID: o.StatusID, Name: statusNames[o.StatusID]}
+	o.PromotionOverused = false
+	o.Items, o.Taxes = nil, nil
+	o.BillingAddress, o.ShippingAddress = Address{}, Address{}
+
+	return &o
+}
+
+// orders match returns true for, newest first
+func (d *memoryData) findOrders(match func(o Order) bool) []*Order {
+	var orders []*Order
+	for _, o := range d.orders {
+		if match(o) {
+			orders = append(orders, d.listedOrder(o))
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].CreatedAt.Equal(orders[j].CreatedAt) {
+			return orders[i].CreatedAt.After(orders[j].CreatedAt)
+		}
+		return orders[i].ID > orders[j].ID
+	})
+
+	return orders
+}
+
+func (d *memoryData) orderItems(orderID int) []OrderItem {
+	var items []OrderItem
+	for _, item := range d.orders[orderID].Items {
+		w := d.widgets[item.WidgetID]
+		item.Widget = Widget{ID: w.ID, Name: w.Name}
+		items = append(items, item)
+	}
+	return items
+}
+
+func (d *memoryData) orderRefunds(orderID int) []Refund {
+	var refunds []Refund
+	for _, r := range d.refunds {
+		if r.OrderID == orderID {
+			u := d.users[r.UserID]
+			r.User = User{ID: r.UserID, FirstName: u.FirstName, LastName: u.LastName, Email: u.Email}
+			refunds = append(refunds, r)
+		}
+	}
+
+	sort.Slice(refunds, func(i, j int) bool {
+		if !refunds[i].CreatedAt.Equal(refunds[j].CreatedAt) {
+			return refunds[i].CreatedAt.Before(refunds[j].CreatedAt)
+		}
+		return refunds[i].ID < refunds[j].ID
+	})
+
+	return refunds
+}
+
+func (s *MemoryStore) GetOrderByID(ctx context.Context, orderID int) (Order, error) {
+	if err := s.lock(ctx); err != nil {
+		return Order{}, err
+	}
+	defer s.mu.Unlock()
+
+	d := s.data
+
+	stored, ok := d.orders[orderID]
+	if !ok {
+		return Order{}, sql.ErrNoRows
+	}
+
+	o := *d.listedOrder(stored)
+	if p, ok := d.plans[o.PlanID]; ok {
+		o.Plan = Plan{ID: p.ID, Name: p.Name, Interval: p.Interval}
+	}
+	o.Items = d.orderItems(o.ID)
+	o.Taxes = stored.Taxes
+	o.BillingAddress, o.ShippingAddress = stored.BillingAddress, stored.ShippingAddress
+	o.PromotionOverused = stored.PromotionOverused
+	o.Refunds = d.orderRefunds(o.ID)
+
+	return o, nil
+}
+
+func (s *MemoryStore) GetOrderItems(ctx context.Context, orderID int) ([]OrderItem, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.orderItems(orderID), nil
+}
+
+func (s *MemoryStore) GetOrderTaxes(ctx context.Context, orderID int) ([]OrderTax, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.orders[orderID].Taxes, nil
+}
+
+func (s *MemoryStore) GetOrderAddresses(ctx context.Context, orderID int) (Address, Address, error) {
+	if err := s.lock(ctx); err != nil {
+		return Address{}, Address{}, err
+	}
+	defer s.mu.Unlock()
+
+	o := s.data.orders[orderID]
+
+	return o.BillingAddress, o.ShippingAddress, nil
+}
+
+func (s *MemoryStore) GetAllOrders(ctx context.Context, isRecurring int) ([]*Order, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.findOrders(s.data.recurring(isRecurring)), nil
+}
+
+// match the orders of widgets sold as subscriptions when isRecurring is 1
+func (d *memoryData) recurring(isRecurring int) func(o Order) bool {
+	return func(o Order) bool {
+		w, ok := d.widgets[o.WidgetID]
+		return ok && w.IsRecurring == (isRecurring == 1)
+	}
+}
+
+// a page of rows, the last page and the number of rows
+func paginate[T any](rows []*T, pageSize, page int) ([]*T, int, int) {
+	total := len(rows)
+
+	lastPage := total / pageSize
+	if total%pageSize != 0 {
+		lastPage += 1
+	}
+
+	from := (page - 1) * pageSize
+	if from < 0 || from > total {
+		from = total
+	}
+	to := from + pageSize
+	if to > total {
+		to = total
+	}
+
+	return rows[from:to], lastPage, total
+}
+
+func (s *MemoryStore) GetAllOrdersPaginated(ctx context.Context, pageSize, page, isRecurring int) ([]*Order, int, int, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, 0, 0, err
+	}
+	defer s.mu.Unlock()
+
+	orders, lastPage, total := paginate(s.data.findOrders(s.data.recurring(isRecurring)), pageSize, page)
+
+	return orders, lastPage, total, nil
+}
+
+func (s *MemoryStore) UpdateOrderStatus(ctx context.Context, id, statusID int) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if o, ok := s.data.orders[id]; ok {
+		o.StatusID = statusID
+		s.data.orders[id] = o
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateOrderStatusByPaymentIntent(ctx context.Context, pi string, statusID int) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, o := range s.data.orders {
+		if s.data.transactions[o.TransactionID].PaymentIntent == pi {
+			o.StatusID = statusID
+			o.UpdatedAt = time.Now()
+			s.data.orders[id] = o
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) GetOrderIDByPaymentIntent(ctx context.Context, pi string) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	id := 0
+	for _, o := range s.data.orders {
+		if s.data.transactions[o.TransactionID].PaymentIntent == pi && (id == 0 || o.ID < id) {
+			id = o.ID
+		}
+	}
+	if id == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	return id, nil
+}
+
+func (s *MemoryStore) GetTaxReport(ctx context.Context, from, to time.Time) ([]TaxReportLine, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	type key struct {
+		jurisdiction, name string
+		rate               float64
+		currency           string
+	}
+
+	lines := make(map[key]*TaxReportLine)
+	for _, o := range s.data.orders {
+		if o.CreatedAt.Before(from) || !o.CreatedAt.Before(to) || o.StatusID == StatusRefunded || o.StatusID == StatusCancelled {
+			continue
+		}
+
+		currency := s.data.transactions[o.TransactionID].Currency
+		counted := make(map[key]bool)
+		for _, t := range o.Taxes {
+			k := key{t.Jurisdiction, t.Name, t.Rate, currency}
+			l, ok := lines[k]
+			if !ok {
+				l = &TaxReportLine{Jurisdiction: t.Jurisdiction, Name: t.Name, Rate: t.Rate, Currency: currency}
+				lines[k] = l
+			}
+			if !counted[k] {
+				l.Orders++
+				counted[k] = true
+			}
+			l.Taxable += t.Taxable
+			l.Amount += t.Amount
+		}
+	}
+
+	var report []TaxReportLine
+	for _, l := range lines {
+		report = append(report, *l)
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		a, b := report[i], report[j]
+		if a.Jurisdiction != b.Jurisdiction {
+			return a.Jurisdiction < b.Jurisdiction
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Currency != b.Currency {
+			return a.Currency < b.Currency
+		}
+		return a.Rate < b.Rate
+	})
+
+	return report, nil
+}
+
+func (d *memoryData) userByEmail(email string) (User, error) {
+	for _, u := range d.users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return User{}, sql.ErrNoRows
+}
+
+func (s *MemoryStore) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	if err := s.lock(ctx); err != nil {
+		return User{}, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.userByEmail(email)
+}
+
+func (s *MemoryStore) Authenticate(ctx context.Context, email, password string) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	u, err := s.data.userByEmail(email)
+	if err != nil {
+		return 0, err
+	}
+
+	err = checkPassword(u.Password, password)
+	if err != nil {
+		return 0, err
+	}
+
+	return u.ID, nil
+}
+
+func (s *MemoryStore) UpdatePasswordForUser(ctx context.Context, u User, hash string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if existing, ok := s.data.users[u.ID]; ok {
+		existing.Password = hash
+		s.data.users[u.ID] = existing
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) GetAllUsers(ctx context.Context) ([]*User, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	var users []*User
+	for _, u := range s.data.users {
+		u.Password = ""
+		users = append(users, &u)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].LastName != users[j].LastName {
+			return users[i].LastName < users[j].LastName
+		}
+		return users[i].FirstName < users[j].FirstName
+	})
+
+	return users, nil
+}
+
+func (s *MemoryStore) GetOneUser(ctx context.Context, id int) (User, error) {
+	if err := s.lock(ctx); err != nil {
+		return User{}, err
+	}
+	defer s.mu.Unlock()
+
+	u, ok := s.data.users[id]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	u.Password = ""
+
+	return u, nil
+}
+
+// users are unique by email like the users table
+func (d *memoryData) checkUserEmail(id int, email string) error {
+	if u, err := d.userByEmail(email); err == nil && u.ID != id {
+		return fmt.Errorf("duplicate email %s", email)
+	}
+	return nil
+}
+
+func (s *MemoryStore) EditUser(ctx context.Context, u User) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	existing, ok := s.data.users[u.ID]
+	if !ok {
+		return nil
+	}
+
+	if err := s.data.checkUserEmail(u.ID, u.Email); err != nil {
+		return err
+	}
+
+	existing.FirstName = u.FirstName
+	existing.LastName = u.LastName
+	existing.Email = u.Email
+	existing.Role = u.Role
+	existing.UpdatedAt = time.Now()
+	s.data.users[u.ID] = existing
+
+	return nil
+}
+
+func (s *MemoryStore) AddUser(ctx context.Context, u User, hash string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if err := s.data.checkUserEmail(0, u.Email); err != nil {
+		return err
+	}
+
+	u.ID = s.data.next("users")
+	u.Password = hash
+	u.TwoFactorEnabled = false
+	u.CreatedAt = time.Now()
+	u.UpdatedAt = time.Now()
+	s.data.users[u.ID] = u
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteUser(ctx context.Context, id int) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	delete(s.data.users, id)
+	s.data.tokens = dropTokens(s.data.tokens, func(t memoryToken) bool { return t.ownerID == id })
+	delete(s.data.twoFactor, id)
+	s.data.dropRecoveryCodes(id)
+
+	// refunds keep their amount but forget who made them
+	for rid, r := range s.data.refunds {
+		if r.UserID == id {
+			r.UserID = 0
+			s.data.refunds[rid] = r
+		}
+	}
+
+	return nil
+}
+
+func dropTokens(tokens []memoryToken, drop func(t memoryToken) bool) []memoryToken {
+	var kept []memoryToken
+	for _, t := range tokens {
+		if !drop(t) {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// owner of an unexpired token
+// the index of an unexpired token
+func findToken(tokens []memoryToken, token string) (int, bool) {
+	hash := sha256.Sum256([]byte(token))
+
+	for i, t := range tokens {
+		if t.hash == string(hash[:]) && t.expiry.After(time.Now()) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (s *MemoryStore) InsertToken(ctx context.Context, t *Token, u User) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	tokens := dropTokens(s.data.tokens, func(existing memoryToken) bool {
+		return existing.ownerID == u.ID && existing.expiry.Before(time.Now())
+	})
+
+	t.ID = s.data.next("tokens")
+	t.CreatedAt = time.Now()
+	s.data.tokens = append(tokens, memoryToken{
+		ownerID:   u.ID,
+		hash:      string(t.Hash),
+		expiry:    t.Expiry,
+		id:        t.ID,
+		name:      t.Name,
+		scope:     t.Scope,
+		createdAt: t.CreatedAt,
+	})
+
+	return nil
+}
+
+func (s *MemoryStore) GetUserForToken(ctx context.Context, token string) (*User, *Token, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer s.mu.Unlock()
+
+	i, ok := findToken(s.data.tokens, token)
+	if !ok || s.data.tokens[i].scope == ScopeLoginChallenge {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	u, ok := s.data.users[s.data.tokens[i].ownerID]
+	if !ok {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	if now := time.Now(); now.Sub(s.data.tokens[i].lastUsed) > time.Minute {
+		s.data.tokens[i].lastUsed = now
+	}
+	t := s.data.tokens[i].token()
+
+	return &User{ID: u.ID, FirstName: u.FirstName, LastName: u.LastName, Email: u.Email, Role: u.Role, TwoFactorEnabled: u.TwoFactorEnabled}, &t, nil
+}
+
+func (s *MemoryStore) GetTokensForUser(ctx context.Context, userID int) ([]Token, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	var tokens []Token
+	for i := len(s.data.tokens) - 1; i >= 0; i-- {
+		t := s.data.tokens[i]
+		if t.ownerID == userID && t.expiry.After(time.Now()) && t.scope != ScopeLoginChallenge {
+			tokens = append(tokens, t.token())
+		}
+	}
+
+	return tokens, nil
+}
+
+func (s *MemoryStore) UseLoginChallenge(ctx context.Context, token string) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	i, ok := findToken(s.data.tokens, token)
+	if !ok || s.data.tokens[i].scope != ScopeLoginChallenge {
+		return 0, sql.ErrNoRows
+	}
+
+	userID := s.data.tokens[i].ownerID
+	s.data.tokens = append(s.data.tokens[:i:i], s.data.tokens[i+1:]...)
+
+	return userID, nil
+}
+
+func (s *MemoryStore) DeleteToken(ctx context.Context, userID, id int) (bool, error) {
+	if err := s.lock(ctx); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+
+	n := len(s.data.tokens)
+	s.data.tokens = dropTokens(s.data.tokens, func(t memoryToken) bool { return t.ownerID == userID && t.id == id })
+
+	return len(s.data.tokens) < n, nil
+}
+
+func (s *MemoryStore) InsertCustomerToken(ctx context.Context, t *Token, c Customer) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	tokens := dropTokens(s.data.customerTokens, func(existing memoryToken) bool {
+		return existing.ownerID == c.ID && existing.expiry.Before(time.Now())
+	})
+	s.data.customerTokens = append(tokens, memoryToken{ownerID: c.ID, hash: string(t.Hash), expiry: t.Expiry})
+
+	return nil
+}
+
+func (s *MemoryStore) GetCustomerForToken(ctx context.Context, token string) (*Customer, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	i, ok := findToken(s.data.customerTokens, token)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	id := s.data.customerTokens[i].ownerID
+
+	c, ok := s.data.customers[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &Customer{ID: c.ID, FirstName: c.FirstName, LastName: c.LastName, Email: c.Email, StripeCustomerID: c.StripeCustomerID}, nil
+}
+
+func (s *MemoryStore) DeleteCustomerToken(ctx context.Context, token string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	hash := sha256.Sum256([]byte(token))
+	s.data.customerTokens = dropTokens(s.data.customerTokens, func(t memoryToken) bool { return t.hash == string(hash[:]) })
+
+	return nil
+}
+
+func (s *MemoryStore) GetCustomer(ctx context.Context, id int) (Customer, error) {
+	if err := s.lock(ctx); err != nil {
+		return Customer{}, err
+	}
+	defer s.mu.Unlock()
+
+	c, ok := s.data.customers[id]
+	if !ok {
+		return c, sql.ErrNoRows
+	}
+
+	return c, nil
+}
+
+// the oldest customer with an email
+func (d *memoryData) customerByEmail(email string) (Customer, error) {
+	email = NormalizeEmail(email)
+
+	var found Customer
+	for _, c := range d.customers {
+		if strings.EqualFold(c.Email, email) && (found.ID == 0 || c.ID < found.ID) {
+			found = c
+		}
+	}
+
+	if found.ID == 0 {
+		return found, sql.ErrNoRows
+	}
+	return found, nil
+}
+
+func (d *memoryData) insertCustomer(c Customer) int {
+	c.ID = d.next("customers")
+	c.Email = NormalizeEmail(c.Email)
+	c.Password = ""
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = time.Now()
+	d.customers[c.ID] = c
+
+	return c.ID
+}
+
+func (s *MemoryStore) GetCustomerByEmail(ctx context.Context, email string) (Customer, error) {
+	if err := s.lock(ctx); err != nil {
+		return Customer{}, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.customerByEmail(email)
+}
+
+func (s *MemoryStore) InsertCustomer(ctx context.Context, c Customer) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	if _, err := s.data.customerByEmail(c.Email); err == nil {
+		return 0, fmt.Errorf("duplicate email %s", NormalizeEmail(c.Email))
+	}
+
+	return s.data.insertCustomer(c), nil
+}
+
+func (s *MemoryStore) GetOrInsertCustomer(ctx context.Context, c Customer) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	existing, err := s.data.customerByEmail(c.Email)
+	if err == nil {
+		return existing.ID, nil
+	}
+
+	return s.data.insertCustomer(c), nil
+}
+
+// apply change to a customer if it exists
+func (d *memoryData) updateCustomer(id int, change func(c *Customer)) {
+	c, ok := d.customers[id]
+	if !ok {
+		return
+	}
+
+	change(&c)
+	c.UpdatedAt = time.Now()
+	d.customers[id] = c
+}
+
+func (s *MemoryStore) UpdateCustomerStripeID(ctx context.Context, id int, stripeCustomerID string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	s.data.updateCustomer(id, func(c *Customer) { c.StripeCustomerID = stripeCustomerID })
+
+	return nil
+}
+
+func (s *MemoryStore) UpdatePasswordForCustomer(ctx context.Context, c Customer, hash string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	s.data.updateCustomer(c.ID, func(c *Customer) { c.Password = hash })
+
+	return nil
+}
+
+func (s *MemoryStore) AuthenticateCustomer(ctx context.Context, email, password string) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	c, err := s.data.customerByEmail(email)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.Password == "" {
+		return 0, errors.New("no password set")
+	}
+
+	err = checkPassword(c.Password, password)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.ID, nil
+}
+
+func (s *MemoryStore) GetCustomerOrders(ctx context.Context, customerID int) ([]*Order, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.findOrders(func(o Order) bool { return o.CustomerID == customerID }), nil
+}
+
+func (s *MemoryStore) GetDuplicateCustomers(ctx context.Context) ([]DuplicateCustomers, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	ids := make(map[string][]int)
+	for _, c := range s.data.customers {
+		email := NormalizeEmail(c.Email)
+		ids[email] = append(ids[email], c.ID)
+	}
+
+	var duplicates []DuplicateCustomers
+	for email, customers := range ids {
+		if len(customers) < 2 {
+			continue
+		}
+
+		sort.Ints(customers)
+		duplicates = append(duplicates, DuplicateCustomers{Email: email, Keep: customers[0], IDs: customers[1:]})
+	}
+
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].Email < duplicates[j].Email })
+
+	return duplicates, nil
+}
+
+func (s *MemoryStore) MergeCustomers(ctx context.Context, keepID int, ids []int) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	d := s.data
+
+	// newest first, so its stripe customer and password are the ones kept
+	for i := len(ids) - 1; i >= 0; i-- {
+		id := ids[i]
+		if id == keepID {
+			continue
+		}
+
+		for oid, o := range d.orders {
+			if o.CustomerID == id {
+				o.CustomerID = keepID
+				d.orders[oid] = o
+			}
+		}
+
+		for aid, a := range d.addresses {
+			if a.CustomerID == id {
+				a.CustomerID = keepID
+				d.addresses[aid] = a
+			}
+		}
+
+		for sid, sub := range d.subscriptions {
+			if sub.CustomerID == id {
+				sub.CustomerID = keepID
+				d.subscriptions[sid] = sub
+			}
+		}
+
+		if duplicate, ok := d.customers[id]; ok {
+			d.updateCustomer(keepID, func(c *Customer) {
+				if c.StripeCustomerID == "" {
+					c.StripeCustomerID = duplicate.StripeCustomerID
+				}
+				if c.Password == "" {
+					c.Password = duplicate.Password
+				}
+			})
+		}
+
+		delete(d.customers, id)
+		d.customerTokens = dropTokens(d.customerTokens, func(t memoryToken) bool { return t.ownerID == id })
+	}
+
+	d.updateCustomer(keepID, func(c *Customer) { c.Email = NormalizeEmail(c.Email) })
+
+	return nil
+}
+
+func (s *MemoryStore) InsertAddress(ctx context.Context, a Address) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	a.ID = s.data.next("addresses")
+	a.CreatedAt = time.Now()
+	a.UpdatedAt = time.Now()
+	s.data.addresses[a.ID] = a
+
+	return a.ID, nil
+}
+
+func (s *MemoryStore) GetCustomerAddresses(ctx context.Context, customerID int) ([]Address, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	var addresses []Address
+	for _, a := range s.data.addresses {
+		if a.CustomerID == customerID {
+			addresses = append(addresses, a)
+		}
+	}
+
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i].ID > addresses[j].ID })
+
+	return addresses, nil
+}
+
+func (s *MemoryStore) InsertTransaction(ctx context.Context, txn Transaction) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	for _, t := range s.data.transactions {
+		if t.PaymentIntent == txn.PaymentIntent {
+			return 0, fmt.Errorf("duplicate payment intent %s", txn.PaymentIntent)
+		}
+	}
+
+	txn.ID = s.data.next("transactions")
+	txn.CreatedAt = time.Now()
+	txn.UpdatedAt = time.Now()
+	s.data.transactions[txn.ID] = txn
+
+	return txn.ID, nil
+}
+
+func (s *MemoryStore) UpdateTransactionStatusByPaymentIntent(ctx context.Context, pi string, statusID int) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, txn := range s.data.transactions {
+		if txn.PaymentIntent == pi {
+			txn.TransactionStatusID = statusID
+			txn.UpdatedAt = time.Now()
+			s.data.transactions[id] = txn
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) DeclineTransactionsByPaymentIntent(ctx context.Context, pi string, before time.Time) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, txn := range s.data.transactions {
+		if txn.PaymentIntent == pi && txn.UpdatedAt.Before(before) {
+			txn.TransactionStatusID = TransactionStatusDeclined
+			txn.UpdatedAt = time.Now()
+			s.data.transactions[id] = txn
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) UpdateTransactionCard(ctx context.Context, id int, pm, lastFour string, expiryMonth, expiryYear int) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	txn, ok := s.data.transactions[id]
+	if !ok {
+		return nil
+	}
+
+	txn.PaymentMethod = pm
+	txn.LastFour = lastFour
+	txn.ExpiryMonth = expiryMonth
+	txn.ExpiryYear = expiryYear
+	txn.UpdatedAt = time.Now()
+	s.data.transactions[id] = txn
+
+	return nil
+}
+
+func (s *MemoryStore) GetOrderRefunds(ctx context.Context, orderID int) ([]Refund, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.orderRefunds(orderID), nil
+}
+
+// the refund recorded for a stripe refund id
+func (d *memoryData) refundByStripeID(id string) (Refund, bool) {
+	if id == "" {
+		return Refund{}, false
+	}
+	for _, r := range d.refunds {
+		if r.StripeRefundID == id {
+			return r, true
+		}
+	}
+	return Refund{}, false
+}
+
+func (d *memoryData) refundableAmount(transactionID int) (int, error) {
+	txn, ok := d.transactions[transactionID]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	refundable := txn.Amount
+	for _, r := range d.refunds {
+		if r.TransactionID == transactionID {
+			refundable -= r.Amount
+		}
+	}
+
+	return refundable, nil
+}
+
+func (s *MemoryStore) GetRefundableAmount(ctx context.Context, transactionID int) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.refundableAmount(transactionID)
+}
+
+func (s *MemoryStore) InsertRefund(ctx context.Context, r Refund) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	d := s.data
+
+	txn, ok := d.transactions[r.TransactionID]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	r.User = User{}
+
+	existing, ok := d.refundByStripeID(r.StripeRefundID)
+	switch {
+	case !ok:
+		r.ID = d.next("refunds")
+		r.CreatedAt = time.Now()
+		r.UpdatedAt = time.Now()
+		d.refunds[r.ID] = r
+	case r.UserID > 0:
+		existing.UserID, existing.Reason, existing.Note = r.UserID, r.Reason, r.Note
+		d.refunds[existing.ID] = existing
+	}
+
+	refundable, err := d.refundableAmount(r.TransactionID)
+	if err != nil {
+		return 0, err
+	}
+
+	txnStatus, orderStatus := TransactionStatusPartiallyRefunded, StatusPartiallyRefunded
+	if refundable <= 0 {
+		txnStatus, orderStatus = TransactionStatusRefunded, StatusRefunded
+	}
+
+	txn.TransactionStatusID = txnStatus
+	txn.UpdatedAt = time.Now()
+	d.transactions[txn.ID] = txn
+
+	if o, ok := d.orders[r.OrderID]; ok {
+		o.StatusID = orderStatus
+		o.UpdatedAt = time.Now()
+		d.orders[o.ID] = o
+	}
+
+	return refundable, nil
+}
+
+func (s *MemoryStore) InsertReconciliation(ctx context.Context, r Reconciliation) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	r.ID = s.data.next("reconciliations")
+	r.ResolvedAt = time.Time{}
+	r.CreatedAt = time.Now()
+	r.UpdatedAt = time.Now()
+	s.data.reconciliations[r.ID] = r
+
+	return r.ID, nil
+}
+
+func (s *MemoryStore) CreateCart(ctx context.Context) (Cart, error) {
+	if err := s.lock(ctx); err != nil {
+		return Cart{}, err
+	}
+	defer s.mu.Unlock()
+
+	var cart Cart
+
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return cart, err
+	}
+
+	cart.ID = s.data.next("carts")
+	cart.Token = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	cart.CreatedAt = time.Now()
+	cart.UpdatedAt = time.Now()
+	s.data.carts[cart.ID] = cart
+
+	return cart, nil
+}
+
+func (s *MemoryStore) GetCartByToken(ctx context.Context, token string) (Cart, error) {
+	if err := s.lock(ctx); err != nil {
+		return Cart{}, err
+	}
+	defer s.mu.Unlock()
+
+	var cart Cart
+	for _, c := range s.data.carts {
+		if c.Token == token {
+			cart = c
+		}
+	}
+	if cart.ID == 0 {
+		return cart, sql.ErrNoRows
+	}
+
+	cart.Currency = DefaultCurrency
+
+	for _, i := range s.data.cartItems {
+		if i.CartID != cart.ID {
+			continue
+		}
+
+		w, err := s.data.widget(i.WidgetID)
+		if err != nil {
+			continue
+		}
+		i.Widget = w
+
+		cart.Items = append(cart.Items, i)
+	}
+
+	sort.Slice(cart.Items, func(i, j int) bool { return cart.Items[i].ID < cart.Items[j].ID })
+
+	return cart, nil
+}
+
+// the line of a widget in a cart
+func (d *memoryData) cartItem(cartID, widgetID int) (CartItem, bool) {
+	for _, i := range d.cartItems {
+		if i.CartID == cartID && i.WidgetID == widgetID {
+			return i, true
+		}
+	}
+	return CartItem{}, false
+}
+
+func (s *MemoryStore) AddCartItem(ctx context.Context, cartID, widgetID, quantity int) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.carts[cartID]; !ok {
+		return fmt.Errorf("cart %d does not exist", cartID)
+	}
+	if _, ok := s.data.widgets[widgetID]; !ok {
+		return fmt.Errorf("widget %d does not exist", widgetID)
+	}
+
+	item, ok := s.data.cartItem(cartID, widgetID)
+	if !ok {
+		item = CartItem{ID: s.data.next("cart_items"), CartID: cartID, WidgetID: widgetID, CreatedAt: time.Now()}
+	}
+	item.Quantity += quantity
+	item.UpdatedAt = time.Now()
+	s.data.cartItems[item.ID] = item
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateCartItem(ctx context.Context, cartID, widgetID, quantity int) error {
+	if quantity < 1 {
+		return s.RemoveCartItem(ctx, cartID, widgetID)
+	}
+
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if item, ok := s.data.cartItem(cartID, widgetID); ok {
+		item.Quantity = quantity
+		item.UpdatedAt = time.Now()
+		s.data.cartItems[item.ID] = item
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) RemoveCartItem(ctx context.Context, cartID, widgetID int) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if item, ok := s.data.cartItem(cartID, widgetID); ok {
+		delete(s.data.cartItems, item.ID)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteCart(ctx context.Context, id int) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	for itemID, i := range s.data.cartItems {
+		if i.CartID == id {
+			delete(s.data.cartItems, itemID)
+		}
+	}
+	delete(s.data.carts, id)
+
+	return nil
+}
+
+func (s *MemoryStore) PriceCart(ctx context.Context, cart *Cart, currency string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	prices := make([]int, len(cart.Items))
+	for i, item := range cart.Items {
+		price, err := s.data.widgetPrice(item.Widget, currency)
+		if err != nil {
+			return err
+		}
+		prices[i] = price
+	}
+
+	for i := range cart.Items {
+		cart.Items[i].Widget.Price = prices[i]
+		cart.Items[i].Widget.Currency = strings.ToLower(currency)
+	}
+	cart.Currency = strings.ToLower(currency)
+
+	return nil
+}
+
+func (d *memoryData) promotionByCode(code string) (Promotion, error) {
+	code = PromotionCode(code)
+
+	for _, p := range d.promotions {
+		if p.Code == code {
+			return p, nil
+		}
+	}
+	return Promotion{}, &PromotionError{Code: code, Reason: "is not valid"}
+}
+
+func (s *MemoryStore) GetPromotionByCode(ctx context.Context, code string) (Promotion, error) {
+	if err := s.lock(ctx); err != nil {
+		return Promotion{}, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.promotionByCode(code)
+}
+
+func (s *MemoryStore) GetPromotion(ctx context.Context, id int) (Promotion, error) {
+	if err := s.lock(ctx); err != nil {
+		return Promotion{}, err
+	}
+	defer s.mu.Unlock()
+
+	p, ok := s.data.promotions[id]
+	if !ok {
+		return p, sql.ErrNoRows
+	}
+
+	return p, nil
+}
+
+func (s *MemoryStore) GetAllPromotions(ctx context.Context) ([]*Promotion, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	var promotions []*Promotion
+	for _, p := range s.data.promotions {
+		p := p
+		promotions = append(promotions, &p)
+	}
+
+	sort.Slice(promotions, func(i, j int) bool { return promotions[i].ID > promotions[j].ID })
+
+	return promotions, nil
+}
+
+func (s *MemoryStore) QuotePromotion(ctx context.Context, q Quote, code string) (Quote, error) {
+	if err := s.lock(ctx); err != nil {
+		return q, err
+	}
+	defer s.mu.Unlock()
+
+	p, err := s.data.promotionByCode(code)
+	if err != nil {
+		return q, err
+	}
+
+	err = p.Usable(time.Now())
+	if err != nil {
+		return q, err
+	}
+
+	return p.Apply(q)
+}
+
+func (s *MemoryStore) InsertPromotion(ctx context.Context, p Promotion) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	p.Code = PromotionCode(p.Code)
+	if _, err := s.data.promotionByCode(p.Code); err == nil {
+		return 0, fmt.Errorf("duplicate promotion code %s", p.Code)
+	}
+
+	p.ID = s.data.next("promotions")
+	p.Currency = strings.ToLower(p.Currency)
+	p.TimesUsed = 0
+	p.Active = true
+	p.StripeCouponID = ""
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = time.Now()
+	s.data.promotions[p.ID] = p
+
+	return p.ID, nil
+}
+
+// apply change to a promotion if it exists
+func (d *memoryData) updatePromotion(id int, change func(p *Promotion)) {
+	p, ok := d.promotions[id]
+	if !ok {
+		return
+	}
+
+	change(&p)
+	p.UpdatedAt = time.Now()
+	d.promotions[id] = p
+}
+
+func (s *MemoryStore) SetPromotionActive(ctx context.Context, id int, active bool) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	s.data.updatePromotion(id, func(p *Promotion) { p.Active = active })
+
+	return nil
+}
+
+func (s *MemoryStore) SetPromotionCoupon(ctx context.Context, id int, couponID string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	s.data.updatePromotion(id, func(p *Promotion) { p.StripeCouponID = couponID })
+
+	return nil
+}
+
+func (s *MemoryStore) RedeemPromotion(ctx context.Context, id int) (bool, error) {
+	if err := s.lock(ctx); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+
+	p, ok := s.data.promotions[id]
+	if !ok {
+		return false, sql.ErrNoRows
+	}
+
+	s.data.updatePromotion(id, func(p *Promotion) { p.TimesUsed++ })
+
+	return p.MaxUses == 0 || p.TimesUsed < p.MaxUses, nil
+}
+
+func (s *MemoryStore) GetPromotionUsage(ctx context.Context, id int) ([]PromotionUsage, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	byCurrency := make(map[string]*PromotionUsage)
+	for _, o := range s.data.orders {
+		if o.PromotionID != id {
+			continue
+		}
+
+		txn, ok := s.data.transactions[o.TransactionID]
+		if !ok {
+			continue
+		}
+
+		u, ok := byCurrency[txn.Currency]
+		if !ok {
+			u = &PromotionUsage{Currency: txn.Currency}
+			byCurrency[txn.Currency] = u
+		}
+		u.Orders++
+		u.Discount += o.Discount
+		u.Revenue += o.Amount
+	}
+
+	var usage []PromotionUsage
+	for _, u := range byCurrency {
+		usage = append(usage, *u)
+	}
+
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Currency < usage[j].Currency })
+
+	return usage, nil
+}
+
+// a plan with its widget priced as the plan
+func (d *memoryData) plan(p Plan) (Plan, bool) {
+	w, ok := d.widgets[p.WidgetID]
+	if !ok {
+		return p, false
+	}
+
+	p.Widget = Widget{
+		ID:          w.ID,
+		Name:        w.Name,
+		Description: w.Description,
+		Image:       w.Image,
+		TaxCategory: w.TaxCategory,
+		IsRecurring: w.IsRecurring,
+		Price:       p.Price,
+		Currency:    p.Currency,
+	}
+
+	return p, true
+}
+
+// the plan with the lowest id match returns true for
+func (d *memoryData) findPlan(match func(p Plan) bool) (Plan, error) {
+	var found Plan
+	for _, p := range d.plans {
+		if match(p) && (found.ID == 0 || p.ID < found.ID) {
+			found = p
+		}
+	}
+
+	p, ok := d.plan(found)
+	if found.ID == 0 || !ok {
+		return Plan{}, sql.ErrNoRows
+	}
+
+	return p, nil
+}
+
+func (s *MemoryStore) GetPlan(ctx context.Context, id int) (Plan, error) {
+	if err := s.lock(ctx); err != nil {
+		return Plan{}, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.findPlan(func(p Plan) bool { return p.ID == id })
+}
+
+func (s *MemoryStore) GetPlanBySlug(ctx context.Context, slug string) (Plan, error) {
+	if err := s.lock(ctx); err != nil {
+		return Plan{}, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.findPlan(func(p Plan) bool { return strings.EqualFold(p.Slug, slug) })
+}
+
+func (s *MemoryStore) GetPlanByStripePrice(ctx context.Context, priceID string) (Plan, error) {
+	if err := s.lock(ctx); err != nil {
+		return Plan{}, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.findPlan(func(p Plan) bool { return p.StripePriceID == priceID })
+}
+
+func (s *MemoryStore) GetActivePlans(ctx context.Context) ([]*Plan, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	var plans []*Plan
+	for _, p := range s.data.plans {
+		if p, ok := s.data.plan(p); ok && p.Active {
+			plans = append(plans, &p)
+		}
+	}
+
+	sort.Slice(plans, func(i, j int) bool {
+		a, b := plans[i], plans[j]
+		if a.Tier != b.Tier {
+			return a.Tier < b.Tier
+		}
+		if (a.Interval == IntervalYear) != (b.Interval == IntervalYear) {
+			return b.Interval == IntervalYear
+		}
+		return a.ID < b.ID
+	})
+
+	return plans, nil
+}
+
+// the subscription created by an order, if any
+func (d *memoryData) orderSubscription(orderID int) (Subscription, bool) {
+	for _, sub := range d.subscriptions {
+		if sub.OrderID == orderID {
+			return sub, true
+		}
+	}
+	return Subscription{}, false
+}
+
+func (s *MemoryStore) GetSubscriptionOrdersPaginated(ctx context.Context, pageSize, page int, filter string) ([]*Order, int, int, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, 0, 0, err
+	}
+	defer s.mu.Unlock()
+
+	d := s.data
+	recurring := d.recurring(1)
+
+	match := recurring
+	switch filter {
+	case SubscriptionFilterTrial:
+		match = func(o Order) bool {
+			sub, ok := d.orderSubscription(o.ID)
+			return recurring(o) && ok && sub.Status == SubscriptionTrialing
+		}
+	case SubscriptionFilterConverted:
+		match = func(o Order) bool {
+			sub, ok := d.orderSubscription(o.ID)
+			return recurring(o) && ok && !sub.TrialEnd.IsZero() && sub.Status == SubscriptionActive
+		}
+	}
+
+	orders, lastPage, total := paginate(d.findOrders(match), pageSize, page)
+
+	return orders, lastPage, total, nil
+}
+
+func (s *MemoryStore) InsertSubscription(ctx context.Context, sub Subscription) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	for _, existing := range s.data.subscriptions {
+		if existing.StripeSubscriptionID == sub.StripeSubscriptionID {
+			return 0, fmt.Errorf("duplicate stripe subscription %s", sub.StripeSubscriptionID)
+		}
+	}
+
+	sub.ID = s.data.next("subscriptions")
+	sub.CreatedAt = time.Now()
+	sub.UpdatedAt = time.Now()
+	sub.Plan = Plan{}
+	s.data.subscriptions[sub.ID] = sub
+
+	return sub.ID, nil
+}
+
+// a subscription with its plan
+func (d *memoryData) subscription(sub Subscription) (Subscription, bool) {
+	p, ok := d.plans[sub.PlanID]
+	if !ok {
+		return sub, false
+	}
+
+	sub.Plan, ok = d.plan(p)
+	return sub, ok
+}
+
+func (d *memoryData) findSubscription(match func(sub Subscription) bool) (Subscription, error) {
+	for _, sub := range d.subscriptions {
+		if match(sub) {
+			if sub, ok := d.subscription(sub); ok {
+				return sub, nil
+			}
+		}
+	}
+	return Subscription{}, sql.ErrNoRows
+}
+
+func (s *MemoryStore) GetSubscription(ctx context.Context, id int) (Subscription, error) {
+	if err := s.lock(ctx); err != nil {
+		return Subscription{}, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.findSubscription(func(sub Subscription) bool { return sub.ID == id })
+}
+
+func (s *MemoryStore) GetSubscriptionByOrderID(ctx context.Context, orderID int) (Subscription, error) {
+	if err := s.lock(ctx); err != nil {
+		return Subscription{}, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.findSubscription(func(sub Subscription) bool { return sub.OrderID == orderID })
+}
+
+func (s *MemoryStore) UpdateSubscriptionState(ctx context.Context, state Subscription) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	d := s.data
+	n := 0
+
+	for id, sub := range d.subscriptions {
+		if sub.StripeSubscriptionID != state.StripeSubscriptionID {
+			continue
+		}
+
+		if state.PlanID > 0 {
+			sub.PlanID = state.PlanID
+		}
+		// an extended trial gets a reminder again
+		if !sub.TrialEnd.Equal(state.TrialEnd) {
+			delete(d.trialReminders, id)
+		}
+
+		sub.Status = state.Status
+		sub.CurrentPeriodStart = state.CurrentPeriodStart
+		sub.CurrentPeriodEnd = state.CurrentPeriodEnd
+		sub.CancelAt = state.CancelAt
+		sub.CancelAtPeriodEnd = state.CancelAtPeriodEnd
+		sub.Paused = state.Paused
+		sub.CanceledAt = state.CanceledAt
+		sub.TrialStart = state.TrialStart
+		sub.TrialEnd = state.TrialEnd
+		sub.UpdatedAt = time.Now()
+		d.subscriptions[id] = sub
+		n++
+
+		if o, ok := d.orders[sub.OrderID]; ok && o.StatusID != StatusRefunded && o.StatusID != StatusDisputed {
+			o.StatusID = state.OrderStatus()
+			o.UpdatedAt = time.Now()
+			d.orders[o.ID] = o
+		}
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) GetTrialsEndingBefore(ctx context.Context, t time.Time) ([]*Subscription, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	var subscriptions []*Subscription
+	for id, sub := range s.data.subscriptions {
+		_, reminded := s.data.trialReminders[id]
+		if sub.Status != SubscriptionTrialing || !sub.TrialEnd.After(time.Now()) || sub.TrialEnd.After(t) ||
+			reminded || sub.CancelAtPeriodEnd || !sub.CancelAt.IsZero() {
+			continue
+		}
+
+		if sub, ok := s.data.subscription(sub); ok {
+			subscriptions = append(subscriptions, &sub)
+		}
+	}
+
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].TrialEnd.Before(subscriptions[j].TrialEnd) })
+
+	return subscriptions, nil
+}
+
+func (s *MemoryStore) SetTrialReminderSent(ctx context.Context, id int) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.subscriptions[id]; ok {
+		s.data.trialReminders[id] = time.Now()
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) RecordStripeEvent(ctx context.Context, id, eventType string) (bool, error) {
+	if err := s.lock(ctx); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.events[id]; ok {
+		return false, nil
+	}
+	s.data.events[id] = StripeEvent{ID: id, Type: eventType, CreatedAt: time.Now()}
+
+	return true, nil
+}
+
+func (s *MemoryStore) DeleteStripeEvent(ctx context.Context, id string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	delete(s.data.events, id)
+
+	return nil
+}
+
+func (s *MemoryStore) StartIdempotentRequest(ctx context.Context, key, owner, endpoint, hash string, abandonAfter time.Duration) (IdempotentRequest, bool, error) {
+	if err := s.lock(ctx); err != nil {
+		return IdempotentRequest{}, false, err
+	}
+	defer s.mu.Unlock()
+
+	for id, req := range s.data.idempotencyKeys {
+		if req.Key != key || req.Owner != owner || req.Endpoint != endpoint {
+			continue
+		}
+
+		if req.StatusCode != 0 || req.RequestHash != hash || !req.UpdatedAt.Before(time.Now().Add(-abandonAfter)) {
+			return req, false, nil
+		}
+
+		// taken over when abandoned
+		req.UpdatedAt = time.Now()
+		s.data.idempotencyKeys[id] = req
+		return req, true, nil
+	}
+
+	req := IdempotentRequest{
+		ID:          s.data.next("idempotency_keys"),
+		Key:         key,
+		Owner:       owner,
+		Endpoint:    endpoint,
+		RequestHash: hash,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+	s.data.idempotencyKeys[req.ID] = req
+
+	return IdempotentRequest{ID: req.ID, Key: key, Owner: owner, Endpoint: endpoint, RequestHash: hash}, true, nil
+}
+
+func (s *MemoryStore) SaveIdempotentResponse(ctx context.Context, id, statusCode int, body []byte) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if req, ok := s.data.idempotencyKeys[id]; ok {
+		req.StatusCode = statusCode
+		req.ResponseBody = append([]byte(nil), body...)
+		req.UpdatedAt = time.Now()
+		s.data.idempotencyKeys[id] = req
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteIdempotentRequest(ctx context.Context, id int) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	delete(s.data.idempotencyKeys, id)
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteIdempotencyKeysBefore(ctx context.Context, t time.Time) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, req := range s.data.idempotencyKeys {
+		if req.CreatedAt.Before(t) {
+			delete(s.data.idempotencyKeys, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) InsertAuditEntry(ctx context.Context, e AuditEntry) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	e.ID = s.data.next("audit_log")
+	e.UserAgent = truncate(e.UserAgent, 255)
+	e.CreatedAt = time.Now()
+	s.data.auditLog = append(s.data.auditLog, e)
+
+	return e.ID, nil
+}
+
+// entries matching f, newest first
+func (d *memoryData) auditEntries(f AuditFilter) []*AuditEntry {
+	var entries []*AuditEntry
+	for i := len(d.auditLog) - 1; i >= 0; i-- {
+		if e := d.auditLog[i]; f.Match(e) {
+			entries = append(entries, &e)
+		}
+	}
+	return entries
+}
+
+func (s *MemoryStore) GetAuditEntries(ctx context.Context, f AuditFilter) ([]*AuditEntry, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.auditEntries(f), nil
+}
+
+func (s *MemoryStore) GetAuditEntriesPaginated(ctx context.Context, f AuditFilter, pageSize, page int) ([]*AuditEntry, int, int, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, 0, 0, err
+	}
+	defer s.mu.Unlock()
+
+	entries, lastPage, total := paginate(s.data.auditEntries(f), pageSize, page)
+
+	return entries, lastPage, total, nil
+}
+
+func (d *memoryData) dropRecoveryCodes(userID int) {
+	var kept []memoryRecoveryCode
+	for _, c := range d.recoveryCodes {
+		if c.userID != userID {
+			kept = append(kept, c)
+		}
+	}
+	d.recoveryCodes = kept
+}
+
+// users without a second factor have a zero TwoFactor
+func (s *MemoryStore) GetTwoFactor(ctx context.Context, userID int) (TwoFactor, error) {
+	if err := s.lock(ctx); err != nil {
+		return TwoFactor{}, err
+	}
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.users[userID]; !ok {
+		return TwoFactor{}, sql.ErrNoRows
+	}
+
+	t := s.data.twoFactor[userID]
+	t.UserID = userID
+	for _, c := range s.data.recoveryCodes {
+		if c.userID == userID && !c.used {
+			t.RecoveryCodesLeft++
+		}
+	}
+
+	return t, nil
+}
+
+func (s *MemoryStore) SetTwoFactorSecret(ctx context.Context, userID int, secret string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	u, ok := s.data.users[userID]
+	if !ok {
+		return nil
+	}
+	u.TwoFactorEnabled = false
+	s.data.users[userID] = u
+	s.data.twoFactor[userID] = TwoFactor{UserID: userID, Secret: secret}
+
+	return nil
+}
+
+func (s *MemoryStore) EnableTwoFactor(ctx context.Context, userID int, step int64, hashes [][]byte) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	u, ok := s.data.users[userID]
+	if !ok {
+		return nil
+	}
+	u.TwoFactorEnabled = true
+	s.data.users[userID] = u
+
+	t := s.data.twoFactor[userID]
+	t.Enabled = true
+	t.LastStep = step
+	s.data.twoFactor[userID] = t
+
+	s.data.dropRecoveryCodes(userID)
+	for _, hash := range hashes {
+		s.data.recoveryCodes = append(s.data.recoveryCodes, memoryRecoveryCode{userID: userID, hash: string(hash)})
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) UseTwoFactorStep(ctx context.Context, userID int, step int64) (bool, error) {
+	if err := s.lock(ctx); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+
+	t, ok := s.data.twoFactor[userID]
+	if !ok || t.LastStep >= step {
+		return false, nil
+	}
+	t.LastStep = step
+	s.data.twoFactor[userID] = t
+
+	return true, nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(ctx context.Context, userID int, hash []byte) (bool, error) {
+	if err := s.lock(ctx); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+
+	for i, c := range s.data.recoveryCodes {
+		if c.userID == userID && c.hash == string(hash) && !c.used {
+			s.data.recoveryCodes[i].used = true
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *MemoryStore) ResetTwoFactor(ctx context.Context, userID int) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if u, ok := s.data.users[userID]; ok {
+		u.TwoFactorEnabled = false
+		s.data.users[userID] = u
+	}
+	delete(s.data.twoFactor, userID)
+	s.data.dropRecoveryCodes(userID)
+
+	return nil
+}
+
+func (s *MemoryStore) AddRateLimitHit(ctx context.Context, key string, at time.Time) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	s.data.rateLimitHits = append(s.data.rateLimitHits, memoryRateLimitHit{key: key, at: at})
+
+	return nil
+}
+
+func (s *MemoryStore) GetRateLimitHits(ctx context.Context, key string, since time.Time) (ratelimit.Hits, error) {
+	if err := s.lock(ctx); err != nil {
+		return ratelimit.Hits{}, err
+	}
+	defer s.mu.Unlock()
+
+	var hits ratelimit.Hits
+	for _, h := range s.data.rateLimitHits {
+		if h.key != key || !h.at.After(since) {
+			continue
+		}
+		if hits.Count == 0 || h.at.Before(hits.First) {
+			hits.First = h.at
+		}
+		if h.at.After(hits.Last) {
+			hits.Last = h.at
+		}
+		hits.Count++
+	}
+
+	return hits, nil
+}
+
+func (d *memoryData) dropRateLimitHits(drop func(h memoryRateLimitHit) bool) int {
+	var kept []memoryRateLimitHit
+	for _, h := range d.rateLimitHits {
+		if !drop(h) {
+			kept = append(kept, h)
+		}
+	}
+
+	n := len(d.rateLimitHits) - len(kept)
+	d.rateLimitHits = kept
+	return n
+}
+
+func (s *MemoryStore) DeleteRateLimitHits(ctx context.Context, key string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	s.data.dropRateLimitHits(func(h memoryRateLimitHit) bool { return h.key == key })
+
+	return nil
+}
+
+func (s *MemoryStore) LockRateLimitKey(ctx context.Context, l ratelimit.Lock) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	s.data.rateLimitLocks[l.Key] = memoryRateLimitLock{Lock: l}
+
+	return nil
+}
+
+func (s *MemoryStore) GetRateLimitLock(ctx context.Context, key string) (time.Time, error) {
+	if err := s.lock(ctx); err != nil {
+		return time.Time{}, err
+	}
+	defer s.mu.Unlock()
+
+	return s.data.rateLimitLocks[key].Until, nil
+}
+
+func (s *MemoryStore) UnlockRateLimitKey(ctx context.Context, key string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	delete(s.data.rateLimitLocks, key)
+
+	return nil
+}
+
+func (s *MemoryStore) GetRateLimitLocksToNotify(ctx context.Context) ([]ratelimit.Lock, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	var locks []ratelimit.Lock
+	for _, l := range s.data.rateLimitLocks {
+		if !l.notified && l.Until.After(time.Now()) {
+			locks = append(locks, l.Lock)
+		}
+	}
+
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Until.Before(locks[j].Until) })
+
+	return locks, nil
+}
+
+func (s *MemoryStore) SetRateLimitLockNotified(ctx context.Context, key string) (bool, error) {
+	if err := s.lock(ctx); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+
+	l, ok := s.data.rateLimitLocks[key]
+	if !ok || l.notified {
+		return false, nil
+	}
+	l.notified = true
+	s.data.rateLimitLocks[key] = l
+
+	return true, nil
+}
+
+func (s *MemoryStore) DeleteRateLimitsBefore(ctx context.Context, t time.Time) (int, error) {
+	if err := s.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	n := s.data.dropRateLimitHits(func(h memoryRateLimitHit) bool { return h.at.Before(t) })
+
+	for key, l := range s.data.rateLimitLocks {
+		if l.Until.Before(t) {
+			delete(s.data.rateLimitLocks, key)
+		}
+	}
+
+	return n, nil
+}
@@ -10,9 +10,67 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// timeout of a query when the model has none set
+const DefaultQueryTimeout = 3 * time.Second
+
 // type for database connection values
 type DBModel struct {
 	DB *sql.DB
+	// longest a query may run, queries also stop when the caller's context is done
+	Timeout time.Duration
+	// set on the model withTx passes to its function, statements run in the transaction
+	tx *sql.Tx
+}
+
+// the statements of *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// where the statements of the model run, its transaction if it has one
+func (m *DBModel) db() querier {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
+}
+
+// timeout of a query of the model
+func (m *DBModel) timeout() time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+	return DefaultQueryTimeout
+}
+
+// run fn with a store whose statements all run in one transaction
+func (m *DBModel) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	return m.withTx(ctx, func(tx *DBModel) error {
+		return fn(tx)
+	})
+}
+
+// run fn with a model whose statements all run in one transaction, committed when fn
+// returns nil and rolled back otherwise, fn joins the transaction of a model that has one
+func (m *DBModel) withTx(ctx context.Context, fn func(tx *DBModel) error) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(&DBModel{DB: m.DB, Timeout: m.Timeout, tx: tx})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // wrapper for all models
@@ -34,6 +92,8 @@ type Widget struct {
 	Description    string    `json:"description"`
 	InventoryLevel int       `json:"inventory_level"`
 	Price          int       `json:"price"`
+	Currency       string    `json:"currency"`
+	TaxCategory    string    `json:"tax_category"`
 	Image          string    `json:"image"`
 	IsRecurring    bool      `json:"is_recurring"`
 	PlanID         string    `json:"plan_id"`
@@ -41,15 +101,15 @@ type Widget struct {
 	UpdatedAt      time.Time `json:"-"`
 }
 
-func (m *DBModel) GetWidget(id int) (Widget, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+func (m *DBModel) GetWidget(ctx context.Context, id int) (Widget, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	var widget Widget
 
-	row := m.DB.QueryRowContext(ctx,
+	row := m.db().QueryRowContext(ctx,
 		`select 
-			id, name, description, inventory_level, price, 
+			id, name, description, inventory_level, price, tax_category,
 			coalesce(image, ''), is_recurring, plan_id,
 			created_at, updated_at 
 		from widgets 
@@ -60,6 +120,7 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 		&widget.Description,
 		&widget.InventoryLevel,
 		&widget.Price,
+		&widget.TaxCategory,
 		&widget.Image,
 		&widget.IsRecurring,
 		&widget.PlanID,
@@ -69,6 +130,7 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 	if err != nil {
 		return widget, err
 	}
+	widget.Currency = DefaultCurrency
 	return widget, nil
 }
 
@@ -76,18 +138,61 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 type Order struct {
 	ID            int         `json:"id"`
 	WidgetID      int         `json:"widget_id"`
+	PlanID        int         `json:"plan_id"`
 	TransactionID int         `json:"transaction_id"`
 	CustomerID    int         `json:"customer_id"`
 	StatusID      int         `json:"status_id"`
 	Quantity      int         `json:"quantity"`
+	Subtotal      int         `json:"subtotal"`
 	Amount        int         `json:"amount"`
+	PromotionID   int         `json:"promotion_id"`
+	Discount      int         `json:"discount"`
+	Tax           int         `json:"tax"`
+	TaxCountry    string      `json:"tax_country"`
+	TaxRegion     string      `json:"tax_region"`
 	CreatedAt     time.Time   `json:"-"`
 	UpdatedAt     time.Time   `json:"-"`
 	Widget        Widget      `json:"widget"`
 	Transaction   Transaction `json:"transaction"`
 	Customer      Customer    `json:"customer"`
+	Status        Status      `json:"status"`
+	Plan          Plan        `json:"plan"`
+	Items         []OrderItem `json:"items"`
+	Taxes         []OrderTax  `json:"taxes"`
+	Refunds       []Refund    `json:"refunds"`
+	// copies of the addresses at the time of the order
+	BillingAddress  Address `json:"billing_address"`
+	ShippingAddress Address `json:"shipping_address"`
+	// the promotion had been used up by other orders by the time this one was paid
+	PromotionOverused bool `json:"promotion_overused"`
 }
 
+// type for order lines, Price is the unit price at the time of the order
+type OrderItem struct {
+	ID       int `json:"id"`
+	OrderID  int `json:"order_id"`
+	WidgetID int `json:"widget_id"`
+	Quantity int `json:"quantity"`
+	Price    int `json:"price"`
+	Amount   int `json:"amount"`
+	// share of the order's promotion discount, only set on quotes
+	Discount  int       `json:"discount,omitempty"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	Widget    Widget    `json:"widget"`
+}
+
+// order statuses, ids of rows in statuses
+const (
+	StatusCleared           = 1
+	StatusRefunded          = 2
+	StatusCancelled         = 3
+	StatusDisputed          = 4
+	StatusPastDue           = 5
+	StatusTrialing          = 6
+	StatusPartiallyRefunded = 7
+)
+
 // type for order statuses
 type Status struct {
 	ID        int       `json:"id"`
@@ -96,6 +201,15 @@ type Status struct {
 	UpdatedAt time.Time `json:"-"`
 }
 
+// transaction statuses, ids of rows in transaction_statuses
+const (
+	TransactionStatusPending           = 1
+	TransactionStatusCleared           = 2
+	TransactionStatusDeclined          = 3
+	TransactionStatusRefunded          = 4
+	TransactionStatusPartiallyRefunded = 5
+)
+
 // type for transaction statuses
 type TransactionStatus struct {
 	ID        int       `json:"id"`
@@ -122,28 +236,33 @@ type Transaction struct {
 
 // type for users
 type User struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	Password  string `json:"password"`
+	// set once the user has confirmed an authenticator app
+	TwoFactorEnabled bool      `json:"two_factor_enabled"`
+	CreatedAt        time.Time `json:"-"`
+	UpdatedAt        time.Time `json:"-"`
 }
 
-// type for customers
+// type for customers, one row per normalized email
 type Customer struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID               int       `json:"id"`
+	FirstName        string    `json:"first_name"`
+	LastName         string    `json:"last_name"`
+	Email            string    `json:"email"`
+	StripeCustomerID string    `json:"stripe_customer_id"`
+	Password         string    `json:"-"`
+	CreatedAt        time.Time `json:"-"`
+	UpdatedAt        time.Time `json:"-"`
 }
 
 // insert a new transaction into DB and return id
-func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) InsertTransaction(ctx context.Context, txn Transaction) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	stmt := `
@@ -154,7 +273,7 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	result, err := m.db().ExecContext(ctx, stmt,
 		txn.Amount,
 		txn.Currency,
 		txn.LastFour,
@@ -180,54 +299,202 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 }
 
 // insert a new order into DB and return id
-func (m *DBModel) InsertOrder(order Order) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) InsertOrder(ctx context.Context, order Order) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
-	stmt := `
-		insert into orders
-			(widget_id, transaction_id, customer_id, status_id, quantity,
-			amount, created_at, updated_at)
-		values (?, ?, ?, ?, ?, ?, ?, ?)
-	`
+	var id int64
+
+	// the order, its lines, taxes and addresses are saved together or not at all
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		stmt := `
+			insert into orders
+				(widget_id, plan_id, transaction_id, customer_id, status_id, quantity, subtotal,
+				amount, promotion_id, discount, promotion_overused, tax, tax_country, tax_region,
+				created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`
+
+		result, err := tx.db().ExecContext(ctx, stmt,
+			order.WidgetID,
+			nullID(order.PlanID),
+			order.TransactionID,
+			order.CustomerID,
+			order.StatusID,
+			order.Quantity,
+			order.Subtotal,
+			order.Amount,
+			nullID(order.PromotionID),
+			order.Discount,
+			order.PromotionOverused,
+			order.Tax,
+			order.TaxCountry,
+			order.TaxRegion,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
 
-	result, err := m.DB.ExecContext(ctx, stmt,
-		order.WidgetID,
-		order.TransactionID,
-		order.CustomerID,
-		order.StatusID,
-		order.Quantity,
-		order.Amount,
-		time.Now(),
-		time.Now(),
-	)
+		id, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		stmt = `
+			insert into order_items
+				(order_id, widget_id, quantity, price, amount, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?)
+		`
+
+		for _, item := range order.Items {
+			_, err = tx.db().ExecContext(ctx, stmt,
+				id,
+				item.WidgetID,
+				item.Quantity,
+				item.Price,
+				item.Amount,
+				time.Now(),
+				time.Now(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		stmt = `
+			insert into order_taxes
+				(order_id, jurisdiction, name, rate, taxable, amount, created_at)
+			values (?, ?, ?, ?, ?, ?, ?)
+		`
+
+		for _, t := range order.Taxes {
+			_, err = tx.db().ExecContext(ctx, stmt,
+				id,
+				t.Jurisdiction,
+				t.Name,
+				t.Rate,
+				t.Taxable,
+				t.Amount,
+				time.Now(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		stmt = `
+			insert into order_addresses
+				(order_id, kind, name, line1, line2, city, region, postal_code, country, created_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`
+
+		addresses := []struct {
+			kind string
+			Address
+		}{
+			{AddressBilling, order.BillingAddress},
+			{AddressShipping, order.ShippingAddress},
+		}
+
+		for _, a := range addresses {
+			if a.IsZero() {
+				continue
+			}
+
+			_, err = tx.db().ExecContext(ctx, stmt,
+				id,
+				a.kind,
+				a.Name,
+				a.Line1,
+				a.Line2,
+				a.City,
+				a.Region,
+				a.PostalCode,
+				a.Country,
+				time.Now(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	id, err := result.LastInsertId()
+	return int(id), nil
+}
+
+// get the lines of an order
+func (m *DBModel) GetOrderItems(ctx context.Context, orderID int) ([]OrderItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var items []OrderItem
+
+	query := `
+		select
+			oi.id, oi.order_id, oi.widget_id, oi.quantity, oi.price, oi.amount,
+			oi.created_at, oi.updated_at, w.id, w.name
+		from
+			order_items oi
+			left join widgets w on (oi.widget_id = w.id)
+		where
+			oi.order_id = ?
+		order by
+			oi.id
+	`
+
+	rows, err := m.db().QueryContext(ctx, query, orderID)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	return int(id), nil
+	for rows.Next() {
+		var i OrderItem
+		err = rows.Scan(
+			&i.ID,
+			&i.OrderID,
+			&i.WidgetID,
+			&i.Quantity,
+			&i.Price,
+			&i.Amount,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Widget.ID,
+			&i.Widget.Name,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, i)
+	}
+
+	return items, nil
 }
 
-// insert a new order into DB and return id
-func (m *DBModel) InsertCustomer(c Customer) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// insert a new customer into DB and return id
+func (m *DBModel) InsertCustomer(ctx context.Context, c Customer) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	stmt := `
 		insert into customers
-			(first_name, last_name, email, created_at, updated_at)
-		values (?, ?, ?, ?, ?)
+			(first_name, last_name, email, stripe_customer_id, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	result, err := m.db().ExecContext(ctx, stmt,
 		c.FirstName,
 		c.LastName,
-		c.Email,
+		NormalizeEmail(c.Email),
+		c.StripeCustomerID,
 		time.Now(),
 		time.Now(),
 	)
@@ -244,16 +511,16 @@ func (m *DBModel) InsertCustomer(c Customer) (int, error) {
 }
 
 // get a user by email address
-func (m *DBModel) GetUserByEmail(email string) (User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	email = strings.ToLower(email)
 	var u User
 
-	row := m.DB.QueryRowContext(ctx, `
+	row := m.db().QueryRowContext(ctx, `
 		select
-			id, first_name, last_name, email, password, created_at, updated_at
+			id, first_name, last_name, email, role, password, totp_enabled, created_at, updated_at
 		from
 			users
 		where email = ?`, email)
@@ -263,7 +530,9 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 		&u.FirstName,
 		&u.LastName,
 		&u.Email,
+		&u.Role,
 		&u.Password,
+		&u.TwoFactorEnabled,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -275,37 +544,44 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 }
 
 // authenticate user and return userID
-func (m *DBModel) Authenticate(email, password string) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) Authenticate(ctx context.Context, email, password string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	var id int
 	var hashedPassword string
 
-	row := m.DB.QueryRowContext(ctx, `select id, password from users where email = ?`, email)
+	row := m.db().QueryRowContext(ctx, `select id, password from users where email = ?`, email)
 	err := row.Scan(&id, &hashedPassword)
 	if err != nil {
 		return 0, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return 0, errors.New("incorrect password")
-	} else if err != nil {
+	err = checkPassword(hashedPassword, password)
+	if err != nil {
 		return 0, err
 	}
 
 	return id, nil
 }
 
+// compare a password with the bcrypt hash it was saved as
+func checkPassword(hash, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return errors.New("incorrect password")
+	}
+	return err
+}
+
 // update user password
-func (m *DBModel) UpdatePasswordForUser(u User, hash string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) UpdatePasswordForUser(ctx context.Context, u User, hash string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	stmt := `update users set password = ? where id = ?`
 
-	_, err := m.DB.ExecContext(ctx, stmt, hash, u.ID)
+	_, err := m.db().ExecContext(ctx, stmt, hash, u.ID)
 	if err != nil {
 		return err
 	}
@@ -314,8 +590,8 @@ func (m *DBModel) UpdatePasswordForUser(u User, hash string) error {
 }
 
 // get all orders from database filtered by isRecurring
-func (m *DBModel) GetAllOrders(isRecurring int) ([]*Order, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) GetAllOrders(ctx context.Context, isRecurring int) ([]*Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	var orders []*Order
@@ -323,7 +599,8 @@ func (m *DBModel) GetAllOrders(isRecurring int) ([]*Order, error) {
 	query := `
 	SELECT
 		o.id, o.widget_id, o.transaction_id, o.customer_id,
-		o.status_id, o.quantity, o.amount, o.created_at, o.updated_at, 
+		o.status_id, o.quantity, o.amount, coalesce(o.promotion_id, 0), o.discount,
+		o.created_at, o.updated_at,
 		w.id, w.name, t.id, t.amount, t.currency, t.last_four, 
 		t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
 		c.id, c.first_name, c.last_name, c.email
@@ -336,7 +613,7 @@ func (m *DBModel) GetAllOrders(isRecurring int) ([]*Order, error) {
 	ORDER BY
 		o.created_at desc`
 
-	rows, err := m.DB.QueryContext(ctx, query, isRecurring)
+	rows, err := m.db().QueryContext(ctx, query, isRecurring)
 	if err != nil {
 		return nil, err
 	}
@@ -352,6 +629,8 @@ func (m *DBModel) GetAllOrders(isRecurring int) ([]*Order, error) {
 			&o.StatusID,
 			&o.Quantity,
 			&o.Amount,
+			&o.PromotionID,
+			&o.Discount,
 			&o.CreatedAt,
 			&o.UpdatedAt,
 			&o.Widget.ID,
@@ -379,8 +658,13 @@ func (m *DBModel) GetAllOrders(isRecurring int) ([]*Order, error) {
 }
 
 // paginate all orders data from database
-func (m *DBModel) GetAllOrdersPaginated(pageSize, page, isRecurring int) ([]*Order, int, int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) GetAllOrdersPaginated(ctx context.Context, pageSize, page, isRecurring int) ([]*Order, int, int, error) {
+	return m.ordersPaginated(ctx, pageSize, page, `w.is_recurring = ?`, isRecurring)
+}
+
+// a page of the orders matching where, which can use the subscription of an order as s
+func (m *DBModel) ordersPaginated(ctx context.Context, pageSize, page int, where string, args ...any) ([]*Order, int, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	var orders []*Order
@@ -399,13 +683,14 @@ func (m *DBModel) GetAllOrdersPaginated(pageSize, page, isRecurring int) ([]*Ord
 		LEFT JOIN widgets w ON (o.widget_id = w.id)
 		LEFT JOIN transactions t ON (o.transaction_id = t.id)
 		LEFT JOIN customers c ON (o.customer_id = c.id)
+		LEFT JOIN subscriptions s ON (s.order_id = o.id)
 	WHERE 
-		w.is_recurring = ?
+		` + where + `
 	ORDER BY
 		o.created_at desc
 	LIMIT ? OFFSET ?`
 
-	rows, err := m.DB.QueryContext(ctx, query, isRecurring, pageSize, offset)
+	rows, err := m.db().QueryContext(ctx, query, append(args, pageSize, offset)...)
 	if err != nil {
 		return nil, 0, 0, err
 	}
@@ -450,12 +735,13 @@ func (m *DBModel) GetAllOrdersPaginated(pageSize, page, isRecurring int) ([]*Ord
 		FROM 
 			orders o
 			LEFT JOIN widgets w ON (o.widget_id = w.id)
+			LEFT JOIN subscriptions s ON (s.order_id = o.id)
 		WHERE 
-			w.is_recurring = ?
+			` + where + `
 	`
 
 	var totalRecords int
-	countRow := m.DB.QueryRowContext(ctx, query, isRecurring)
+	countRow := m.db().QueryRowContext(ctx, query, args...)
 	err = countRow.Scan(&totalRecords)
 	if err != nil {
 		return nil, 0, 0, err
@@ -470,40 +756,53 @@ func (m *DBModel) GetAllOrdersPaginated(pageSize, page, isRecurring int) ([]*Ord
 }
 
 // get one sales detail from database by order ID
-func (m *DBModel) GetOrderByID(orderID int) (Order, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) GetOrderByID(ctx context.Context, orderID int) (Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	var o Order
 
 	query := `
 	SELECT
-		o.id, o.widget_id, o.transaction_id, o.customer_id,
-		o.status_id, o.quantity, o.amount, o.created_at, o.updated_at, 
-		w.id, w.name, t.id, t.amount, t.currency, t.last_four, 
+		o.id, o.widget_id, coalesce(o.plan_id, 0), o.transaction_id, o.customer_id,
+		o.status_id, o.quantity, o.subtotal, o.amount, coalesce(o.promotion_id, 0), o.discount,
+		o.promotion_overused, o.tax, o.tax_country, o.tax_region, o.created_at, o.updated_at,
+		w.id, w.name, w.is_recurring, t.id, t.amount, t.currency, t.last_four,
 		t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
-		c.id, c.first_name, c.last_name, c.email
+		c.id, c.first_name, c.last_name, c.email, s.id, s.name,
+		coalesce(p.id, 0), coalesce(p.name, ''), coalesce(p.billing_interval, '')
 	FROM
 		orders o
 		LEFT JOIN widgets w ON (o.widget_id = w.id)
 		LEFT JOIN transactions t ON (o.transaction_id = t.id)
 		LEFT JOIN customers c ON (o.customer_id = c.id)
+		LEFT JOIN statuses s ON (o.status_id = s.id)
+		LEFT JOIN plans p ON (o.plan_id = p.id)
 	WHERE o.id = ?`
 
-	row := m.DB.QueryRowContext(ctx, query, orderID)
+	row := m.db().QueryRowContext(ctx, query, orderID)
 
 	err := row.Scan(
 		&o.ID,
 		&o.WidgetID,
+		&o.PlanID,
 		&o.TransactionID,
 		&o.CustomerID,
 		&o.StatusID,
 		&o.Quantity,
+		&o.Subtotal,
 		&o.Amount,
+		&o.PromotionID,
+		&o.Discount,
+		&o.PromotionOverused,
+		&o.Tax,
+		&o.TaxCountry,
+		&o.TaxRegion,
 		&o.CreatedAt,
 		&o.UpdatedAt,
 		&o.Widget.ID,
 		&o.Widget.Name,
+		&o.Widget.IsRecurring,
 		&o.Transaction.ID,
 		&o.Transaction.Amount,
 		&o.Transaction.Currency,
@@ -516,21 +815,46 @@ func (m *DBModel) GetOrderByID(orderID int) (Order, error) {
 		&o.Customer.FirstName,
 		&o.Customer.LastName,
 		&o.Customer.Email,
+		&o.Status.ID,
+		&o.Status.Name,
+		&o.Plan.ID,
+		&o.Plan.Name,
+		&o.Plan.Interval,
 	)
 	if err != nil {
 		return o, err
 	}
 
+	o.Items, err = m.GetOrderItems(ctx, o.ID)
+	if err != nil {
+		return o, err
+	}
+
+	o.Taxes, err = m.GetOrderTaxes(ctx, o.ID)
+	if err != nil {
+		return o, err
+	}
+
+	o.BillingAddress, o.ShippingAddress, err = m.GetOrderAddresses(ctx, o.ID)
+	if err != nil {
+		return o, err
+	}
+
+	o.Refunds, err = m.GetOrderRefunds(ctx, o.ID)
+	if err != nil {
+		return o, err
+	}
+
 	return o, nil
 }
 
-func (m *DBModel) UpdateOrderStatus(id, statusID int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) UpdateOrderStatus(ctx context.Context, id, statusID int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	stmt := `update orders set status_id = ? where id = ?`
 
-	_, err := m.DB.ExecContext(ctx, stmt, statusID, id)
+	_, err := m.db().ExecContext(ctx, stmt, statusID, id)
 	if err != nil {
 		return err
 	}
@@ -538,22 +862,141 @@ func (m *DBModel) UpdateOrderStatus(id, statusID int) error {
 	return nil
 }
 
-func (m *DBModel) GetAllUsers() ([]*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// update the status of orders paid by the given payment intent or subscription id,
+// returns the number of orders updated
+func (m *DBModel) UpdateOrderStatusByPaymentIntent(ctx context.Context, pi string, statusID int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		update orders o
+			inner join transactions t on (o.transaction_id = t.id)
+		set
+			o.status_id = ?, o.updated_at = ?
+		where
+			t.payment_intent = ?
+	`
+
+	result, err := m.db().ExecContext(ctx, stmt, statusID, time.Now(), pi)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// get the id of the order paid by the given payment intent, sql.ErrNoRows when it
+// hasn't been saved
+func (m *DBModel) GetOrderIDByPaymentIntent(ctx context.Context, pi string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	query := `
+		select
+			o.id
+		from
+			orders o
+			inner join transactions t on (o.transaction_id = t.id)
+		where
+			t.payment_intent = ?
+		order by
+			o.id
+		limit 1
+	`
+
+	var id int
+	err := m.db().QueryRowContext(ctx, query, pi).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// update the status of transactions for the given payment intent or subscription id,
+// returns the number of transactions updated
+func (m *DBModel) UpdateTransactionStatusByPaymentIntent(ctx context.Context, pi string, statusID int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `update transactions set transaction_status_id = ?, updated_at = ? where payment_intent = ?`
+
+	result, err := m.db().ExecContext(ctx, stmt, statusID, time.Now(), pi)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// mark declined the transactions for the given payment intent or subscription id that
+// haven't changed since before, so that a failure reported late doesn't undo a payment
+// recorded after it, returns the number of transactions updated
+func (m *DBModel) DeclineTransactionsByPaymentIntent(ctx context.Context, pi string, before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		update transactions set transaction_status_id = ?, updated_at = ?
+		where payment_intent = ? and updated_at < ?`
+
+	result, err := m.db().ExecContext(ctx, stmt, TransactionStatusDeclined, time.Now(), pi, before)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// record the card a subscription is now billed to
+func (m *DBModel) UpdateTransactionCard(ctx context.Context, id int, pm, lastFour string, expiryMonth, expiryYear int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		update transactions
+		set payment_method = ?, last_four = ?, expiry_month = ?, expiry_year = ?, updated_at = ?
+		where id = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, pm, lastFour, expiryMonth, expiryYear, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *DBModel) GetAllUsers(ctx context.Context) ([]*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	var users []*User
 
 	query := `
 		select
-			id, last_name, first_name, email, created_at, updated_at
+			id, last_name, first_name, email, role, totp_enabled, created_at, updated_at
 		from
 			users
 		order by
 			last_name, first_name
 	`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.db().QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -566,6 +1009,8 @@ func (m *DBModel) GetAllUsers() ([]*User, error) {
 			&u.LastName,
 			&u.FirstName,
 			&u.Email,
+			&u.Role,
+			&u.TwoFactorEnabled,
 			&u.CreatedAt,
 			&u.UpdatedAt,
 		)
@@ -580,27 +1025,29 @@ func (m *DBModel) GetAllUsers() ([]*User, error) {
 	return users, nil
 }
 
-func (m *DBModel) GetOneUser(id int) (User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) GetOneUser(ctx context.Context, id int) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	var u User
 
 	query := `
 		select
-			id, last_name, first_name, email, created_at, updated_at
+			id, last_name, first_name, email, role, totp_enabled, created_at, updated_at
 		from
 			users
 		where id = ?
 	`
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+	row := m.db().QueryRowContext(ctx, query, id)
 
 	err := row.Scan(
 		&u.ID,
 		&u.LastName,
 		&u.FirstName,
 		&u.Email,
+		&u.Role,
+		&u.TwoFactorEnabled,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -611,8 +1058,8 @@ func (m *DBModel) GetOneUser(id int) (User, error) {
 	return u, nil
 }
 
-func (m *DBModel) EditUser(u User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) EditUser(ctx context.Context, u User) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	stmt := `
@@ -620,13 +1067,14 @@ func (m *DBModel) EditUser(u User) error {
 			first_name = ?,
 			last_name = ?,
 			email = ?,
+			role = ?,
 			updated_at = ?
 		where
 			id = ?
 	`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
-		u.FirstName, u.LastName, u.Email, time.Now(), u.ID)
+	_, err := m.db().ExecContext(ctx, stmt,
+		u.FirstName, u.LastName, u.Email, u.Role, time.Now(), u.ID)
 	if err != nil {
 		return err
 	}
@@ -634,18 +1082,18 @@ func (m *DBModel) EditUser(u User) error {
 	return nil
 }
 
-func (m *DBModel) AddUser(u User, hash string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) AddUser(ctx context.Context, u User, hash string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	stmt := `
 		insert into users 
-			(first_name, last_name, email, password, created_at, updated_at)
-		values (?, ?, ?, ?, ?, ?)
+			(first_name, last_name, email, role, password, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?)
 	`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
-		u.FirstName, u.LastName, u.Email, hash, time.Now(), time.Now())
+	_, err := m.db().ExecContext(ctx, stmt,
+		u.FirstName, u.LastName, u.Email, u.Role, hash, time.Now(), time.Now())
 	if err != nil {
 		return err
 	}
@@ -653,19 +1101,19 @@ func (m *DBModel) AddUser(u User, hash string) error {
 	return nil
 }
 
-func (m *DBModel) DeleteUser(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *DBModel) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	stmt := `delete from users where id = ?`
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	_, err := m.db().ExecContext(ctx, stmt, id)
 	if err != nil {
 		return err
 	}
 
 	stmt = `delete from tokens where user_id = ?`
-	_, err = m.DB.ExecContext(ctx, stmt, id)
+	_, err = m.db().ExecContext(ctx, stmt, id)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// billing intervals of plans, the same values stripe uses for prices
+const (
+	IntervalMonth = "month"
+	IntervalYear  = "year"
+)
+
+// type for a subscription plan, a tier of recurring widget billed every Interval,
+// a higher Tier is an upgrade
+type Plan struct {
+	ID            int       `json:"id"`
+	WidgetID      int       `json:"widget_id"`
+	Slug          string    `json:"slug"`
+	Name          string    `json:"name"`
+	Tier          int       `json:"tier"`
+	Interval      string    `json:"interval"`
+	Price         int       `json:"price"`
+	TrialDays     int       `json:"trial_days"`
+	Currency      string    `json:"currency"`
+	StripePriceID string    `json:"stripe_price_id"`
+	Active        bool      `json:"active"`
+	CreatedAt     time.Time `json:"-"`
+	UpdatedAt     time.Time `json:"-"`
+	Widget        Widget    `json:"widget"`
+}
+
+// Monthly or Annual
+func (p Plan) IntervalName() string {
+	if p.Interval == IntervalYear {
+		return "Annual"
+	}
+	return "Monthly"
+}
+
+// product name on invoices, e.g. Bronze Plan Monthly Subscription
+func (p Plan) InvoiceProduct() string {
+	return p.Name + " " + p.IntervalName() + " Subscription"
+}
+
+// the widget of the plan priced as the plan, for promotions of the plan
+func (p Plan) PricedWidget() Widget {
+	w := p.Widget
+	w.Price = p.Price
+	w.Currency = p.Currency
+	w.PlanID = p.StripePriceID
+	return w
+}
+
+const planColumns = `
+	p.id, p.widget_id, p.slug, p.name, p.tier, p.billing_interval, p.price, p.trial_days, p.currency,
+	p.stripe_price_id, p.active, p.created_at, p.updated_at,
+	w.id, w.name, w.description, coalesce(w.image, ''), w.tax_category, w.is_recurring`
+
+// scan destinations of planColumns
+func planFields(p *Plan) []any {
+	return []any{
+		&p.ID,
+		&p.WidgetID,
+		&p.Slug,
+		&p.Name,
+		&p.Tier,
+		&p.Interval,
+		&p.Price,
+		&p.TrialDays,
+		&p.Currency,
+		&p.StripePriceID,
+		&p.Active,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+		&p.Widget.ID,
+		&p.Widget.Name,
+		&p.Widget.Description,
+		&p.Widget.Image,
+		&p.Widget.TaxCategory,
+		&p.Widget.IsRecurring,
+	}
+}
+
+func scanPlan(row rowScanner) (Plan, error) {
+	var p Plan
+
+	err := row.Scan(planFields(&p)...)
+	if err != nil {
+		return p, err
+	}
+	p.Widget.Price = p.Price
+	p.Widget.Currency = p.Currency
+
+	return p, nil
+}
+
+// get a plan by id
+func (m *DBModel) GetPlan(ctx context.Context, id int) (Plan, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	row := m.db().QueryRowContext(ctx, `
+		select `+planColumns+`
+		from plans p
+			inner join widgets w on (p.widget_id = w.id)
+		where p.id = ?`, id)
+
+	return scanPlan(row)
+}
+
+// get a plan by the slug of its page
+func (m *DBModel) GetPlanBySlug(ctx context.Context, slug string) (Plan, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	row := m.db().QueryRowContext(ctx, `
+		select `+planColumns+`
+		from plans p
+			inner join widgets w on (p.widget_id = w.id)
+		where p.slug = ?`, slug)
+
+	return scanPlan(row)
+}
+
+// get the plan billed by a stripe price
+func (m *DBModel) GetPlanByStripePrice(ctx context.Context, priceID string) (Plan, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	row := m.db().QueryRowContext(ctx, `
+		select `+planColumns+`
+		from plans p
+			inner join widgets w on (p.widget_id = w.id)
+		where p.stripe_price_id = ?
+		order by p.id
+		limit 1`, priceID)
+
+	return scanPlan(row)
+}
+
+// get the plans customers can subscribe to, by tier with monthly plans first
+func (m *DBModel) GetActivePlans(ctx context.Context) ([]*Plan, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var plans []*Plan
+
+	rows, err := m.db().QueryContext(ctx, `
+		select `+planColumns+`
+		from plans p
+			inner join widgets w on (p.widget_id = w.id)
+		where p.active = 1
+		order by p.tier, p.billing_interval = 'year', p.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, &p)
+	}
+
+	return plans, nil
+}
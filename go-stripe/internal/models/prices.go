@@ -0,0 +1,144 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// returned when a widget has no price in the requested currency
+type NotPricedError struct {
+	WidgetName string
+	Currency   string
+}
+
+func (e *NotPricedError) Error() string {
+	return fmt.Sprintf("%s is not sold in %s", e.WidgetName, strings.ToUpper(e.Currency))
+}
+
+// type for the price of a widget in one currency, in minor units
+type WidgetPrice struct {
+	ID        int       `json:"id"`
+	WidgetID  int       `json:"widget_id"`
+	Currency  string    `json:"currency"`
+	Price     int       `json:"price"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// price of a widget in currency, widgets.price is used for the default currency when no row exists
+func (m *DBModel) widgetPrice(ctx context.Context, widget Widget, currency string) (int, error) {
+	currency = strings.ToLower(currency)
+
+	var price int
+	err := m.db().QueryRowContext(ctx,
+		`select price from widget_prices where widget_id = ? and currency = ?`, widget.ID, currency).Scan(&price)
+	if errors.Is(err, sql.ErrNoRows) {
+		if currency == DefaultCurrency {
+			return widget.Price, nil
+		}
+		return 0, &NotPricedError{WidgetName: widget.Name, Currency: currency}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return price, nil
+}
+
+// get a widget with its price in currency
+func (m *DBModel) GetWidgetInCurrency(ctx context.Context, id int, currency string) (Widget, error) {
+	widget, err := m.GetWidget(ctx, id)
+	if err != nil {
+		return widget, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	price, err := m.widgetPrice(ctx, widget, currency)
+	if err != nil {
+		return widget, err
+	}
+
+	widget.Price = price
+	widget.Currency = strings.ToLower(currency)
+
+	return widget, nil
+}
+
+// get the prices of a widget in every currency it is sold in
+func (m *DBModel) GetWidgetPrices(ctx context.Context, widgetID int) ([]WidgetPrice, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var prices []WidgetPrice
+
+	rows, err := m.db().QueryContext(ctx, `
+		select id, widget_id, currency, price, created_at, updated_at
+		from widget_prices
+		where widget_id = ?
+		order by currency`, widgetID)
+	if err != nil {
+		return prices, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p WidgetPrice
+		err = rows.Scan(&p.ID, &p.WidgetID, &p.Currency, &p.Price, &p.CreatedAt, &p.UpdatedAt)
+		if err != nil {
+			return prices, err
+		}
+		prices = append(prices, p)
+	}
+
+	return prices, nil
+}
+
+// set the price of a widget in a currency
+func (m *DBModel) SetWidgetPrice(ctx context.Context, widgetID int, currency string, price int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		insert into widget_prices
+			(widget_id, currency, price, created_at, updated_at)
+		values (?, ?, ?, ?, ?)
+		on duplicate key update
+			price = values(price), updated_at = values(updated_at)
+	`
+
+	_, err := m.db().ExecContext(ctx, stmt, widgetID, strings.ToLower(currency), price, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// reprice the items of a cart in currency, the cart is left unchanged when an item isn't sold in it
+func (m *DBModel) PriceCart(ctx context.Context, cart *Cart, currency string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	prices := make([]int, len(cart.Items))
+	for i, item := range cart.Items {
+		price, err := m.widgetPrice(ctx, item.Widget, currency)
+		if err != nil {
+			return err
+		}
+		prices[i] = price
+	}
+
+	for i := range cart.Items {
+		cart.Items[i].Widget.Price = prices[i]
+		cart.Items[i].Widget.Currency = strings.ToLower(currency)
+	}
+	cart.Currency = strings.ToLower(currency)
+
+	return nil
+}
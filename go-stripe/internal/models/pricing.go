@@ -0,0 +1,115 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"myapp/internal/tax"
+	"strconv"
+	"strings"
+)
+
+// currency of widgets.price, used when the customer hasn't picked one
+const DefaultCurrency = "cad"
+
+// returned when the items of a quote can't be sold once
+var ErrInvalidQuoteItem = errors.New("invalid item")
+
+// server side price of a set of order lines, computed from the catalog
+type Quote struct {
+	Items         []OrderItem `json:"items"`
+	Currency      string      `json:"currency"`
+	Subtotal      int         `json:"subtotal"`
+	PromotionID   int         `json:"promotion_id,omitempty"`
+	PromotionCode string      `json:"promotion_code,omitempty"`
+	Discount      int         `json:"discount"`
+	TaxAddress    tax.Address `json:"tax_address"`
+	Taxes         []tax.Line  `json:"taxes,omitempty"`
+	Tax           int         `json:"tax"`
+	Total         int         `json:"total"`
+}
+
+// describe the quoted lines as widget_id:quantity pairs, e.g. "1:2,3:1"
+func (q Quote) ItemsKey() string {
+	var parts []string
+	for _, i := range q.Items {
+		parts = append(parts, fmt.Sprintf("%d:%d", i.WidgetID, i.Quantity))
+	}
+	return strings.Join(parts, ",")
+}
+
+// metadata attached to the payment intent created for the quote
+func (q Quote) Metadata() map[string]string {
+	metadata := map[string]string{
+		"items":    q.ItemsKey(),
+		"quantity": strconv.Itoa(q.Quantity()),
+		"total":    strconv.Itoa(q.Total),
+	}
+	if q.PromotionCode != "" {
+		metadata["promotion_code"] = q.PromotionCode
+		metadata["discount"] = strconv.Itoa(q.Discount)
+	}
+	if q.TaxAddress.Country != "" {
+		metadata["tax"] = strconv.Itoa(q.Tax)
+		metadata["tax_location"] = q.TaxAddress.String()
+	}
+	return metadata
+}
+
+// number of units quoted
+func (q Quote) Quantity() int {
+	quantity := 0
+	for _, i := range q.Items {
+		quantity += i.Quantity
+	}
+	return quantity
+}
+
+// price widget_id and quantity of every line at the current catalog prices in currency,
+// prices sent by the client are never used
+func (m *DBModel) QuoteItems(ctx context.Context, items []OrderItem, currency string) (Quote, error) {
+	return quoteItems(items, currency, func(id int, currency string) (Widget, error) {
+		return m.GetWidgetInCurrency(ctx, id, currency)
+	})
+}
+
+// quote items with the widgets getWidget prices in currency
+func quoteItems(items []OrderItem, currency string, getWidget func(id int, currency string) (Widget, error)) (Quote, error) {
+	quote := Quote{Currency: strings.ToLower(currency)}
+
+	if len(items) == 0 {
+		return quote, fmt.Errorf("%w: nothing to charge", ErrInvalidQuoteItem)
+	}
+
+	for _, item := range items {
+		if item.Quantity < 1 {
+			return quote, fmt.Errorf("%w: quantity must be at least 1", ErrInvalidQuoteItem)
+		}
+
+		widget, err := getWidget(item.WidgetID, quote.Currency)
+		var notPriced *NotPricedError
+		if errors.As(err, &notPriced) {
+			return quote, fmt.Errorf("%w: %s", ErrInvalidQuoteItem, notPriced)
+		}
+		if err != nil {
+			return quote, err
+		}
+
+		if widget.IsRecurring {
+			return quote, fmt.Errorf("%w: %s is sold as a subscription", ErrInvalidQuoteItem, widget.Name)
+		}
+
+		quote.Items = append(quote.Items, OrderItem{
+			WidgetID: widget.ID,
+			Quantity: item.Quantity,
+			Price:    widget.Price,
+			Amount:   widget.Price * item.Quantity,
+			Widget:   widget,
+		})
+		quote.Subtotal += widget.Price * item.Quantity
+	}
+
+	quote.Total = quote.Subtotal
+
+	return quote, nil
+}
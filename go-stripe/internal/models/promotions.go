@@ -0,0 +1,395 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// kinds of promotion, Value is a percentage or an amount in minor units of Currency
+const (
+	PromotionPercent = "percent"
+	PromotionFixed   = "fixed"
+)
+
+// type for discount codes
+type Promotion struct {
+	ID          int    `json:"id"`
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Kind        string `json:"kind"`
+	Value       int    `json:"value"`
+	// fixed discounts only apply to purchases in their currency
+	Currency string `json:"currency"`
+	// restrict the code to one widget or one subscription plan, zero values mean any
+	WidgetID int    `json:"widget_id"`
+	PlanID   string `json:"plan_id"`
+	// number of monthly invoices discounted for subscriptions, zero discounts the first one
+	DurationMonths int `json:"duration_months"`
+	// zero means unlimited
+	MaxUses   int `json:"max_uses"`
+	TimesUsed int `json:"times_used"`
+	// zero times mean no start or expiry date
+	StartsAt       time.Time `json:"starts_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	Active         bool      `json:"active"`
+	StripeCouponID string    `json:"-"`
+	CreatedAt      time.Time `json:"-"`
+	UpdatedAt      time.Time `json:"-"`
+}
+
+// orders placed with a promotion in one currency
+type PromotionUsage struct {
+	Currency string `json:"currency"`
+	Orders   int    `json:"orders"`
+	Discount int    `json:"discount"`
+	Revenue  int    `json:"revenue"`
+}
+
+// returned when a promotion code can't be used for a purchase
+type PromotionError struct {
+	Code   string
+	Reason string
+}
+
+func (e *PromotionError) Error() string {
+	return fmt.Sprintf("promotion code %s %s", e.Code, e.Reason)
+}
+
+// normalize a code typed by a customer
+func PromotionCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// check that the promotion can be redeemed at time now
+func (p Promotion) Usable(now time.Time) error {
+	switch {
+	case !p.Active:
+		return &PromotionError{Code: p.Code, Reason: "is not valid"}
+	case !p.StartsAt.IsZero() && now.Before(p.StartsAt):
+		return &PromotionError{Code: p.Code, Reason: "is not valid yet"}
+	case !p.ExpiresAt.IsZero() && !now.Before(p.ExpiresAt):
+		return &PromotionError{Code: p.Code, Reason: "has expired"}
+	case p.MaxUses > 0 && p.TimesUsed >= p.MaxUses:
+		return &PromotionError{Code: p.Code, Reason: "has been used up"}
+	}
+	return nil
+}
+
+// discount given on amount in currency
+func (p Promotion) discount(amount int, currency string) (int, error) {
+	var d int
+
+	switch p.Kind {
+	case PromotionPercent:
+		d = amount * p.Value / 100
+	case PromotionFixed:
+		if !strings.EqualFold(p.Currency, currency) {
+			return 0, &PromotionError{Code: p.Code, Reason: fmt.Sprintf("can only be used for purchases in %s", strings.ToUpper(p.Currency))}
+		}
+		d = p.Value
+	default:
+		return 0, fmt.Errorf("promotion %d has unknown kind %q", p.ID, p.Kind)
+	}
+
+	if d > amount {
+		d = amount
+	}
+
+	return d, nil
+}
+
+// discount the lines of a quote the promotion applies to
+func (p Promotion) Apply(q Quote) (Quote, error) {
+	if p.PlanID != "" {
+		return q, &PromotionError{Code: p.Code, Reason: "only applies to subscriptions"}
+	}
+
+	eligible := 0
+	for _, item := range q.Items {
+		if p.WidgetID == 0 || p.WidgetID == item.WidgetID {
+			eligible += item.Amount
+		}
+	}
+
+	if eligible == 0 {
+		return q, &PromotionError{Code: p.Code, Reason: "does not apply to these items"}
+	}
+
+	d, err := p.discount(eligible, q.Currency)
+	if err != nil {
+		return q, err
+	}
+
+	if d >= q.Subtotal {
+		return q, &PromotionError{Code: p.Code, Reason: "can't be used for a free order"}
+	}
+
+	// spread the discount over the eligible lines so each is taxed on what was paid for it
+	items := make([]OrderItem, len(q.Items))
+	copy(items, q.Items)
+	remaining, last := d, -1
+	for i, item := range items {
+		if p.WidgetID == 0 || p.WidgetID == item.WidgetID {
+			items[i].Discount = d * item.Amount / eligible
+			remaining -= items[i].Discount
+			last = i
+		}
+	}
+	items[last].Discount += remaining
+
+	q.Items = items
+	q.PromotionID = p.ID
+	q.PromotionCode = p.Code
+	q.Discount = d
+	q.Total = q.Subtotal - d
+
+	return q, nil
+}
+
+// discount given on the first invoice of a subscription to widget
+func (p Promotion) ApplyToPlan(widget Widget) (int, error) {
+	if (p.PlanID != "" && p.PlanID != widget.PlanID) || (p.WidgetID != 0 && p.WidgetID != widget.ID) {
+		return 0, &PromotionError{Code: p.Code, Reason: "does not apply to this plan"}
+	}
+
+	return p.discount(widget.Price, widget.Currency)
+}
+
+const promotionColumns = `
+	id, code, description, kind, value, currency, coalesce(widget_id, 0), plan_id,
+	duration_months, max_uses, times_used, starts_at, expires_at, active,
+	stripe_coupon_id, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPromotion(row rowScanner) (Promotion, error) {
+	var p Promotion
+	var startsAt, expiresAt sql.NullTime
+
+	err := row.Scan(
+		&p.ID,
+		&p.Code,
+		&p.Description,
+		&p.Kind,
+		&p.Value,
+		&p.Currency,
+		&p.WidgetID,
+		&p.PlanID,
+		&p.DurationMonths,
+		&p.MaxUses,
+		&p.TimesUsed,
+		&startsAt,
+		&expiresAt,
+		&p.Active,
+		&p.StripeCouponID,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	if err != nil {
+		return p, err
+	}
+
+	p.StartsAt = startsAt.Time
+	p.ExpiresAt = expiresAt.Time
+
+	return p, nil
+}
+
+// null for zero values of optional columns
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id > 0}
+}
+
+// get a promotion by the code a customer typed
+func (m *DBModel) GetPromotionByCode(ctx context.Context, code string) (Promotion, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	row := m.db().QueryRowContext(ctx, `select `+promotionColumns+` from promotions where code = ?`, PromotionCode(code))
+	p, err := scanPromotion(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, &PromotionError{Code: PromotionCode(code), Reason: "is not valid"}
+	}
+
+	return p, err
+}
+
+func (m *DBModel) GetPromotion(ctx context.Context, id int) (Promotion, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	row := m.db().QueryRowContext(ctx, `select `+promotionColumns+` from promotions where id = ?`, id)
+
+	return scanPromotion(row)
+}
+
+// get every promotion, newest first
+func (m *DBModel) GetAllPromotions(ctx context.Context) ([]*Promotion, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var promotions []*Promotion
+
+	rows, err := m.db().QueryContext(ctx, `select `+promotionColumns+` from promotions order by id desc`)
+	if err != nil {
+		return promotions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPromotion(rows)
+		if err != nil {
+			return promotions, err
+		}
+		promotions = append(promotions, &p)
+	}
+
+	return promotions, nil
+}
+
+// look up a code and apply it to a quote, checking that it can still be redeemed
+func (m *DBModel) QuotePromotion(ctx context.Context, q Quote, code string) (Quote, error) {
+	p, err := m.GetPromotionByCode(ctx, code)
+	if err != nil {
+		return q, err
+	}
+
+	err = p.Usable(time.Now())
+	if err != nil {
+		return q, err
+	}
+
+	return p.Apply(q)
+}
+
+func (m *DBModel) InsertPromotion(ctx context.Context, p Promotion) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		insert into promotions
+			(code, description, kind, value, currency, widget_id, plan_id, duration_months,
+			max_uses, starts_at, expires_at, active, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1, ?, ?)
+	`
+
+	result, err := m.db().ExecContext(ctx, stmt,
+		PromotionCode(p.Code),
+		p.Description,
+		p.Kind,
+		p.Value,
+		strings.ToLower(p.Currency),
+		nullID(p.WidgetID),
+		p.PlanID,
+		p.DurationMonths,
+		p.MaxUses,
+		nullTime(p.StartsAt),
+		nullTime(p.ExpiresAt),
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// enable or disable a promotion
+func (m *DBModel) SetPromotionActive(ctx context.Context, id int, active bool) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `update promotions set active = ?, updated_at = ? where id = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, active, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// remember the stripe coupon created for a subscription promotion
+func (m *DBModel) SetPromotionCoupon(ctx context.Context, id int, couponID string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `update promotions set stripe_coupon_id = ?, updated_at = ? where id = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, couponID, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// count a redemption, and report whether it was within the usage limit. the customer
+// has paid by then, so a use beyond the limit since the order was quoted is counted
+// too. it runs in the transaction saving the order, which locks the promotion, so the
+// last use of a promotion goes to one order only
+func (m *DBModel) RedeemPromotion(ctx context.Context, id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var maxUses, timesUsed int
+	err := m.db().QueryRowContext(ctx, `
+		select max_uses, times_used from promotions where id = ? for update`, id).Scan(&maxUses, &timesUsed)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = m.db().ExecContext(ctx, `
+		update promotions set times_used = times_used + 1, updated_at = ? where id = ?`, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+
+	return maxUses == 0 || timesUsed < maxUses, nil
+}
+
+// summarize the orders placed with a promotion by currency
+func (m *DBModel) GetPromotionUsage(ctx context.Context, id int) ([]PromotionUsage, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var usage []PromotionUsage
+
+	rows, err := m.db().QueryContext(ctx, `
+		select t.currency, count(o.id), coalesce(sum(o.discount), 0), coalesce(sum(o.amount), 0)
+		from orders o inner join transactions t on (o.transaction_id = t.id)
+		where o.promotion_id = ?
+		group by t.currency
+		order by t.currency`, id)
+	if err != nil {
+		return usage, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u PromotionUsage
+		err = rows.Scan(&u.Currency, &u.Orders, &u.Discount, &u.Revenue)
+		if err != nil {
+			return usage, err
+		}
+		usage = append(usage, u)
+	}
+
+	return usage, nil
+}
@@ -0,0 +1,189 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"myapp/internal/ratelimit"
+	"time"
+)
+
+// record a hit of a rate limited key
+func (m *DBModel) AddRateLimitHit(ctx context.Context, key string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	_, err := m.db().ExecContext(ctx, `insert into rate_limit_hits (rate_key, created_at) values (?, ?)`, key, at)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// the hits of key since a time
+func (m *DBModel) GetRateLimitHits(ctx context.Context, key string, since time.Time) (ratelimit.Hits, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var hits ratelimit.Hits
+	var first, last sql.NullTime
+
+	row := m.db().QueryRowContext(ctx, `
+		select
+			count(id), min(created_at), max(created_at)
+		from
+			rate_limit_hits
+		where
+			rate_key = ? and created_at > ?`, key, since)
+
+	err := row.Scan(&hits.Count, &first, &last)
+	if err != nil {
+		return hits, err
+	}
+
+	hits.First = first.Time
+	hits.Last = last.Time
+
+	return hits, nil
+}
+
+func (m *DBModel) DeleteRateLimitHits(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	_, err := m.db().ExecContext(ctx, `delete from rate_limit_hits where rate_key = ?`, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// lock a key out, a new lock of a key is notified again
+func (m *DBModel) LockRateLimitKey(ctx context.Context, l ratelimit.Lock) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		insert into rate_limit_locks
+			(rate_key, email, locked_until, created_at)
+		values (?, ?, ?, ?)
+		on duplicate key update
+			email = values(email), locked_until = values(locked_until),
+			notified_at = null, created_at = values(created_at)
+	`
+
+	_, err := m.db().ExecContext(ctx, stmt, l.Key, l.Email, l.Until, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// the end of the lock of key, zero when it has none
+func (m *DBModel) GetRateLimitLock(ctx context.Context, key string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var until time.Time
+
+	row := m.db().QueryRowContext(ctx, `select locked_until from rate_limit_locks where rate_key = ?`, key)
+	err := row.Scan(&until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return until, nil
+}
+
+func (m *DBModel) UnlockRateLimitKey(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	_, err := m.db().ExecContext(ctx, `delete from rate_limit_locks where rate_key = ?`, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// the locks still in force whose account hasn't been told about them
+func (m *DBModel) GetRateLimitLocksToNotify(ctx context.Context) ([]ratelimit.Lock, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var locks []ratelimit.Lock
+
+	rows, err := m.db().QueryContext(ctx, `
+		select
+			rate_key, email, locked_until
+		from
+			rate_limit_locks
+		where
+			notified_at is null and locked_until > ?
+		order by
+			created_at`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l ratelimit.Lock
+		err = rows.Scan(&l.Key, &l.Email, &l.Until)
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+
+	return locks, nil
+}
+
+// mark the lock of key as notified, false when another instance of the api already has
+func (m *DBModel) SetRateLimitLockNotified(ctx context.Context, key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, `
+		update rate_limit_locks set notified_at = ? where rate_key = ? and notified_at is null`, time.Now(), key)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// delete the hits recorded before t and the locks that ended before it, returns the hits deleted
+func (m *DBModel) DeleteRateLimitsBefore(ctx context.Context, t time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, `delete from rate_limit_hits where created_at < ?`, t)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = m.db().ExecContext(ctx, `delete from rate_limit_locks where locked_until < ?`, t)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
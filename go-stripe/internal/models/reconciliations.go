@@ -0,0 +1,63 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// kinds of checkouts that need reconciliation
+const (
+	ReconcilePayment      = "payment"
+	ReconcileSubscription = "subscription"
+)
+
+// type for a checkout stripe accepted but the database could not save, PaymentIntent
+// is the subscription id of subscriptions and Details the order as json, so that it
+// can be entered by hand. ResolvedAt is zero until someone does
+type Reconciliation struct {
+	ID            int       `json:"id"`
+	Kind          string    `json:"kind"`
+	PaymentIntent string    `json:"payment_intent"`
+	Email         string    `json:"email"`
+	Amount        int       `json:"amount"`
+	Currency      string    `json:"currency"`
+	Details       string    `json:"details"`
+	Error         string    `json:"error"`
+	ResolvedAt    time.Time `json:"resolved_at"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"-"`
+}
+
+// record a checkout that needs reconciliation and return its id
+func (m *DBModel) InsertReconciliation(ctx context.Context, r Reconciliation) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		insert into reconciliations
+			(kind, payment_intent, email, amount, currency, details, error, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := m.db().ExecContext(ctx, stmt,
+		r.Kind,
+		r.PaymentIntent,
+		r.Email,
+		r.Amount,
+		r.Currency,
+		r.Details,
+		r.Error,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
@@ -0,0 +1,198 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// reasons for refunds, the first three are also stripe's
+const (
+	RefundReasonRequestedByCustomer = "requested_by_customer"
+	RefundReasonDuplicate           = "duplicate"
+	RefundReasonFraudulent          = "fraudulent"
+	RefundReasonDamaged             = "damaged"
+	RefundReasonOther               = "other"
+)
+
+// reasons in the order the admin picks them
+var RefundReasons = []string{
+	RefundReasonRequestedByCustomer,
+	RefundReasonDuplicate,
+	RefundReasonFraudulent,
+	RefundReasonDamaged,
+	RefundReasonOther,
+}
+
+func ValidRefundReason(reason string) bool {
+	for _, r := range RefundReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// type for the refunds of a transaction, UserID is the admin who refunded it,
+// zero for refunds made before they were recorded
+type Refund struct {
+	ID             int       `json:"id"`
+	TransactionID  int       `json:"transaction_id"`
+	OrderID        int       `json:"order_id"`
+	UserID         int       `json:"user_id"`
+	Amount         int       `json:"amount"`
+	Currency       string    `json:"currency"`
+	Reason         string    `json:"reason"`
+	Note           string    `json:"note"`
+	StripeRefundID string    `json:"stripe_refund_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"-"`
+	User           User      `json:"user"`
+}
+
+// get the refunds of an order, oldest first
+func (m *DBModel) GetOrderRefunds(ctx context.Context, orderID int) ([]Refund, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var refunds []Refund
+
+	rows, err := m.db().QueryContext(ctx, `
+		select
+			r.id, r.transaction_id, r.order_id, coalesce(r.user_id, 0), r.amount, r.currency,
+			r.reason, r.note, coalesce(r.stripe_refund_id, ''), r.created_at, r.updated_at,
+			coalesce(u.first_name, ''), coalesce(u.last_name, ''), coalesce(u.email, '')
+		from
+			refunds r
+			left join users u on (r.user_id = u.id)
+		where
+			r.order_id = ?
+		order by
+			r.created_at, r.id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Refund
+		err = rows.Scan(
+			&r.ID,
+			&r.TransactionID,
+			&r.OrderID,
+			&r.UserID,
+			&r.Amount,
+			&r.Currency,
+			&r.Reason,
+			&r.Note,
+			&r.StripeRefundID,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+			&r.User.FirstName,
+			&r.User.LastName,
+			&r.User.Email,
+		)
+		if err != nil {
+			return nil, err
+		}
+		r.User.ID = r.UserID
+
+		refunds = append(refunds, r)
+	}
+
+	return refunds, nil
+}
+
+// the amount of a transaction not refunded yet
+func (m *DBModel) GetRefundableAmount(ctx context.Context, transactionID int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var refundable int
+
+	row := m.db().QueryRowContext(ctx, `
+		select t.amount - coalesce(sum(r.amount), 0)
+		from
+			transactions t
+			left join refunds r on (r.transaction_id = t.id)
+		where
+			t.id = ?
+		group by
+			t.id, t.amount`, transactionID)
+
+	err := row.Scan(&refundable)
+	if err != nil {
+		return 0, err
+	}
+
+	return refundable, nil
+}
+
+// record a refund and set the status of its transaction and order, refunded once
+// the refunds add up to the transaction amount and partially refunded until then,
+// returns the amount still refundable. a stripe refund is recorded once, the admin who
+// made it takes over the row the webhook may have saved first
+func (m *DBModel) InsertRefund(ctx context.Context, r Refund) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var refundable int
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		_, err := tx.db().ExecContext(ctx, `
+			insert into refunds
+				(transaction_id, order_id, user_id, amount, currency, reason, note,
+				stripe_refund_id, created_at, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			on duplicate key update
+				user_id = coalesce(values(user_id), user_id),
+				reason = if(values(user_id) is null, reason, values(reason)),
+				note = if(values(user_id) is null, note, values(note))`,
+			r.TransactionID,
+			r.OrderID,
+			nullID(r.UserID),
+			r.Amount,
+			r.Currency,
+			r.Reason,
+			r.Note,
+			sql.NullString{String: r.StripeRefundID, Valid: r.StripeRefundID != ""},
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+
+		// locks the transaction so concurrent refunds are totalled one after the other
+		row := tx.db().QueryRowContext(ctx, `
+			select t.amount - (select coalesce(sum(r.amount), 0) from refunds r where r.transaction_id = t.id)
+			from transactions t
+			where t.id = ?
+			for update`, r.TransactionID)
+
+		err = row.Scan(&refundable)
+		if err != nil {
+			return err
+		}
+
+		txnStatus, orderStatus := TransactionStatusPartiallyRefunded, StatusPartiallyRefunded
+		if refundable <= 0 {
+			txnStatus, orderStatus = TransactionStatusRefunded, StatusRefunded
+		}
+
+		_, err = tx.db().ExecContext(ctx, `update transactions set transaction_status_id = ?, updated_at = ? where id = ?`,
+			txnStatus, time.Now(), r.TransactionID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.db().ExecContext(ctx, `update orders set status_id = ?, updated_at = ? where id = ?`,
+			orderStatus, time.Now(), r.OrderID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return refundable, nil
+}
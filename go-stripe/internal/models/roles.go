@@ -0,0 +1,103 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// roles of the admin users, from the least to the most trusted
+const (
+	RoleViewer  = "viewer"
+	RoleSupport = "support"
+	RoleFinance = "finance"
+	RoleOwner   = "owner"
+)
+
+// what a role allows, checked per route by the api and the web server
+const (
+	PermissionViewSales          = "sales:view"
+	PermissionRefund             = "sales:refund"
+	PermissionCancelSubscription = "subscriptions:cancel"
+	PermissionVirtualTerminal    = "terminal:charge"
+	PermissionManagePromotions   = "promotions:manage"
+	PermissionViewTaxReport      = "reports:tax"
+	PermissionManageUsers        = "users:manage"
+	PermissionViewAudit          = "audit:view"
+)
+
+var rolePermissions = map[string][]string{
+	RoleViewer: {
+		PermissionViewSales,
+	},
+	RoleSupport: {
+		PermissionViewSales,
+		PermissionCancelSubscription,
+	},
+	RoleFinance: {
+		PermissionViewSales,
+		PermissionRefund,
+		PermissionCancelSubscription,
+		PermissionVirtualTerminal,
+		PermissionManagePromotions,
+		PermissionViewTaxReport,
+		PermissionViewAudit,
+	},
+	RoleOwner: {
+		PermissionViewSales,
+		PermissionRefund,
+		PermissionCancelSubscription,
+		PermissionVirtualTerminal,
+		PermissionManagePromotions,
+		PermissionViewTaxReport,
+		PermissionManageUsers,
+		PermissionViewAudit,
+	},
+}
+
+// the roles a user can be given, in the order of the role select
+func Roles() []string {
+	return []string{RoleViewer, RoleSupport, RoleFinance, RoleOwner}
+}
+
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// whether role allows permission, unknown roles allow nothing
+func Can(role, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the user's role allows permission
+func (u User) Can(permission string) bool {
+	return Can(u.Role, permission)
+}
+
+// a set of roles, like the roles that must use two-factor authentication
+type RoleSet map[string]bool
+
+// the roles of a comma separated list, an empty list is an empty set
+func ParseRoleSet(s string) (RoleSet, error) {
+	set := make(RoleSet)
+	for _, role := range strings.Split(s, ",") {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			continue
+		}
+		if !ValidRole(role) {
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+		set[role] = true
+	}
+	return set, nil
+}
+
+func (rs RoleSet) Has(role string) bool {
+	return rs[role]
+}
@@ -0,0 +1,189 @@
+package models
+
+import (
+	"context"
+	"myapp/internal/ratelimit"
+	"time"
+)
+
+// widgets, their prices in every currency and their stock
+type WidgetStore interface {
+	GetWidget(ctx context.Context, id int) (Widget, error)
+	GetWidgetInCurrency(ctx context.Context, id int, currency string) (Widget, error)
+	GetWidgetPrices(ctx context.Context, widgetID int) ([]WidgetPrice, error)
+	SetWidgetPrice(ctx context.Context, widgetID int, currency string, price int) error
+	QuoteItems(ctx context.Context, items []OrderItem, currency string) (Quote, error)
+	AvailableStock(ctx context.Context, widgetID int) (int, error)
+	CheckStock(ctx context.Context, items []OrderItem) error
+	ReserveStock(ctx context.Context, pi string, items []OrderItem, ttl time.Duration) error
+	ReleaseStock(ctx context.Context, pi string) error
+	CommitStock(ctx context.Context, pi string, items []OrderItem) error
+	ReleaseExpiredReservations(ctx context.Context) (int, error)
+	RestockOrder(ctx context.Context, orderID int) (bool, error)
+	RestockOrdersByPaymentIntent(ctx context.Context, pi string) error
+}
+
+// orders with their lines, taxes and addresses
+type OrderStore interface {
+	InsertOrder(ctx context.Context, order Order) (int, error)
+	GetOrderByID(ctx context.Context, orderID int) (Order, error)
+	GetOrderItems(ctx context.Context, orderID int) ([]OrderItem, error)
+	GetOrderTaxes(ctx context.Context, orderID int) ([]OrderTax, error)
+	GetOrderAddresses(ctx context.Context, orderID int) (Address, Address, error)
+	GetAllOrders(ctx context.Context, isRecurring int) ([]*Order, error)
+	GetAllOrdersPaginated(ctx context.Context, pageSize, page, isRecurring int) ([]*Order, int, int, error)
+	UpdateOrderStatus(ctx context.Context, id, statusID int) error
+	UpdateOrderStatusByPaymentIntent(ctx context.Context, pi string, statusID int) (int, error)
+	GetOrderIDByPaymentIntent(ctx context.Context, pi string) (int, error)
+	GetTaxReport(ctx context.Context, from, to time.Time) ([]TaxReportLine, error)
+}
+
+// admin users
+type UserStore interface {
+	GetUserByEmail(ctx context.Context, email string) (User, error)
+	Authenticate(ctx context.Context, email, password string) (int, error)
+	UpdatePasswordForUser(ctx context.Context, u User, hash string) error
+	GetAllUsers(ctx context.Context) ([]*User, error)
+	GetOneUser(ctx context.Context, id int) (User, error)
+	EditUser(ctx context.Context, u User) error
+	AddUser(ctx context.Context, u User, hash string) error
+	DeleteUser(ctx context.Context, id int) error
+}
+
+// api tokens of users and customers
+type TokenStore interface {
+	InsertToken(ctx context.Context, t *Token, u User) error
+	GetUserForToken(ctx context.Context, token string) (*User, *Token, error)
+	UseLoginChallenge(ctx context.Context, token string) (int, error)
+	GetTokensForUser(ctx context.Context, userID int) ([]Token, error)
+	DeleteToken(ctx context.Context, userID, id int) (bool, error)
+	InsertCustomerToken(ctx context.Context, t *Token, c Customer) error
+	GetCustomerForToken(ctx context.Context, token string) (*Customer, error)
+	DeleteCustomerToken(ctx context.Context, token string) error
+}
+
+// customers, their accounts and saved addresses
+type CustomerStore interface {
+	GetCustomer(ctx context.Context, id int) (Customer, error)
+	GetCustomerByEmail(ctx context.Context, email string) (Customer, error)
+	InsertCustomer(ctx context.Context, c Customer) (int, error)
+	GetOrInsertCustomer(ctx context.Context, c Customer) (int, error)
+	UpdateCustomerStripeID(ctx context.Context, id int, stripeCustomerID string) error
+	UpdatePasswordForCustomer(ctx context.Context, c Customer, hash string) error
+	AuthenticateCustomer(ctx context.Context, email, password string) (int, error)
+	GetCustomerOrders(ctx context.Context, customerID int) ([]*Order, error)
+	GetDuplicateCustomers(ctx context.Context) ([]DuplicateCustomers, error)
+	MergeCustomers(ctx context.Context, keepID int, ids []int) error
+	InsertAddress(ctx context.Context, a Address) (int, error)
+	GetCustomerAddresses(ctx context.Context, customerID int) ([]Address, error)
+}
+
+// payments, their refunds and the ones that need reconciliation
+type TransactionStore interface {
+	InsertTransaction(ctx context.Context, txn Transaction) (int, error)
+	UpdateTransactionStatusByPaymentIntent(ctx context.Context, pi string, statusID int) (int, error)
+	DeclineTransactionsByPaymentIntent(ctx context.Context, pi string, before time.Time) (int, error)
+	UpdateTransactionCard(ctx context.Context, id int, pm, lastFour string, expiryMonth, expiryYear int) error
+	GetOrderRefunds(ctx context.Context, orderID int) ([]Refund, error)
+	GetRefundableAmount(ctx context.Context, transactionID int) (int, error)
+	InsertRefund(ctx context.Context, r Refund) (int, error)
+	InsertReconciliation(ctx context.Context, r Reconciliation) (int, error)
+}
+
+// shopping carts
+type CartStore interface {
+	CreateCart(ctx context.Context) (Cart, error)
+	GetCartByToken(ctx context.Context, token string) (Cart, error)
+	AddCartItem(ctx context.Context, cartID, widgetID, quantity int) error
+	UpdateCartItem(ctx context.Context, cartID, widgetID, quantity int) error
+	RemoveCartItem(ctx context.Context, cartID, widgetID int) error
+	DeleteCart(ctx context.Context, id int) error
+	PriceCart(ctx context.Context, cart *Cart, currency string) error
+}
+
+// promotion codes
+type PromotionStore interface {
+	GetPromotionByCode(ctx context.Context, code string) (Promotion, error)
+	GetPromotion(ctx context.Context, id int) (Promotion, error)
+	GetAllPromotions(ctx context.Context) ([]*Promotion, error)
+	QuotePromotion(ctx context.Context, q Quote, code string) (Quote, error)
+	InsertPromotion(ctx context.Context, p Promotion) (int, error)
+	SetPromotionActive(ctx context.Context, id int, active bool) error
+	SetPromotionCoupon(ctx context.Context, id int, couponID string) error
+	RedeemPromotion(ctx context.Context, id int) (bool, error)
+	GetPromotionUsage(ctx context.Context, id int) ([]PromotionUsage, error)
+}
+
+// subscription plans and the state of the subscriptions to them
+type SubscriptionStore interface {
+	GetPlan(ctx context.Context, id int) (Plan, error)
+	GetPlanBySlug(ctx context.Context, slug string) (Plan, error)
+	GetPlanByStripePrice(ctx context.Context, priceID string) (Plan, error)
+	GetActivePlans(ctx context.Context) ([]*Plan, error)
+	GetSubscriptionOrdersPaginated(ctx context.Context, pageSize, page int, filter string) ([]*Order, int, int, error)
+	InsertSubscription(ctx context.Context, s Subscription) (int, error)
+	GetSubscription(ctx context.Context, id int) (Subscription, error)
+	GetSubscriptionByOrderID(ctx context.Context, orderID int) (Subscription, error)
+	UpdateSubscriptionState(ctx context.Context, s Subscription) (int, error)
+	GetTrialsEndingBefore(ctx context.Context, t time.Time) ([]*Subscription, error)
+	SetTrialReminderSent(ctx context.Context, id int) error
+}
+
+// stripe webhook events and requests made with an idempotency key
+type RequestStore interface {
+	RecordStripeEvent(ctx context.Context, id, eventType string) (bool, error)
+	DeleteStripeEvent(ctx context.Context, id string) error
+	StartIdempotentRequest(ctx context.Context, key, owner, endpoint, hash string, abandonAfter time.Duration) (IdempotentRequest, bool, error)
+	SaveIdempotentResponse(ctx context.Context, id, statusCode int, body []byte) error
+	DeleteIdempotentRequest(ctx context.Context, id int) error
+	DeleteIdempotencyKeysBefore(ctx context.Context, t time.Time) (int, error)
+}
+
+// the append-only log of what admin users did
+type AuditStore interface {
+	InsertAuditEntry(ctx context.Context, e AuditEntry) (int, error)
+	GetAuditEntries(ctx context.Context, f AuditFilter) ([]*AuditEntry, error)
+	GetAuditEntriesPaginated(ctx context.Context, f AuditFilter, pageSize, page int) ([]*AuditEntry, int, int, error)
+}
+
+// the second factor of admin users and their recovery codes
+type TwoFactorStore interface {
+	GetTwoFactor(ctx context.Context, userID int) (TwoFactor, error)
+	SetTwoFactorSecret(ctx context.Context, userID int, secret string) error
+	EnableTwoFactor(ctx context.Context, userID int, step int64, hashes [][]byte) error
+	UseTwoFactorStep(ctx context.Context, userID int, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID int, hash []byte) (bool, error)
+	ResetTwoFactor(ctx context.Context, userID int) error
+}
+
+// hits and locks of the rate limiter, shared by every instance of the servers
+type RateLimitStore interface {
+	ratelimit.Store
+	GetRateLimitLocksToNotify(ctx context.Context) ([]ratelimit.Lock, error)
+	SetRateLimitLockNotified(ctx context.Context, key string) (bool, error)
+	DeleteRateLimitsBefore(ctx context.Context, t time.Time) (int, error)
+}
+
+// everything the servers store, implemented by mysql (DBModel) and MemoryStore
+type Store interface {
+	WidgetStore
+	OrderStore
+	UserStore
+	TokenStore
+	CustomerStore
+	TransactionStore
+	CartStore
+	PromotionStore
+	SubscriptionStore
+	RequestStore
+	AuditStore
+	TwoFactorStore
+	RateLimitStore
+	// run fn with a store whose changes are all kept when fn returns nil and none otherwise
+	WithTx(ctx context.Context, fn func(tx Store) error) error
+}
+
+var (
+	_ Store = (*DBModel)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
@@ -0,0 +1,326 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// subscription statuses, as stripe reports them
+const (
+	SubscriptionActive     = "active"
+	SubscriptionTrialing   = "trialing"
+	SubscriptionPastDue    = "past_due"
+	SubscriptionUnpaid     = "unpaid"
+	SubscriptionIncomplete = "incomplete"
+	SubscriptionCanceled   = "canceled"
+)
+
+// type for the state of a stripe subscription, times are zero when stripe has none
+type Subscription struct {
+	ID                   int       `json:"id"`
+	CustomerID           int       `json:"customer_id"`
+	PlanID               int       `json:"plan_id"`
+	OrderID              int       `json:"order_id"`
+	StripeSubscriptionID string    `json:"stripe_subscription_id"`
+	Status               string    `json:"status"`
+	CurrentPeriodStart   time.Time `json:"current_period_start"`
+	CurrentPeriodEnd     time.Time `json:"current_period_end"`
+	CancelAt             time.Time `json:"cancel_at"`
+	CancelAtPeriodEnd    bool      `json:"cancel_at_period_end"`
+	Paused               bool      `json:"paused"`
+	CanceledAt           time.Time `json:"canceled_at"`
+	TrialStart           time.Time `json:"trial_start"`
+	TrialEnd             time.Time `json:"trial_end"`
+	CreatedAt            time.Time `json:"-"`
+	UpdatedAt            time.Time `json:"-"`
+	Plan                 Plan      `json:"plan"`
+}
+
+// in its free trial, the first invoice is billed at TrialEnd
+func (s Subscription) Trialing() bool {
+	return s.Status == SubscriptionTrialing
+}
+
+// a canceled subscription is over, one scheduled for cancellation is not
+func (s Subscription) Ended() bool {
+	return s.Status == SubscriptionCanceled
+}
+
+// the subscription ends at the end of the period, or at CancelAt, unless reactivated
+func (s Subscription) CancelScheduled() bool {
+	return !s.Ended() && (s.CancelAtPeriodEnd || !s.CancelAt.IsZero())
+}
+
+// when a scheduled cancellation takes effect
+func (s Subscription) EndsAt() time.Time {
+	if !s.CancelAt.IsZero() {
+		return s.CancelAt
+	}
+	return s.CurrentPeriodEnd
+}
+
+// the status of the order of the subscription, shown in the admin lists
+func (s Subscription) OrderStatus() int {
+	switch {
+	case s.Ended() || s.CancelScheduled():
+		return StatusCancelled
+	case s.Status == SubscriptionPastDue || s.Status == SubscriptionUnpaid:
+		return StatusPastDue
+	case s.Trialing():
+		return StatusTrialing
+	default:
+		return StatusCleared
+	}
+}
+
+// filters of the subscriptions list of the admin
+const (
+	SubscriptionFilterTrial     = "trial"
+	SubscriptionFilterConverted = "converted"
+)
+
+// a page of subscription orders, filter is empty for all of them, trial for the
+// subscriptions in their trial and converted for those paying after a trial
+func (m *DBModel) GetSubscriptionOrdersPaginated(ctx context.Context, pageSize, page int, filter string) ([]*Order, int, int, error) {
+	switch filter {
+	case SubscriptionFilterTrial:
+		return m.ordersPaginated(ctx, pageSize, page, `w.is_recurring = 1 and s.status = ?`, SubscriptionTrialing)
+	case SubscriptionFilterConverted:
+		return m.ordersPaginated(ctx, pageSize, page, `w.is_recurring = 1 and s.trial_end is not null and s.status = ?`, SubscriptionActive)
+	default:
+		return m.GetAllOrdersPaginated(ctx, pageSize, page, 1)
+	}
+}
+
+// insert a subscription and return its id
+func (m *DBModel) InsertSubscription(ctx context.Context, s Subscription) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `
+		insert into subscriptions
+			(customer_id, plan_id, order_id, stripe_subscription_id, status,
+			current_period_start, current_period_end, cancel_at, cancel_at_period_end,
+			paused, canceled_at, trial_start, trial_end, created_at, updated_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := m.db().ExecContext(ctx, stmt,
+		s.CustomerID,
+		s.PlanID,
+		s.OrderID,
+		s.StripeSubscriptionID,
+		s.Status,
+		nullTime(s.CurrentPeriodStart),
+		nullTime(s.CurrentPeriodEnd),
+		nullTime(s.CancelAt),
+		s.CancelAtPeriodEnd,
+		s.Paused,
+		nullTime(s.CanceledAt),
+		nullTime(s.TrialStart),
+		nullTime(s.TrialEnd),
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+const subscriptionColumns = `
+	s.id, s.customer_id, s.plan_id, s.order_id, s.stripe_subscription_id, s.status,
+	s.current_period_start, s.current_period_end, s.cancel_at, s.cancel_at_period_end,
+	s.paused, s.canceled_at, s.trial_start, s.trial_end, s.created_at, s.updated_at,` + planColumns
+
+func scanSubscription(row rowScanner) (Subscription, error) {
+	var s Subscription
+	var periodStart, periodEnd, cancelAt, canceledAt, trialStart, trialEnd sql.NullTime
+
+	dest := []any{
+		&s.ID,
+		&s.CustomerID,
+		&s.PlanID,
+		&s.OrderID,
+		&s.StripeSubscriptionID,
+		&s.Status,
+		&periodStart,
+		&periodEnd,
+		&cancelAt,
+		&s.CancelAtPeriodEnd,
+		&s.Paused,
+		&canceledAt,
+		&trialStart,
+		&trialEnd,
+		&s.CreatedAt,
+		&s.UpdatedAt,
+	}
+
+	err := row.Scan(append(dest, planFields(&s.Plan)...)...)
+	if err != nil {
+		return s, err
+	}
+	s.Plan.Widget.Price = s.Plan.Price
+	s.Plan.Widget.Currency = s.Plan.Currency
+
+	s.CurrentPeriodStart = periodStart.Time
+	s.CurrentPeriodEnd = periodEnd.Time
+	s.CancelAt = cancelAt.Time
+	s.CanceledAt = canceledAt.Time
+	s.TrialStart = trialStart.Time
+	s.TrialEnd = trialEnd.Time
+
+	return s, nil
+}
+
+// get a subscription with its plan
+func (m *DBModel) GetSubscription(ctx context.Context, id int) (Subscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	row := m.db().QueryRowContext(ctx, `
+		select `+subscriptionColumns+`
+		from subscriptions s
+			inner join plans p on (s.plan_id = p.id)
+			inner join widgets w on (p.widget_id = w.id)
+		where s.id = ?`, id)
+
+	return scanSubscription(row)
+}
+
+// get the subscription created by an order
+func (m *DBModel) GetSubscriptionByOrderID(ctx context.Context, orderID int) (Subscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	row := m.db().QueryRowContext(ctx, `
+		select `+subscriptionColumns+`
+		from subscriptions s
+			inner join plans p on (s.plan_id = p.id)
+			inner join widgets w on (p.widget_id = w.id)
+		where s.order_id = ?`, orderID)
+
+	return scanSubscription(row)
+}
+
+// save the state stripe reports for a subscription and the matching order status,
+// returns the number of subscriptions updated, a zero PlanID keeps the plan
+func (m *DBModel) UpdateSubscriptionState(ctx context.Context, s Subscription) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var n int64
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		result, err := tx.db().ExecContext(ctx, `
+			update subscriptions
+			set
+				plan_id = if(? > 0, ?, plan_id),
+				status = ?,
+				current_period_start = ?,
+				current_period_end = ?,
+				cancel_at = ?,
+				cancel_at_period_end = ?,
+				paused = ?,
+				canceled_at = ?,
+				trial_reminder_sent_at = if(trial_end <=> ?, trial_reminder_sent_at, null),
+				trial_start = ?,
+				trial_end = ?,
+				updated_at = ?
+			where stripe_subscription_id = ?`,
+			s.PlanID, s.PlanID,
+			s.Status,
+			nullTime(s.CurrentPeriodStart),
+			nullTime(s.CurrentPeriodEnd),
+			nullTime(s.CancelAt),
+			s.CancelAtPeriodEnd,
+			s.Paused,
+			nullTime(s.CanceledAt),
+			// an extended trial gets a reminder again, before trial_end is updated
+			nullTime(s.TrialEnd),
+			nullTime(s.TrialStart),
+			nullTime(s.TrialEnd),
+			time.Now(),
+			s.StripeSubscriptionID,
+		)
+		if err != nil {
+			return err
+		}
+
+		n, err = result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		// orders keep a status for the admin lists
+		_, err = tx.db().ExecContext(ctx, `
+			update orders o
+				inner join subscriptions s on (s.order_id = o.id)
+			set o.status_id = ?, o.updated_at = ?
+			where s.stripe_subscription_id = ? and o.status_id not in (?, ?)`,
+			s.OrderStatus(), time.Now(), s.StripeSubscriptionID, StatusRefunded, StatusDisputed)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// get the trials ending before a time whose customer has not been reminded,
+// trials that won't convert because they are cancelled are left out
+func (m *DBModel) GetTrialsEndingBefore(ctx context.Context, t time.Time) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var subscriptions []*Subscription
+
+	rows, err := m.db().QueryContext(ctx, `
+		select `+subscriptionColumns+`
+		from subscriptions s
+			inner join plans p on (s.plan_id = p.id)
+			inner join widgets w on (p.widget_id = w.id)
+		where
+			s.status = ?
+			and s.trial_end > ? and s.trial_end <= ?
+			and s.trial_reminder_sent_at is null
+			and s.cancel_at_period_end = 0 and s.cancel_at is null
+		order by s.trial_end`, SubscriptionTrialing, time.Now(), t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, &s)
+	}
+
+	return subscriptions, nil
+}
+
+// remember that the customer of a trial was told it is about to convert
+func (m *DBModel) SetTrialReminderSent(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	stmt := `update subscriptions set trial_reminder_sent_at = ?, updated_at = ? where id = ?`
+
+	_, err := m.db().ExecContext(ctx, stmt, time.Now(), time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"context"
+	"myapp/internal/tax"
+	"time"
+)
+
+// type for the taxes charged on an order, one row per jurisdiction and tax
+type OrderTax struct {
+	ID           int       `json:"id"`
+	OrderID      int       `json:"order_id"`
+	Jurisdiction string    `json:"jurisdiction"`
+	Name         string    `json:"name"`
+	Rate         float64   `json:"rate"`
+	Taxable      int       `json:"taxable"`
+	Amount       int       `json:"amount"`
+	CreatedAt    time.Time `json:"-"`
+}
+
+// tax collected by one jurisdiction in one currency, for filing
+type TaxReportLine struct {
+	Jurisdiction string  `json:"jurisdiction"`
+	Name         string  `json:"name"`
+	Rate         float64 `json:"rate"`
+	Currency     string  `json:"currency"`
+	Orders       int     `json:"orders"`
+	Taxable      int     `json:"taxable"`
+	Amount       int     `json:"amount"`
+}
+
+// add the taxes owed for a billing address to a quote, lines are taxed on
+// their amount after the promotion discount
+func (q Quote) ApplyTax(rates *tax.Table, addr tax.Address) (Quote, error) {
+	var items []tax.Item
+	for _, item := range q.Items {
+		items = append(items, tax.Item{
+			Category: item.Widget.TaxCategory,
+			Amount:   item.Amount - item.Discount,
+		})
+	}
+
+	lines, err := rates.Calculate(addr, items)
+	if err != nil {
+		return q, err
+	}
+
+	q.TaxAddress = addr
+	q.Taxes = lines
+	q.Tax = 0
+	for _, l := range lines {
+		q.Tax += l.Amount
+	}
+	q.Total = q.Subtotal - q.Discount + q.Tax
+
+	return q, nil
+}
+
+// taxes of a quote as order rows
+func (q Quote) OrderTaxes() []OrderTax {
+	var taxes []OrderTax
+	for _, l := range q.Taxes {
+		taxes = append(taxes, OrderTax{
+			Jurisdiction: l.Jurisdiction,
+			Name:         l.Name,
+			Rate:         l.Percent,
+			Taxable:      l.Taxable,
+			Amount:       l.Amount,
+		})
+	}
+	return taxes
+}
+
+// get the taxes charged on an order
+func (m *DBModel) GetOrderTaxes(ctx context.Context, orderID int) ([]OrderTax, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var taxes []OrderTax
+
+	rows, err := m.db().QueryContext(ctx, `
+		select id, order_id, jurisdiction, name, rate, taxable, amount, created_at
+		from order_taxes
+		where order_id = ?
+		order by id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t OrderTax
+		err = rows.Scan(
+			&t.ID,
+			&t.OrderID,
+			&t.Jurisdiction,
+			&t.Name,
+			&t.Rate,
+			&t.Taxable,
+			&t.Amount,
+			&t.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		taxes = append(taxes, t)
+	}
+
+	return taxes, nil
+}
+
+// total the taxes of orders placed in [from, to) by jurisdiction, refunded and
+// cancelled orders are left out
+func (m *DBModel) GetTaxReport(ctx context.Context, from, to time.Time) ([]TaxReportLine, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var report []TaxReportLine
+
+	rows, err := m.db().QueryContext(ctx, `
+		select
+			ot.jurisdiction, ot.name, ot.rate, t.currency,
+			count(distinct o.id), sum(ot.taxable), sum(ot.amount)
+		from
+			order_taxes ot
+			inner join orders o on (ot.order_id = o.id)
+			inner join transactions t on (o.transaction_id = t.id)
+		where
+			o.created_at >= ? and o.created_at < ?
+			and o.status_id not in (?, ?)
+		group by
+			ot.jurisdiction, ot.name, ot.rate, t.currency
+		order by
+			ot.jurisdiction, ot.name, t.currency`,
+		from, to, StatusRefunded, StatusCancelled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l TaxReportLine
+		err = rows.Scan(
+			&l.Jurisdiction,
+			&l.Name,
+			&l.Rate,
+			&l.Currency,
+			&l.Orders,
+			&l.Taxable,
+			&l.Amount,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		report = append(report, l)
+	}
+
+	return report, nil
+}
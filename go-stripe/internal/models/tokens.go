@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base32"
 	"log"
 	"time"
@@ -11,15 +12,77 @@ import (
 
 const (
 	ScopeAuthentication = "authentication"
+	ScopeCustomer       = "customer"
+	// scopes of the tokens an admin user makes for a device or an integration
+	ScopeReports  = "reports"
+	ScopeRefunds  = "refunds"
+	ScopeTerminal = "terminal"
+	// given with the login token of a user with two-factor authentication, the web
+	// logs them in with it once, it opens nothing else
+	ScopeLoginChallenge = "login-challenge"
 )
 
-// type for authentication token
+// what a token of a scope allows, as well as its user's role has to. Tokens of
+// ScopeAuthentication, given at login, allow everything the role does
+var scopePermissions = map[string][]string{
+	ScopeReports: {
+		PermissionViewSales,
+		PermissionViewTaxReport,
+	},
+	ScopeRefunds: {
+		PermissionViewSales,
+		PermissionRefund,
+	},
+	ScopeTerminal: {
+		PermissionVirtualTerminal,
+	},
+}
+
+// type for authentication token. PlainText is only set when the token is made
 type Token struct {
-	PlainText string    `json:"token"`
+	ID        int       `json:"id"`
+	PlainText string    `json:"token,omitempty"`
 	UserID    int64     `json:"-"`
+	Name      string    `json:"name"`
 	Hash      []byte    `json:"-"`
 	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+	// zero until the token is used, updated at most once a minute
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// the scopes an admin user can make tokens of, in the order of the scope select
+func TokenScopes() []string {
+	return []string{ScopeReports, ScopeRefunds, ScopeTerminal}
+}
+
+// the scopes whose permissions the user's role all allows
+func (u User) TokenScopes() []string {
+	var scopes []string
+	for _, scope := range TokenScopes() {
+		allowed := true
+		for _, p := range scopePermissions[scope] {
+			allowed = allowed && u.Can(p)
+		}
+		if allowed {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// whether the token's scope allows permission, its user's role must allow it too
+func (t *Token) Allows(permission string) bool {
+	if t.Scope == ScopeAuthentication {
+		return true
+	}
+	for _, p := range scopePermissions[t.Scope] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
 }
 
 // generate a token that lasts for ttl, and return the token
@@ -43,68 +106,268 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 	return token, nil
 }
 
-// save token to database
-func (m *DBModel) InsertToken(t *Token, u User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// save token to database, a user can have several tokens
+func (m *DBModel) InsertToken(ctx context.Context, t *Token, u User) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
-	// delete existing tokens
-	stmt := `delete from tokens where user_id = ?`
-	_, err := m.DB.ExecContext(ctx, stmt, u.ID)
+	// delete expired tokens
+	stmt := `delete from tokens where user_id = ? and expiry < ?`
+	_, err := m.db().ExecContext(ctx, stmt, u.ID, time.Now())
 	if err != nil {
 		return err
 	}
 
-	stmt = `insert into tokens (user_id, name, email, token_hash, created_at, updated_at, expiry)
-			values (?, ?, ?, ?, ?, ?, ?)`
+	t.CreatedAt = time.Now()
 
-	_, err = m.DB.ExecContext(ctx, stmt,
+	stmt = `insert into tokens (user_id, name, email, token_hash, scope, created_at, updated_at, expiry)
+			values (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := m.db().ExecContext(ctx, stmt,
 		u.ID,
-		u.LastName,
+		t.Name,
 		u.Email,
 		t.Hash,
-		time.Now(),
-		time.Now(),
+		t.Scope,
+		t.CreatedAt,
+		t.CreatedAt,
 		t.Expiry,
 	)
+	if err != nil {
+		return err
+	}
 
+	id, err := result.LastInsertId()
 	if err != nil {
 		return err
 	}
+
+	t.ID = int(id)
+
 	return nil
 }
 
-// get user matching to token
-func (m *DBModel) GetUserForToken(token string) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// get user matching to token, and the token, recording that it was used
+func (m *DBModel) GetUserForToken(ctx context.Context, token string) (*User, *Token, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	tokenHash := sha256.Sum256([]byte(token))
 
 	var user User
+	var t Token
+	var lastUsed sql.NullTime
 
 	query := `
 		select
-			u.id, u.first_name, u.last_name, u.email
+			u.id, u.first_name, u.last_name, u.email, u.role, u.totp_enabled,
+			t.id, t.name, t.scope, t.expiry, t.created_at, t.last_used_at
 		from
 			users u
 			inner join tokens t on (u.id = t.user_id)
 		where
 			t.token_hash = ?
 			and t.expiry > ?
+			and t.scope <> ?
 	`
 
-	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], time.Now()).Scan(
+	err := m.db().QueryRowContext(ctx, query, tokenHash[:], time.Now(), ScopeLoginChallenge).Scan(
 		&user.ID,
 		&user.FirstName,
 		&user.LastName,
 		&user.Email,
+		&user.Role,
+		&user.TwoFactorEnabled,
+		&t.ID,
+		&t.Name,
+		&t.Scope,
+		&t.Expiry,
+		&t.CreatedAt,
+		&lastUsed,
 	)
 
 	if err != nil {
 		log.Println(err)
+		return nil, nil, err
+	}
+
+	t.UserID = int64(user.ID)
+	t.LastUsedAt = lastUsed.Time
+
+	// at most once a minute, so that every request doesn't write
+	now := time.Now()
+	if now.Sub(t.LastUsedAt) > time.Minute {
+		_, err = m.db().ExecContext(ctx, `update tokens set last_used_at = ? where id = ?`, now, t.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.LastUsedAt = now
+	}
+
+	return &user, &t, nil
+}
+
+// the tokens of a user that haven't expired, newest first
+func (m *DBModel) GetTokensForUser(ctx context.Context, userID int) ([]Token, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var tokens []Token
+
+	rows, err := m.db().QueryContext(ctx, `
+		select
+			id, name, scope, expiry, created_at, last_used_at
+		from
+			tokens
+		where
+			user_id = ? and expiry > ? and scope <> ?
+		order by
+			created_at desc, id desc`, userID, time.Now(), ScopeLoginChallenge)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := Token{UserID: int64(userID)}
+		var lastUsed sql.NullTime
+		err = rows.Scan(&t.ID, &t.Name, &t.Scope, &t.Expiry, &t.CreatedAt, &lastUsed)
+		if err != nil {
+			return nil, err
+		}
+		t.LastUsedAt = lastUsed.Time
+		tokens = append(tokens, t)
+	}
+
+	return tokens, nil
+}
+
+// delete an unexpired login challenge and return the id of its user, so that it
+// logs in once. sql.ErrNoRows when there is no such challenge
+func (m *DBModel) UseLoginChallenge(ctx context.Context, token string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+
+	var id, userID int
+	err := m.db().QueryRowContext(ctx, `
+		select id, user_id from tokens where token_hash = ? and scope = ? and expiry > ?`,
+		tokenHash[:], ScopeLoginChallenge, time.Now()).Scan(&id, &userID)
+	if err != nil {
+		return 0, err
+	}
+
+	// two logins with the same challenge, only the one that deletes it goes on
+	result, err := m.db().ExecContext(ctx, `delete from tokens where id = ?`, id)
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rowsAffected == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	return userID, nil
+}
+
+// revoke a token of a user, false when the user has no such token
+func (m *DBModel) DeleteToken(ctx context.Context, userID, id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, `delete from tokens where id = ? and user_id = ?`, id, userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// save a customer token to database, a customer can be logged in on several devices
+func (m *DBModel) InsertCustomerToken(ctx context.Context, t *Token, c Customer) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	// delete expired tokens
+	stmt := `delete from customer_tokens where customer_id = ? and expiry < ?`
+	_, err := m.db().ExecContext(ctx, stmt, c.ID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	stmt = `insert into customer_tokens (customer_id, token_hash, created_at, updated_at, expiry)
+			values (?, ?, ?, ?, ?)`
+
+	_, err = m.db().ExecContext(ctx, stmt,
+		c.ID,
+		t.Hash,
+		time.Now(),
+		time.Now(),
+		t.Expiry,
+	)
+
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// get customer matching to token
+func (m *DBModel) GetCustomerForToken(ctx context.Context, token string) (*Customer, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+
+	var customer Customer
+
+	query := `
+		select
+			c.id, c.first_name, c.last_name, c.email, c.stripe_customer_id
+		from
+			customers c
+			inner join customer_tokens t on (c.id = t.customer_id)
+		where
+			t.token_hash = ?
+			and t.expiry > ?
+	`
+
+	err := m.db().QueryRowContext(ctx, query, tokenHash[:], time.Now()).Scan(
+		&customer.ID,
+		&customer.FirstName,
+		&customer.LastName,
+		&customer.Email,
+		&customer.StripeCustomerID,
+	)
+
+	if err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	return &customer, nil
+}
+
+// delete a customer token when the customer logs out
+func (m *DBModel) DeleteCustomerToken(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+
+	_, err := m.db().ExecContext(ctx, `delete from customer_tokens where token_hash = ?`, tokenHash[:])
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
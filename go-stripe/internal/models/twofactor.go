@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+// recovery codes given to a user when they enable two-factor authentication
+const RecoveryCodeCount = 10
+
+// type for the second factor of an admin user. Secret is encrypted, and only
+// enabled once the user has entered a code of it. LastStep is the step of the
+// last code used, so that a code can't be used twice
+type TwoFactor struct {
+	UserID            int
+	Secret            string
+	Enabled           bool
+	LastStep          int64
+	RecoveryCodesLeft int
+}
+
+// new single-use recovery codes, shown to the user once, and the hashes they are saved as
+func GenerateRecoveryCodes(n int) ([]string, [][]byte, error) {
+	codes := make([]string, n)
+	hashes := make([][]byte, n)
+
+	for i := range codes {
+		randomBytes := make([]byte, 5)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = HashRecoveryCode(code)
+	}
+
+	return codes, hashes, nil
+}
+
+// hash of a recovery code, however it was typed
+func HashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// the second factor of a user, with the number of recovery codes not used yet
+func (m *DBModel) GetTwoFactor(ctx context.Context, userID int) (TwoFactor, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	t := TwoFactor{UserID: userID}
+
+	row := m.db().QueryRowContext(ctx, `
+		select
+			u.totp_secret, u.totp_enabled, u.totp_last_step,
+			(select count(id) from user_recovery_codes where user_id = u.id and used_at is null)
+		from
+			users u
+		where
+			u.id = ?`, userID)
+
+	err := row.Scan(&t.Secret, &t.Enabled, &t.LastStep, &t.RecoveryCodesLeft)
+	if err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
+
+// save the encrypted secret of an authenticator app the user is setting up
+func (m *DBModel) SetTwoFactorSecret(ctx context.Context, userID int, secret string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	_, err := m.db().ExecContext(ctx, `
+		update users set
+			totp_secret = ?, totp_enabled = 0, totp_last_step = 0, updated_at = ?
+		where
+			id = ?`, secret, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// turn on the second factor once the user has entered the code of step, replacing
+// their recovery codes with hashes
+func (m *DBModel) EnableTwoFactor(ctx context.Context, userID int, step int64, hashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	return m.withTx(ctx, func(tx *DBModel) error {
+		_, err := tx.db().ExecContext(ctx, `
+			update users set
+				totp_enabled = 1, totp_last_step = ?, updated_at = ?
+			where
+				id = ?`, step, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.db().ExecContext(ctx, `delete from user_recovery_codes where user_id = ?`, userID)
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range hashes {
+			_, err = tx.db().ExecContext(ctx, `
+				insert into user_recovery_codes (user_id, code_hash, created_at)
+				values (?, ?, ?)`, userID, hash, time.Now())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// record that the code of step was used, false when a code of that step or a later one already was
+func (m *DBModel) UseTwoFactorStep(ctx context.Context, userID int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, `
+		update users set totp_last_step = ? where id = ? and totp_last_step < ?`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// use up a recovery code of the user, false when it doesn't exist or was used already
+func (m *DBModel) UseRecoveryCode(ctx context.Context, userID int, hash []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, `
+		update user_recovery_codes set used_at = ?
+		where
+			user_id = ? and code_hash = ? and used_at is null
+		limit 1`, time.Now(), userID, hash)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// turn off the second factor of a user and forget its secret and recovery codes
+func (m *DBModel) ResetTwoFactor(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	return m.withTx(ctx, func(tx *DBModel) error {
+		_, err := tx.db().ExecContext(ctx, `
+			update users set
+				totp_secret = '', totp_enabled = 0, totp_last_step = 0, updated_at = ?
+			where
+				id = ?`, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.db().ExecContext(ctx, `delete from user_recovery_codes where user_id = ?`, userID)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,98 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// returned for currencies the shop doesn't sell in
+var ErrUnsupportedCurrency = errors.New("unsupported currency")
+
+// currency the shop can charge in, amounts are always kept in minor units
+// (cents, or whole units for zero-decimal currencies like jpy)
+type Currency struct {
+	Code     string
+	Symbol   string
+	Decimals int
+}
+
+// supported currencies in the order they are offered on the storefront
+var currencies = []Currency{
+	{Code: "cad", Symbol: "CA$", Decimals: 2},
+	{Code: "usd", Symbol: "US$", Decimals: 2},
+	{Code: "eur", Symbol: "€", Decimals: 2},
+	{Code: "gbp", Symbol: "£", Decimals: 2},
+	{Code: "jpy", Symbol: "¥", Decimals: 0},
+	{Code: "krw", Symbol: "₩", Decimals: 0},
+}
+
+// list the supported currencies
+func Currencies() []Currency {
+	return append([]Currency(nil), currencies...)
+}
+
+// find a supported currency by its iso code, in any case
+func Lookup(code string) (Currency, error) {
+	code = strings.ToLower(code)
+	for _, c := range currencies {
+		if c.Code == code {
+			return c, nil
+		}
+	}
+	return Currency{}, fmt.Errorf("%w: %q", ErrUnsupportedCurrency, code)
+}
+
+// format an amount in minor units with the currency symbol, e.g. CA$1,234.50 or ¥1,235
+func Format(amount int, code string) string {
+	c, err := Lookup(code)
+	if err != nil {
+		return FormatCode(amount, code)
+	}
+
+	if amount < 0 {
+		return "-" + c.Symbol + number(-amount, c.Decimals)
+	}
+	return c.Symbol + number(amount, c.Decimals)
+}
+
+// format an amount in minor units followed by the upper case iso code, e.g. 1,234.50 CAD,
+// for output that can't print every currency symbol
+func FormatCode(amount int, code string) string {
+	decimals := 2
+	if c, err := Lookup(code); err == nil {
+		decimals = c.Decimals
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	return fmt.Sprintf("%s%s %s", sign, number(amount, decimals), strings.ToUpper(code))
+}
+
+// print a non-negative amount in minor units with thousands separators
+func number(amount, decimals int) string {
+	unit := 1
+	for i := 0; i < decimals; i++ {
+		unit *= 10
+	}
+
+	whole := fmt.Sprintf("%d", amount/unit)
+
+	var b strings.Builder
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+
+	if decimals > 0 {
+		fmt.Fprintf(&b, ".%0*d", decimals, amount%unit)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package money
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		code     string
+		want     string
+		decimals int
+	}{
+		{"cad", "cad", 2},
+		{"USD", "usd", 2},
+		{"Eur", "eur", 2},
+		{"gbp", "gbp", 2},
+		{"jpy", "jpy", 0},
+		{"KRW", "krw", 0},
+	}
+
+	for _, tt := range tests {
+		c, err := Lookup(tt.code)
+		if err != nil {
+			t.Errorf("Lookup(%q): %v", tt.code, err)
+			continue
+		}
+		if c.Code != tt.want || c.Decimals != tt.decimals {
+			t.Errorf("Lookup(%q) = %s with %d decimals, want %s with %d", tt.code, c.Code, c.Decimals, tt.want, tt.decimals)
+		}
+	}
+
+	for _, code := range []string{"", "chf", "yen"} {
+		if _, err := Lookup(code); !errors.Is(err, ErrUnsupportedCurrency) {
+			t.Errorf("Lookup(%q): got %v, want ErrUnsupportedCurrency", code, err)
+		}
+	}
+}
+
+// amounts are minor units, which are whole yen and won but cents of the other currencies
+func TestFormatMinorUnits(t *testing.T) {
+	tests := []struct {
+		amount int
+		code   string
+		want   string
+	}{
+		{1, "cad", "CA$0.01"},
+		{1, "jpy", "¥1"},
+		{1, "krw", "₩1"},
+		{100, "usd", "US$1.00"},
+		{100, "jpy", "¥100"},
+		{123450, "eur", "€1,234.50"},
+		{123450, "krw", "₩123,450"},
+		{0, "gbp", "£0.00"},
+		{0, "jpy", "¥0"},
+	}
+
+	for _, tt := range tests {
+		if got := Format(tt.amount, tt.code); got != tt.want {
+			t.Errorf("Format(%d, %q) = %q, want %q", tt.amount, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int
+		code   string
+		want   string
+	}{
+		{"thousands", 123456789, "cad", "CA$1,234,567.89"},
+		{"exact thousand", 100000, "cad", "CA$1,000.00"},
+		{"under a thousand", 99999, "cad", "CA$999.99"},
+		{"leading zero cents", 1005, "gbp", "£10.05"},
+		{"zero-decimal thousands", 1234567, "jpy", "¥1,234,567"},
+		{"negative", -1050, "usd", "-US$10.50"},
+		{"negative zero-decimal", -1500, "krw", "-₩1,500"},
+		{"upper case code", 1050, "USD", "US$10.50"},
+		{"unsupported currency", 1050, "chf", "10.50 CHF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Format(tt.amount, tt.code); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatCode(t *testing.T) {
+	tests := []struct {
+		amount int
+		code   string
+		want   string
+	}{
+		{123450, "cad", "1,234.50 CAD"},
+		{123450, "jpy", "123,450 JPY"},
+		{5, "krw", "5 KRW"},
+		{5, "eur", "0.05 EUR"},
+		{-250, "gbp", "-2.50 GBP"},
+		{-250, "jpy", "-250 JPY"},
+		// unsupported currencies are taken to have cents
+		{250, "chf", "2.50 CHF"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatCode(tt.amount, tt.code); got != tt.want {
+			t.Errorf("FormatCode(%d, %q) = %q, want %q", tt.amount, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestCurrenciesIsACopy(t *testing.T) {
+	list := Currencies()
+	if len(list) == 0 || list[0].Code != "cad" {
+		t.Fatalf("got %+v, want cad first", list)
+	}
+
+	list[0].Decimals = 0
+	if c, _ := Lookup("cad"); c.Decimals != 2 {
+		t.Error("changing the list changed the supported currencies")
+	}
+}
@@ -0,0 +1,237 @@
+// Package ratelimit counts the hits of keys, like an ip address or the email of an
+// account, in sliding windows kept in a Store that every instance of the servers
+// shares, slows down the keys that keep failing and locks them out after too many
+// failures.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// the hits of a key since some time
+type Hits struct {
+	Count int
+	First time.Time
+	Last  time.Time
+}
+
+// a key locked out until a time, Email is the account told about it
+type Lock struct {
+	Key   string
+	Email string
+	Until time.Time
+}
+
+// where hits and locks are kept, implemented by the mysql and in-memory stores of models
+type Store interface {
+	AddRateLimitHit(ctx context.Context, key string, at time.Time) error
+	GetRateLimitHits(ctx context.Context, key string, since time.Time) (Hits, error)
+	DeleteRateLimitHits(ctx context.Context, key string) error
+	LockRateLimitKey(ctx context.Context, l Lock) error
+	// the end of the lock of key, zero when it isn't locked
+	GetRateLimitLock(ctx context.Context, key string) (time.Time, error)
+	UnlockRateLimitKey(ctx context.Context, key string) error
+}
+
+// a number of hits allowed in a sliding window
+type Rule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// rules shared by the api and the web server
+var (
+	LoginPerIP    = Rule{Limit: 30, Window: 5 * time.Minute}
+	ResetPerIP    = Rule{Limit: 10, Window: time.Hour}
+	ResetPerEmail = Rule{Limit: 3, Window: time.Hour}
+)
+
+// how long hits are kept, longer than the window of any rule
+const Retention = 24 * time.Hour
+
+// keys of the hits and locks
+func AccountKey(email string) string {
+	return "account:" + normalize(email)
+}
+
+// the account of a customer, apart from an admin user with the same email
+func CustomerKey(email string) string {
+	return "customer:" + normalize(email)
+}
+
+func IPKey(action, ip string) string {
+	return action + ":ip:" + ip
+}
+
+func EmailKey(action, email string) string {
+	return action + ":email:" + normalize(email)
+}
+
+func normalize(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// the error of a key that must wait before its next attempt
+type LimitedError struct {
+	Wait   time.Duration
+	Locked bool
+}
+
+func (e *LimitedError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many failed attempts, this account is locked for %s", e.wait())
+	}
+	return fmt.Sprintf("too many attempts, try again in %s", e.wait())
+}
+
+// the wait in whole seconds, for the Retry-After header
+func (e *LimitedError) Seconds() int {
+	return int(math.Ceil(e.Wait.Seconds()))
+}
+
+func (e *LimitedError) wait() time.Duration {
+	return time.Duration(e.Seconds()) * time.Second
+}
+
+type Limiter struct {
+	Store Store
+	// failures of a key within FailureWindow before it is locked for Lockout
+	MaxFailures   int
+	FailureWindow time.Duration
+	Lockout       time.Duration
+	// after DelayAfter failures each attempt waits Delay after the last one,
+	// doubled with every further failure up to MaxDelay
+	DelayAfter int
+	Delay      time.Duration
+	MaxDelay   time.Duration
+	// the clock of the limiter, time.Now when nil
+	Now func() time.Time
+}
+
+// a limiter locking keys after maxFailures failures in the lockout period
+func New(store Store, maxFailures int, lockout time.Duration) *Limiter {
+	return &Limiter{
+		Store:         store,
+		MaxFailures:   maxFailures,
+		FailureWindow: lockout,
+		Lockout:       lockout,
+		DelayAfter:    3,
+		Delay:         time.Second,
+		MaxDelay:      time.Minute,
+	}
+}
+
+func (l *Limiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// record a hit of key if rule allows it, and return a *LimitedError otherwise
+func (l *Limiter) Allow(ctx context.Context, key string, rule Rule) error {
+	now := l.now()
+
+	hits, err := l.Store.GetRateLimitHits(ctx, key, now.Add(-rule.Window))
+	if err != nil {
+		return err
+	}
+
+	if hits.Count >= rule.Limit {
+		// the oldest hit leaves the window first
+		return &LimitedError{Wait: hits.First.Add(rule.Window).Sub(now)}
+	}
+
+	return l.Store.AddRateLimitHit(ctx, key, now)
+}
+
+// return a *LimitedError if key is locked, or still has to wait after its last failure
+func (l *Limiter) Check(ctx context.Context, key string) error {
+	now := l.now()
+
+	until, err := l.Store.GetRateLimitLock(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if until.After(now) {
+		return &LimitedError{Wait: until.Sub(now), Locked: true}
+	}
+
+	hits, err := l.Store.GetRateLimitHits(ctx, key, now.Add(-l.FailureWindow))
+	if err != nil {
+		return err
+	}
+
+	if hits.Count < l.DelayAfter {
+		return nil
+	}
+
+	delay := l.MaxDelay
+	if n := hits.Count - l.DelayAfter; n < 16 && l.Delay<<n < l.MaxDelay {
+		delay = l.Delay << n
+	}
+
+	if wait := hits.Last.Add(delay).Sub(now); wait > 0 {
+		return &LimitedError{Wait: wait}
+	}
+
+	return nil
+}
+
+// record a failed attempt of key, and lock it once it has failed MaxFailures times
+// within FailureWindow. email is told about the lock
+func (l *Limiter) Fail(ctx context.Context, key, email string) error {
+	now := l.now()
+
+	err := l.Store.AddRateLimitHit(ctx, key, now)
+	if err != nil {
+		return err
+	}
+
+	hits, err := l.Store.GetRateLimitHits(ctx, key, now.Add(-l.FailureWindow))
+	if err != nil {
+		return err
+	}
+
+	if hits.Count < l.MaxFailures {
+		return nil
+	}
+
+	// failures let through before the lock keep it as it is, so it is told about once
+	until, err := l.Store.GetRateLimitLock(ctx, key)
+	if err != nil || until.After(now) {
+		return err
+	}
+
+	return l.Store.LockRateLimitKey(ctx, Lock{Key: key, Email: normalize(email), Until: now.Add(l.Lockout)})
+}
+
+// forget the failures of key after a successful attempt
+func (l *Limiter) Succeed(ctx context.Context, key string) error {
+	return l.Store.DeleteRateLimitHits(ctx, key)
+}
+
+// lift the lock of key and forget its failures
+func (l *Limiter) Unlock(ctx context.Context, key string) error {
+	err := l.Store.UnlockRateLimitKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return l.Store.DeleteRateLimitHits(ctx, key)
+}
+
+// the end of the lock of key, zero when it isn't locked
+func (l *Limiter) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	until, err := l.Store.GetRateLimitLock(ctx, key)
+	if err != nil || !until.After(l.now()) {
+		return time.Time{}, err
+	}
+
+	return until, nil
+}
@@ -0,0 +1,339 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"myapp/internal/models"
+	"myapp/internal/ratelimit"
+	"testing"
+	"time"
+)
+
+// a clock the tests move by hand
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+// a limiter on a memory store and a clock starting now, locking keys after 5
+// failures within 10 minutes for 15 minutes, without delays
+func newLimiter() (*ratelimit.Limiter, *models.MemoryStore, *clock) {
+	store := models.NewMemoryStore()
+	c := &clock{t: time.Now()}
+
+	l := ratelimit.New(store, 5, 15*time.Minute)
+	l.FailureWindow = 10 * time.Minute
+	l.Delay = 0
+	l.Now = c.now
+
+	return l, store, c
+}
+
+// the wait of a *LimitedError, and whether it is a lock
+func limited(t *testing.T, err error) (time.Duration, bool) {
+	t.Helper()
+
+	if err == nil {
+		return 0, false
+	}
+
+	var le *ratelimit.LimitedError
+	if !errors.As(err, &le) {
+		t.Fatalf("got %v, want a *LimitedError", err)
+	}
+	return le.Wait, le.Locked
+}
+
+func TestAllow(t *testing.T) {
+	ctx := context.Background()
+	l, _, c := newLimiter()
+	rule := ratelimit.Rule{Limit: 3, Window: time.Minute}
+
+	tests := []struct {
+		after time.Duration
+		wait  time.Duration
+	}{
+		{0, 0},
+		{10 * time.Second, 0},
+		{10 * time.Second, 0},
+		// the first hit leaves the window 40 seconds later
+		{20 * time.Second, 20 * time.Second},
+		{10 * time.Second, 10 * time.Second},
+		{11 * time.Second, 0},
+		// the limited attempts weren't counted
+		{0, 9 * time.Second},
+	}
+
+	for i, tt := range tests {
+		c.advance(tt.after)
+
+		wait, locked := limited(t, l.Allow(ctx, "key", rule))
+		if wait != tt.wait || locked {
+			t.Errorf("hit %d: got wait %s, locked %v, want wait %s", i, wait, locked, tt.wait)
+		}
+	}
+
+	// other keys have their own hits
+	if err := l.Allow(ctx, "other", rule); err != nil {
+		t.Errorf("got %v for another key", err)
+	}
+}
+
+func TestCheckDelaysFailures(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		failures int
+		wait     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{6, 8 * time.Second},
+		{9, time.Minute},
+		{25, time.Minute},
+	}
+
+	for _, tt := range tests {
+		l, _, c := newLimiter()
+		l.MaxFailures = 100
+		l.Delay = time.Second
+
+		for i := 0; i < tt.failures; i++ {
+			if err := l.Fail(ctx, "key", "ada@example.com"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		wait, locked := limited(t, l.Check(ctx, "key"))
+		if wait != tt.wait || locked {
+			t.Errorf("%d failures: got wait %s, locked %v, want wait %s", tt.failures, wait, locked, tt.wait)
+		}
+
+		// the delay runs from the last failure
+		c.advance(tt.wait)
+		if err := l.Check(ctx, "key"); err != nil {
+			t.Errorf("%d failures: got %v once the delay was over", tt.failures, err)
+		}
+	}
+}
+
+func TestFailLocksOut(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// the time before each failure
+		gaps   []time.Duration
+		locked bool
+	}{
+		{"under the limit", []time.Duration{0, 0, 0, 0}, false},
+		{"at the limit", []time.Duration{0, 0, 0, 0, 0}, true},
+		{"within the window", []time.Duration{0, 2 * time.Minute, 2 * time.Minute, 2 * time.Minute, time.Minute}, true},
+		{"spread past the window", []time.Duration{0, 3 * time.Minute, 3 * time.Minute, 3 * time.Minute, 3 * time.Minute}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _, c := newLimiter()
+
+			for _, gap := range tt.gaps {
+				c.advance(gap)
+				if err := l.Fail(ctx, "key", "ada@example.com"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			wait, locked := limited(t, l.Check(ctx, "key"))
+			if locked != tt.locked {
+				t.Fatalf("got locked %v, want %v", locked, tt.locked)
+			}
+			if !tt.locked {
+				return
+			}
+			if wait != 15*time.Minute {
+				t.Errorf("got wait %s, want the whole lockout", wait)
+			}
+
+			until, err := l.LockedUntil(ctx, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !until.Equal(c.now().Add(15 * time.Minute)) {
+				t.Errorf("locked until %s, want %s", until, c.now().Add(15*time.Minute))
+			}
+		})
+	}
+}
+
+func TestLockoutExpires(t *testing.T) {
+	ctx := context.Background()
+	l, _, c := newLimiter()
+
+	for i := 0; i < 5; i++ {
+		if err := l.Fail(ctx, "key", "ada@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.advance(15*time.Minute - time.Second)
+	if wait, locked := limited(t, l.Check(ctx, "key")); !locked || wait != time.Second {
+		t.Errorf("got wait %s, locked %v a second before the end of the lock", wait, locked)
+	}
+
+	c.advance(time.Second)
+	if err := l.Check(ctx, "key"); err != nil {
+		t.Errorf("got %v once the lock is over", err)
+	}
+	if until, err := l.LockedUntil(ctx, "key"); err != nil || !until.IsZero() {
+		t.Errorf("got locked until %s, %v once the lock is over", until, err)
+	}
+
+	// the failures before the lock have left the window, one more doesn't lock again
+	if err := l.Fail(ctx, "key", "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, locked := limited(t, l.Check(ctx, "key")); locked {
+		t.Error("locked again by the first failure after the lock")
+	}
+}
+
+func TestSucceedForgetsFailures(t *testing.T) {
+	ctx := context.Background()
+	l, _, _ := newLimiter()
+
+	for i := 0; i < 4; i++ {
+		if err := l.Fail(ctx, "key", "ada@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Succeed(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := l.Fail(ctx, "key", "ada@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, locked := limited(t, l.Check(ctx, "key")); locked {
+		t.Error("failures before a successful attempt still counted")
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	ctx := context.Background()
+	l, _, _ := newLimiter()
+
+	for i := 0; i < 5; i++ {
+		if err := l.Fail(ctx, "key", "ada@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Unlock(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Check(ctx, "key"); err != nil {
+		t.Errorf("got %v after unlocking", err)
+	}
+
+	// the failures were forgotten with the lock
+	if err := l.Fail(ctx, "key", "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, locked := limited(t, l.Check(ctx, "key")); locked {
+		t.Error("locked again by the first failure after unlocking")
+	}
+}
+
+// failures let through before the lock, by requests running at the same time,
+// don't lock the key again and have it told about twice
+func TestLockIsNotifiedOnce(t *testing.T) {
+	ctx := context.Background()
+	l, store, c := newLimiter()
+
+	for i := 0; i < 5; i++ {
+		if err := l.Fail(ctx, "key", "Ada@Example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	until, err := l.LockedUntil(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locks, err := store.GetRateLimitLocksToNotify(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locks) != 1 || locks[0].Email != "ada@example.com" || !locks[0].Until.Equal(until) {
+		t.Fatalf("got locks to notify %+v", locks)
+	}
+	if claimed, err := store.SetRateLimitLockNotified(ctx, "key"); err != nil || !claimed {
+		t.Fatalf("got claimed %v, %v", claimed, err)
+	}
+
+	c.advance(time.Minute)
+	for i := 0; i < 3; i++ {
+		if err := l.Fail(ctx, "key", "ada@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	locks, err = store.GetRateLimitLocksToNotify(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locks) != 0 {
+		t.Errorf("got %d locks to notify again", len(locks))
+	}
+
+	if later, err := l.LockedUntil(ctx, "key"); err != nil || !later.Equal(until) {
+		t.Errorf("got locked until %s, %v, want the lock unchanged", later, err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{ratelimit.AccountKey(" Ada@Example.com "), "account:ada@example.com"},
+		{ratelimit.CustomerKey("ADA@example.com"), "customer:ada@example.com"},
+		{ratelimit.IPKey("login", "192.0.2.1"), "login:ip:192.0.2.1"},
+		{ratelimit.EmailKey("reset", "Ada@example.com"), "reset:email:ada@example.com"},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got key %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestLimitedErrorRoundsUp(t *testing.T) {
+	tests := []struct {
+		wait    time.Duration
+		seconds int
+	}{
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Millisecond, 1},
+		{15 * time.Minute, 900},
+	}
+
+	for _, tt := range tests {
+		err := &ratelimit.LimitedError{Wait: tt.wait}
+		if s := err.Seconds(); s != tt.seconds {
+			t.Errorf("Seconds() of %s = %d, want %d", tt.wait, s, tt.seconds)
+		}
+	}
+}
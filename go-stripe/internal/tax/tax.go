@@ -0,0 +1,286 @@
+package tax
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// category of widgets without a more specific one
+const DefaultCategory = "standard"
+
+// category of a rate that applies to every category without its own rate in the jurisdiction
+const AnyCategory = "*"
+
+// returned when an address lacks what is needed to pick the rates for it
+type AddressError struct {
+	Field   string
+	Country string
+}
+
+func (e *AddressError) Error() string {
+	if e.Field == "region" {
+		return fmt.Sprintf("a billing province or state is required for %s", e.Country)
+	}
+	return "a billing country is required"
+}
+
+// location taxes are computed for, iso 3166 country code and subdivision code
+// without the country prefix, e.g. CA and ON
+type Address struct {
+	Country string `json:"country"`
+	Region  string `json:"region"`
+}
+
+// normalize codes typed by a customer
+func NewAddress(country, region string) Address {
+	return Address{
+		Country: strings.ToUpper(strings.TrimSpace(country)),
+		Region:  strings.ToUpper(strings.TrimSpace(region)),
+	}
+}
+
+// jurisdiction code of the address, e.g. CA-ON
+func (a Address) String() string {
+	if a.Region == "" {
+		return a.Country
+	}
+	return a.Country + "-" + a.Region
+}
+
+// one tax levied by a jurisdiction, an empty region applies to the whole country
+type Rate struct {
+	Country      string  `json:"country"`
+	Region       string  `json:"region"`
+	Category     string  `json:"category"`
+	Jurisdiction string  `json:"jurisdiction"`
+	Name         string  `json:"name"`
+	Percent      float64 `json:"percent"`
+}
+
+// amount to tax in minor units and the tax category of what is sold
+type Item struct {
+	Category string
+	Amount   int
+}
+
+// tax charged by one jurisdiction on an order
+type Line struct {
+	Jurisdiction string  `json:"jurisdiction"`
+	Name         string  `json:"name"`
+	Percent      float64 `json:"percent"`
+	Taxable      int     `json:"taxable"`
+	Amount       int     `json:"amount"`
+}
+
+// rate table loaded from a file
+type Table struct {
+	rates []Rate
+	// countries with rates that depend on the region
+	regional map[string]bool
+}
+
+// build a table from rates, checking every row
+func NewTable(rates []Rate) (*Table, error) {
+	t := &Table{regional: make(map[string]bool)}
+
+	for i, r := range rates {
+		r.Country = strings.ToUpper(strings.TrimSpace(r.Country))
+		r.Region = strings.ToUpper(strings.TrimSpace(r.Region))
+		r.Category = strings.ToLower(strings.TrimSpace(r.Category))
+		r.Jurisdiction = strings.ToUpper(strings.TrimSpace(r.Jurisdiction))
+		r.Name = strings.TrimSpace(r.Name)
+
+		if r.Category == "" {
+			r.Category = AnyCategory
+		}
+
+		switch {
+		case len(r.Country) != 2:
+			return nil, fmt.Errorf("tax rate %d: country must be a two letter code", i+1)
+		case r.Jurisdiction == "" || r.Name == "":
+			return nil, fmt.Errorf("tax rate %d: jurisdiction and name are required", i+1)
+		case r.Percent < 0 || r.Percent > 100:
+			return nil, fmt.Errorf("tax rate %d: percent must be between 0 and 100", i+1)
+		}
+
+		if r.Region != "" {
+			t.regional[r.Country] = true
+		}
+		t.rates = append(t.rates, r)
+	}
+
+	return t, nil
+}
+
+// load a rate table from a .csv file with a header row naming the Rate fields, or a .json array of rates
+func Load(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rates []Rate
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.NewDecoder(f).Decode(&rates)
+	case ".csv":
+		rates, err = readCSV(f)
+	default:
+		err = errors.New("rate tables must be .csv or .json files")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	t, err := NewTable(rates)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return t, nil
+}
+
+func readCSV(r io.Reader) ([]Rate, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for _, name := range []string{"country", "region", "category", "jurisdiction", "name", "percent"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+
+	var rates []Rate
+	for i, rec := range records[1:] {
+		percent, err := strconv.ParseFloat(rec[columns["percent"]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid percent %q", i+2, rec[columns["percent"]])
+		}
+
+		rates = append(rates, Rate{
+			Country:      rec[columns["country"]],
+			Region:       rec[columns["region"]],
+			Category:     rec[columns["category"]],
+			Jurisdiction: rec[columns["jurisdiction"]],
+			Name:         rec[columns["name"]],
+			Percent:      percent,
+		})
+	}
+
+	return rates, nil
+}
+
+// check that an address has what the table needs to tax it
+func (t *Table) Validate(addr Address) error {
+	if addr.Country == "" {
+		return &AddressError{Field: "country"}
+	}
+	if addr.Region == "" && t != nil && t.regional[addr.Country] {
+		return &AddressError{Field: "region", Country: addr.Country}
+	}
+	return nil
+}
+
+// rates that apply to category at addr, a rate for the category replaces the
+// jurisdiction's rate for any category
+func (t *Table) Rates(addr Address, category string) []Rate {
+	if t == nil {
+		return nil
+	}
+
+	if category == "" {
+		category = DefaultCategory
+	}
+
+	var matched []Rate
+	for _, r := range t.rates {
+		if r.Country != addr.Country || (r.Region != "" && r.Region != addr.Region) {
+			continue
+		}
+		if r.Category != category && r.Category != AnyCategory {
+			continue
+		}
+
+		replaced := false
+		for i, m := range matched {
+			if m.Jurisdiction == r.Jurisdiction && m.Name == r.Name {
+				if r.Category == category {
+					matched[i] = r
+				}
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			matched = append(matched, r)
+		}
+	}
+
+	return matched
+}
+
+// compute the taxes on items sold to addr, one line per jurisdiction and tax,
+// rounded to the nearest minor unit once per line
+func (t *Table) Calculate(addr Address, items []Item) ([]Line, error) {
+	err := t.Validate(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []Line
+	for _, item := range items {
+		for _, r := range t.Rates(addr, item.Category) {
+			if r.Percent == 0 || item.Amount <= 0 {
+				continue
+			}
+
+			found := false
+			for i, l := range lines {
+				if l.Jurisdiction == r.Jurisdiction && l.Name == r.Name && l.Percent == r.Percent {
+					lines[i].Taxable += item.Amount
+					found = true
+					break
+				}
+			}
+			if !found {
+				lines = append(lines, Line{Jurisdiction: r.Jurisdiction, Name: r.Name, Percent: r.Percent, Taxable: item.Amount})
+			}
+		}
+	}
+
+	for i, l := range lines {
+		lines[i].Amount = int(math.Round(float64(l.Taxable) * l.Percent / 100))
+	}
+
+	return lines, nil
+}
+
+// label of a tax line for receipts and invoices, e.g. "GST 5%"
+func (l Line) Label() string {
+	return fmt.Sprintf("%s %s%%", l.Name, strconv.FormatFloat(l.Percent, 'f', -1, 64))
+}
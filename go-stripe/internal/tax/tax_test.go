@@ -0,0 +1,254 @@
+package tax
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testTable(t *testing.T) *Table {
+	t.Helper()
+
+	table, err := NewTable([]Rate{
+		{Country: "ca", Jurisdiction: "CA", Name: "GST", Percent: 5},
+		{Country: "CA", Region: "qc", Jurisdiction: "CA-QC", Name: "QST", Percent: 9.975},
+		{Country: "CA", Region: "ON", Jurisdiction: "CA-ON", Name: "HST", Percent: 8},
+		{Country: "US", Region: "NY", Jurisdiction: "US-NY", Name: "Sales Tax", Percent: 4},
+		{Country: "US", Region: "NY", Category: "food", Jurisdiction: "US-NY", Name: "Sales Tax", Percent: 0},
+		{Country: "DE", Jurisdiction: "DE", Name: "VAT", Percent: 19},
+		{Country: "DE", Category: "Books", Jurisdiction: "DE", Name: "VAT", Percent: 7},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return table
+}
+
+func TestRates(t *testing.T) {
+	table := testTable(t)
+
+	tests := []struct {
+		name     string
+		addr     Address
+		category string
+		want     []string
+	}{
+		{"country rate", NewAddress("ca", " ab "), "", []string{"GST 5%"}},
+		{"country and region rates", NewAddress("CA", "QC"), "", []string{"GST 5%", "QST 9.975%"}},
+		{"another region", NewAddress("CA", "ON"), "", []string{"GST 5%", "HST 8%"}},
+		{"region only", NewAddress("US", "NY"), DefaultCategory, []string{"Sales Tax 4%"}},
+		{"region without rates", NewAddress("US", "OR"), "", nil},
+		{"category replaces any", NewAddress("US", "NY"), "food", []string{"Sales Tax 0%"}},
+		{"category of the country", NewAddress("DE", ""), "books", []string{"VAT 7%"}},
+		{"category without its own rate", NewAddress("DE", ""), "toys", []string{"VAT 19%"}},
+		{"country without rates", NewAddress("FR", ""), "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range table.Rates(tt.addr, tt.category) {
+				got = append(got, Line{Name: r.Name, Percent: r.Percent}.Label())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	table := testTable(t)
+
+	tests := []struct {
+		name  string
+		table *Table
+		addr  Address
+		field string
+	}{
+		{"no country", table, NewAddress("", ""), "country"},
+		{"region required", table, NewAddress("CA", ""), "region"},
+		{"region given", table, NewAddress("CA", "ON"), ""},
+		{"country without regions", table, NewAddress("DE", ""), ""},
+		{"unknown country", table, NewAddress("FR", ""), ""},
+		{"no table", nil, NewAddress("CA", ""), ""},
+		{"no table nor country", nil, NewAddress("", ""), "country"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.table.Validate(tt.addr)
+
+			var addrErr *AddressError
+			switch {
+			case tt.field == "" && err != nil:
+				t.Errorf("got %v", err)
+			case tt.field != "" && !errors.As(err, &addrErr):
+				t.Errorf("got %v, want an *AddressError", err)
+			case tt.field != "" && addrErr.Field != tt.field:
+				t.Errorf("got an error about the %s, want the %s", addrErr.Field, tt.field)
+			}
+		})
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	table := testTable(t)
+
+	tests := []struct {
+		name  string
+		addr  Address
+		items []Item
+		want  []Line
+	}{
+		{
+			// 3 x 16.65 rounds to 3 x 17 = 51 per item, the order is taxed once on 999
+			name:  "rounded per line, not per item",
+			addr:  NewAddress("CA", "AB"),
+			items: []Item{{Amount: 333}, {Amount: 333}, {Amount: 333}},
+			want:  []Line{{Jurisdiction: "CA", Name: "GST", Percent: 5, Taxable: 999, Amount: 50}},
+		},
+		{
+			name:  "half rounded up",
+			addr:  NewAddress("CA", "AB"),
+			items: []Item{{Amount: 10}},
+			want:  []Line{{Jurisdiction: "CA", Name: "GST", Percent: 5, Taxable: 10, Amount: 1}},
+		},
+		{
+			name:  "one line per tax",
+			addr:  NewAddress("CA", "QC"),
+			items: []Item{{Amount: 1000}, {Amount: 2000}},
+			want: []Line{
+				{Jurisdiction: "CA", Name: "GST", Percent: 5, Taxable: 3000, Amount: 150},
+				{Jurisdiction: "CA-QC", Name: "QST", Percent: 9.975, Taxable: 3000, Amount: 299},
+			},
+		},
+		{
+			name:  "one line per rate of a tax",
+			addr:  NewAddress("DE", ""),
+			items: []Item{{Category: "books", Amount: 1000}, {Amount: 1000}, {Category: "books", Amount: 500}},
+			want: []Line{
+				{Jurisdiction: "DE", Name: "VAT", Percent: 7, Taxable: 1500, Amount: 105},
+				{Jurisdiction: "DE", Name: "VAT", Percent: 19, Taxable: 1000, Amount: 190},
+			},
+		},
+		{
+			name:  "exempt category",
+			addr:  NewAddress("US", "NY"),
+			items: []Item{{Category: "food", Amount: 1000}, {Amount: 500}},
+			want:  []Line{{Jurisdiction: "US-NY", Name: "Sales Tax", Percent: 4, Taxable: 500, Amount: 20}},
+		},
+		{
+			// lines of 1000 and 2000 with a discount of 600 spread as 200 and 400
+			name:  "discounted subtotal",
+			addr:  NewAddress("CA", "AB"),
+			items: []Item{{Amount: 1000 - 200}, {Amount: 2000 - 400}},
+			want:  []Line{{Jurisdiction: "CA", Name: "GST", Percent: 5, Taxable: 2400, Amount: 120}},
+		},
+		{
+			name:  "line discounted to nothing",
+			addr:  NewAddress("CA", "AB"),
+			items: []Item{{Amount: 0}, {Amount: 999}},
+			want:  []Line{{Jurisdiction: "CA", Name: "GST", Percent: 5, Taxable: 999, Amount: 50}},
+		},
+		{
+			name:  "all discounted",
+			addr:  NewAddress("CA", "AB"),
+			items: []Item{{Amount: 0}},
+			want:  nil,
+		},
+		{
+			name:  "no rates",
+			addr:  NewAddress("FR", ""),
+			items: []Item{{Amount: 1000}},
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := table.Calculate(tt.addr, tt.items)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalculateChecksAddress(t *testing.T) {
+	_, err := testTable(t).Calculate(NewAddress("CA", ""), []Item{{Amount: 1000}})
+
+	var addrErr *AddressError
+	if !errors.As(err, &addrErr) || addrErr.Field != "region" {
+		t.Errorf("got %v, want a region error", err)
+	}
+}
+
+func TestNewTableChecksRates(t *testing.T) {
+	tests := []struct {
+		name string
+		rate Rate
+	}{
+		{"country code", Rate{Country: "CAN", Jurisdiction: "CA", Name: "GST", Percent: 5}},
+		{"no jurisdiction", Rate{Country: "CA", Name: "GST", Percent: 5}},
+		{"no name", Rate{Country: "CA", Jurisdiction: "CA", Percent: 5}},
+		{"negative percent", Rate{Country: "CA", Jurisdiction: "CA", Name: "GST", Percent: -1}},
+		{"percent over 100", Rate{Country: "CA", Jurisdiction: "CA", Name: "GST", Percent: 101}},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewTable([]Rate{tt.rate}); err == nil {
+			t.Errorf("%s: got no error", tt.name)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	csvPath := filepath.Join(dir, "rates.csv")
+	err := os.WriteFile(csvPath, []byte(`# canadian rates
+country, region, category, jurisdiction, name, percent
+CA, , , CA, GST, 5
+CA, QC, , CA-QC, QST, 9.975
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonPath := filepath.Join(dir, "rates.json")
+	err = os.WriteFile(jsonPath, []byte(`[
+	{"country": "CA", "jurisdiction": "CA", "name": "GST", "percent": 5},
+	{"country": "CA", "region": "QC", "jurisdiction": "CA-QC", "name": "QST", "percent": 9.975}
+]`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{csvPath, jsonPath} {
+		table, err := Load(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if got := table.Rates(NewAddress("CA", "QC"), ""); len(got) != 2 {
+			t.Errorf("%s: got rates %+v", filepath.Base(path), got)
+		}
+		if err := table.Validate(NewAddress("CA", "")); err == nil {
+			t.Errorf("%s: a region isn't required", filepath.Base(path))
+		}
+	}
+
+	txtPath := filepath.Join(dir, "rates.txt")
+	if err := os.WriteFile(txtPath, []byte("CA GST 5\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(txtPath); err == nil {
+		t.Error("loaded a table that isn't .csv or .json")
+	}
+}
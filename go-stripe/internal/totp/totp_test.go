@@ -0,0 +1,122 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// the ascii secret "12345678901234567890" of the sha-1 test vectors of rfc 6238
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// the vectors of rfc 6238 are 8 digits long, the codes here are their last 6
+func TestCodeMatchesRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		step int64
+		code string
+	}{
+		{59, 0x1, "287082"},
+		{1111111109, 0x23523EC, "081804"},
+		{1111111111, 0x23523ED, "050471"},
+		{1234567890, 0x273EF07, "005924"},
+		{2000000000, 0x3F940AA, "279037"},
+		{20000000000, 0x27BC86AA, "353130"},
+	}
+
+	for _, tt := range tests {
+		step := Step(time.Unix(tt.unix, 0))
+		if step != tt.step {
+			t.Errorf("Step(%d) = %#x, want %#x", tt.unix, step, tt.step)
+		}
+
+		code, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+func TestCodeAcceptsLowercaseSecret(t *testing.T) {
+	code, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "287082" {
+		t.Errorf("got %s", code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	codeAt := func(step int64) string {
+		code, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+		step int64
+	}{
+		{"current step", codeAt(current), true, current},
+		{"previous step", codeAt(current - 1), true, current - 1},
+		{"next step", codeAt(current + 1), true, current + 1},
+		{"two steps behind", codeAt(current - 2), false, 0},
+		{"two steps ahead", codeAt(current + 2), false, 0},
+		{"too short", codeAt(current)[:5], false, 0},
+		{"too long", codeAt(current) + "0", false, 0},
+		{"empty", "", false, 0},
+		{"not a number", "05o471", false, 0},
+		{"spaces", "050 71", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, tt.code, now)
+			if ok != tt.ok || step != tt.step {
+				t.Errorf("Validate(%q) = %d, %v, want %d, %v", tt.code, step, ok, tt.step, tt.ok)
+			}
+		})
+	}
+}
+
+// UseTwoFactorStep refuses a step already used, so a code must give the step it
+// was made for wherever it falls in the window, not the current one
+func TestValidateReturnsStepOfCode(t *testing.T) {
+	issued := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, Step(issued))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range []time.Duration{0, Period * time.Second, -Period * time.Second} {
+		step, ok := Validate(rfcSecret, code, issued.Add(offset))
+		if !ok || step != Step(issued) {
+			t.Errorf("code used %v after it was issued: got step %d, %v, want %d", offset, step, ok, Step(issued))
+		}
+	}
+
+	next, err := Code(rfcSecret, Step(issued)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step, ok := Validate(rfcSecret, next, issued)
+	if !ok || step != Step(issued)+1 {
+		t.Errorf("code of the next step: got step %d, %v", step, ok)
+	}
+}
+
+func TestValidateRejectsBadSecret(t *testing.T) {
+	if _, ok := Validate("not base32!", "123456", time.Now()); ok {
+		t.Error("accepted a code for a secret that isn't base32")
+	}
+}
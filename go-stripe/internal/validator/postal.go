@@ -0,0 +1,49 @@
+package validator
+
+import (
+	"regexp"
+	"strings"
+)
+
+// postal code formats of the countries we ship to
+var postalCodes = map[string]*regexp.Regexp{
+	"AU": regexp.MustCompile(`^\d{4}$`),
+	"CA": regexp.MustCompile(`^[ABCEGHJ-NPRSTVXY]\d[ABCEGHJ-NPRSTV-Z] ?\d[ABCEGHJ-NPRSTV-Z]\d$`),
+	"DE": regexp.MustCompile(`^\d{5}$`),
+	"ES": regexp.MustCompile(`^\d{5}$`),
+	"FR": regexp.MustCompile(`^\d{5}$`),
+	"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`),
+	"IE": regexp.MustCompile(`^[AC-FHKNPRTV-Y]\d[\dW] ?[AC-FHKNPRTV-Y\d]{4}$`),
+	"IT": regexp.MustCompile(`^\d{5}$`),
+	"JP": regexp.MustCompile(`^\d{3}-?\d{4}$`),
+	"KR": regexp.MustCompile(`^\d{5}$`),
+	"NL": regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`),
+	"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+}
+
+// countries whose addresses need a province or state
+var regionCountries = map[string]bool{
+	"AU": true,
+	"CA": true,
+	"US": true,
+}
+
+// report whether the postal code format of country is known
+func HasPostalCode(country string) bool {
+	_, ok := postalCodes[strings.ToUpper(country)]
+	return ok
+}
+
+// check a postal code against the format used in country, codes of other countries are accepted
+func PostalCode(country, code string) bool {
+	rx, ok := postalCodes[strings.ToUpper(country)]
+	if !ok {
+		return true
+	}
+	return rx.MatchString(strings.ToUpper(strings.TrimSpace(code)))
+}
+
+// report whether addresses in country need a province or state
+func RegionRequired(country string) bool {
+	return regionCountries[strings.ToUpper(country)]
+}